@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Kinds of items in the admin review queue.
+const (
+	reviewSignupBonus = "signup_bonus"
+	reviewTipRing     = "tip_ring"
+)
+
+// Statuses of a review.
+const (
+	reviewPending  = "pending"
+	reviewApproved = "approved"
+	reviewDenied   = "denied"
+)
+
+// review is a decision left to the admins.
+type review struct {
+	ID          int64
+	Kind        string
+	UserID      string
+	OtherUserID string
+	Address     string
+	Amount      *big.Int
+	Reason      string
+	CreatedAt   time.Time
+}
+
+// signupBonusEligibility explains why the user can't have the signup bonus
+// for address. A non-empty reason with needsReview set leaves the decision to
+// an admin instead of denying the bonus outright.
+func signupBonusEligibility(ctx context.Context, api *slack.Client, userID, address string) (reason string, needsReview bool) {
+	user, err := api.GetUserInfo(userID)
+	if err != nil || user == nil {
+		logWarn(ctx, "Failed to look up user", logFields{"user": userID, "error": err})
+		return "I couldn't check your Slack account", true
+	}
+	switch {
+	case user.IsBot:
+		return "bots don't get a signup bonus", false
+	case user.Deleted:
+		return "deactivated accounts don't get a signup bonus", false
+	case user.IsRestricted || user.IsUltraRestricted:
+		return "guests don't get a signup bonus", false
+	}
+
+	// when the checks can't run, an admin decides instead
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		logError(ctx, "Failed to check signup bonus", logFields{"user": userID, "error": err})
+		return "I couldn't check whether you already got one", true
+	}
+	defer db.Close()
+
+	var claimed bool
+	err = db.QueryRow(`
+		SELECT true FROM signup_bonuses WHERE slack_user_id = $1 OR lower(ethereum_address) = lower($2) LIMIT 1;
+	`, userID, address).Scan(&claimed)
+	if err != nil && err != sql.ErrNoRows {
+		logError(ctx, "Failed to check signup bonus", logFields{"user": userID, "error": err})
+		return "I couldn't check whether you already got one", true
+	}
+	if claimed {
+		return "that address or your account already got a signup bonus", false
+	}
+
+	if minAge := retrieveDurationSetting(settingBonusMinAge); minAge > 0 {
+		// Slack doesn't tell how old an account is, so count from the first
+		// time the user talked to the bot
+		var age sql.NullFloat64
+		err := db.QueryRow(`
+			SELECT EXTRACT(EPOCH FROM now() - MIN(created_at)) FROM audit_log WHERE actor = $1;
+		`, userID).Scan(&age)
+		if err != nil {
+			logError(ctx, "Failed to check account age", logFields{"user": userID, "error": err})
+			return "I couldn't check how old your account is", true
+		}
+		if !age.Valid || time.Duration(age.Float64)*time.Second < minAge {
+			return fmt.Sprintf("your account is newer than %s", minAge), true
+		}
+	}
+	return "", false
+}
+
+// grantSignupBonus gives the signup bonus to a user registering address for
+// the first time, when they are eligible, and tells them what was decided.
+func grantSignupBonus(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, address string) {
+	bonus := retrieveAmountSetting(settingSignupBonus)
+	if bonus.Sign() <= 0 {
+		return
+	}
+
+	reason, needsReview := signupBonusEligibility(ctx, api, ev.User, address)
+	if needsReview {
+		err := queueReview(ctx, api, &review{Kind: reviewSignupBonus, UserID: ev.User, Address: address, Amount: bonus, Reason: reason})
+		if err != nil {
+			sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+			return
+		}
+		sendSlackMessage(api, ev.User, fmt.Sprintf(":hourglass: Your signup bonus of %s CULT is waiting for an admin because %s", formatAmount(bonus, tokenAsset), reason))
+		return
+	}
+	if reason != "" {
+		sendSlackMessage(api, ev.User, fmt.Sprintf(":no_entry_sign: No signup bonus this time: %s", reason))
+		return
+	}
+
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		return recordSignupBonus(tx, ev.User, address, bonus)
+	})
+	if isUniqueViolation(err) {
+		sendSlackMessage(api, ev.User, ":no_entry_sign: No signup bonus this time: that address or your account already got a signup bonus")
+	} else if err != nil {
+		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+	} else {
+		logInfo(ctx, "Granted signup bonus", logFields{"user": ev.User, "amount": formatAmount(bonus, tokenAsset)})
+		sendSlackMessage(api, ev.Channel, fmt.Sprintf(":point_left: :sunglasses: :point_left: Enjoy your free %s CULT!", formatAmount(bonus, tokenAsset)))
+	}
+}
+
+// recordSignupBonus credits the bonus and claims address so that no other
+// account gets a bonus for it.
+func recordSignupBonus(tx *sql.Tx, userID, address string, bonus *big.Int) error {
+	_, err := tx.Exec(`
+		INSERT INTO signup_bonuses(slack_user_id, ethereum_address) VALUES ($1, $2);
+	`, userID, address)
+	if err != nil {
+		return err
+	}
+	return adjustBalance(tx, ledgerEntry{UserID: userID, Asset: tokenAsset, Kind: kindSignupBonus, Amount: bonus})
+}
+
+// checkTipRateLimit explains why the user can't tip right now, or returns "".
+// Tips are held back while the limit can't be checked.
+func checkTipRateLimit(ctx context.Context, userID string) string {
+	limit := retrieveCountSetting(settingTipHourlyLimit)
+	if limit == 0 {
+		return ""
+	}
+
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		logError(ctx, "Failed to check tip rate limit", logFields{"user": userID, "error": err})
+		return "I couldn't check your tip rate, please try again later"
+	}
+	defer db.Close()
+
+	var count int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM tips WHERE from_user_id = $1 AND created_at > now() - interval '1 hour';
+	`, userID).Scan(&count)
+	if err != nil {
+		logError(ctx, "Failed to check tip rate limit", logFields{"user": userID, "error": err})
+		return "I couldn't check your tip rate, please try again later"
+	}
+
+	if count >= limit {
+		return fmt.Sprintf("You can send %d tips per hour, please slow down", limit)
+	}
+	return ""
+}
+
+// detectTipRing looks for tips going back and forth between from and to, or
+// around through a third user, within the tip ring window. It returns what
+// it found, or "". Failed lookups are logged and find nothing, since the tip
+// already went through.
+func detectTipRing(ctx context.Context, from, to string) string {
+	threshold := retrieveCountSetting(settingTipRingThreshold)
+	if threshold == 0 || from == to {
+		return ""
+	}
+	window := retrieveDurationSetting(settingTipRingWindow).Seconds()
+
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		logError(ctx, "Failed to look for tip rings", logFields{"user": from, "error": err})
+		return ""
+	}
+	defer db.Close()
+
+	var sent, received int
+	err = db.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE from_user_id = $1 AND to_user_id = $2),
+			COUNT(*) FILTER (WHERE from_user_id = $2 AND to_user_id = $1)
+		FROM tips
+		WHERE created_at > now() - $3 * interval '1 second'
+		AND ((from_user_id = $1 AND to_user_id = $2) OR (from_user_id = $2 AND to_user_id = $1));
+	`, from, to, window).Scan(&sent, &received)
+	if err != nil {
+		logError(ctx, "Failed to look for tip rings", logFields{"user": from, "error": err})
+		return ""
+	}
+	if sent > 0 && received > 0 && sent+received >= threshold {
+		return fmt.Sprintf("<@%s> and <@%s> tipped each other %d times", from, to, sent+received)
+	}
+
+	// from -> to -> third -> from, counting the tips on the two legs that
+	// close the ring and the ones from sent to to
+	var third string
+	var count int
+	err = db.QueryRow(`
+		SELECT a.to_user_id, COUNT(DISTINCT a.id) + COUNT(DISTINCT b.id)
+		FROM tips a JOIN tips b ON b.from_user_id = a.to_user_id AND b.to_user_id = $1
+		WHERE a.from_user_id = $2 AND a.to_user_id NOT IN ($1, $2)
+		AND a.created_at > now() - $3 * interval '1 second' AND b.created_at > now() - $3 * interval '1 second'
+		GROUP BY a.to_user_id ORDER BY 2 DESC LIMIT 1;
+	`, from, to, window).Scan(&third, &count)
+	if err != nil && err != sql.ErrNoRows {
+		logError(ctx, "Failed to look for tip rings", logFields{"user": from, "error": err})
+		return ""
+	}
+	if third != "" && count+sent >= threshold {
+		return fmt.Sprintf("tips went around <@%s>, <@%s> and <@%s>", from, to, third)
+	}
+	return ""
+}
+
+// flagTipRing queues a tip ring for review unless the pair is already
+// waiting for one.
+func flagTipRing(ctx context.Context, api *slack.Client, from, to, reason string) (bool, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var pending bool
+	err = db.QueryRow(`
+		SELECT true FROM reviews
+		WHERE kind = $1 AND status = $2 AND ((slack_user_id = $3 AND other_user_id = $4) OR (slack_user_id = $4 AND other_user_id = $3))
+		LIMIT 1;
+	`, reviewTipRing, reviewPending, from, to).Scan(&pending)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if pending {
+		return false, nil
+	}
+	return true, queueReview(ctx, api, &review{Kind: reviewTipRing, UserID: from, OtherUserID: to, Reason: reason})
+}
+
+// queueReview adds r to the review queue and tells the admins.
+func queueReview(ctx context.Context, api *slack.Client, r *review) error {
+	var amount sql.NullString
+	if r.Amount != nil {
+		amount = nullString(r.Amount.String())
+	}
+
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRow(`
+			INSERT INTO reviews(kind, slack_user_id, other_user_id, ethereum_address, amount, reason)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id;
+		`, r.Kind, r.UserID, nullString(r.OtherUserID), nullString(r.Address), amount, r.Reason).Scan(&r.ID)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditRecord{Actor: auditActorSystem, Action: "review_queued", Subject: fmt.Sprintf("review %d", r.ID), After: reviewPending, Detail: r.describe()})
+	})
+	if err != nil {
+		return err
+	}
+	logInfo(ctx, "Queued review", logFields{"review": r.ID, "kind": r.Kind, "user": r.UserID})
+
+	alertAdmins(api, fmt.Sprintf(":mag: Review %d: %s. Use `admin review approve %d` or `admin review deny %d`", r.ID, r.describe(), r.ID, r.ID))
+	return nil
+}
+
+func (r *review) describe() string {
+	if r.Kind == reviewSignupBonus {
+		return fmt.Sprintf("signup bonus of %s CULT for <@%s> (`%s`) held because %s", formatAmount(r.Amount, tokenAsset), r.UserID, r.Address, r.Reason)
+	}
+	return "possible tip ring: " + r.Reason
+}
+
+// pendingReviews loads the review queue, oldest first.
+func pendingReviews() ([]*review, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT id, kind, slack_user_id, other_user_id, ethereum_address, amount, reason, created_at
+		FROM reviews WHERE status = $1 ORDER BY id;
+	`, reviewPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reviews []*review
+	for rows.Next() {
+		var r review
+		var other, address, amount sql.NullString
+		if err := rows.Scan(&r.ID, &r.Kind, &r.UserID, &other, &address, &amount, &r.Reason, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.OtherUserID, r.Address = other.String, address.String
+		r.Amount, _ = new(big.Int).SetString(amount.String, 10)
+		reviews = append(reviews, &r)
+	}
+	return reviews, rows.Err()
+}
+
+func handleAdminReviewsCommand(api *slack.Client, ev *slack.MessageEvent) {
+	reviews, err := pendingReviews()
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	if len(reviews) == 0 {
+		sendSlackMessage(api, ev.Channel, ":sparkles: Nothing to review")
+		return
+	}
+
+	lines := []string{":mag: Waiting for review:"}
+	for _, r := range reviews {
+		lines = append(lines, fmt.Sprintf("• %d (%s): %s", r.ID, r.CreatedAt.Format("2006-01-02"), r.describe()))
+	}
+	sendSlackMessage(api, ev.Channel, strings.Join(lines, "\n"))
+}
+
+// handleAdminReviewDecisionCommand settles a review. Approving a held signup
+// bonus grants it, approving a tip ring clears it as legitimate.
+func handleAdminReviewDecisionCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, idArg string, approve bool) {
+	id, err := strconv.ParseInt(idArg, 10, 64)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":thonk: That isn't a review number")
+		return
+	}
+
+	status := reviewDenied
+	if approve {
+		status = reviewApproved
+	}
+
+	var r review
+	err = withLedgerTx(ctx, func(tx *sql.Tx) error {
+		var current string
+		var other, address, amount sql.NullString
+		err := tx.QueryRow(`
+			SELECT kind, slack_user_id, other_user_id, ethereum_address, amount, reason, status
+			FROM reviews WHERE id = $1 FOR UPDATE;
+		`, id).Scan(&r.Kind, &r.UserID, &other, &address, &amount, &r.Reason, &current)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("There is no review %d", id)
+		} else if err != nil {
+			return err
+		}
+		if current != reviewPending {
+			return fmt.Errorf("Review %d was already %s", id, current)
+		}
+		r.ID, r.OtherUserID, r.Address = id, other.String, address.String
+		r.Amount, _ = new(big.Int).SetString(amount.String, 10)
+
+		if r.Kind == reviewSignupBonus && approve {
+			if err := recordSignupBonus(tx, r.UserID, r.Address, r.Amount); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(`
+			UPDATE reviews SET status = $2, reviewed_by = $3, reviewed_at = now() WHERE id = $1;
+		`, id, status, ev.User)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditRecord{Actor: ev.User, Action: "review", Subject: fmt.Sprintf("review %d", id), Before: reviewPending, After: status, Detail: r.describe(), Event: slackEventRef(ev)})
+	})
+	if isUniqueViolation(err) {
+		sendSlackMessage(api, ev.Channel, ":thonk: That address or account already got a signup bonus")
+		return
+	} else if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+
+	sendSlackMessage(api, ev.Channel, fmt.Sprintf(":white_check_mark: Review %d %s", id, status))
+	if r.Kind != reviewSignupBonus {
+		return
+	}
+	if approve {
+		sendSlackMessage(api, r.UserID, fmt.Sprintf(":point_left: :sunglasses: :point_left: An admin approved your signup bonus, enjoy your free %s CULT!", formatAmount(r.Amount, tokenAsset)))
+	} else {
+		sendSlackMessage(api, r.UserID, fmt.Sprintf(":no_entry_sign: An admin turned down your signup bonus, which was held because %s", r.Reason))
+	}
+}
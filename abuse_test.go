@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// testSlackUsers returns a client of a Slack whose users.info answers with
+// the given users, as JSON objects by id.
+func testSlackUsers(t *testing.T, users map[string]string) *slack.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := users[r.FormValue("user")]
+		if !strings.HasSuffix(r.URL.Path, "/users.info") || !ok {
+			w.Write([]byte(`{"ok":false,"error":"user_not_found"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"user":` + user + `}`))
+	}))
+	api := slack.SLACK_API
+	slack.SLACK_API = srv.URL + "/"
+	t.Cleanup(func() {
+		slack.SLACK_API = api
+		srv.Close()
+	})
+	return slack.New("test")
+}
+
+// testSettings configures setting defaults for the test.
+func testSettings(settings map[string]string) {
+	currentConfig.Store(&config{Settings: settings})
+}
+
+// testAbuseDB opens the test database to add tips, bonuses and audit
+// entries at given times.
+func testAbuseDB(t *testing.T) *sql.DB {
+	testDatabase(t)
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// insertTestTip records a tip sent ago, without moving balances.
+func insertTestTip(t *testing.T, db *sql.DB, from, to string, ago time.Duration) {
+	_, err := db.Exec(`
+		INSERT INTO balances (slack_user_id, asset) VALUES ($1, $3), ($2, $3)
+		ON CONFLICT ON CONSTRAINT balances_slack_user_id_asset_key DO NOTHING;
+	`, from, to, tokenAsset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		INSERT INTO tips (from_user_id, to_user_id, asset, amount, created_at) VALUES ($1, $2, $3, 1, now() - $4 * interval '1 second');
+	`, from, to, tokenAsset, ago.Seconds())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignupBonusEligibility(t *testing.T) {
+	db := testAbuseDB(t)
+	ctx := context.Background()
+	api := testSlackUsers(t, map[string]string{
+		"U1": `{"id":"U1"}`,
+		"U2": `{"id":"U2"}`,
+		"U3": `{"id":"U3"}`,
+		"UB": `{"id":"UB","is_bot":true}`,
+		"UD": `{"id":"UD","deleted":true}`,
+		"UG": `{"id":"UG","is_restricted":true}`,
+		"UU": `{"id":"UU","is_ultra_restricted":true}`,
+	})
+	claimed := "0xAbC0000000000000000000000000000000000001"
+	if _, err := db.Exec(`INSERT INTO accounts (slack_user_id, ethereum_address) VALUES ('U2', $1);`, claimed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO signup_bonuses (slack_user_id, ethereum_address) VALUES ('U2', $1);`, claimed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO audit_log (actor, action, created_at) VALUES ('U3', 'register', now() - interval '2 days');`); err != nil {
+		t.Fatal(err)
+	}
+	fresh := "0x0000000000000000000000000000000000000002"
+
+	tests := []struct {
+		name        string
+		minAge      string
+		user        string
+		address     string
+		reason      string
+		needsReview bool
+	}{
+		{"eligible", "0s", "U1", fresh, "", false},
+		{"bot", "0s", "UB", fresh, "bots", false},
+		{"deactivated", "0s", "UD", fresh, "deactivated", false},
+		{"guest", "0s", "UG", fresh, "guests", false},
+		{"single-channel guest", "0s", "UU", fresh, "guests", false},
+		{"unknown user", "0s", "UX", fresh, "couldn't check your Slack account", true},
+		{"claimed user", "0s", "U2", fresh, "already got a signup bonus", false},
+		{"claimed address", "0s", "U1", strings.ToLower(claimed), "already got a signup bonus", false},
+		{"new account", "24h", "U1", fresh, "newer than 24h0m0s", true},
+		{"old account", "24h", "U3", fresh, "", false},
+		{"too new account", "72h", "U3", fresh, "newer than 72h0m0s", true},
+	}
+	for _, test := range tests {
+		testSettings(map[string]string{settingBonusMinAge: test.minAge})
+		reason, needsReview := signupBonusEligibility(ctx, api, test.user, test.address)
+		if needsReview != test.needsReview || (test.reason == "") != (reason == "") || !strings.Contains(reason, test.reason) {
+			t.Errorf("%s: reason %q, review %v, want %q, %v", test.name, reason, needsReview, test.reason, test.needsReview)
+		}
+	}
+}
+
+func TestDetectTipRing(t *testing.T) {
+	db := testAbuseDB(t)
+	ctx := context.Background()
+	tips := []struct {
+		from, to string
+		ago      time.Duration
+	}{
+		// back and forth
+		{"U1", "U2", time.Hour}, {"U2", "U1", time.Hour}, {"U1", "U2", time.Minute}, {"U2", "U1", time.Minute},
+		// one way only
+		{"U3", "U4", time.Hour}, {"U3", "U4", time.Hour}, {"U3", "U4", time.Hour}, {"U3", "U4", time.Hour},
+		// back and forth, but long ago
+		{"U5", "U6", 48 * time.Hour}, {"U6", "U5", 48 * time.Hour}, {"U5", "U6", 48 * time.Hour}, {"U6", "U5", time.Hour},
+		// around U7, U8 and U9
+		{"U7", "U8", time.Hour}, {"U8", "U9", time.Hour}, {"U8", "U9", time.Hour}, {"U9", "U7", time.Hour},
+	}
+	for _, tip := range tips {
+		insertTestTip(t, db, tip.from, tip.to, tip.ago)
+	}
+
+	tests := []struct {
+		name     string
+		settings map[string]string
+		from, to string
+		want     string
+	}{
+		{"each other", nil, "U1", "U2", "<@U1> and <@U2> tipped each other 4 times"},
+		{"each other reversed", nil, "U2", "U1", "<@U2> and <@U1> tipped each other 4 times"},
+		{"higher threshold", map[string]string{settingTipRingThreshold: "5"}, "U1", "U2", ""},
+		{"disabled", map[string]string{settingTipRingThreshold: "0"}, "U1", "U2", ""},
+		{"one way", nil, "U3", "U4", ""},
+		{"outside the window", nil, "U5", "U6", ""},
+		{"wider window", map[string]string{settingTipRingWindow: "72h"}, "U5", "U6", "<@U5> and <@U6> tipped each other 4 times"},
+		{"around", nil, "U7", "U8", "tips went around <@U7>, <@U8> and <@U9>"},
+		{"around the other way", nil, "U8", "U7", ""},
+		{"to themselves", nil, "U1", "U1", ""},
+	}
+	for _, test := range tests {
+		testSettings(test.settings)
+		if got := detectTipRing(ctx, test.from, test.to); got != test.want {
+			t.Errorf("%s: found %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckTipRateLimit(t *testing.T) {
+	db := testAbuseDB(t)
+	ctx := context.Background()
+	insertTestTip(t, db, "U1", "U2", 2*time.Hour)
+	insertTestTip(t, db, "U1", "U2", 30*time.Minute)
+	insertTestTip(t, db, "U1", "U3", time.Minute)
+	insertTestTip(t, db, "U2", "U1", time.Minute)
+
+	if reason := checkTipRateLimit(ctx, "U1"); reason != "" {
+		t.Errorf("limited without a limit: %q", reason)
+	}
+	testSettings(map[string]string{settingTipHourlyLimit: "3"})
+	if reason := checkTipRateLimit(ctx, "U1"); reason != "" {
+		t.Errorf("limited after 2 tips in the last hour: %q", reason)
+	}
+	insertTestTip(t, db, "U1", "U2", 0)
+	if reason := checkTipRateLimit(ctx, "U1"); !strings.Contains(reason, "3 tips per hour") {
+		t.Errorf("after 3 tips in the last hour: %q", reason)
+	}
+	if reason := checkTipRateLimit(ctx, "U2"); reason != "" {
+		t.Errorf("the tips of U1 limited U2: %q", reason)
+	}
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nlopes/slack"
+)
+
+// apiPageLimit is the default and apiMaxLimit the largest page of the list
+// endpoints. Exports aren't paged.
+const (
+	apiPageLimit = 50
+	apiMaxLimit  = 500
+)
+
+// apiAccount is a user as the admin API shows it.
+type apiAccount struct {
+	UserID       string            `json:"user_id"`
+	Address      string            `json:"address,omitempty"`
+	Frozen       bool              `json:"frozen"`
+	FrozenReason string            `json:"frozen_reason,omitempty"`
+	Balances     map[string]string `json:"balances"`
+}
+
+// apiLedgerEntry is a row of the ledger as the admin API shows it.
+type apiLedgerEntry struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Asset     string    `json:"asset"`
+	Kind      string    `json:"kind"`
+	Amount    string    `json:"amount"`
+	Chain     string    `json:"chain,omitempty"`
+	TxHash    string    `json:"tx_hash,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// apiWithdrawal is a withdrawal as the admin API shows it.
+type apiWithdrawal struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Chain     string    `json:"chain"`
+	Asset     string    `json:"asset"`
+	Address   string    `json:"address"`
+	Amount    string    `json:"amount"`
+	Fee       string    `json:"fee,omitempty"`
+	FeeAsset  string    `json:"fee_asset,omitempty"`
+	Status    string    `json:"status"`
+	TxHash    string    `json:"tx_hash,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// apiAdjustment is the body of a credit or debit, and the answer to it.
+type apiAdjustment struct {
+	UserID string `json:"user_id,omitempty"`
+	Action string `json:"action,omitempty"`
+	Amount string `json:"amount"`
+	Asset  string `json:"asset"`
+	Reason string `json:"reason"`
+	// Balance is the balance of the asset after the adjustment.
+	Balance string `json:"balance,omitempty"`
+}
+
+// adminAPIHandler serves the admin JSON API under /api/v1/, described by
+// openapi.yaml. Every request but the one for the spec needs a bearer token
+// with the scope of the endpoint.
+func adminAPIHandler(api *slack.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+		if path == "openapi.yaml" {
+			w.Header().Set("Content-Type", "application/yaml")
+			http.ServeFile(w, r, "openapi.yaml")
+			return
+		}
+
+		// the request's context ends with the response, while an approved
+		// withdrawal is paid after it
+		ctx := correlatedContext()
+		principal, err := authenticateAPI(ctx, r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		logInfo(ctx, "Admin API request", logFields{"actor": principal.Actor, "method": r.Method, "path": r.URL.Path})
+
+		if r.Method == "POST" {
+			if !beginWork() {
+				apiError(w, http.StatusServiceUnavailable, "shutting down")
+				return
+			}
+			defer endWork()
+		}
+
+		parts := strings.Split(path, "/")
+		scope, handler := routeAdminAPI(api, r.Method, parts)
+		if handler == nil {
+			apiError(w, http.StatusNotFound, "no such endpoint")
+			return
+		}
+		if !principal.Scopes[scope] {
+			apiError(w, http.StatusForbidden, fmt.Sprintf("the %s scope is required", scope))
+			return
+		}
+		handler(ctx, w, r, principal)
+	}
+}
+
+type apiHandler func(ctx context.Context, w http.ResponseWriter, r *http.Request, p *apiPrincipal)
+
+// routeAdminAPI returns the scope and handler of an endpoint, or a nil
+// handler when there is no such endpoint.
+func routeAdminAPI(api *slack.Client, method string, parts []string) (string, apiHandler) {
+	switch {
+	case method == "GET" && len(parts) == 1 && parts[0] == "accounts":
+		return scopeRead, handleAPIAccounts
+	case method == "GET" && len(parts) == 2 && parts[0] == "accounts":
+		return scopeRead, withPathParam(parts[1], handleAPIAccount)
+	case method == "GET" && len(parts) == 3 && parts[0] == "accounts" && parts[2] == "ledger":
+		return scopeRead, withPathParam(parts[1], handleAPILedger)
+	case method == "POST" && len(parts) == 3 && parts[0] == "accounts" && (parts[2] == "credit" || parts[2] == "debit"):
+		return scopeAdjust, apiAdjustHandler(api, parts[1], parts[2])
+	case method == "GET" && len(parts) == 1 && parts[0] == "withdrawals":
+		return scopeRead, handleAPIWithdrawals
+	case method == "GET" && len(parts) == 2 && parts[0] == "withdrawals":
+		return scopeRead, withPathParam(parts[1], handleAPIWithdrawal)
+	case method == "POST" && len(parts) == 3 && parts[0] == "withdrawals" && (parts[2] == "approve" || parts[2] == "reject"):
+		return scopeReview, apiReviewHandler(api, parts[1], parts[2] == "approve")
+	case method == "GET" && len(parts) == 2 && parts[0] == "export":
+		return scopeRead, withPathParam(parts[1], handleAPIExport)
+	case method == "GET" && len(parts) == 2 && parts[0] == "reports":
+		return scopeRead, withPathParam(parts[1], handleAPIReport)
+	}
+	return "", nil
+}
+
+func withPathParam(param string, fn func(ctx context.Context, w http.ResponseWriter, r *http.Request, param string)) apiHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p *apiPrincipal) {
+		fn(ctx, w, r, param)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// internalAPIError logs err, which may carry details callers shouldn't see.
+func internalAPIError(ctx context.Context, w http.ResponseWriter, err error) {
+	logError(ctx, "Admin API request failed", logFields{"error": err})
+	apiError(w, http.StatusInternalServerError, "internal error, see the logs for correlation ID "+correlationID(ctx))
+}
+
+// pageParams reads the limit and the before or offset cursor of a list.
+func pageParams(r *http.Request, cursor string) (limit int, value int64, err error) {
+	limit = apiPageLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+		}
+	}
+	if s := r.URL.Query().Get(cursor); s != "" {
+		if value, err = strconv.ParseInt(s, 10, 64); err != nil || value < 0 {
+			return 0, 0, fmt.Errorf("%s must be a non-negative integer", cursor)
+		}
+	}
+	return limit, value, nil
+}
+
+// queryAccounts finds the users whose ID or address contains search, with
+// their balances. A nil limit returns them all.
+func queryAccounts(search string, limit interface{}, offset int64) ([]*apiAccount, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT u.slack_user_id, COALESCE(a.ethereum_address, ''), f.slack_user_id IS NOT NULL, COALESCE(f.reason, '')
+		FROM (SELECT slack_user_id FROM accounts UNION SELECT slack_user_id FROM balances) u
+		LEFT JOIN accounts a ON a.slack_user_id = u.slack_user_id
+		LEFT JOIN frozen_users f ON f.slack_user_id = u.slack_user_id
+		WHERE u.slack_user_id IS NOT NULL
+		AND ($1 = '' OR u.slack_user_id ILIKE '%' || $1 || '%' OR a.ethereum_address ILIKE '%' || $1 || '%')
+		ORDER BY u.slack_user_id LIMIT $2 OFFSET $3;
+	`, search, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*apiAccount
+	byUser := map[string]*apiAccount{}
+	var ids []string
+	for rows.Next() {
+		a := &apiAccount{Balances: map[string]string{}}
+		if err := rows.Scan(&a.UserID, &a.Address, &a.Frozen, &a.FrozenReason); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+		byUser[a.UserID] = a
+		ids = append(ids, a.UserID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return accounts, nil
+	}
+
+	balances, err := db.Query(`
+		SELECT slack_user_id, asset, balance FROM balances WHERE slack_user_id = ANY($1);
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer balances.Close()
+	for balances.Next() {
+		var userID, asset, balance string
+		if err := balances.Scan(&userID, &asset, &balance); err != nil {
+			return nil, err
+		}
+		if amount, ok := parseStoredAmount(balance); ok {
+			byUser[userID].Balances[asset] = formatAmount(amount, asset)
+		}
+	}
+	return accounts, balances.Err()
+}
+
+func handleAPIAccounts(ctx context.Context, w http.ResponseWriter, r *http.Request, p *apiPrincipal) {
+	limit, offset, err := pageParams(r, "offset")
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	accounts, err := queryAccounts(r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		internalAPIError(ctx, w, err)
+		return
+	}
+	if accounts == nil {
+		accounts = []*apiAccount{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"accounts": accounts})
+}
+
+func findAccount(userID string) (*apiAccount, error) {
+	accounts, err := queryAccounts(userID, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range accounts {
+		if a.UserID == userID {
+			return a, nil
+		}
+	}
+	return nil, nil
+}
+
+func handleAPIAccount(ctx context.Context, w http.ResponseWriter, r *http.Request, userID string) {
+	account, err := findAccount(userID)
+	if err != nil {
+		internalAPIError(ctx, w, err)
+		return
+	}
+	if account == nil {
+		apiError(w, http.StatusNotFound, "no such account")
+		return
+	}
+	writeJSON(w, http.StatusOK, account)
+}
+
+// queryLedger loads the ledger entries of userID, or of everyone when it is
+// empty, newest first and older than before when it isn't 0. A nil limit
+// returns them all.
+func queryLedger(userID string, before int64, limit interface{}) ([]*apiLedgerEntry, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT id, slack_user_id, asset, kind, amount, COALESCE(chain, ''), COALESCE(tx_hash, ''), COALESCE(note, ''), created_at
+		FROM ledger_entries
+		WHERE ($1 = '' OR slack_user_id = $1) AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC LIMIT $3;
+	`, userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*apiLedgerEntry{}
+	for rows.Next() {
+		var e apiLedgerEntry
+		var amount string
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Asset, &e.Kind, &amount, &e.Chain, &e.TxHash, &e.Note, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if value, ok := parseStoredAmount(amount); ok {
+			e.Amount = formatAmount(value, e.Asset)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+func handleAPILedger(ctx context.Context, w http.ResponseWriter, r *http.Request, userID string) {
+	limit, before, err := pageParams(r, "before")
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	entries, err := queryLedger(userID, before, limit)
+	if err != nil {
+		internalAPIError(ctx, w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
+
+// apiAdjustHandler credits or debits a user. A request with an
+// Idempotency-Key header is applied once, and retries get the first answer.
+func apiAdjustHandler(api *slack.Client, userID, action string) apiHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p *apiPrincipal) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "unreadable body")
+			return
+		}
+		var req apiAdjustment
+		if err := json.Unmarshal(body, &req); err != nil {
+			apiError(w, http.StatusBadRequest, "the body must be JSON with amount, asset and reason")
+			return
+		}
+
+		key := r.Header.Get("Idempotency-Key")
+		sum := sha256.Sum256([]byte(action + "\n" + userID + "\n" + string(body)))
+		requestHash := hex.EncodeToString(sum[:])
+		if key != "" && replayIdempotent(ctx, w, p.Actor, key, requestHash) {
+			return
+		}
+
+		asset, err := parseAsset(req.Asset)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		amount, err := parseAmount(req.Amount, asset)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if amount.Sign() < 1 {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("Must %s more than 0 %s", action, asset))
+			return
+		}
+		reason := strings.TrimSpace(req.Reason)
+		if reason == "" {
+			apiError(w, http.StatusBadRequest, "Please give a reason")
+			return
+		}
+
+		answer := apiAdjustment{UserID: userID, Action: action, Amount: formatAmount(amount, asset), Asset: asset, Reason: reason}
+		event := "api:" + correlationID(ctx)
+		err = adminAdjust(ctx, p.Actor, event, action, userID, asset, amount, reason, func(tx *sql.Tx) error {
+			var balance string
+			err := tx.QueryRow(`
+				SELECT balance FROM balances WHERE slack_user_id = $1 AND asset = $2;
+			`, userID, asset).Scan(&balance)
+			if err != nil {
+				return err
+			}
+			if value, ok := parseStoredAmount(balance); ok {
+				answer.Balance = formatAmount(value, asset)
+			}
+			if key == "" {
+				return nil
+			}
+
+			response, err := json.Marshal(answer)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO api_idempotency_keys(actor, key, request_hash, response) VALUES ($1, $2, $3, $4);
+			`, p.Actor, key, requestHash, string(response))
+			return err
+		})
+		switch {
+		case err == errInsufficientFunds:
+			apiError(w, http.StatusConflict, err.Error())
+			return
+		case isUniqueViolation(err):
+			// a retry raced this request, and was applied instead
+			if !replayIdempotent(ctx, w, p.Actor, key, requestHash) {
+				apiError(w, http.StatusConflict, "a request with this Idempotency-Key is in progress")
+			}
+			return
+		case err != nil:
+			internalAPIError(ctx, w, err)
+			return
+		}
+
+		verb := adjustVerb(action)
+		sendSlackMessage(api, userID, fmt.Sprintf(":bank: An admin %s your balance %s %s: %s", verb, answer.Amount, asset, reason))
+		alertAdmins(api, fmt.Sprintf(":robot_face: %s %s <@%s> %s %s through the API: %s", p.Actor, verb, userID, answer.Amount, asset, reason))
+		writeJSON(w, http.StatusOK, answer)
+	}
+}
+
+// replayIdempotent answers with the stored response of an earlier request
+// with the same Idempotency-Key, and reports whether there was one. A key
+// reused for a different request is a conflict.
+func replayIdempotent(ctx context.Context, w http.ResponseWriter, actor, key, requestHash string) bool {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		internalAPIError(ctx, w, err)
+		return true
+	}
+	defer db.Close()
+
+	var storedHash, response string
+	err = db.QueryRow(`
+		SELECT request_hash, response FROM api_idempotency_keys WHERE actor = $1 AND key = $2;
+	`, actor, key).Scan(&storedHash, &response)
+	switch {
+	case err == sql.ErrNoRows:
+		return false
+	case err != nil:
+		internalAPIError(ctx, w, err)
+	case storedHash != requestHash:
+		apiError(w, http.StatusConflict, "the Idempotency-Key was already used for a different request")
+	default:
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, response)
+	}
+	return true
+}
+
+func toAPIWithdrawals(withdrawals []*withdrawal) []*apiWithdrawal {
+	list := make([]*apiWithdrawal, len(withdrawals))
+	for i, w := range withdrawals {
+		list[i] = &apiWithdrawal{
+			ID:        w.ID,
+			UserID:    w.UserID,
+			Chain:     w.Chain,
+			Asset:     w.Asset,
+			Address:   w.Address,
+			Amount:    formatAmount(w.Amount, w.Asset),
+			FeeAsset:  w.FeeAsset,
+			Status:    w.Status,
+			TxHash:    w.TxHash,
+			Error:     w.Error,
+			CreatedAt: w.CreatedAt,
+		}
+		if w.Fee != nil {
+			list[i].Fee = formatAmount(w.Fee, w.FeeAsset)
+		}
+	}
+	return list
+}
+
+// withdrawalFilter selects withdrawals by status, user and chain, and pages
+// back from Before when it isn't 0.
+type withdrawalFilter struct {
+	Status string
+	User   string
+	Chain  string
+	Before int64
+}
+
+func withdrawalFilterFrom(r *http.Request, before int64) withdrawalFilter {
+	query := r.URL.Query()
+	return withdrawalFilter{Status: query.Get("status"), User: query.Get("user"), Chain: query.Get("chain"), Before: before}
+}
+
+// filterWithdrawals loads the withdrawals matching f, newest first. A nil
+// limit returns them all.
+func filterWithdrawals(f withdrawalFilter, limit interface{}) ([]*withdrawal, error) {
+	var conditions []string
+	var args []interface{}
+	filter := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.Status != "" {
+		filter("status = $%d", f.Status)
+	}
+	if f.User != "" {
+		filter("slack_user_id = $%d", f.User)
+	}
+	if f.Chain != "" {
+		filter("chain = $%d", f.Chain)
+	}
+	if f.Before > 0 {
+		filter("id < $%d", f.Before)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+	return queryWithdrawals(fmt.Sprintf(`%s ORDER BY id DESC LIMIT $%d;`, where, len(args)), args...)
+}
+
+func handleAPIWithdrawals(ctx context.Context, w http.ResponseWriter, r *http.Request, p *apiPrincipal) {
+	limit, before, err := pageParams(r, "before")
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	withdrawals, err := filterWithdrawals(withdrawalFilterFrom(r, before), limit)
+	if err != nil {
+		internalAPIError(ctx, w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"withdrawals": toAPIWithdrawals(withdrawals)})
+}
+
+func handleAPIWithdrawal(ctx context.Context, w http.ResponseWriter, r *http.Request, idArg string) {
+	id, err := strconv.ParseInt(idArg, 10, 64)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "no such withdrawal")
+		return
+	}
+	found, err := queryWithdrawals(`WHERE id = $1;`, id)
+	if err != nil {
+		internalAPIError(ctx, w, err)
+		return
+	}
+	if len(found) == 0 {
+		apiError(w, http.StatusNotFound, "no such withdrawal")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIWithdrawals(found)[0])
+}
+
+// apiReviewHandler approves or rejects a withdrawal pending approval, as
+// `admin approve` and `admin reject` do.
+func apiReviewHandler(api *slack.Client, idArg string, approve bool) apiHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p *apiPrincipal) {
+		id, err := strconv.ParseInt(idArg, 10, 64)
+		if err != nil {
+			apiError(w, http.StatusNotFound, "no such withdrawal")
+			return
+		}
+		found, err := queryWithdrawals(`WHERE id = $1;`, id)
+		if err != nil {
+			internalAPIError(ctx, w, err)
+			return
+		}
+		if len(found) == 0 {
+			apiError(w, http.StatusNotFound, "no such withdrawal")
+			return
+		}
+
+		reviewed, err := reviewWithdrawal(ctx, api, id, approve, p.Actor, "api:"+correlationID(ctx))
+		if err != nil {
+			apiError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		decision := ":no_entry_sign: %s rejected the withdrawal of %s %s by <@%s> through the API"
+		if approve {
+			decision = ":white_check_mark: %s approved the withdrawal of %s %s by <@%s> through the API"
+		}
+		alertAdmins(api, fmt.Sprintf(decision, p.Actor, formatAmount(reviewed.Amount, reviewed.Asset), reviewed.Asset, reviewed.UserID))
+		writeJSON(w, http.StatusOK, toAPIWithdrawals([]*withdrawal{reviewed})[0])
+	}
+}
+
+// handleAPIExport writes every account, ledger entry or withdrawal as JSON
+// or, with format=csv, as CSV.
+func handleAPIExport(ctx context.Context, w http.ResponseWriter, r *http.Request, kind string) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		apiError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+
+	data, header, records, err := exportData(kind, withdrawalFilterFrom(r, 0))
+	if err == errUnknownExport {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		internalAPIError(ctx, w, err)
+		return
+	}
+
+	writeTable(w, format, kind, data, header, records)
+}
+
+// handleAPIReport answers a ledger, statement or summary report for the
+// period in the month, or from and to, parameters.
+func handleAPIReport(ctx context.Context, w http.ResponseWriter, r *http.Request, kind string) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		apiError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+	period, err := parseReportPeriod(q.Get("month"), q.Get("from"), q.Get("to"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	data, header, records, err := reportData(ctx, kind, period, q.Get("user"))
+	if err == errUnknownReport {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		internalAPIError(ctx, w, err)
+		return
+	}
+	writeTable(w, format, fmt.Sprintf("%s-%s", kind, period.From.Format("2006-01-02")), data, header, records)
+}
+
+// writeTable answers data as JSON, or the records as a CSV attachment.
+func writeTable(w http.ResponseWriter, format, name string, data interface{}, header []string, records [][]string) {
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+	out := csv.NewWriter(w)
+	out.Write(header)
+	out.WriteAll(records)
+}
+
+var errUnknownExport = errors.New("export accounts, ledger or withdrawals")
+
+// exportData loads every account, ledger entry or withdrawal, the latter
+// selected by filter, both as JSON values and as CSV records.
+func exportData(kind string, filter withdrawalFilter) (data interface{}, header []string, records [][]string, err error) {
+	switch kind {
+	case "accounts":
+		accounts, err := queryAccounts("", nil, 0)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		header = []string{"user_id", "address", "frozen", "asset", "balance"}
+		for _, a := range accounts {
+			if len(a.Balances) == 0 {
+				records = append(records, []string{a.UserID, a.Address, strconv.FormatBool(a.Frozen), "", ""})
+			}
+			for asset, balance := range a.Balances {
+				records = append(records, []string{a.UserID, a.Address, strconv.FormatBool(a.Frozen), asset, balance})
+			}
+		}
+		return accounts, header, records, nil
+	case "ledger":
+		entries, err := queryLedger("", 0, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		header = []string{"id", "user_id", "asset", "kind", "amount", "chain", "tx_hash", "note", "created_at"}
+		for _, e := range entries {
+			records = append(records, []string{strconv.FormatInt(e.ID, 10), e.UserID, e.Asset, e.Kind, e.Amount, e.Chain, e.TxHash, e.Note, e.CreatedAt.Format(time.RFC3339)})
+		}
+		return entries, header, records, nil
+	case "withdrawals":
+		withdrawals, err := filterWithdrawals(filter, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		list := toAPIWithdrawals(withdrawals)
+		header = []string{"id", "user_id", "chain", "asset", "address", "amount", "fee", "fee_asset", "status", "tx_hash", "error", "created_at"}
+		for _, wd := range list {
+			records = append(records, []string{strconv.FormatInt(wd.ID, 10), wd.UserID, wd.Chain, wd.Asset, wd.Address, wd.Amount, wd.Fee, wd.FeeAsset, wd.Status, wd.TxHash, wd.Error, wd.CreatedAt.Format(time.RFC3339)})
+		}
+		return list, header, records, nil
+	}
+	return nil, nil, nil, errUnknownExport
+}
+
+// parseStoredAmount reads a NUMERIC amount from the database.
+func parseStoredAmount(s string) (*big.Int, bool) {
+	return new(big.Int).SetString(s, 10)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIAdjustIdempotency(t *testing.T) {
+	testDatabase(t)
+	api := testSlack(t)
+	ops := &apiPrincipal{Actor: "api:ops", Scopes: map[string]bool{scopeAdjust: true}}
+	hr := &apiPrincipal{Actor: "api:hr", Scopes: map[string]bool{scopeAdjust: true}}
+	credit := `{"amount":"1","asset":"CULT","reason":"bonus"}`
+
+	var first string
+	tests := []struct {
+		name     string
+		p        *apiPrincipal
+		key      string
+		body     string
+		status   int
+		replayed bool
+		balance  string
+	}{
+		{"first", ops, "k1", credit, http.StatusOK, false, "1"},
+		{"retry", ops, "k1", credit, http.StatusOK, true, "1"},
+		{"different request", ops, "k1", `{"amount":"2","asset":"CULT","reason":"bonus"}`, http.StatusConflict, false, ""},
+		{"other actor", hr, "k1", credit, http.StatusOK, false, "2"},
+		{"other key", ops, "k2", credit, http.StatusOK, false, "3"},
+		{"no key", ops, "", credit, http.StatusOK, false, "4"},
+		{"no key again", ops, "", credit, http.StatusOK, false, "5"},
+		{"invalid", ops, "k3", `{"amount":"0","asset":"CULT","reason":"bonus"}`, http.StatusBadRequest, false, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/accounts/U1/credit", strings.NewReader(test.body))
+		if test.key != "" {
+			r.Header.Set("Idempotency-Key", test.key)
+		}
+		w := httptest.NewRecorder()
+		apiAdjustHandler(api, "U1", "credit")(context.Background(), w, r, test.p)
+
+		if w.Code != test.status {
+			t.Fatalf("%s: status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != test.replayed {
+			t.Errorf("%s: replayed is %v, want %v", test.name, replayed, test.replayed)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var answer apiAdjustment
+		if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+			t.Fatalf("%s: %v: %s", test.name, err, w.Body)
+		}
+		if answer.Balance != test.balance {
+			t.Errorf("%s: balance is %s, want %s", test.name, answer.Balance, test.balance)
+		}
+		switch test.name {
+		case "first":
+			first = strings.TrimSpace(w.Body.String())
+		case "retry":
+			if body := strings.TrimSpace(w.Body.String()); body != first {
+				t.Errorf("retry answered %s, want %s", body, first)
+			}
+		}
+	}
+}
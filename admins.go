@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// adminGroupsTTL is how long the members of the admin user groups are cached.
+const adminGroupsTTL = 5 * time.Minute
+
+var adminGroupsMu sync.Mutex
+var adminGroupMembers map[string]bool
+var adminGroupsFetchedAt time.Time
+var adminGroupsFetched string
+
+// isAdmin reports whether the Slack user may run privileged commands, either
+// because they are listed in the admin users or are a member of one of the
+// admin user groups.
+func isAdmin(api *slack.Client, userID string) bool {
+	if userID == "" {
+		return false
+	}
+	config := runtimeConfig()
+	for _, id := range config.Slack.AdminUsers {
+		if id == userID {
+			return true
+		}
+	}
+	if len(config.Slack.AdminGroups) == 0 {
+		return false
+	}
+
+	adminGroupsMu.Lock()
+	defer adminGroupsMu.Unlock()
+
+	// a reload may have changed the groups
+	groups := strings.Join(config.Slack.AdminGroups, ",")
+	if time.Since(adminGroupsFetchedAt) > adminGroupsTTL || groups != adminGroupsFetched {
+		members := map[string]bool{}
+		for _, group := range config.Slack.AdminGroups {
+			ids, err := api.GetUserGroupMembers(group)
+			if err != nil {
+				// keep the members we knew about rather than locking admins out
+				logWarn(context.Background(), "Failed to fetch members of admin group", logFields{"group": group, "error": err})
+				return adminGroupMembers[userID]
+			}
+			for _, id := range ids {
+				members[id] = true
+			}
+		}
+		adminGroupMembers = members
+		adminGroupsFetchedAt = time.Now()
+		adminGroupsFetched = groups
+	}
+	return adminGroupMembers[userID]
+}
+
+// alertAdmins posts a message to the admin channel, or just logs it when no
+// channel is configured.
+func alertAdmins(api *slack.Client, message string) {
+	channel := runtimeConfig().Slack.AdminChannel
+	if channel == "" {
+		logWarn(context.Background(), "Admin alert", logFields{"alert": message})
+		return
+	}
+	sendSlackMessage(api, channel, message)
+}
+
+// isFrozen reports whether an admin froze the user's funds.
+func isFrozen(userID string) bool {
+	db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	defer db.Close()
+
+	var frozen bool
+	db.QueryRow(`
+		SELECT true FROM frozen_users WHERE slack_user_id = $1 LIMIT 1;
+	`, userID).Scan(&frozen)
+
+	return frozen
+}
+
+// parseUserMention extracts the user ID from a Slack mention like <@U123> or
+// <@U123|name>.
+func parseUserMention(mention string) (string, error) {
+	if !strings.HasPrefix(mention, "<@") || !strings.HasSuffix(mention, ">") {
+		return "", fmt.Errorf("%s isn't a user, try @someone", mention)
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(mention, "<@"), ">")
+	if i := strings.Index(id, "|"); i >= 0 {
+		id = id[:i]
+	}
+	if id == "" {
+		return "", fmt.Errorf("%s isn't a user, try @someone", mention)
+	}
+	return id, nil
+}
+
+const adminUsage = `:thonk: Usage:
+> admin credit @user [amount] [CULT|ETH] [reason]
+> admin debit @user [amount] [CULT|ETH] [reason]
+> admin freeze @user [reason]
+> admin unfreeze @user
+> admin pause withdrawals
+> admin resume withdrawals
+> admin set [setting] [value]
+> admin approve [withdrawal]
+> admin reject [withdrawal]
+> admin reviews
+> admin review approve [review]
+> admin review deny [review]
+> admin settings
+> admin audit verify
+> admin webhooks
+> admin webhooks replay [id|all]`
+
+// handleAdminCommand runs `admin` subcommands. Every change they make is
+// recorded in the audit log.
+func handleAdminCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, args []string) {
+	if len(args) == 0 {
+		sendSlackMessage(api, ev.Channel, adminUsage)
+		return
+	}
+
+	switch {
+	case (args[0] == "credit" || args[0] == "debit") && len(args) >= 4:
+		handleAdminAdjustCommand(ctx, api, ev, args[0], args[1], args[2], args[3:])
+	case args[0] == "freeze" && len(args) >= 2:
+		handleAdminFreezeCommand(ctx, api, ev, args[1], strings.Join(args[2:], " "))
+	case args[0] == "unfreeze" && len(args) == 2:
+		handleAdminUnfreezeCommand(ctx, api, ev, args[1])
+	case (args[0] == "pause" || args[0] == "resume") && len(args) == 2 && args[1] == "withdrawals":
+		handleAdminSetCommand(ctx, api, ev, settingWithdrawalsPaused, fmt.Sprint(args[0] == "pause"))
+	case (args[0] == "approve" || args[0] == "reject") && len(args) == 2:
+		handleAdminReviewCommand(ctx, api, ev, args[1], args[0] == "approve")
+	case args[0] == "reviews" && len(args) == 1:
+		handleAdminReviewsCommand(api, ev)
+	case args[0] == "review" && len(args) == 3 && (args[1] == "approve" || args[1] == "deny"):
+		handleAdminReviewDecisionCommand(ctx, api, ev, args[2], args[1] == "approve")
+	case args[0] == "set" && len(args) == 3:
+		handleAdminSetCommand(ctx, api, ev, args[1], args[2])
+	case args[0] == "settings" && len(args) == 1:
+		handleAdminSettingsCommand(api, ev)
+	case args[0] == "audit" && len(args) == 2 && args[1] == "verify":
+		handleAuditVerifyCommand(api, ev)
+	case args[0] == "webhooks" && len(args) == 1:
+		handleAdminWebhooksCommand(api, ev)
+	case args[0] == "webhooks" && len(args) == 3 && args[1] == "replay":
+		handleAdminWebhooksReplayCommand(ctx, api, ev, args[2])
+	default:
+		sendSlackMessage(api, ev.Channel, adminUsage)
+	}
+}
+
+// handleAdminAdjustCommand credits or debits a user's balance. rest is the
+// optional asset followed by the reason, which is mandatory.
+func handleAdminAdjustCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, action, mention, amountArg string, rest []string) {
+	userID, err := parseUserMention(mention)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+		return
+	}
+
+	asset := tokenAsset
+	if parsed, err := parseAsset(rest[0]); err == nil {
+		asset = parsed
+		rest = rest[1:]
+	}
+	reason := strings.Join(rest, " ")
+	if reason == "" {
+		sendSlackMessage(api, ev.Channel, ":thonk: Please give a reason")
+		return
+	}
+
+	amount, err := parseAmount(amountArg, asset)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+		return
+	}
+	if amount.Sign() < 1 {
+		sendSlackMessage(api, ev.Channel, fmt.Sprintf(":thonk: Must %s more than 0 %s", action, asset))
+		return
+	}
+
+	if err := adminAdjust(ctx, ev.User, slackEventRef(ev), action, userID, asset, amount, reason, nil); err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+
+	verb := adjustVerb(action)
+	sendSlackMessage(api, ev.Channel, fmt.Sprintf(":white_check_mark: %s %s %s %s", strings.Title(verb), mention, formatAmount(amount, asset), asset))
+	sendSlackMessage(api, userID, fmt.Sprintf(":bank: An admin %s your balance %s %s: %s", verb, formatAmount(amount, asset), asset, reason))
+}
+
+// adminAdjust credits or debits amount of asset to userID on behalf of
+// actor, and records it in the audit log. within, when given, runs in the
+// same transaction.
+func adminAdjust(ctx context.Context, actor, event, action, userID, asset string, amount *big.Int, reason string, within func(tx *sql.Tx) error) error {
+	return withLedgerTx(ctx, func(tx *sql.Tx) error {
+		err := applyAdjustment(tx, actor, event, action, userID, asset, amount, reason)
+		if err != nil || within == nil {
+			return err
+		}
+		return within(tx)
+	})
+}
+
+// applyAdjustment is adminAdjust within tx.
+func applyAdjustment(tx *sql.Tx, actor, event, action, userID, asset string, amount *big.Int, reason string) error {
+	kind, delta := kindAdminCredit, amount
+	if action == "debit" {
+		kind, delta = kindAdminDebit, new(big.Int).Neg(amount)
+	}
+
+	err := adjustBalance(tx, ledgerEntry{UserID: userID, Asset: asset, Kind: kind, Amount: delta, Note: reason})
+	if err != nil {
+		return err
+	}
+	return recordAudit(tx, auditRecord{Actor: actor, Action: "admin_" + action, Subject: userID, Detail: fmt.Sprintf("%s %s: %s", formatAmount(amount, asset), asset, reason), Event: event})
+}
+
+func adjustVerb(action string) string {
+	if action == "debit" {
+		return "debited"
+	}
+	return "credited"
+}
+
+func handleAdminFreezeCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, mention, reason string) {
+	userID, err := parseUserMention(mention)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+		return
+	}
+
+	err = withLedgerTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO frozen_users(slack_user_id, reason, frozen_by) VALUES ($1, $2, $3)
+			ON CONFLICT (slack_user_id)
+			DO UPDATE SET reason=$2, frozen_by=$3, frozen_at=now();
+		`, userID, nullString(reason), ev.User)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditRecord{Actor: ev.User, Action: "admin_freeze", Subject: userID, After: "frozen", Detail: reason, Event: slackEventRef(ev)})
+	})
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	sendSlackMessage(api, ev.Channel, fmt.Sprintf(":ice_cube: Froze %s, they can't tip, register or withdraw until unfrozen", mention))
+}
+
+func handleAdminUnfreezeCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, mention string) {
+	userID, err := parseUserMention(mention)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+		return
+	}
+
+	err = withLedgerTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			DELETE FROM frozen_users WHERE slack_user_id = $1;
+		`, userID)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditRecord{Actor: ev.User, Action: "admin_unfreeze", Subject: userID, Before: "frozen", Event: slackEventRef(ev)})
+	})
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	sendSlackMessage(api, ev.Channel, fmt.Sprintf(":sunny: Unfroze %s", mention))
+}
+
+func handleAdminSetCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, key, value string) {
+	if err := validateSetting(key, value); err != nil {
+		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+		return
+	}
+
+	var previous string
+	err := withLedgerTx(ctx, func(tx *sql.Tx) (err error) {
+		previous, err = storeSetting(tx, key, value, ev.User)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditRecord{Actor: ev.User, Action: "admin_set", Subject: key, Before: previous, After: value, Event: slackEventRef(ev)})
+	})
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	sendSlackMessage(api, ev.Channel, fmt.Sprintf(":white_check_mark: Set `%s` to `%s` (was `%s`)", key, value, previous))
+}
+
+func handleAdminSettingsCommand(api *slack.Client, ev *slack.MessageEvent) {
+	lines := []string{":gear: Settings:"}
+	for _, key := range settingNames() {
+		lines = append(lines, fmt.Sprintf("• `%s`: `%s`", key, retrieveSetting(key)))
+	}
+	sendSlackMessage(api, ev.Channel, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes of the admin API. Callers with the admin token have all of them.
+const (
+	// scopeRead lists and exports accounts, ledger entries and withdrawals.
+	scopeRead = "read"
+	// scopeAdjust credits and debits balances.
+	scopeAdjust = "adjust"
+	// scopeReview approves and rejects held withdrawals.
+	scopeReview = "review"
+)
+
+var apiScopes = []string{scopeRead, scopeAdjust, scopeReview}
+
+// oidcScopePrefix prefixes the API scopes in the scopes of OIDC tokens, such
+// as tiperc20:read.
+const oidcScopePrefix = "tiperc20:"
+
+// jwksTTL is how long the signing keys of the OIDC issuer are cached. An
+// unknown key ID refreshes them sooner, at most once per jwksMinRefresh.
+const (
+	jwksTTL        = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// apiKey authenticates a caller of the admin API, such as an HR tool.
+type apiKey struct {
+	Name   string   `json:"name" yaml:"name"`
+	Key    string   `json:"key" yaml:"key"`
+	Scopes []string `json:"scopes" yaml:"scopes"`
+}
+
+// oidcConfig accepts bearer tokens of an OpenID Connect provider in place of
+// API keys.
+type oidcConfig struct {
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// ScopesClaim is the claim the scopes are read from, scope by default.
+	ScopesClaim string `yaml:"scopes_claim"`
+}
+
+// apiPrincipal is an authenticated caller of the admin API.
+type apiPrincipal struct {
+	// Actor is who the audit log records, api:NAME for API keys and
+	// oidc:SUBJECT for OIDC tokens.
+	Actor  string
+	Scopes map[string]bool
+}
+
+func validAPIScope(scope string) bool {
+	for _, s := range apiScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateAPI finds the caller of r from its bearer token: the admin
+// token, an API key or an OIDC token, in that order.
+func authenticateAPI(ctx context.Context, r *http.Request) (*apiPrincipal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, errors.New("missing bearer token")
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	if adminHTTPToken != "" && secureEqual(token, adminHTTPToken) {
+		p := &apiPrincipal{Actor: "api:admin", Scopes: map[string]bool{}}
+		for _, s := range apiScopes {
+			p.Scopes[s] = true
+		}
+		return p, nil
+	}
+
+	config := runtimeConfig()
+	for _, key := range config.HTTP.APIKeys {
+		if secureEqual(token, key.Key) {
+			p := &apiPrincipal{Actor: "api:" + key.Name, Scopes: map[string]bool{}}
+			for _, s := range key.Scopes {
+				p.Scopes[s] = true
+			}
+			return p, nil
+		}
+	}
+
+	if config.HTTP.OIDC.Issuer != "" && strings.Count(token, ".") == 2 {
+		return oidcTokens.verify(ctx, config.HTTP.OIDC, token)
+	}
+	return nil, errors.New("invalid token")
+}
+
+// secureEqual compares secrets in constant time.
+func secureEqual(a, b string) bool {
+	x, y := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(x[:], y[:]) == 1
+}
+
+// oidcVerifier checks RS256 signed ID and access tokens against the keys of
+// the issuer, found through its discovery document.
+type oidcVerifier struct {
+	mu        sync.Mutex
+	issuer    string
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+var oidcTokens = &oidcVerifier{}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (v *oidcVerifier) verify(ctx context.Context, config oidcConfig, token string) (*apiPrincipal, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	key, err := v.key(ctx, config.Issuer, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != config.Issuer {
+		return nil, errors.New("token from another issuer")
+	}
+	if !audienceIncludes(claims["aud"], config.Audience) {
+		return nil, errors.New("token for another audience")
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); !ok || exp < now {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && nbf > now+60 {
+		return nil, errors.New("token not valid yet")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("token without subject")
+	}
+
+	claim := config.ScopesClaim
+	if claim == "" {
+		claim = "scope"
+	}
+	p := &apiPrincipal{Actor: "oidc:" + sub, Scopes: map[string]bool{}}
+	for _, s := range claimStrings(claims[claim]) {
+		if scope := strings.TrimPrefix(s, oidcScopePrefix); scope != s && validAPIScope(scope) {
+			p.Scopes[scope] = true
+		}
+	}
+	return p, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// audienceIncludes handles the aud claim being a string or a list.
+func audienceIncludes(aud interface{}, audience string) bool {
+	for _, a := range claimStrings(aud) {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings reads a claim holding a space separated string or a list of
+// strings.
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		var list []string
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// key returns the signing key kid of issuer, refreshing the cached keys when
+// they are old or don't have it.
+func (v *oidcVerifier) key(ctx context.Context, issuer, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stale := v.issuer != issuer || time.Since(v.fetchedAt) > jwksTTL
+	if _, ok := v.keys[kid]; !ok && time.Since(v.fetchedAt) > jwksMinRefresh {
+		stale = true
+	}
+	if stale {
+		keys, err := fetchJWKS(ctx, issuer)
+		if err != nil {
+			if v.issuer != issuer || v.keys == nil {
+				return nil, err
+			}
+			// keep the keys we have through an outage of the issuer
+			logWarn(ctx, "Failed to refresh OIDC signing keys", logFields{"issuer": issuer, "error": err})
+		} else {
+			v.issuer, v.keys = issuer, keys
+		}
+		v.fetchedAt = time.Now()
+	}
+
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, errors.New("token signed with an unknown key")
+	}
+	return key, nil
+}
+
+// fetchJWKS reads the RSA signing keys of issuer by key ID.
+func fetchJWKS(ctx context.Context, issuer string) (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("the OIDC discovery document has no jwks_uri")
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("the OIDC issuer has no RSA signing keys")
+	}
+	return keys, nil
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OIDC issuer serving the discovery document and the keys
+// of its signer.
+type testIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	kid string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key, kid: "key-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": issuer.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": issuer.kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *testIssuer) config() oidcConfig {
+	return oidcConfig{Issuer: i.URL, Audience: "tiperc20"}
+}
+
+// token signs claims with the key of the issuer, as alg.
+func (i *testIssuer) token(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(jwtHeader{Alg: alg, Kid: kid}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (i *testIssuer) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   i.URL,
+		"aud":   "tiperc20",
+		"sub":   "alice",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "openid tiperc20:read tiperc20:review tiperc20:unknown adjust",
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	ctx := context.Background()
+
+	p, err := (&oidcVerifier{}).verify(ctx, issuer.config(), issuer.token(t, "RS256", issuer.kid, issuer.claims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Actor != "oidc:alice" {
+		t.Errorf("actor is %q", p.Actor)
+	}
+	if len(p.Scopes) != 2 || !p.Scopes[scopeRead] || !p.Scopes[scopeReview] {
+		t.Errorf("scopes are %v", p.Scopes)
+	}
+
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		change func(claims map[string]interface{})
+		want   string
+	}{
+		{"algorithm", "HS256", "key-1", nil, `unsupported token algorithm "HS256"`},
+		{"key", "RS256", "key-2", nil, "token signed with an unknown key"},
+		{"issuer", "RS256", "key-1", func(c map[string]interface{}) { c["iss"] = "https://other.example.com" }, "token from another issuer"},
+		{"audience", "RS256", "key-1", func(c map[string]interface{}) { c["aud"] = []string{"other", "another"} }, "token for another audience"},
+		{"expired", "RS256", "key-1", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, "token expired"},
+		{"no expiry", "RS256", "key-1", func(c map[string]interface{}) { delete(c, "exp") }, "token expired"},
+		{"not yet", "RS256", "key-1", func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() }, "token not valid yet"},
+		{"subject", "RS256", "key-1", func(c map[string]interface{}) { delete(c, "sub") }, "token without subject"},
+	}
+	for _, test := range tests {
+		claims := issuer.claims()
+		if test.change != nil {
+			test.change(claims)
+		}
+		_, err := (&oidcVerifier{}).verify(ctx, issuer.config(), issuer.token(t, test.alg, test.kid, claims))
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: error is %v, want %q", test.name, err, test.want)
+		}
+	}
+
+	token := issuer.token(t, "RS256", issuer.kid, issuer.claims())
+	parts := strings.Split(token, ".")
+	forged := issuer.claims()
+	forged["sub"] = "mallory"
+	data, _ := json.Marshal(forged)
+	parts[1] = base64.RawURLEncoding.EncodeToString(data)
+	if _, err := (&oidcVerifier{}).verify(ctx, issuer.config(), strings.Join(parts, ".")); err == nil || err.Error() != "invalid token signature" {
+		t.Errorf("forged claims: error is %v", err)
+	}
+	if _, err := (&oidcVerifier{}).verify(ctx, issuer.config(), "not.a.token"); err == nil || err.Error() != "malformed token" {
+		t.Errorf("malformed token: error is %v", err)
+	}
+}
+
+func TestOIDCScopesClaim(t *testing.T) {
+	issuer := newTestIssuer(t)
+	config := issuer.config()
+	config.ScopesClaim = "permissions"
+	claims := issuer.claims()
+	claims["permissions"] = []string{"tiperc20:adjust", "tiperc20:read"}
+
+	p, err := (&oidcVerifier{}).verify(context.Background(), config, issuer.token(t, "RS256", issuer.kid, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Scopes) != 2 || !p.Scopes[scopeAdjust] || !p.Scopes[scopeRead] {
+		t.Errorf("scopes are %v", p.Scopes)
+	}
+}
+
+func TestAudienceIncludes(t *testing.T) {
+	tests := []struct {
+		aud  interface{}
+		want bool
+	}{
+		{"tiperc20", true},
+		{"other", false},
+		{[]interface{}{"other", "tiperc20"}, true},
+		{[]interface{}{"other", 1.0}, false},
+		{nil, false},
+		{1.0, false},
+	}
+	for _, test := range tests {
+		if got := audienceIncludes(test.aud, "tiperc20"); got != test.want {
+			t.Errorf("%v: %v, want %v", test.aud, got, test.want)
+		}
+	}
+}
+
+func TestClaimStrings(t *testing.T) {
+	tests := []struct {
+		claim interface{}
+		want  []string
+	}{
+		{"", nil},
+		{" openid  tiperc20:read ", []string{"openid", "tiperc20:read"}},
+		{[]interface{}{"tiperc20:read", true, "tiperc20:adjust"}, []string{"tiperc20:read", "tiperc20:adjust"}},
+		{map[string]interface{}{"scope": "read"}, nil},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		if got := claimStrings(test.claim); strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%v: %q, want %q", test.claim, got, test.want)
+		}
+	}
+}
+
+func TestAuthenticateAPI(t *testing.T) {
+	issuer := newTestIssuer(t)
+	c := &config{}
+	c.HTTP.APIKeys = []apiKey{{Name: "hr", Key: "0123456789abcdef", Scopes: []string{scopeRead}}}
+	c.HTTP.OIDC = issuer.config()
+	currentConfig.Store(c)
+	adminHTTPToken = "admin-token-0123"
+	oidcTokens = &oidcVerifier{}
+	t.Cleanup(func() {
+		currentConfig.Store(&config{})
+		adminHTTPToken = ""
+		oidcTokens = &oidcVerifier{}
+	})
+
+	tests := []struct {
+		header string
+		actor  string
+		scopes []string
+	}{
+		{"Bearer admin-token-0123", "api:admin", apiScopes},
+		{"Bearer 0123456789abcdef", "api:hr", []string{scopeRead}},
+		{"Bearer " + issuer.token(t, "RS256", issuer.kid, issuer.claims()), "oidc:alice", []string{scopeRead, scopeReview}},
+		{"Bearer 0123456789abcdeg", "", nil},
+		{"Basic admin-token-0123", "", nil},
+		{"", "", nil},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/accounts", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		p, err := authenticateAPI(context.Background(), r)
+		if test.actor == "" {
+			if err == nil {
+				t.Errorf("%.30s: authenticated as %s", test.header, p.Actor)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%.30s: %v", test.header, err)
+			continue
+		}
+		if p.Actor != test.actor || len(p.Scopes) != len(test.scopes) {
+			t.Errorf("%.30s: authenticated as %s with %v", test.header, p.Actor, p.Scopes)
+		}
+		for _, s := range test.scopes {
+			if !p.Scopes[s] {
+				t.Errorf("%.30s: no %s scope", test.header, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// auditActorSystem is the actor of changes the bot makes on its own, such as
+// confirming mined withdrawals.
+const auditActorSystem = "system"
+
+// auditLockID serializes appends to the audit log so that every entry chains
+// to the one before it. The lock is held from recordAudit to the commit, so
+// audited transactions only run one at a time from there on: the chain has a
+// single head, and an entry can't be hashed before the one before it is
+// committed. Transactions audit last where they can, to keep that short.
+const auditLockID = 0x61756469
+
+// auditRecord is one entry of the audit log. Each entry's hash covers its
+// fields and the hash of the previous entry, so editing or deleting an entry
+// breaks the chain from there on.
+type auditRecord struct {
+	ID        int64     `json:"id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Subject   string    `json:"subject"`
+	Before    string    `json:"before"`
+	After     string    `json:"after"`
+	Detail    string    `json:"detail"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"-"`
+}
+
+// computeHash hashes the record's fields, which include the previous hash.
+func (r *auditRecord) computeHash() string {
+	fields := *r
+	fields.CreatedAt = r.CreatedAt.UTC()
+	encoded, _ := json.Marshal(fields)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// slackEventRef identifies the Slack message that caused a change.
+func slackEventRef(ev *slack.MessageEvent) string {
+	if ev == nil {
+		return ""
+	}
+	return ev.Channel + "/" + ev.Timestamp
+}
+
+// recordAudit appends r to the audit log inside the transaction that made the
+// change.
+func recordAudit(tx *sql.Tx, r auditRecord) error {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1);`, auditLockID); err != nil {
+		return err
+	}
+
+	var prevHash sql.NullString
+	err := tx.QueryRow(`
+		SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1;
+	`).Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// the id is part of the hash, so take it from the sequence up front
+	if err := tx.QueryRow(`SELECT nextval('audit_log_id_seq');`).Scan(&r.ID); err != nil {
+		return err
+	}
+	r.PrevHash = prevHash.String
+	r.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	r.Hash = r.computeHash()
+
+	_, err = tx.Exec(`
+		INSERT INTO audit_log(id, actor, action, subject, before_value, after_value, detail, event, created_at, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
+	`, r.ID, r.Actor, r.Action, nullString(r.Subject), nullString(r.Before), nullString(r.After), nullString(r.Detail), nullString(r.Event), r.CreatedAt, nullString(r.PrevHash), r.Hash)
+	return err
+}
+
+// auditCommand records a command sent to the bot before it runs. args are
+// the words of the message after the mention of the bot.
+func auditCommand(ctx context.Context, ev *slack.MessageEvent, args []string) error {
+	return withLedgerTx(ctx, func(tx *sql.Tx) error {
+		return recordAudit(tx, commandAuditRecord(ev, args))
+	})
+}
+
+// commandAuditRecord records the command and its arguments rather than the
+// text of the message, which is kept out of the database like it is kept out
+// of the logs. Anything but a known command is likely chatter, so only that
+// it was unknown is recorded.
+func commandAuditRecord(ev *slack.MessageEvent, args []string) auditRecord {
+	r := auditRecord{Actor: ev.User, Action: "command", Subject: commandLabel(args[0]), Event: slackEventRef(ev)}
+	if r.Subject == args[0] {
+		r.Detail = strings.Join(args[1:], " ")
+	}
+	return r
+}
+
+// querier reads from a database or from within a transaction.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// verifyAuditLog walks the audit log and checks every hash and link. Entries
+// written before the log was chained are counted as legacy. It returns the
+// number of chained entries and the hash of the last one.
+func verifyAuditLog(q querier) (legacy, chained int, head string, err error) {
+	rows, err := q.Query(`
+		SELECT id, actor, action, subject, before_value, after_value, detail, event, created_at, prev_hash, hash
+		FROM audit_log ORDER BY id;
+	`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r auditRecord
+		var subject, before, after, detail, event, prevHash, hash sql.NullString
+		if err = rows.Scan(&r.ID, &r.Actor, &r.Action, &subject, &before, &after, &detail, &event, &r.CreatedAt, &prevHash, &hash); err != nil {
+			return
+		}
+		r.Subject, r.Before, r.After, r.Detail, r.Event = subject.String, before.String, after.String, detail.String, event.String
+		r.PrevHash, r.Hash = prevHash.String, hash.String
+
+		if r.Hash == "" {
+			if chained > 0 {
+				err = fmt.Errorf("entry %d has no hash", r.ID)
+				return
+			}
+			legacy++
+			continue
+		}
+		if r.PrevHash != head {
+			err = fmt.Errorf("entry %d doesn't follow the entry before it, an entry was removed or inserted", r.ID)
+			return
+		}
+		if r.computeHash() != r.Hash {
+			err = fmt.Errorf("entry %d was modified", r.ID)
+			return
+		}
+		head = r.Hash
+		chained++
+	}
+	err = rows.Err()
+	return
+}
+
+func handleAuditVerifyCommand(api *slack.Client, ev *slack.MessageEvent) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	defer db.Close()
+
+	legacy, chained, head, err := verifyAuditLog(db)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":rotating_light: The audit log was tampered with: "+err.Error())
+		return
+	}
+
+	message := fmt.Sprintf(":white_check_mark: The audit log checks out: %d chained entries, head `%s`", chained, head)
+	if legacy > 0 {
+		message += fmt.Sprintf(" (%d older entries aren't chained)", legacy)
+	}
+	sendSlackMessage(api, ev.Channel, message)
+}
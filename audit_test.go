@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+func TestAuditHash(t *testing.T) {
+	at := time.Date(2026, 10, 19, 12, 30, 0, 123456000, time.UTC)
+	base := auditRecord{ID: 7, Actor: "U1", Action: "admin_set", Subject: "signup-bonus", Before: "10", After: "20",
+		Detail: "detail", Event: "C1/1.2", CreatedAt: at, PrevHash: "abc"}
+	hash := base.computeHash()
+	if len(hash) != 64 {
+		t.Fatalf("hash %q isn't SHA-256 hex", hash)
+	}
+
+	same := base
+	same.CreatedAt = at.In(time.FixedZone("JST", 9*3600))
+	same.Hash = "stored"
+	if same.computeHash() != hash {
+		t.Error("the hash depends on the time zone or the stored hash")
+	}
+
+	changes := map[string]func(r *auditRecord){
+		"id":         func(r *auditRecord) { r.ID++ },
+		"actor":      func(r *auditRecord) { r.Actor = "U2" },
+		"action":     func(r *auditRecord) { r.Action = "admin_unfreeze" },
+		"subject":    func(r *auditRecord) { r.Subject = "tip-limit" },
+		"before":     func(r *auditRecord) { r.Before = "11" },
+		"after":      func(r *auditRecord) { r.After = "21" },
+		"detail":     func(r *auditRecord) { r.Detail = "other" },
+		"event":      func(r *auditRecord) { r.Event = "C1/1.3" },
+		"created_at": func(r *auditRecord) { r.CreatedAt = at.Add(time.Microsecond) },
+		"prev_hash":  func(r *auditRecord) { r.PrevHash = "abd" },
+	}
+	for field, change := range changes {
+		r := base
+		change(&r)
+		if r.computeHash() == hash {
+			t.Errorf("changing %s keeps the hash", field)
+		}
+	}
+}
+
+func TestCommandAuditRecord(t *testing.T) {
+	ev := &slack.MessageEvent{Msg: slack.Msg{User: "U1", Channel: "C1", Timestamp: "1.2", Text: "<@UBOT> tip <@U2> 10 please"}}
+	tests := []struct {
+		args    []string
+		subject string
+		detail  string
+	}{
+		{[]string{"tip", "<@U2>", "10", "CULT"}, "tip", "<@U2> 10 CULT"},
+		{[]string{"balance"}, "balance", ""},
+		{[]string{"thanks", "for", "the", "help"}, "unknown", ""},
+	}
+	for _, test := range tests {
+		r := commandAuditRecord(ev, test.args)
+		if r.Actor != "U1" || r.Action != "command" || r.Event != "C1/1.2" || r.Subject != test.subject || r.Detail != test.detail {
+			t.Errorf("%q: recorded %+v", test.args, r)
+		}
+	}
+}
+
+// testAuditLog returns a SQLite database whose audit log has a chain of
+// entries with the given ids, after one legacy entry, and which can be
+// tampered with.
+func testAuditLog(t *testing.T, ids ...int64) (*sql.DB, []auditRecord) {
+	url := testSQLiteURL(t)
+	if _, err := migrateDatabase(context.Background(), url, true); err != nil {
+		t.Fatal(err)
+	}
+	d, dsn := databaseDialect(url)
+	db, err := sql.Open(d.Name, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`DROP TRIGGER audit_log_no_update; DROP TRIGGER audit_log_no_delete;`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO audit_log (id, actor, action) VALUES (1, 'U0', 'register');`); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []auditRecord
+	prev := ""
+	for i, id := range ids {
+		r := auditRecord{ID: id, Actor: "U1", Action: "command", Subject: "tip", Detail: "<@U2> 10",
+			CreatedAt: time.Date(2026, 10, 19, 12, i, 0, 500000, time.UTC), PrevHash: prev}
+		r.Hash = r.computeHash()
+		insertTestAudit(t, db, r)
+		records = append(records, r)
+		prev = r.Hash
+	}
+	return db, records
+}
+
+func insertTestAudit(t *testing.T, db *sql.DB, r auditRecord) {
+	_, err := db.Exec(`
+		INSERT INTO audit_log (id, actor, action, subject, before_value, after_value, detail, event, created_at, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
+	`, r.ID, r.Actor, r.Action, nullString(r.Subject), nullString(r.Before), nullString(r.After), nullString(r.Detail), nullString(r.Event), r.CreatedAt, nullString(r.PrevHash), r.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	db, records := testAuditLog(t, 10, 20, 30, 40)
+	legacy, chained, head, err := verifyAuditLog(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy != 1 || chained != 4 || head != records[3].Hash {
+		t.Errorf("verified %d legacy and %d chained entries up to %s", legacy, chained, head)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(db *sql.DB, records []auditRecord)
+		want   string
+	}{
+		{"edited", func(db *sql.DB, records []auditRecord) {
+			db.Exec(`UPDATE audit_log SET detail = '<@U3> 10' WHERE id = 20;`)
+		}, "entry 20 was modified"},
+		{"edited and rehashed", func(db *sql.DB, records []auditRecord) {
+			r := records[1]
+			r.Detail = "<@U3> 10"
+			db.Exec(`UPDATE audit_log SET detail = $1, hash = $2 WHERE id = 20;`, r.Detail, r.computeHash())
+		}, "entry 30 doesn't follow the entry before it"},
+		{"deleted", func(db *sql.DB, records []auditRecord) {
+			db.Exec(`DELETE FROM audit_log WHERE id = 20;`)
+		}, "entry 30 doesn't follow the entry before it"},
+		{"deleted last", func(db *sql.DB, records []auditRecord) {
+			db.Exec(`DELETE FROM audit_log WHERE id = 40;`)
+		}, ""},
+		{"inserted", func(db *sql.DB, records []auditRecord) {
+			r := auditRecord{ID: 25, Actor: "U9", Action: "admin_credit", Subject: "U9", Detail: "1000000 CULT",
+				CreatedAt: records[1].CreatedAt, PrevHash: records[1].Hash}
+			r.Hash = r.computeHash()
+			insertTestAudit(t, db, r)
+		}, "entry 30 doesn't follow the entry before it"},
+		{"unchained", func(db *sql.DB, records []auditRecord) {
+			db.Exec(`INSERT INTO audit_log (id, actor, action) VALUES (50, 'U9', 'admin_credit');`)
+		}, "entry 50 has no hash"},
+	}
+	for _, test := range tests {
+		db, records := testAuditLog(t, 10, 20, 30, 40)
+		test.tamper(db, records)
+		_, _, head, err := verifyAuditLog(db)
+		if test.want == "" {
+			// entries cut off at the end only show against a head noted
+			// before, as audit verify prints it
+			if err != nil || head != records[2].Hash {
+				t.Errorf("%s: head is %s: %v", test.name, head, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error is %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestRecordAudit(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+	for _, subject := range []string{"U1", "U2", "U3"} {
+		err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+			return recordAudit(tx, auditRecord{Actor: "U0", Action: "admin_freeze", Subject: subject})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, chained, _, err := verifyAuditLog(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chained != 3 {
+		t.Errorf("%d entries are chained, want 3", chained)
+	}
+	if _, err := db.Exec(`UPDATE audit_log SET subject = 'U9';`); err != nil {
+		t.Fatal(err)
+	}
+	if _, chained, _, err := verifyAuditLog(db); err != nil || chained != 3 {
+		t.Errorf("the append-only rules let an entry change: %d chained, %v", chained, err)
+	}
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotFormat = "tiperc20-snapshot"
+	// snapshotVersion changes with the layout of snapshots, not with the
+	// schema, whose version is recorded separately. Version 2 keeps
+	// timestamps in RFC 3339.
+	snapshotVersion = 2
+)
+
+// snapshotTables are the tables of a snapshot, in an order that restores
+// rows before the rows referring to them.
+var snapshotTables = []string{
+	"accounts",
+	"balances",
+	"ledger_entries",
+	"withdrawals",
+	"tips",
+	"signup_bonuses",
+	"settings",
+	"frozen_users",
+	"reviews",
+	"audit_log",
+	"api_idempotency_keys",
+	"webhook_deliveries",
+	"webhook_dead_letters",
+}
+
+// snapshot is the portable state of the bot. Every value is kept as text:
+// timestamps in RFC 3339 and UTC, booleans as true or false, and the others
+// as the database writes them. Both Postgres and SQLite read them back into
+// their own column types, see snapshotText and snapshotValue.
+type snapshot struct {
+	Format        string           `json:"format"`
+	Version       int              `json:"version"`
+	SchemaVersion int64            `json:"schema_version"`
+	CreatedAt     time.Time        `json:"created_at"`
+	Tables        []*snapshotTable `json:"tables"`
+	// Checksum covers the fields above and the checksum of every table.
+	Checksum string `json:"checksum"`
+}
+
+type snapshotTable struct {
+	Name    string      `json:"name"`
+	Columns []string    `json:"columns"`
+	Rows    [][]*string `json:"rows"`
+	// Checksum is the SHA-256 of the JSON of the columns and rows.
+	Checksum string `json:"checksum"`
+}
+
+func (t *snapshotTable) computeChecksum() string {
+	encoded, _ := json.Marshal(struct {
+		Columns []string    `json:"columns"`
+		Rows    [][]*string `json:"rows"`
+	}{t.Columns, t.Rows})
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *snapshot) computeChecksum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%d\n%s\n", s.Format, s.Version, s.SchemaVersion, s.CreatedAt.UTC().Format(time.RFC3339Nano))
+	for _, t := range s.Tables {
+		fmt.Fprintf(h, "%s %s\n", t.Name, t.Checksum)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *snapshot) table(name string) *snapshotTable {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// values maps the named columns of each row of t, leaving out NULLs.
+func (t *snapshotTable) values(columns ...string) ([][]string, error) {
+	index := map[string]int{}
+	for i, c := range t.Columns {
+		index[c] = i
+	}
+	var rows [][]string
+	for _, row := range t.Rows {
+		values := make([]string, len(columns))
+		for i, c := range columns {
+			j, ok := index[c]
+			if !ok {
+				return nil, fmt.Errorf("table %s has no column %s", t.Name, c)
+			}
+			if row[j] != nil {
+				values[i] = *row[j]
+			}
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
+
+// takeSnapshot reads every table of the database at url in one transaction,
+// so that the snapshot is consistent.
+func takeSnapshot(ctx context.Context, url string) (*snapshot, error) {
+	d, dsn := databaseDialect(url)
+	db, err := sql.Open(d.Name, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	opts := &sql.TxOptions{ReadOnly: true}
+	if d == postgresDialect {
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if d == postgresDialect {
+		if _, err := tx.Exec(`SET LOCAL TimeZone = 'UTC';`); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &snapshot{Format: snapshotFormat, Version: snapshotVersion, CreatedAt: time.Now().UTC()}
+	applied, err := appliedVersions(tx)
+	if err != nil {
+		return nil, err
+	}
+	for version, isApplied := range applied {
+		if isApplied && version > s.SchemaVersion {
+			s.SchemaVersion = version
+		}
+	}
+	for _, name := range snapshotTables {
+		t, err := readSnapshotTable(tx, name)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %v", name, err)
+		}
+		s.Tables = append(s.Tables, t)
+	}
+	s.Checksum = s.computeChecksum()
+	return s, nil
+}
+
+func readSnapshotTable(tx *sql.Tx, name string) (*snapshotTable, error) {
+	// the names are our own, never input
+	rows, err := tx.Query(`SELECT * FROM ` + name + ` LIMIT 0;`)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	order := "1"
+	for _, c := range columns {
+		if c == "id" {
+			order = "id"
+		}
+	}
+	rows, err = tx.Query(`SELECT * FROM ` + name + ` ORDER BY ` + order + `;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	t := &snapshotTable{Name: name, Columns: columns, Rows: [][]*string{}}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := make([]*string, len(columns))
+		for i, v := range values {
+			row[i] = snapshotText(v)
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	t.Checksum = t.computeChecksum()
+	return t, rows.Err()
+}
+
+// snapshotText formats a value as the driver scanned it, by its type, as the
+// text a snapshot keeps. NULL stays nil.
+func snapshotText(v interface{}) *string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		s = v.UTC().Format(time.RFC3339Nano)
+	case bool:
+		s = strconv.FormatBool(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+	return &s
+}
+
+// snapshotValue parses the text of a snapshot value back for a column of
+// databaseType, as the driver names it: Postgres' type, or the type SQLite
+// columns are declared with. Other types are left to the database to parse
+// from the text.
+func snapshotValue(databaseType string, s *string) (interface{}, error) {
+	if s == nil {
+		return nil, nil
+	}
+	switch databaseType {
+	case "BOOL", "BOOLEAN":
+		return strconv.ParseBool(*s)
+	case "TIMESTAMP", "TIMESTAMPTZ", "DATETIME":
+		return time.Parse(time.RFC3339Nano, *s)
+	}
+	return *s, nil
+}
+
+// readSnapshot decodes a snapshot, gzipped or not, and checks its format and
+// checksums.
+func readSnapshot(r io.Reader) (*snapshot, error) {
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipped, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer unzipped.Close()
+		r = unzipped
+	} else {
+		r = buffered
+	}
+
+	s := &snapshot{}
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, fmt.Errorf("not a snapshot: %v", err)
+	}
+	if s.Format != snapshotFormat {
+		return nil, errors.New("not a tiperc20 snapshot")
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d isn't supported, only %d", s.Version, snapshotVersion)
+	}
+	for _, t := range s.Tables {
+		if t.Checksum != t.computeChecksum() {
+			return nil, fmt.Errorf("table %s doesn't match its checksum", t.Name)
+		}
+		for i, row := range t.Rows {
+			if len(row) != len(t.Columns) {
+				return nil, fmt.Errorf("table %s row %d has %d values for %d columns", t.Name, i+1, len(row), len(t.Columns))
+			}
+		}
+	}
+	if s.Checksum != s.computeChecksum() {
+		return nil, errors.New("the snapshot doesn't match its checksum")
+	}
+	for _, name := range snapshotTables {
+		if s.table(name) == nil {
+			return nil, fmt.Errorf("the snapshot has no %s table", name)
+		}
+	}
+	return s, nil
+}
+
+// balanceKey identifies a balance.
+type balanceKey struct {
+	UserID string
+	Asset  string
+}
+
+// checkSnapshotLedger checks that the balances of s agree with its ledger.
+// A balance can't be negative, nor lower than its ledger entries add up to:
+// balances from before the ledger existed started from a positive amount.
+// Every entry, withdrawal and tip must belong to a balance. It returns the
+// total balance of each asset.
+func checkSnapshotLedger(s *snapshot) (totals map[string]*big.Int, problems []string, err error) {
+	balances, err := s.table("balances").values("slack_user_id", "asset", "balance")
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := s.table("ledger_entries").values("slack_user_id", "asset", "amount")
+	if err != nil {
+		return nil, nil, err
+	}
+	withdrawals, err := s.table("withdrawals").values("slack_user_id", "asset", "amount")
+	if err != nil {
+		return nil, nil, err
+	}
+	tips, err := s.table("tips").values("from_user_id", "to_user_id", "asset")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	totals = map[string]*big.Int{}
+	held := map[balanceKey]*big.Int{}
+	for _, b := range balances {
+		amount, ok := parseStoredAmount(b[2])
+		if !ok {
+			problems = append(problems, fmt.Sprintf("the %s balance of %s is invalid: %q", b[1], b[0], b[2]))
+			continue
+		}
+		if amount.Sign() < 0 {
+			problems = append(problems, fmt.Sprintf("the %s balance of %s is negative", b[1], b[0]))
+		}
+		held[balanceKey{b[0], b[1]}] = amount
+		if totals[b[1]] == nil {
+			totals[b[1]] = new(big.Int)
+		}
+		totals[b[1]].Add(totals[b[1]], amount)
+	}
+
+	ledger := map[balanceKey]*big.Int{}
+	for _, e := range entries {
+		k := balanceKey{e[0], e[1]}
+		amount, ok := parseStoredAmount(e[2])
+		if !ok {
+			problems = append(problems, fmt.Sprintf("a %s ledger entry of %s has an invalid amount %q", e[1], e[0], e[2]))
+			continue
+		}
+		if held[k] == nil {
+			problems = append(problems, fmt.Sprintf("%s has %s ledger entries but no balance", e[0], e[1]))
+			held[k] = new(big.Int)
+		}
+		if ledger[k] == nil {
+			ledger[k] = new(big.Int)
+		}
+		ledger[k].Add(ledger[k], amount)
+	}
+	for k, sum := range ledger {
+		if held[k].Cmp(sum) < 0 {
+			problems = append(problems, fmt.Sprintf("the %s balance of %s is %s, less than its ledger entries add up to, %s",
+				k.Asset, k.UserID, formatAmount(held[k], k.Asset), formatAmount(sum, k.Asset)))
+		}
+	}
+
+	for _, w := range withdrawals {
+		if held[balanceKey{w[0], w[1]}] == nil {
+			problems = append(problems, fmt.Sprintf("%s has %s withdrawals but no balance", w[0], w[1]))
+		}
+	}
+	for _, t := range tips {
+		for _, user := range t[:2] {
+			if held[balanceKey{user, t[2]}] == nil {
+				problems = append(problems, fmt.Sprintf("%s has %s tips but no balance", user, t[2]))
+			}
+		}
+	}
+	return totals, problems, nil
+}
+
+var errRestoreDryRun = errors.New("dry run")
+
+// restoreSnapshot migrates the database at url and loads s into it, in one
+// transaction. The database must be empty unless replace is given, which
+// empties it first. After loading, the counts, the asset totals and the
+// balances against the ledger are checked again in the database, as is the
+// hash chain of the audit log, and with dryRun everything is rolled back.
+// A dry run can't replace, since emptying the tables would lock the bot out
+// of them until the rollback.
+func restoreSnapshot(ctx context.Context, url string, s *snapshot, replace, dryRun bool) error {
+	if dryRun && replace {
+		return errors.New("-dry-run can't be used with -replace, check the snapshot against an empty database")
+	}
+	totals, problems, err := checkSnapshotLedger(s)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the snapshot's ledger is inconsistent:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	d, _ := databaseDialect(url)
+	err = withMigrationLock(ctx, url, func(tx *sql.Tx, migrations []*migration, applied map[int64]bool) (bool, error) {
+		if latest := migrations[len(migrations)-1].Version; s.SchemaVersion > latest {
+			return false, fmt.Errorf("the snapshot is of schema version %d, newer than this version's %d", s.SchemaVersion, latest)
+		}
+		if d == postgresDialect {
+			if _, err := tx.Exec(`SET LOCAL TimeZone = 'UTC';`); err != nil {
+				return false, err
+			}
+		}
+		// migrate within the restore, so that a dry run leaves no trace
+		if err := applyMigrations(ctx, tx, pendingMigrations(ctx, migrations, applied)); err != nil {
+			return false, err
+		}
+
+		if replace {
+			if d != postgresDialect {
+				return false, errors.New("only Postgres databases can be replaced, restore into an empty one")
+			}
+			// TRUNCATE skips the rules that keep the audit log append-only
+			if _, err := tx.Exec(`TRUNCATE ` + strings.Join(snapshotTables, ", ") + ` RESTART IDENTITY CASCADE;`); err != nil {
+				return false, err
+			}
+		} else {
+			for _, name := range snapshotTables {
+				var exists bool
+				if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ` + name + `);`).Scan(&exists); err != nil {
+					return false, err
+				}
+				if exists {
+					return false, fmt.Errorf("table %s isn't empty, restore with -replace to overwrite the database", name)
+				}
+			}
+		}
+
+		for _, name := range snapshotTables {
+			if err := insertSnapshotTable(tx, d, s.table(name)); err != nil {
+				return false, fmt.Errorf("table %s: %v", name, err)
+			}
+		}
+		if err := verifyRestore(tx, s, totals); err != nil {
+			return false, err
+		}
+		if _, _, _, err := verifyAuditLog(tx); err != nil {
+			return false, fmt.Errorf("the restored audit log doesn't check out: %v", err)
+		}
+
+		if d == postgresDialect {
+			err := recordAudit(tx, auditRecord{Actor: ctlActor(), Action: "restore", Subject: s.Checksum,
+				Detail: fmt.Sprintf("snapshot of %s at schema version %d", s.CreatedAt.Format(time.RFC3339), s.SchemaVersion)})
+			if err != nil {
+				return false, err
+			}
+		}
+		if dryRun {
+			return false, errRestoreDryRun
+		}
+		return true, nil
+	})
+	if err == errRestoreDryRun {
+		return nil
+	}
+	return err
+}
+
+func insertSnapshotTable(tx *sql.Tx, d *sqlDialect, t *snapshotTable) error {
+	// the values are parsed for the columns they are restored into
+	rows, err := tx.Query(`SELECT ` + strings.Join(t.Columns, ", ") + ` FROM ` + t.Name + ` LIMIT 0;`)
+	if err != nil {
+		return err
+	}
+	columnTypes, err := rows.ColumnTypes()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	placeholders := make([]string, len(t.Columns))
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO ` + t.Name + ` (` + strings.Join(t.Columns, ", ") + `) VALUES (` + strings.Join(placeholders, ", ") + `);`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	values := make([]interface{}, len(t.Columns))
+	for i, row := range t.Rows {
+		for j, v := range row {
+			if values[j], err = snapshotValue(columnTypes[j].DatabaseTypeName(), v); err != nil {
+				return fmt.Errorf("row %d column %s: %v", i+1, t.Columns[j], err)
+			}
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return fmt.Errorf("row %d: %v", i+1, err)
+		}
+	}
+
+	// SQLite carries on from the highest id by itself
+	if d != postgresDialect {
+		return nil
+	}
+	var sequence sql.NullString
+	if err := tx.QueryRow(`SELECT pg_get_serial_sequence($1, 'id');`, t.Name).Scan(&sequence); err != nil || !sequence.Valid {
+		// tables without a serial id
+		return nil
+	}
+	_, err = tx.Exec(`SELECT setval($1, COALESCE((SELECT MAX(id) FROM `+t.Name+`), 0) + 1, false);`, sequence.String)
+	return err
+}
+
+// verifyRestore checks what the database holds after a restore against the
+// snapshot.
+func verifyRestore(tx *sql.Tx, s *snapshot, totals map[string]*big.Int) error {
+	for _, t := range s.Tables {
+		var count int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM ` + t.Name + `;`).Scan(&count); err != nil {
+			return err
+		}
+		if count != len(t.Rows) {
+			return fmt.Errorf("table %s has %d rows after the restore, the snapshot %d", t.Name, count, len(t.Rows))
+		}
+	}
+
+	// summed here, as SQLite would sum the TEXT balances as floats
+	rows, err := tx.Query(`SELECT asset, CAST(balance AS TEXT) FROM balances;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	restored := map[string]*big.Int{}
+	for rows.Next() {
+		var asset, balance string
+		if err := rows.Scan(&asset, &balance); err != nil {
+			return err
+		}
+		amount, ok := parseStoredAmount(balance)
+		if !ok {
+			return fmt.Errorf("a %s balance is %q after the restore", asset, balance)
+		}
+		if restored[asset] == nil {
+			restored[asset] = new(big.Int)
+		}
+		restored[asset].Add(restored[asset], amount)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for asset, total := range totals {
+		if restored[asset] == nil || restored[asset].Cmp(total) != 0 {
+			return fmt.Errorf("the %s balances add up to %v after the restore, not %s", asset, restored[asset], total)
+		}
+	}
+	return nil
+}
+
+const backupUsage = `usage: tiperc20 backup [-o FILE]
+       tiperc20 restore [-dry-run] [-replace] FILE
+
+backup writes a snapshot of the database to FILE, gzipped when it ends in
+.gz, or to stdout. restore loads one into an empty database, or with
+-replace overwrites the database, once its ledger checks out. -dry-run
+checks the snapshot and the restore into an empty database, then rolls
+back.`
+
+// runBackup runs `tiperc20 backup` and `tiperc20 restore` and returns their
+// exit code.
+func runBackup(ctx context.Context, url string, args []string) int {
+	if err := backupCommand(ctx, url, args); err != nil {
+		if err == errCtlUsage {
+			fmt.Fprintln(os.Stderr, backupUsage)
+		} else {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func backupCommand(ctx context.Context, url string, args []string) error {
+	if url == "" {
+		return errors.New("database.url (DATABASE_URL) is required")
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	output := flags.String("o", "", "the file to write, stdout by default")
+	dryRun := flags.Bool("dry-run", false, "check the restore, then roll it back")
+	replace := flags.Bool("replace", false, "overwrite the database")
+	if err := flags.Parse(args[1:]); err != nil {
+		return errCtlUsage
+	}
+
+	if args[0] == "backup" {
+		if flags.NArg() > 0 || *dryRun || *replace {
+			return errCtlUsage
+		}
+		s, err := takeSnapshot(ctx, url)
+		if err != nil {
+			return err
+		}
+		return writeSnapshot(s, *output)
+	}
+
+	if flags.NArg() != 1 || *output != "" {
+		return errCtlUsage
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s, err := readSnapshot(file)
+	if err != nil {
+		return err
+	}
+	if err := restoreSnapshot(ctx, url, s, *replace, *dryRun); err != nil {
+		return err
+	}
+
+	verb := "Restored"
+	if *dryRun {
+		verb = "Checked, without restoring,"
+	}
+	fmt.Fprintf(os.Stderr, "%s the snapshot of %s at schema version %d:\n", verb, s.CreatedAt.Format(time.RFC3339), s.SchemaVersion)
+	for _, t := range s.Tables {
+		fmt.Fprintf(os.Stderr, "  %-22s %d rows\n", t.Name, len(t.Rows))
+	}
+	return nil
+}
+
+func writeSnapshot(s *snapshot, path string) (err error) {
+	var out io.Writer = os.Stdout
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		out = file
+		if strings.HasSuffix(path, ".gz") {
+			zipped := gzip.NewWriter(file)
+			defer func() {
+				if closeErr := zipped.Close(); err == nil {
+					err = closeErr
+				}
+			}()
+			out = zipped
+		}
+	}
+	if err := json.NewEncoder(out).Encode(s); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote the snapshot %s\n", s.Checksum)
+	return nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotValues(t *testing.T) {
+	at := time.Date(2026, 10, 19, 12, 30, 0, 123456000, time.FixedZone("JST", 9*3600))
+	tests := []struct {
+		databaseType string
+		scanned      interface{}
+		text         string
+		restored     interface{}
+	}{
+		{"BOOL", true, "true", true},
+		{"BOOL", false, "false", false},
+		{"TIMESTAMP", at, "2026-10-19T03:30:00.123456Z", at},
+		{"TIMESTAMPTZ", at.UTC(), "2026-10-19T03:30:00.123456Z", at},
+		{"INT4", int64(42), "42", "42"},
+		{"NUMERIC", []byte("115792089237316195423570985008687907853269984665640564039457584007913129639935"), "115792089237316195423570985008687907853269984665640564039457584007913129639935", "115792089237316195423570985008687907853269984665640564039457584007913129639935"},
+		{"TEXT", "CULT", "CULT", "CULT"},
+	}
+	for _, test := range tests {
+		text := snapshotText(test.scanned)
+		if text == nil || *text != test.text {
+			t.Errorf("%s %v: kept as %v, want %q", test.databaseType, test.scanned, text, test.text)
+			continue
+		}
+		restored, err := snapshotValue(test.databaseType, text)
+		if err != nil {
+			t.Errorf("%s %q: %v", test.databaseType, test.text, err)
+			continue
+		}
+		if want, ok := test.restored.(time.Time); ok {
+			if got, ok := restored.(time.Time); !ok || !got.Equal(want) {
+				t.Errorf("%s %q: restored as %v, want %v", test.databaseType, test.text, restored, want)
+			}
+		} else if restored != test.restored {
+			t.Errorf("%s %q: restored as %#v, want %#v", test.databaseType, test.text, restored, test.restored)
+		}
+	}
+
+	if text := snapshotText(nil); text != nil {
+		t.Errorf("NULL kept as %q", *text)
+	}
+	if v, err := snapshotValue("BOOL", nil); v != nil || err != nil {
+		t.Errorf("NULL restored as %v: %v", v, err)
+	}
+	for _, bad := range []struct{ databaseType, text string }{
+		{"BOOL", "maybe"},
+		{"TIMESTAMP", "2026-10-19 12:30:00+09"},
+	} {
+		if _, err := snapshotValue(bad.databaseType, &bad.text); err == nil {
+			t.Errorf("%s %q: no error", bad.databaseType, bad.text)
+		}
+	}
+}
+
+func TestRestoreDryRunReplace(t *testing.T) {
+	s := &snapshot{Format: snapshotFormat, Version: snapshotVersion}
+	if err := restoreSnapshot(context.Background(), "postgres://unused", s, true, true); err == nil {
+		t.Error("a dry run replaced the database")
+	}
+}
+
+func testSnapshotText(s string) *string {
+	return &s
+}
+
+// testSnapshot returns a sealed snapshot with an empty table for every table
+// but those given.
+func testSnapshot(tables ...*snapshotTable) *snapshot {
+	s := &snapshot{
+		Format:        snapshotFormat,
+		Version:       snapshotVersion,
+		SchemaVersion: 20,
+		CreatedAt:     time.Date(2026, 10, 19, 3, 30, 0, 0, time.UTC),
+	}
+	given := map[string]*snapshotTable{}
+	for _, t := range tables {
+		given[t.Name] = t
+	}
+	for _, name := range snapshotTables {
+		t := given[name]
+		if t == nil {
+			t = &snapshotTable{Name: name, Columns: []string{"id"}}
+		}
+		s.Tables = append(s.Tables, t)
+	}
+	sealTestSnapshot(s)
+	return s
+}
+
+func sealTestSnapshot(s *snapshot) {
+	for _, t := range s.Tables {
+		t.Checksum = t.computeChecksum()
+	}
+	s.Checksum = s.computeChecksum()
+}
+
+func encodeTestSnapshot(t *testing.T, s *snapshot, zipped bool) *bytes.Buffer {
+	var buf bytes.Buffer
+	var err error
+	if zipped {
+		w := gzip.NewWriter(&buf)
+		err = json.NewEncoder(w).Encode(s)
+		if err == nil {
+			err = w.Close()
+		}
+	} else {
+		err = json.NewEncoder(&buf).Encode(s)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestReadSnapshot(t *testing.T) {
+	settings := &snapshotTable{
+		Name:    "settings",
+		Columns: []string{"key", "value"},
+		Rows:    [][]*string{{testSnapshotText("signup-bonus"), testSnapshotText("10")}, {testSnapshotText("tip-limit"), nil}},
+	}
+	for _, zipped := range []bool{false, true} {
+		s, err := readSnapshot(encodeTestSnapshot(t, testSnapshot(settings), zipped))
+		if err != nil {
+			t.Errorf("gzip %v: %v", zipped, err)
+			continue
+		}
+		rows, err := s.table("settings").values("value", "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 || rows[0][0] != "10" || rows[0][1] != "signup-bonus" || rows[1][0] != "" {
+			t.Errorf("gzip %v: settings are %q", zipped, rows)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(s *snapshot)
+		want   string
+	}{
+		{"format", func(s *snapshot) {
+			s.Format = "other"
+			sealTestSnapshot(s)
+		}, "not a tiperc20 snapshot"},
+		{"version", func(s *snapshot) {
+			s.Version = 1
+			sealTestSnapshot(s)
+		}, "snapshot version 1"},
+		{"table", func(s *snapshot) {
+			s.table("settings").Rows[0][1] = testSnapshotText("1000")
+		}, "table settings doesn't match its checksum"},
+		{"row", func(s *snapshot) {
+			s.table("settings").Rows[0] = s.table("settings").Rows[0][:1]
+			sealTestSnapshot(s)
+		}, "table settings row 1 has 1 values for 2 columns"},
+		{"resealed table", func(s *snapshot) {
+			t := s.table("settings")
+			t.Rows[0][1] = testSnapshotText("1000")
+			t.Checksum = t.computeChecksum()
+		}, "the snapshot doesn't match its checksum"},
+		{"schema", func(s *snapshot) { s.SchemaVersion++ }, "the snapshot doesn't match its checksum"},
+		{"missing table", func(s *snapshot) {
+			s.Tables = s.Tables[:len(s.Tables)-1]
+			sealTestSnapshot(s)
+		}, "the snapshot has no " + snapshotTables[len(snapshotTables)-1] + " table"},
+	}
+	for _, test := range tests {
+		s := testSnapshot(&snapshotTable{
+			Name:    "settings",
+			Columns: []string{"key", "value"},
+			Rows:    [][]*string{{testSnapshotText("signup-bonus"), testSnapshotText("10")}},
+		})
+		test.change(s)
+		_, err := readSnapshot(encodeTestSnapshot(t, s, false))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error is %v, want %q", test.name, err, test.want)
+		}
+	}
+
+	if _, err := readSnapshot(strings.NewReader("{")); err == nil || !strings.HasPrefix(err.Error(), "not a snapshot") {
+		t.Errorf("truncated snapshot: error is %v", err)
+	}
+}
+
+// testLedgerTable builds a table of rows of text.
+func testLedgerTable(name string, columns []string, rows ...[]string) *snapshotTable {
+	t := &snapshotTable{Name: name, Columns: columns}
+	for _, row := range rows {
+		var values []*string
+		for _, v := range row {
+			values = append(values, testSnapshotText(v))
+		}
+		t.Rows = append(t.Rows, values)
+	}
+	return t
+}
+
+func TestCheckSnapshotLedger(t *testing.T) {
+	balanceColumns := []string{"slack_user_id", "asset", "balance"}
+	entryColumns := []string{"slack_user_id", "asset", "amount"}
+	tipColumns := []string{"from_user_id", "to_user_id", "asset"}
+	tests := []struct {
+		name        string
+		balances    [][]string
+		entries     [][]string
+		withdrawals [][]string
+		tips        [][]string
+		totals      map[string]string
+		problems    []string
+	}{
+		{
+			name:     "agrees",
+			balances: [][]string{{"U1", "CULT", "70"}, {"U2", "CULT", "30"}, {"U1", "ETH", "5"}},
+			entries:  [][]string{{"U1", "CULT", "100"}, {"U1", "CULT", "-30"}, {"U2", "CULT", "30"}, {"U1", "ETH", "5"}},
+			tips:     [][]string{{"U1", "U2", "CULT"}},
+			totals:   map[string]string{"CULT": "100", "ETH": "5"},
+		},
+		{
+			name:     "older than the ledger",
+			balances: [][]string{{"U1", "CULT", "70"}},
+			entries:  [][]string{{"U1", "CULT", "-30"}},
+			totals:   map[string]string{"CULT": "70"},
+		},
+		{
+			name:     "invalid balance",
+			balances: [][]string{{"U1", "CULT", "lots"}},
+			totals:   map[string]string{},
+			problems: []string{`the CULT balance of U1 is invalid: "lots"`},
+		},
+		{
+			name:     "negative",
+			balances: [][]string{{"U1", "CULT", "-1"}},
+			totals:   map[string]string{"CULT": "-1"},
+			problems: []string{"the CULT balance of U1 is negative"},
+		},
+		{
+			name:     "less than the ledger",
+			balances: [][]string{{"U1", "CULT", "1"}},
+			entries:  [][]string{{"U1", "CULT", "2"}},
+			totals:   map[string]string{"CULT": "1"},
+			problems: []string{"the CULT balance of U1 is " + formatAmount(big.NewInt(1), "CULT") + ", less than its ledger entries add up to, " + formatAmount(big.NewInt(2), "CULT")},
+		},
+		{
+			name:     "invalid entry",
+			balances: [][]string{{"U1", "CULT", "1"}},
+			entries:  [][]string{{"U1", "CULT", "1.5"}},
+			totals:   map[string]string{"CULT": "1"},
+			problems: []string{`a CULT ledger entry of U1 has an invalid amount "1.5"`},
+		},
+		{
+			name:        "orphans",
+			entries:     [][]string{{"U1", "CULT", "0"}},
+			withdrawals: [][]string{{"U2", "ETH", "1"}},
+			tips:        [][]string{{"U1", "U3", "CULT"}},
+			totals:      map[string]string{},
+			problems: []string{
+				"U1 has CULT ledger entries but no balance",
+				"U2 has ETH withdrawals but no balance",
+				"U3 has CULT tips but no balance",
+			},
+		},
+	}
+	for _, test := range tests {
+		s := testSnapshot(
+			testLedgerTable("balances", balanceColumns, test.balances...),
+			testLedgerTable("ledger_entries", entryColumns, test.entries...),
+			testLedgerTable("withdrawals", entryColumns, test.withdrawals...),
+			testLedgerTable("tips", tipColumns, test.tips...),
+		)
+		totals, problems, err := checkSnapshotLedger(s)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if strings.Join(problems, "\n") != strings.Join(test.problems, "\n") {
+			t.Errorf("%s: problems are %q, want %q", test.name, problems, test.problems)
+		}
+		if len(totals) != len(test.totals) {
+			t.Errorf("%s: totals are %v, want %v", test.name, totals, test.totals)
+		}
+		for asset, want := range test.totals {
+			if totals[asset] == nil || totals[asset].String() != want {
+				t.Errorf("%s: the %s total is %v, want %s", test.name, asset, totals[asset], want)
+			}
+		}
+	}
+
+	s := testSnapshot(testLedgerTable("balances", []string{"slack_user_id", "asset"}, []string{"U1", "CULT"}))
+	if _, _, err := checkSnapshotLedger(s); err == nil {
+		t.Error("a balances table without a balance column was checked")
+	}
+}
+
+func TestSnapshotSQLite(t *testing.T) {
+	ctx := context.Background()
+	from, to := testSQLiteURL(t), testSQLiteURL(t)
+	if _, err := migrateDatabase(ctx, from, true); err != nil {
+		t.Fatal(err)
+	}
+	d, dsn := databaseDialect(from)
+	db, err := sql.Open(d.Name, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		INSERT INTO accounts (slack_user_id, ethereum_address, address_changed_at) VALUES ('U1', '0xabc', '2026-10-19 12:30:00.5');
+		INSERT INTO balances (slack_user_id, asset, balance) VALUES ('U1', 'CULT', '70'), ('U2', 'CULT', '30');
+		INSERT INTO ledger_entries (slack_user_id, asset, kind, amount) VALUES ('U1', 'CULT', 'admin_credit', '100'), ('U1', 'CULT', 'tip_sent', '-30'), ('U2', 'CULT', 'tip_received', '30');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := takeSnapshot(ctx, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.SchemaVersion != 12 {
+		t.Errorf("schema version is %d", s.SchemaVersion)
+	}
+	s, err = readSnapshot(encodeTestSnapshot(t, s, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreSnapshot(ctx, to, s, false, true); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if err := restoreSnapshot(ctx, to, s, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreSnapshot(ctx, to, s, false, false); err == nil || !strings.Contains(err.Error(), "isn't empty") {
+		t.Errorf("restoring twice: %v", err)
+	}
+	if err := restoreSnapshot(ctx, to, s, true, false); err == nil || !strings.Contains(err.Error(), "only Postgres") {
+		t.Errorf("replacing SQLite: %v", err)
+	}
+
+	restored, err := takeSnapshot(ctx, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range s.Tables {
+		if got := restored.table(want.Name); got.Checksum != want.Checksum {
+			gotRows, _ := json.Marshal(got.Rows)
+			wantRows, _ := json.Marshal(want.Rows)
+			t.Errorf("table %s restored as %s, want %s", want.Name, gotRows, wantRows)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nlopes/slack"
+)
+
+// maxBatchSize bounds the recipients of one disperse transaction so that it
+// stays well below the block gas limit.
+const maxBatchSize = 100
+
+// batchMiningTimeout is how long a batch may take to be mined before it is
+// left for an operator to look at.
+const batchMiningTimeout = 30 * time.Minute
+
+// approvalMiningTimeout bounds the wait for the approval of the disperse
+// contract, which holds the hot wallet.
+const approvalMiningTimeout = 5 * time.Minute
+
+// batchingEnabled reports whether CULT withdrawals on c are queued and paid
+// out together instead of sent one by one. The disperse contract pulls from
+// the hot wallet, so treasury mode chains are never batched.
+func batchingEnabled(c *chain) bool {
+	return withdrawBatchWindow > 0 && c.DisperseAddress != "" && !c.treasuryMode()
+}
+
+// queueWithdrawal debits the user's balance and queues the withdrawal for
+// the next batch of its chain. Its gas fee is charged like for an individual
+// transfer, which the batch may fall back to, and what the batch costs less
+// is given back once it is mined.
+func queueWithdrawal(ctx context.Context, w *withdrawal) error {
+	w.Status = withdrawalQueued
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		return debitWithdrawal(tx, w)
+	})
+	if err == nil {
+		logInfo(ctx, "Queued withdrawal", logFields{"withdrawal": w.ID, "user": w.UserID, "chain": w.Chain, "amount": formatAmount(w.Amount, w.Asset), "asset": w.Asset})
+	}
+	return err
+}
+
+// runWithdrawalBatcher pays out the queued withdrawals of every chain with
+// batching enabled once per WITHDRAW_BATCH_WINDOW.
+func runWithdrawalBatcher(api *slack.Client) {
+	if withdrawBatchWindow <= 0 {
+		return
+	}
+
+	for range time.Tick(withdrawBatchWindow) {
+		// queued withdrawals wait while an admin has paused withdrawals
+		if withdrawalsPaused() {
+			continue
+		}
+		for _, name := range chainNames() {
+			c := chains[name]
+			if !batchingEnabled(c) {
+				continue
+			}
+			if !beginWork() {
+				return
+			}
+			ctx := correlatedContext()
+			if err := processWithdrawalBatch(ctx, api, c); err != nil {
+				logError(ctx, "Failed to process withdrawal batch", logFields{"chain": c.Name, "error": err})
+			}
+			endWork()
+		}
+	}
+}
+
+// processWithdrawalBatch sends the queued withdrawals of c in a single
+// disperse transaction. When the batch can't be signed or reverts, each
+// withdrawal is retried as an individual transfer. A signed batch that
+// failed to go out is resolved like any interrupted send.
+func processWithdrawalBatch(ctx context.Context, api *slack.Client, c *chain) error {
+	items, tx, fallback, err := startWithdrawalBatch(ctx, api, c)
+	if fallback {
+		payWithdrawalsIndividually(ctx, api, c, items)
+		return nil
+	}
+	if err != nil || tx == nil {
+		return err
+	}
+	ids := withdrawalIDs(items)
+	logInfo(ctx, "Withdrawal batch pending", logFields{"chain": c.Name, "withdrawals": ids, "tx_hash": tx.Hash().Hex()})
+
+	conn, err := c.backend()
+	if err != nil {
+		return err
+	}
+	mineCtx, cancel := context.WithTimeout(ctx, batchMiningTimeout)
+	defer cancel()
+
+	receipt, err := bind.WaitMined(mineCtx, conn, tx)
+	if err != nil {
+		return fmt.Errorf("batch 0x%x: %v", tx.Hash(), err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		logWarn(ctx, "Withdrawal batch reverted, falling back to transfers", logFields{"chain": c.Name, "tx_hash": tx.Hash().Hex()})
+		if _, err := requeueWithdrawals(ctx, items, "its batch reverted"); err != nil {
+			return err
+		}
+		payWithdrawalsIndividually(ctx, api, c, items)
+		return nil
+	}
+
+	if err := setWithdrawalStatus(ctx, ids, withdrawalConfirmed, "", ""); err != nil {
+		return err
+	}
+	settleBatchFees(ctx, items, tx, receipt)
+	for _, w := range items {
+		message := fmt.Sprintf(":point_left: :sunglasses: :point_left: You successfully withdrew %s CULT on %s at %s", formatAmount(w.Amount, w.Asset), c.Name, c.txLink(tx.Hash()))
+		sendSlackMessage(api, w.UserID, message)
+	}
+	return nil
+}
+
+// startWithdrawalBatch sends the batch of queued withdrawals of c while
+// holding its hot wallet, which is let go before the batch is mined. It
+// returns no transaction when there was nothing to send or the batch was
+// resolved, and asks for a fallback to individual transfers when the batch
+// could not be signed.
+func startWithdrawalBatch(ctx context.Context, api *slack.Client, c *chain) (items []*withdrawal, tx *types.Transaction, fallback bool, err error) {
+	unlock, err := c.lockWallet(ctx)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer unlock()
+
+	// an admin may have paused withdrawals while this worker waited
+	if withdrawalsPaused() {
+		return nil, nil, false, nil
+	}
+	items, err = queuedWithdrawals(c.Name, maxBatchSize)
+	if err != nil || len(items) == 0 {
+		return nil, nil, false, err
+	}
+	if err := startSending(ctx, items); err != nil {
+		return nil, nil, false, err
+	}
+
+	tx, err = sendBatch(ctx, c, items)
+	if err != nil && items[0].RawTx != "" {
+		logWarn(ctx, "Failed to broadcast withdrawal batch", logFields{"chain": c.Name, "tx_hash": items[0].TxHash, "error": err})
+		resolveSendingWithdrawals(ctx, api, items, err)
+		return items, nil, false, nil
+	}
+	if err != nil {
+		logWarn(ctx, "Failed to send withdrawal batch, falling back to transfers", logFields{"chain": c.Name, "error": err})
+		return items, nil, true, nil
+	}
+
+	err = setWithdrawalStatus(ctx, withdrawalIDs(items), withdrawalBatched, tx.Hash().Hex(), "")
+	return items, tx, false, err
+}
+
+// sendBatch grants the disperse contract enough allowance over the hot
+// wallet's tokens and sends the withdrawals through it. The signed disperse
+// transaction is stored with every item before it is broadcast.
+func sendBatch(ctx context.Context, c *chain, items []*withdrawal) (*types.Transaction, error) {
+	conn, err := c.backend()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenAddr := common.HexToAddress(c.TokenAddress)
+	disperseAddr := common.HexToAddress(c.DisperseAddress)
+	token, err := NewToken(tokenAddr, conn)
+	if err != nil {
+		return nil, err
+	}
+	disperse, err := NewDisperse(disperseAddr, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := c.transactor()
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make([]common.Address, len(items))
+	values := make([]*big.Int, len(items))
+	total := new(big.Int)
+	for i, w := range items {
+		recipients[i] = common.HexToAddress(w.Address)
+		values[i] = w.Amount
+		total.Add(total, w.Amount)
+	}
+
+	allowance, err := token.Allowance(&bind.CallOpts{Context: ctx}, auth.From, disperseAddr)
+	if err != nil {
+		return nil, err
+	}
+	if allowance.Cmp(total) < 0 {
+		// the approval goes to the audit log before it is broadcast, so that
+		// one left pending by a timeout or a crash can be traced
+		approve := *auth
+		auditSigned(ctx, &approve, "disperse_approval", c.Name, fmt.Sprintf("allow %s CULT to %s", formatAmount(total, tokenAsset), c.DisperseAddress))
+		var approval *types.Transaction
+		err = c.withNonce(ctx, conn, auth.From, func(nonce uint64) error {
+			approve.Nonce = new(big.Int).SetUint64(nonce)
+			approval, err = token.Approve(&approve, disperseAddr, total)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		mineCtx, cancel := context.WithTimeout(ctx, approvalMiningTimeout)
+		defer cancel()
+		receipt, err := bind.WaitMined(mineCtx, conn, approval)
+		if err != nil {
+			return nil, fmt.Errorf("approval 0x%x of the disperse contract: %v", approval.Hash(), err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return nil, errors.New("approval of the disperse contract failed")
+		}
+	}
+
+	persistSigned(ctx, auth, items)
+	var tx *types.Transaction
+	err = c.withNonce(ctx, conn, auth.From, func(nonce uint64) error {
+		auth.Nonce = new(big.Int).SetUint64(nonce)
+		tx, err = disperse.DisperseToken(auth, tokenAddr, recipients, values)
+		return err
+	})
+	return tx, err
+}
+
+// settleBatchFees lowers the gas fees of the withdrawals of a mined batch to
+// an even share of the gas it used, giving the difference back.
+func settleBatchFees(ctx context.Context, items []*withdrawal, tx *types.Transaction, receipt *types.Receipt) {
+	share := new(big.Int).Mul(receipt.GasUsed, tx.GasPrice())
+	share.Div(share, big.NewInt(int64(len(items))))
+
+	for _, w := range items {
+		if w.Fee == nil || w.Fee.Sign() <= 0 {
+			continue
+		}
+		fee := share
+		if w.FeeAsset == tokenAsset {
+			var err error
+			if fee, err = gasFeeInToken(share); err != nil {
+				logError(ctx, "Failed to price the share of a batch", logFields{"withdrawal": w.ID, "error": err})
+				continue
+			}
+		}
+		excess := new(big.Int).Sub(w.Fee, fee)
+		if excess.Sign() <= 0 {
+			continue
+		}
+
+		err := withLedgerTx(ctx, func(dbtx *sql.Tx) error {
+			// the fee is only lowered once, however often the batch is settled
+			var charged string
+			err := dbtx.QueryRow(`
+				SELECT fee FROM withdrawals WHERE id = $1 FOR UPDATE;
+			`, w.ID).Scan(&charged)
+			if err != nil {
+				return err
+			}
+			if charged != w.Fee.String() {
+				return nil
+			}
+
+			err = adjustBalance(dbtx, ledgerEntry{UserID: w.UserID, Asset: w.FeeAsset, Kind: kindRefund, Amount: excess, Chain: w.Chain, TxHash: tx.Hash().Hex(), Note: "gas fee above the share of the batch"})
+			if err != nil {
+				return err
+			}
+			_, err = dbtx.Exec(`
+				UPDATE withdrawals SET fee = $2, updated_at = now() WHERE id = $1;
+			`, w.ID, fee.String())
+			return err
+		})
+		if err != nil {
+			logError(ctx, "Failed to settle the gas fee of a batched withdrawal", logFields{"withdrawal": w.ID, "error": err})
+			continue
+		}
+		w.Fee = fee
+	}
+}
+
+// payWithdrawalsIndividually sends each withdrawal, of CULT or ETH, in its
+// own transfer and refunds the ones that can't be sent.
+func payWithdrawalsIndividually(ctx context.Context, api *slack.Client, c *chain, items []*withdrawal) {
+	for i, w := range items {
+		// the rest stay queued when an admin pauses withdrawals meanwhile
+		if withdrawalsPaused() {
+			logInfo(ctx, "Withdrawals are paused, leaving them queued", logFields{"chain": c.Name, "withdrawals": withdrawalIDs(items[i:])})
+			return
+		}
+		tx, err := payWithdrawal(ctx, api, c, w)
+		if err != nil {
+			logError(ctx, "Failed to pay withdrawal", logFields{"withdrawal": w.ID, "error": err})
+			continue
+		}
+		if tx == nil {
+			continue
+		}
+		message := fmt.Sprintf(":point_left: :sunglasses: :point_left: You successfully withdrew %s %s on %s at %s", formatAmount(w.Amount, w.Asset), w.Asset, c.Name, c.txLink(tx.Hash()))
+		sendSlackMessage(api, w.UserID, message)
+	}
+	checkAllowanceHeadroom(ctx, api, c)
+}
+
+// payWithdrawal sends w on its own while holding the hot wallet of c. It
+// returns no transaction when w could not be sent and was resolved instead.
+func payWithdrawal(ctx context.Context, api *slack.Client, c *chain, w *withdrawal) (*types.Transaction, error) {
+	unlock, err := c.lockWallet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// another worker may have paid w while this one waited for the wallet
+	current, err := queryWithdrawals(`WHERE id = $1;`, w.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(current) == 0 || !payable(current[0]) {
+		return nil, nil
+	}
+
+	// ether transfers can't price themselves like token transfers
+	var quote *gasQuote
+	if w.Asset == etherAsset {
+		if quote, err = quoteEtherTransfer(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := startSending(ctx, []*withdrawal{w}); err != nil {
+		return nil, err
+	}
+	var tx *types.Transaction
+	if w.Asset == etherAsset {
+		tx, err = sendEtherTo(ctx, c, w, quote)
+	} else {
+		tx, err = sendTokenTo(ctx, c, w, nil)
+	}
+	if err != nil {
+		resolveSendingWithdrawals(ctx, api, []*withdrawal{w}, err)
+		return nil, nil
+	}
+	if err := setWithdrawalStatus(ctx, []int64{w.ID}, withdrawalSent, tx.Hash().Hex(), ""); err != nil {
+		logError(ctx, "Failed to update withdrawal", logFields{"withdrawal": w.ID, "error": err})
+	}
+	return tx, nil
+}
+
+// payable reports whether w may be sent on its own: it is approved and
+// waiting, which batches that reverted are put back to, or left over from a
+// batch that was never signed.
+func payable(w *withdrawal) bool {
+	switch w.Status {
+	case withdrawalQueued:
+		return true
+	case withdrawalSending:
+		return w.RawTx == ""
+	}
+	return false
+}
+
+var errAlreadyRefunded = errors.New("the withdrawal was already refunded")
+
+// errReverted is the reason of refunds for transactions that were mined but
+// reverted. Those keep their gas fee, since the gas was spent.
+var errReverted = errors.New("the transfer reverted")
+
+// refundWithdrawal marks w failed and gives its amount back to the user,
+// along with its gas fee unless its transaction reverted.
+func refundWithdrawal(ctx context.Context, api *slack.Client, w *withdrawal, reason error) {
+	refundFee := reason != errReverted && w.Fee != nil && w.Fee.Sign() > 0
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		// another process, such as tiperc20 ctl, may have resolved w first
+		var status string
+		err := tx.QueryRow(`
+			SELECT status FROM withdrawals WHERE id = $1 FOR UPDATE;
+		`, w.ID).Scan(&status)
+		if err != nil {
+			return err
+		}
+		if status == withdrawalFailed {
+			return errAlreadyRefunded
+		}
+
+		err = adjustBalance(tx, ledgerEntry{UserID: w.UserID, Asset: w.Asset, Kind: kindRefund, Amount: w.Amount, Chain: w.Chain})
+		if err != nil {
+			return err
+		}
+		if refundFee {
+			err = adjustBalance(tx, ledgerEntry{UserID: w.UserID, Asset: w.FeeAsset, Kind: kindRefund, Amount: w.Fee, Chain: w.Chain})
+			if err != nil {
+				return err
+			}
+		}
+		return markWithdrawals(tx, []int64{w.ID}, withdrawalFailed, "", reason.Error())
+	})
+	if err == errAlreadyRefunded {
+		logInfo(ctx, "Withdrawal was already refunded", logFields{"withdrawal": w.ID})
+		return
+	}
+	if err != nil {
+		logError(ctx, "Failed to refund withdrawal", logFields{"withdrawal": w.ID, "error": err})
+		return
+	}
+	logInfo(ctx, "Refunded withdrawal", logFields{"withdrawal": w.ID, "user": w.UserID, "reason": reason})
+
+	message := fmt.Sprintf(":x: Your withdrawal of %s %s failed and was refunded: %s", formatAmount(w.Amount, w.Asset), w.Asset, reason)
+	sendSlackMessage(api, w.UserID, message)
+}
+
+func withdrawalIDs(items []*withdrawal) []int64 {
+	ids := make([]int64, len(items))
+	for i, w := range items {
+		ids[i] = w.ID
+	}
+	return ids
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/lib/pq"
+	"github.com/nlopes/slack"
+)
+
+// testTokenCode creates a minimal ERC20 token that mints 10^24 tokens to
+// its creator. It implements balanceOf, allowance, approve, transfer and
+// transferFrom, reverting when a balance or allowance doesn't cover the
+// amount, and logs no events.
+const testTokenCode = "7f00000000000000000000000000000000000000000000d3c21bcecceda10000003355610124806100306000396000f37c010000000000000000000000000000000000000000000000000000000060003504806370a082311461005d578063dd62ed3e1461006b578063095ea7b314610087578063a9059cbb146100a657806323b872dd146100d05761011f565b506004355460005260206000f35b5060043560005260243560205260406000205460005260206000f35b5033600052600435602052602435604060002055600160005260206000f35b503354806024351161011f5760243590033355600435546024350160043555600160005260206000f35b506004356000523360205260406000208054806044351161011f576044359003905560043554806044351161011f57604435900360043555602435546044350160243555600160005260206000f35b600080fd"
+
+// testDisperseCode creates a disperse contract whose disperseToken pulls
+// each value from the caller with transferFrom. A call without data arms it,
+// after which every call reverts, so that tests can make a batch revert.
+const testDisperseCode = "6100c38061000d6000396000f336156100b7576000546100be577c01000000000000000000000000000000000000000000000000000000006000350463c73a2d6014156100be576024356004013560005b818110156100b5577f23b872dd0000000000000000000000000000000000000000000000000000000060005233600452806020026024350160240135602452806020026044350160240135604452602060006064600060006004355af1156100be57600051156100be57600101610043565b005b6001600055005b600080fd"
+
+// simulatedChain is an in-memory chain for the send paths. It adds what the
+// simulated backend lacks to stand in for a node. beforeSend lets tests act
+// just before a transaction is broadcast, and dropNext makes the node accept
+// the next transaction and lose it.
+type simulatedChain struct {
+	*backends.SimulatedBackend
+
+	mu         sync.Mutex
+	sent       map[common.Hash]*types.Transaction
+	beforeSend func(tx *types.Transaction)
+	dropNext   bool
+}
+
+func (s *simulatedChain) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if s.beforeSend != nil {
+		s.beforeSend(tx)
+	}
+	s.mu.Lock()
+	drop := s.dropNext
+	s.dropNext = false
+	s.mu.Unlock()
+	if drop {
+		return nil
+	}
+	if err := s.SimulatedBackend.SendTransaction(ctx, tx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sent[tx.Hash()] = tx
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *simulatedChain) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	s.mu.Lock()
+	tx, ok := s.sent[hash]
+	s.mu.Unlock()
+	if !ok {
+		return nil, false, ethereum.NotFound
+	}
+	receipt, err := s.SimulatedBackend.TransactionReceipt(ctx, hash)
+	if err != nil {
+		return nil, false, err
+	}
+	return tx, receipt == nil, nil
+}
+
+// testChain is a simulated chain with the test token and disperse contract
+// deployed by its hot wallet, which holds all the tokens.
+type testChain struct {
+	*chain
+	sim      *simulatedChain
+	token    common.Address
+	disperse common.Address
+	// operator is a second funded account, to act on the chain while the
+	// hot wallet is busy
+	operator *ecdsa.PrivateKey
+}
+
+func newTestChain(t *testing.T) *testChain {
+	hotKey, _ := crypto.GenerateKey()
+	operator, _ := crypto.GenerateKey()
+	hot := crypto.PubkeyToAddress(hotKey.PublicKey)
+	funds := new(big.Int).Mul(big.NewInt(1000), weiPerEther)
+	sim := &simulatedChain{
+		SimulatedBackend: backends.NewSimulatedBackend(core.GenesisAlloc{
+			hot: {Balance: funds},
+			crypto.PubkeyToAddress(operator.PublicKey): {Balance: funds},
+		}),
+		sent: map[common.Hash]*types.Transaction{},
+	}
+
+	tc := &testChain{sim: sim, operator: operator}
+	tc.token = tc.deploy(t, hotKey, testTokenCode)
+	tc.disperse = tc.deploy(t, hotKey, testDisperseCode)
+	tc.chain = &chain{
+		Name:            "simulated",
+		TokenAddress:    tc.token.Hex(),
+		DisperseAddress: tc.disperse.Hex(),
+		hotWallet:       &keystoreSigner{key: &keystore.Key{Address: hot, PrivateKey: hotKey}},
+		endpoints:       newEndpoints([]string{"simulated"}),
+		sending:         make(chan struct{}, 1),
+		simulated:       sim,
+	}
+
+	// withdrawals and ctl commands look chains up by name
+	previous := chains
+	chains = map[string]*chain{tc.Name: tc.chain}
+	t.Cleanup(func() { chains = previous })
+	return tc
+}
+
+// deploy creates a contract from its hex encoded code and mines it.
+func (tc *testChain) deploy(t *testing.T, key *ecdsa.PrivateKey, code string) common.Address {
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	nonce, err := tc.sim.PendingNonceAt(context.Background(), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := hex.DecodeString(code)
+	tc.send(t, key, types.NewContractCreation(nonce, new(big.Int), big.NewInt(1000000), big.NewInt(1), data))
+	tc.sim.Commit()
+	return crypto.CreateAddress(from, nonce)
+}
+
+// send signs tx with key and broadcasts it without going through the bot.
+func (tc *testChain) send(t *testing.T, key *ecdsa.PrivateKey, tx *types.Transaction) {
+	signed, err := types.SignTx(tx, types.HomesteadSigner{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.sim.SimulatedBackend.SendTransaction(context.Background(), signed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// armDisperse makes every later call of the disperse contract revert. The
+// arming transaction is only pending until the next block is mined.
+func (tc *testChain) armDisperse(t *testing.T) {
+	from := crypto.PubkeyToAddress(tc.operator.PublicKey)
+	nonce, err := tc.sim.PendingNonceAt(context.Background(), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.send(t, tc.operator, types.NewTransaction(nonce, tc.disperse, new(big.Int), big.NewInt(100000), big.NewInt(1), nil))
+}
+
+// mine commits a block every few milliseconds until the test ends, for code
+// that waits for its transactions to be mined.
+func (tc *testChain) mine(t *testing.T) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+				tc.sim.Commit()
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+}
+
+func (tc *testChain) tokenBalance(t *testing.T, address common.Address) *big.Int {
+	token, err := NewToken(tc.token, tc.sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, err := token.BalanceOf(&bind.CallOpts{}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func TestSimulatedContracts(t *testing.T) {
+	tc := newTestChain(t)
+	auth, err := tc.transactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken(tc.token, tc.sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disperse, err := NewDisperse(tc.disperse, tc.sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minted, _ := new(big.Int).SetString("1000000000000000000000000", 10)
+	if balance := tc.tokenBalance(t, auth.From); balance.Cmp(minted) != 0 {
+		t.Fatalf("hot wallet holds %s tokens, want %s", balance, minted)
+	}
+
+	if _, err := token.Approve(auth, tc.disperse, big.NewInt(300)); err != nil {
+		t.Fatal(err)
+	}
+	tc.sim.Commit()
+	recipients := []common.Address{common.HexToAddress("0x01"), common.HexToAddress("0x02")}
+	values := []*big.Int{big.NewInt(100), big.NewInt(200)}
+	tx, err := disperse.DisperseToken(auth, tc.token, recipients, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.sim.Commit()
+	receipt, _ := tc.sim.TransactionReceipt(context.Background(), tx.Hash())
+	if receipt == nil || receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("disperse failed: %+v", receipt)
+	}
+	for i, r := range recipients {
+		if balance := tc.tokenBalance(t, r); balance.Cmp(values[i]) != 0 {
+			t.Errorf("%x holds %s tokens, want %s", r, balance, values[i])
+		}
+	}
+
+	// the allowance is used up, so a second batch can't even be estimated
+	if _, err := disperse.DisperseToken(auth, tc.token, recipients, values); err == nil {
+		t.Error("disperse beyond the allowance was sent")
+	}
+
+	tc.armDisperse(t)
+	tc.sim.Commit()
+	if _, err := token.Approve(auth, tc.disperse, big.NewInt(300)); err != nil {
+		t.Fatal(err)
+	}
+	tc.sim.Commit()
+	if _, err := disperse.DisperseToken(auth, tc.token, recipients, values); err == nil {
+		t.Error("armed disperse contract accepted a batch")
+	}
+}
+
+// testDatabase points the bot at TEST_DATABASE_URL, migrated and emptied,
+// and skips the test when it isn't set.
+func testDatabase(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	os.Setenv("DATABASE_URL", url)
+	currentConfig.Store(&config{})
+
+	ctx := context.Background()
+	if _, err := migrateDatabase(ctx, url, true); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename <> 'goose_db_version';`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(fmt.Sprintf(`TRUNCATE %q RESTART IDENTITY CASCADE;`, table)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testSlack returns a Slack client whose messages go nowhere.
+func testSlack(t *testing.T) *slack.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	api := slack.SLACK_API
+	slack.SLACK_API = srv.URL + "/"
+	t.Cleanup(func() {
+		slack.SLACK_API = api
+		srv.Close()
+	})
+	return slack.New("test")
+}
+
+// queueTestWithdrawals credits a user and queues a withdrawal of each amount
+// to its own address.
+func queueTestWithdrawals(t *testing.T, c *chain, fee *big.Int, amounts ...int64) []*withdrawal {
+	ctx := context.Background()
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		err := adjustBalance(tx, ledgerEntry{UserID: "U1", Asset: tokenAsset, Kind: kindAdminCredit, Amount: big.NewInt(1000000)})
+		if err != nil {
+			return err
+		}
+		return adjustBalance(tx, ledgerEntry{UserID: "U1", Asset: etherAsset, Kind: kindAdminCredit, Amount: weiPerEther})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := make([]*withdrawal, len(amounts))
+	for i, amount := range amounts {
+		w := &withdrawal{UserID: "U1", Chain: c.Name, Asset: tokenAsset, Address: common.BigToAddress(big.NewInt(int64(i + 1))).Hex(), Amount: big.NewInt(amount)}
+		if fee != nil {
+			w.Fee, w.FeeAsset = fee, etherAsset
+		}
+		if err := queueWithdrawal(ctx, w); err != nil {
+			t.Fatal(err)
+		}
+		items[i] = w
+	}
+	return items
+}
+
+func loadTestWithdrawals(t *testing.T, items []*withdrawal) []*withdrawal {
+	current, err := queryWithdrawals(`WHERE id = ANY($1) ORDER BY id;`, pq.Array(withdrawalIDs(items)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(current) != len(items) {
+		t.Fatalf("found %d of %d withdrawals", len(current), len(items))
+	}
+	return current
+}
+
+func TestWithdrawalBatch(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	tc.mine(t)
+	api := testSlack(t)
+	ctx := context.Background()
+
+	fee := new(big.Int).Div(weiPerEther, big.NewInt(1000))
+	items := queueTestWithdrawals(t, tc.chain, fee, 100, 200)
+	if err := processWithdrawalBatch(ctx, api, tc.chain); err != nil {
+		t.Fatal(err)
+	}
+
+	var hash string
+	for i, w := range loadTestWithdrawals(t, items) {
+		if w.Status != withdrawalConfirmed {
+			t.Errorf("withdrawal %d is %s, want %s", w.ID, w.Status, withdrawalConfirmed)
+		}
+		if i > 0 && w.TxHash != hash {
+			t.Errorf("withdrawal %d was sent in %s, not in the batch %s", w.ID, w.TxHash, hash)
+		}
+		hash = w.TxHash
+		if w.Fee == nil || w.Fee.Cmp(fee) >= 0 {
+			t.Errorf("withdrawal %d was charged %v, want its share of the batch", w.ID, w.Fee)
+		}
+		if balance := tc.tokenBalance(t, common.HexToAddress(w.Address)); balance.Cmp(w.Amount) != 0 {
+			t.Errorf("withdrawal %d delivered %s tokens, want %s", w.ID, balance, w.Amount)
+		}
+	}
+
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var approvals int
+	if err := db.QueryRow(`SELECT count(*) FROM audit_log WHERE action = 'disperse_approval';`).Scan(&approvals); err != nil {
+		t.Fatal(err)
+	}
+	if approvals != 1 {
+		t.Errorf("audited %d approvals of the disperse contract, want 1", approvals)
+	}
+}
+
+func TestRevertedWithdrawalBatch(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	tc.mine(t)
+	api := testSlack(t)
+	ctx := context.Background()
+
+	// the batch passes estimation and reverts once mined
+	var batch common.Hash
+	tc.sim.beforeSend = func(tx *types.Transaction) {
+		if tx.To() != nil && *tx.To() == tc.disperse {
+			batch = tx.Hash()
+			tc.armDisperse(t)
+		}
+	}
+
+	items := queueTestWithdrawals(t, tc.chain, nil, 100, 200)
+	if err := processWithdrawalBatch(ctx, api, tc.chain); err != nil {
+		t.Fatal(err)
+	}
+	if batch == (common.Hash{}) {
+		t.Fatal("no batch was sent")
+	}
+
+	for _, w := range loadTestWithdrawals(t, items) {
+		if w.Status != withdrawalSent {
+			t.Errorf("withdrawal %d is %s, want %s", w.ID, w.Status, withdrawalSent)
+		}
+		if w.TxHash == batch.Hex() {
+			t.Errorf("withdrawal %d was left with the reverted batch", w.ID)
+		}
+	}
+
+	if err := settleWithdrawals(ctx, api, tc.chain); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range loadTestWithdrawals(t, items) {
+		if w.Status != withdrawalConfirmed {
+			t.Errorf("withdrawal %d is %s after settling, want %s", w.ID, w.Status, withdrawalConfirmed)
+		}
+		if balance := tc.tokenBalance(t, common.HexToAddress(w.Address)); balance.Cmp(w.Amount) != 0 {
+			t.Errorf("withdrawal %d delivered %s tokens, want %s", w.ID, balance, w.Amount)
+		}
+	}
+}
+
+func TestBatchedWithdrawalsAfterRestart(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	api := testSlack(t)
+	ctx := context.Background()
+
+	// the bot stops after broadcasting the batch, before it is mined
+	items := queueTestWithdrawals(t, tc.chain, nil, 100, 200)
+	tc.mine(t)
+	if _, tx, fallback, err := startWithdrawalBatch(ctx, api, tc.chain); err != nil || tx == nil || fallback {
+		t.Fatalf("batch %v, fallback %v: %v", tx, fallback, err)
+	}
+	for _, w := range loadTestWithdrawals(t, items) {
+		if w.Status != withdrawalBatched {
+			t.Fatalf("withdrawal %d is %s, want %s", w.ID, w.Status, withdrawalBatched)
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if err := settleWithdrawals(ctx, api, tc.chain); err != nil {
+			t.Fatal(err)
+		}
+		current := loadTestWithdrawals(t, items)
+		if current[0].Status == withdrawalConfirmed && current[1].Status == withdrawalConfirmed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("batched withdrawals are %s and %s", current[0].Status, current[1].Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
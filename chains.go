@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Fee models decide the gas price of transactions sent on a chain.
+const (
+	// feeModelSuggested asks the node for its suggested gas price.
+	feeModelSuggested = "suggested"
+	// feeModelFixed always uses the configured gas price.
+	feeModelFixed = "fixed"
+)
+
+// defaultChainName is the chain built from the ethereum section of the
+// config when it has no chains.
+const defaultChainName = "ethereum"
+
+// chain is a network the token can be withdrawn on, each with its own hot
+// wallet and nonce sequence.
+type chain struct {
+	Name          string   `json:"name" yaml:"name"`
+	ChainID       int64    `json:"chain_id" yaml:"chain_id"`
+	RPCEndpoints  []string `json:"rpc_endpoints" yaml:"rpc_endpoints"`
+	Confirmations uint64   `json:"confirmations" yaml:"confirmations"`
+	ExplorerURL   string   `json:"explorer_url" yaml:"explorer_url"`
+	FeeModel      string   `json:"fee_model" yaml:"fee_model"`
+	GasPrice      string   `json:"gas_price" yaml:"gas_price"`
+	TokenAddress  string   `json:"token_address" yaml:"token_address"`
+	KeyJSON       string   `json:"key_json" yaml:"key_json"`
+	Password      string   `json:"password" yaml:"password"`
+
+	// Signer keeps the hot wallet key out of the bot, see signerConfig.
+	Signer signerConfig `json:"signer" yaml:"signer"`
+
+	// DisperseAddress enables batched withdrawals through a disperse
+	// contract deployed at this address.
+	DisperseAddress string `json:"disperse_address" yaml:"disperse_address"`
+
+	// TreasuryAddress enables treasury mode: withdrawals are paid with
+	// transferFrom out of the allowance this address granted the hot wallet.
+	TreasuryAddress         string `json:"treasury_address" yaml:"treasury_address"`
+	AllowanceAlertThreshold string `json:"allowance_alert_threshold" yaml:"allowance_alert_threshold"`
+
+	// Hot wallet policy: tokens above HotWalletCap are swept to
+	// ColdAddress, and below HotWalletFloor admins are asked for a refill
+	// while withdrawals of LargeWithdrawal tokens or more are paused.
+	ColdAddress     string `json:"cold_address" yaml:"cold_address"`
+	HotWalletCap    string `json:"hot_wallet_cap" yaml:"hot_wallet_cap"`
+	HotWalletFloor  string `json:"hot_wallet_floor" yaml:"hot_wallet_floor"`
+	LargeWithdrawal string `json:"large_withdrawal" yaml:"large_withdrawal"`
+
+	// MaxBlockAge is how old the latest block may get before the chain is
+	// reported not ready, 5m by default.
+	MaxBlockAge string `json:"max_block_age" yaml:"max_block_age"`
+	// MaxHeadLag is how many blocks an RPC endpoint may fall behind the
+	// others before it is failed over from, 10 by default.
+	MaxHeadLag uint64 `json:"max_head_lag" yaml:"max_head_lag"`
+
+	hotWallet   Signer
+	maxBlockAge time.Duration
+	maxHeadLag  uint64
+
+	endpointMu sync.Mutex
+	endpoints  []*rpcEndpoint
+	active     int
+	// simulated stands in for the endpoints in tests, see backend.
+	simulated chainBackend
+
+	tokenMu   sync.Mutex
+	tokenInfo *tokenInfo
+
+	// sending is held by whatever transfers out of the hot wallet, see
+	// lockWallet.
+	sending chan struct{}
+
+	walletMu   sync.Mutex
+	belowFloor bool
+
+	nonceMu     sync.Mutex
+	nonce       uint64
+	nonceSynced bool
+}
+
+var chains = map[string]*chain{}
+
+// defaultChain is where withdrawals and deposits go when a user names no
+// chain.
+var defaultChain *chain
+
+// etherChain is the chain whose native coin users hold as ETH. The ETH
+// balances are a single asset, so ether is only deposited and withdrawn on
+// this chain.
+var etherChain *chain
+
+// loadChains builds the chain registry from the chains of the config, or a
+// single chain from its ethereum section. The first chain is the default
+// one.
+func loadChains(config *config) error {
+	list := config.Chains
+	if len(list) == 0 {
+		eth := config.Ethereum
+		list = []*chain{{
+			Name:         defaultChainName,
+			RPCEndpoints: splitList(eth.APIEndpoint),
+			TokenAddress: eth.TokenAddress,
+			Signer:       eth.Signer,
+
+			TreasuryAddress:         eth.TreasuryAddress,
+			AllowanceAlertThreshold: eth.TreasuryAllowanceAlert,
+
+			ColdAddress:     eth.ColdWalletAddress,
+			HotWalletCap:    eth.HotWalletCap,
+			HotWalletFloor:  eth.HotWalletFloor,
+			LargeWithdrawal: eth.LargeWithdrawal,
+		}}
+	}
+
+	registry := map[string]*chain{}
+	for _, c := range list {
+		c.Name = strings.ToLower(c.Name)
+		if c.Name == "" {
+			return errors.New("there is a chain without a name")
+		}
+		if _, ok := registry[c.Name]; ok {
+			return fmt.Errorf("chain %s is defined twice", c.Name)
+		}
+		if len(c.RPCEndpoints) == 0 {
+			return fmt.Errorf("chain %s has no rpc_endpoints", c.Name)
+		}
+		// only the default chain falls back to ETH_KEY_JSON, other chains
+		// must not share its hot wallet and nonces by accident
+		if c.Signer.Type == signerKeyJSON && c.KeyJSON == "" {
+			if c != list[0] {
+				return fmt.Errorf("chain %s has no key_json or signer", c.Name)
+			}
+			c.KeyJSON, c.Password = config.Ethereum.KeyJSON, config.Ethereum.Password
+		}
+		var err error
+		if c.hotWallet, err = newSigner(c.Signer, c.KeyJSON, c.Password); err != nil {
+			return fmt.Errorf("chain %s: %v", c.Name, err)
+		}
+		if c.TreasuryAddress != "" && !common.IsHexAddress(c.TreasuryAddress) {
+			return fmt.Errorf("chain %s has an invalid treasury_address %q", c.Name, c.TreasuryAddress)
+		}
+		if c.ColdAddress != "" && !common.IsHexAddress(c.ColdAddress) {
+			return fmt.Errorf("chain %s has an invalid cold_address %q", c.Name, c.ColdAddress)
+		}
+		c.sending = make(chan struct{}, 1)
+		c.endpoints = newEndpoints(c.RPCEndpoints)
+		c.maxHeadLag = defaultMaxHeadLag
+		if c.MaxHeadLag > 0 {
+			c.maxHeadLag = c.MaxHeadLag
+		}
+		c.maxBlockAge = defaultMaxBlockAge
+		if c.MaxBlockAge != "" {
+			if c.maxBlockAge, err = time.ParseDuration(c.MaxBlockAge); err != nil || c.maxBlockAge <= 0 {
+				return fmt.Errorf("chain %s has an invalid max_block_age %q", c.Name, c.MaxBlockAge)
+			}
+		}
+		switch c.FeeModel {
+		case "":
+			c.FeeModel = feeModelSuggested
+		case feeModelSuggested:
+		case feeModelFixed:
+			if _, ok := new(big.Int).SetString(c.GasPrice, 10); !ok {
+				return fmt.Errorf("chain %s has an invalid gas_price %q", c.Name, c.GasPrice)
+			}
+		default:
+			return fmt.Errorf("chain %s has an unknown fee_model %q", c.Name, c.FeeModel)
+		}
+		registry[c.Name] = c
+	}
+
+	ether := list[0]
+	if config.EtherChain != "" {
+		var ok bool
+		if ether, ok = registry[strings.ToLower(config.EtherChain)]; !ok {
+			return fmt.Errorf("ether_chain %s is not a chain", config.EtherChain)
+		}
+	}
+
+	chains = registry
+	defaultChain = list[0]
+	etherChain = ether
+	return nil
+}
+
+// checkEtherChain fails when ether can't be deposited or withdrawn on c.
+func checkEtherChain(c *chain) error {
+	if c != etherChain {
+		return fmt.Errorf("ETH can only be deposited and withdrawn on %s", etherChain.Name)
+	}
+	return nil
+}
+
+// lookupChain returns the chain with the given name, or the default chain for
+// an empty name.
+func lookupChain(name string) (*chain, error) {
+	if name == "" {
+		return defaultChain, nil
+	}
+	c, ok := chains[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown chain %s, try one of: %s", name, strings.Join(chainNames(), ", "))
+	}
+	return c, nil
+}
+
+func chainNames() []string {
+	names := make([]string, 0, len(chains))
+	for name := range chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// signer returns the transaction signer of the chain. Chains without a chain
+// ID sign unprotected transactions like bind.NewTransactor does.
+func (c *chain) signer() types.Signer {
+	if c.ChainID == 0 {
+		return types.HomesteadSigner{}
+	}
+	return types.NewEIP155Signer(big.NewInt(c.ChainID))
+}
+
+// hotWalletAddress returns the address of the chain's hot wallet.
+func (c *chain) hotWalletAddress() (common.Address, error) {
+	return c.hotWallet.Address(), nil
+}
+
+// transactor returns transact options that have the chain's signer sign for
+// this chain.
+func (c *chain) transactor() (*bind.TransactOpts, error) {
+	from := c.hotWallet.Address()
+	return &bind.TransactOpts{
+		From: from,
+		// bind always passes a homestead signer, replace it so transactions
+		// can't be replayed on another chain
+		Signer: func(_ types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != from {
+				return nil, errors.New("not authorized to sign this account")
+			}
+			return c.hotWallet.SignTx(tx, c.signer(), big.NewInt(c.ChainID))
+		},
+	}, nil
+}
+
+// suggestGasPrice prices transactions according to the chain's fee model.
+func (c *chain) suggestGasPrice(ctx context.Context, conn chainBackend) (*big.Int, error) {
+	if c.FeeModel == feeModelFixed {
+		gasPrice, _ := new(big.Int).SetString(c.GasPrice, 10)
+		return gasPrice, nil
+	}
+	var gasPrice *big.Int
+	err := timeRPC(c, "eth_gasPrice", func() (err error) {
+		gasPrice, err = conn.SuggestGasPrice(ctx)
+		return
+	})
+	return gasPrice, err
+}
+
+// withNonce calls send with the next nonce of the hot wallet. Sends on a
+// chain are serialized so that concurrent withdrawals never reuse a nonce,
+// and the nonce is re-read from the node after a failed send.
+func (c *chain) withNonce(ctx context.Context, conn chainBackend, from common.Address, send func(nonce uint64) error) error {
+	c.nonceMu.Lock()
+	defer c.nonceMu.Unlock()
+
+	var pending uint64
+	err := timeRPC(c, "eth_getTransactionCount", func() (err error) {
+		pending, err = conn.PendingNonceAt(ctx, from)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if !c.nonceSynced || pending > c.nonce {
+		c.nonce = pending
+		c.nonceSynced = true
+	}
+
+	if err := timeRPC(c, "eth_sendRawTransaction", func() error { return send(c.nonce) }); err != nil {
+		c.nonceSynced = false
+		return err
+	}
+	c.nonce++
+	return nil
+}
+
+// confirmations returns how many blocks have been mined on top of the block
+// that included txHash, and zero while the transaction is pending.
+func (c *chain) confirmations(ctx context.Context, conn *ethclient.Client, client *rpc.Client, txHash common.Hash) (uint64, error) {
+	var receipt struct {
+		BlockNumber *hexutil.Big `json:"blockNumber"`
+	}
+	err := timeRPC(c, "eth_getTransactionReceipt", func() error {
+		return client.CallContext(ctx, &receipt, "eth_getTransactionReceipt", txHash)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if receipt.BlockNumber == nil {
+		return 0, nil
+	}
+
+	var head *types.Header
+	err = timeRPC(c, "eth_getBlockByNumber", func() (err error) {
+		head, err = conn.HeaderByNumber(ctx, nil)
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	mined := receipt.BlockNumber.ToInt()
+	if head.Number.Cmp(mined) < 0 {
+		return 0, nil
+	}
+	return new(big.Int).Sub(head.Number, mined).Uint64() + 1, nil
+}
+
+// txLink links to a transaction on the chain's block explorer, or just prints
+// its hash when no explorer is configured.
+func (c *chain) txLink(txHash common.Hash) string {
+	if c.ExplorerURL == "" {
+		return txHash.Hex()
+	}
+	return fmt.Sprintf(c.ExplorerURL, txHash.Hex())
+}
+
+// parseWithdrawArgs reads the optional asset and chain, in any order, from
+// the arguments of a withdraw command.
+func parseWithdrawArgs(args []string) (asset string, c *chain, err error) {
+	asset, c = tokenAsset, defaultChain
+	for _, arg := range args {
+		if a, err := parseAsset(arg); err == nil {
+			asset = a
+			continue
+		}
+		if c, err = lookupChain(arg); err != nil {
+			return "", nil, err
+		}
+	}
+	return asset, c, nil
+}
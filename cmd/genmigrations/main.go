@@ -0,0 +1,49 @@
+// Command genmigrations embeds the SQL migrations in migrations/DIALECT into
+// the tiperc20 binary by writing them to migrations_gen.go. Run it with
+// `go generate` from the repository root after adding a migration.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	paths, err := filepath.Glob(filepath.Join("migrations", "*", "*.sql"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "// Code generated by cmd/genmigrations; DO NOT EDIT.")
+	fmt.Fprintln(&out)
+	fmt.Fprintln(&out, "package main")
+	fmt.Fprintln(&out)
+	fmt.Fprintln(&out, "// embeddedMigrations are the files under migrations, by path.")
+	fmt.Fprintln(&out, "var embeddedMigrations = map[string]string{")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(&out, "%s: %s,\n", strconv.Quote(filepath.ToSlash(path)), strconv.Quote(string(data)))
+	}
+	fmt.Fprintln(&out, "}")
+
+	source, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("migrations_gen.go", source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
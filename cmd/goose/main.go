@@ -10,11 +10,12 @@ import (
 
 	// Init DB drivers.
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
 	flags = flag.NewFlagSet("goose", flag.ExitOnError)
-	dir   = flags.String("dir", ".", "directory with migration files")
+	dir   = flags.String("dir", "migrations/postgres", "directory with migration files")
 )
 
 func main() {
@@ -43,7 +44,7 @@ func main() {
 	driver, dbstring, command := args[0], args[1], args[2]
 
 	switch driver {
-	case "postgres":
+	case "postgres", "sqlite3":
 		if err := goose.SetDialect(driver); err != nil {
 			log.Fatal(err)
 		}
@@ -83,6 +84,7 @@ var (
 
 Drivers:
     postgres
+    sqlite3
 
 Examples:
     goose postgres "user=postgres dbname=postgres sslmode=disable" status
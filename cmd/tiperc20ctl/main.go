@@ -0,0 +1,57 @@
+// Command tiperc20ctl runs operator commands against a tiperc20 deployment
+// without Slack: inspecting and adjusting balances, retrying withdrawals,
+// reconciliation, exports and imports, hot wallet key rotation and token
+// checks.
+//
+// The commands share their code and configuration with the bot, so this is a
+// launcher for `tiperc20 ctl`: it runs the tiperc20 binary installed next to
+// it, or else the one on PATH, with the same arguments and environment.
+// tiperc20 ctl needs no Slack token and doesn't apply migrations.
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	bin, err := tiperc20Binary()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := syscall.Exec(bin, ctlArgs(bin, os.Args[1:]), os.Environ()); err != nil {
+		log.Fatalf("tiperc20ctl: %v", err)
+	}
+}
+
+// ctlArgs returns the command line of tiperc20 bin running tiperc20 ctl with
+// args.
+func ctlArgs(bin string, args []string) []string {
+	// -config belongs to tiperc20, before the ctl subcommand
+	line := []string{bin}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-config") {
+		n := 1
+		if !strings.Contains(args[0], "=") && len(args) > 1 {
+			n = 2
+		}
+		line, args = append(line, args[:n]...), args[n:]
+	}
+	return append(append(line, "ctl"), args...)
+}
+
+func tiperc20Binary() (string, error) {
+	if self, err := os.Executable(); err == nil {
+		bin := filepath.Join(filepath.Dir(self), "tiperc20")
+		if _, err := os.Stat(bin); err == nil {
+			return bin, nil
+		}
+	}
+	return exec.LookPath("tiperc20")
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCtlArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"/app/bin/tiperc20", "ctl"}},
+		{[]string{"reconcile"}, []string{"/app/bin/tiperc20", "ctl", "reconcile"}},
+		{[]string{"-config", "prod.yml", "balance", "U1"}, []string{"/app/bin/tiperc20", "-config", "prod.yml", "ctl", "balance", "U1"}},
+		{[]string{"-config=prod.yml", "token", "mainnet"}, []string{"/app/bin/tiperc20", "-config=prod.yml", "ctl", "token", "mainnet"}},
+		{[]string{"export", "ledger", "-config", "prod.yml"}, []string{"/app/bin/tiperc20", "ctl", "export", "ledger", "-config", "prod.yml"}},
+		{[]string{"-config"}, []string{"/app/bin/tiperc20", "-config", "ctl"}},
+	}
+	for _, test := range tests {
+		if got := ctlArgs("/app/bin/tiperc20", test.args); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config is everything the bot is configured with. It is read from the YAML
+// file given with -config, and each field can be overridden by the
+// environment variable the bot was configured with before there was a file.
+type config struct {
+	Slack struct {
+		BotToken          string   `yaml:"bot_token"`
+		VerificationToken string   `yaml:"verification_token"`
+		TipReaction       string   `yaml:"tip_reaction"`
+		TipAmount         string   `yaml:"tip_amount"`
+		AdminUsers        []string `yaml:"admin_users"`
+		AdminGroups       []string `yaml:"admin_groups"`
+		AdminChannel      string   `yaml:"admin_channel"`
+	} `yaml:"slack"`
+
+	Database struct {
+		URL string `yaml:"url"`
+		// Migrate is auto, verify or off.
+		Migrate string `yaml:"migrate"`
+	} `yaml:"database"`
+
+	Dashboard dashboardConfig `yaml:"dashboard"`
+
+	HTTP struct {
+		Port       int    `yaml:"port"`
+		AdminToken string `yaml:"admin_token"`
+		// APIKeys and OIDC authenticate the callers of the admin API
+		// besides AdminToken.
+		APIKeys []apiKey   `yaml:"api_keys"`
+		OIDC    oidcConfig `yaml:"oidc"`
+	} `yaml:"http"`
+
+	// Ethereum configures the single chain used when Chains is empty.
+	Ethereum struct {
+		APIEndpoint            string       `yaml:"api_endpoint"`
+		TokenAddress           string       `yaml:"token_address"`
+		KeyJSON                string       `yaml:"key_json"`
+		Password               string       `yaml:"password"`
+		Signer                 signerConfig `yaml:"signer"`
+		TreasuryAddress        string       `yaml:"treasury_address"`
+		TreasuryAllowanceAlert string       `yaml:"treasury_allowance_alert"`
+		ColdWalletAddress      string       `yaml:"cold_wallet_address"`
+		HotWalletCap           string       `yaml:"hot_wallet_cap"`
+		HotWalletFloor         string       `yaml:"hot_wallet_floor"`
+		LargeWithdrawal        string       `yaml:"large_withdrawal"`
+	} `yaml:"ethereum"`
+
+	Chains []*chain `yaml:"chains"`
+	// EtherChain names the chain whose native coin is the ETH balance of
+	// users, the default chain when empty. Native coins of other chains
+	// can't be deposited or withdrawn.
+	EtherChain string `yaml:"ether_chain"`
+
+	// Webhooks receive the events of the bot, such as tips and withdrawals.
+	Webhooks []webhookConfig `yaml:"webhooks"`
+
+	GasFee struct {
+		Asset     string `yaml:"asset"`
+		TokenRate string `yaml:"token_rate"`
+	} `yaml:"gas_fee"`
+
+	WithdrawBatchWindow string `yaml:"withdraw_batch_window"`
+	ReconcileInterval   string `yaml:"reconcile_interval"`
+	// ShutdownTimeout is how long a shutdown waits for the work in flight.
+	ShutdownTimeout string `yaml:"shutdown_timeout"`
+
+	Workers struct {
+		Count     int `yaml:"count"`
+		QueueSize int `yaml:"queue_size"`
+		// QueueTimeout drops commands that waited longer than this for a
+		// worker.
+		QueueTimeout   string `yaml:"queue_timeout"`
+		CommandTimeout string `yaml:"command_timeout"`
+	} `yaml:"workers"`
+
+	RateLimits struct {
+		User    string `yaml:"user"`
+		Channel string `yaml:"channel"`
+		Global  string `yaml:"global"`
+	} `yaml:"rate_limits"`
+
+	// Settings are the defaults of the settings admins change with `admin
+	// set`, such as signup-bonus.
+	Settings map[string]string `yaml:"settings"`
+
+	// Messages replace the bot's default messages by key.
+	Messages map[string]string `yaml:"messages"`
+
+	Logging struct {
+		Level           string `yaml:"level"`
+		RedactAddresses bool   `yaml:"redact_addresses"`
+		// MessageText logs the text of the messages sent to the bot, which
+		// is off for privacy unless debugging.
+		MessageText bool `yaml:"message_text"`
+	} `yaml:"logging"`
+}
+
+// defaultConfig is the configuration before the file and environment are
+// applied.
+func defaultConfig() *config {
+	c := &config{}
+	c.HTTP.Port = 20020
+	c.Database.Migrate = migrateAuto
+	c.ReconcileInterval = "24h"
+	c.ShutdownTimeout = "25s"
+	c.Workers.Count = 8
+	c.Workers.QueueSize = 20
+	c.Workers.QueueTimeout = "30s"
+	c.Workers.CommandTimeout = "2m"
+	c.RateLimits.User = defaultUserRateLimits
+	c.RateLimits.Channel = defaultChannelRateLimits
+	c.RateLimits.Global = defaultGlobalRateLimits
+	c.Logging.Level = "info"
+	return c
+}
+
+// loadConfig reads the config file at path, when there is one, and applies
+// the environment over it.
+func loadConfig(path string) (*config, error) {
+	c := defaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyEnv overrides the config with the environment variables that are set.
+func (c *config) applyEnv() error {
+	fields := map[string]*string{
+		"SLACK_BOT_TOKEN":          &c.Slack.BotToken,
+		"SLACK_VERIFICATION_TOKEN": &c.Slack.VerificationToken,
+		"SLACK_TIP_REACTION":       &c.Slack.TipReaction,
+		"SLACK_TIP_AMOUNT":         &c.Slack.TipAmount,
+		"SLACK_ADMIN_CHANNEL":      &c.Slack.AdminChannel,
+		"DATABASE_URL":             &c.Database.URL,
+		"DB_MIGRATE":               &c.Database.Migrate,
+		"ADMIN_HTTP_TOKEN":         &c.HTTP.AdminToken,
+		"DASHBOARD_URL":            &c.Dashboard.URL,
+		"SLACK_CLIENT_ID":          &c.Dashboard.ClientID,
+		"SLACK_CLIENT_SECRET":      &c.Dashboard.ClientSecret,
+		"DASHBOARD_SESSION_SECRET": &c.Dashboard.SessionSecret,
+		"OIDC_ISSUER":              &c.HTTP.OIDC.Issuer,
+		"OIDC_AUDIENCE":            &c.HTTP.OIDC.Audience,
+		"OIDC_SCOPES_CLAIM":        &c.HTTP.OIDC.ScopesClaim,
+		"ETH_API_ENDPOINT":         &c.Ethereum.APIEndpoint,
+		"ERC20_TOKEN_ADDRESS":      &c.Ethereum.TokenAddress,
+		"ETHER_CHAIN":              &c.EtherChain,
+		"ETH_KEY_JSON":             &c.Ethereum.KeyJSON,
+		"ETH_PASSWORD":             &c.Ethereum.Password,
+		"ETH_SIGNER":               &c.Ethereum.Signer.Type,
+		"ETH_SIGNER_KEY_FILE":      &c.Ethereum.Signer.KeyFile,
+		"ETH_SIGNER_PASSWORD_FILE": &c.Ethereum.Signer.PasswordFile,
+		"ETH_SIGNER_ENDPOINT":      &c.Ethereum.Signer.Endpoint,
+		"ETH_SIGNER_ADDRESS":       &c.Ethereum.Signer.Address,
+		"ETH_SIGNER_AUTH_TOKEN":    &c.Ethereum.Signer.AuthToken,
+		"TREASURY_ADDRESS":         &c.Ethereum.TreasuryAddress,
+		"TREASURY_ALLOWANCE_ALERT": &c.Ethereum.TreasuryAllowanceAlert,
+		"COLD_WALLET_ADDRESS":      &c.Ethereum.ColdWalletAddress,
+		"HOT_WALLET_CAP":           &c.Ethereum.HotWalletCap,
+		"HOT_WALLET_FLOOR":         &c.Ethereum.HotWalletFloor,
+		"LARGE_WITHDRAWAL":         &c.Ethereum.LargeWithdrawal,
+		"GAS_FEE_ASSET":            &c.GasFee.Asset,
+		"GAS_FEE_TOKEN_RATE":       &c.GasFee.TokenRate,
+		"WITHDRAW_BATCH_WINDOW":    &c.WithdrawBatchWindow,
+		"RECONCILE_INTERVAL":       &c.ReconcileInterval,
+		"SHUTDOWN_TIMEOUT":         &c.ShutdownTimeout,
+		"WORKER_QUEUE_TIMEOUT":     &c.Workers.QueueTimeout,
+		"COMMAND_TIMEOUT":          &c.Workers.CommandTimeout,
+		"RATE_LIMIT_USER":          &c.RateLimits.User,
+		"RATE_LIMIT_CHANNEL":       &c.RateLimits.Channel,
+		"RATE_LIMIT_GLOBAL":        &c.RateLimits.Global,
+		"LOG_LEVEL":                &c.Logging.Level,
+	}
+	for key, field := range fields {
+		if value, ok := os.LookupEnv(key); ok {
+			*field = value
+		}
+	}
+
+	lists := map[string]*[]string{
+		"SLACK_ADMIN_USERS":  &c.Slack.AdminUsers,
+		"SLACK_ADMIN_GROUPS": &c.Slack.AdminGroups,
+	}
+	for key, field := range lists {
+		if value, ok := os.LookupEnv(key); ok {
+			*field = splitList(value)
+		}
+	}
+
+	flags := map[string]*bool{
+		"LOG_REDACT_ADDRESSES": &c.Logging.RedactAddresses,
+		"LOG_MESSAGE_TEXT":     &c.Logging.MessageText,
+	}
+	for key, field := range flags {
+		if value, ok := os.LookupEnv(key); ok {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*field = b
+		}
+	}
+
+	ints := map[string]*int{
+		"WORKERS":           &c.Workers.Count,
+		"WORKER_QUEUE_SIZE": &c.Workers.QueueSize,
+	}
+	for key, field := range ints {
+		if value, ok := os.LookupEnv(key); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*field = n
+		}
+	}
+
+	if value, ok := os.LookupEnv("ADMIN_API_KEYS"); ok && value != "" {
+		c.HTTP.APIKeys = nil
+		if err := json.Unmarshal([]byte(value), &c.HTTP.APIKeys); err != nil {
+			return fmt.Errorf("invalid ADMIN_API_KEYS: %v", err)
+		}
+	}
+
+	if value, ok := os.LookupEnv("WEBHOOKS"); ok && value != "" {
+		c.Webhooks = nil
+		if err := json.Unmarshal([]byte(value), &c.Webhooks); err != nil {
+			return fmt.Errorf("invalid WEBHOOKS: %v", err)
+		}
+	}
+
+	if value, ok := os.LookupEnv("CHAINS"); ok && value != "" {
+		c.Chains = nil
+		if err := json.Unmarshal([]byte(value), &c.Chains); err != nil {
+			return fmt.Errorf("invalid CHAINS: %v", err)
+		}
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// validate returns every problem of the config, so that they can all be
+// fixed at once. Chains are checked when they are loaded.
+func (c *config) validate() []string {
+	var problems []string
+	if c.Slack.BotToken == "" {
+		problems = append(problems, "slack.bot_token (SLACK_BOT_TOKEN) is required")
+	}
+	problems = append(problems, c.validateCtl()...)
+	sort.Strings(problems)
+	return problems
+}
+
+// validateCtl returns the problems of the config that matter to tiperc20
+// ctl, which doesn't connect to Slack.
+func (c *config) validateCtl() []string {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Database.URL == "" {
+		problem("database.url (DATABASE_URL) is required")
+	} else if d, _ := databaseDialect(c.Database.URL); d != postgresDialect {
+		problem("database.url (DATABASE_URL) must be a Postgres database, SQLite databases can only be migrated")
+	}
+	switch c.Database.Migrate {
+	case migrateAuto, migrateVerify, migrateOff:
+	default:
+		problem("database.migrate (DB_MIGRATE) must be %s, %s or %s", migrateAuto, migrateVerify, migrateOff)
+	}
+	if c.HTTP.Port <= 0 || c.HTTP.Port > 65535 {
+		problem("http.port %d is not a valid port", c.HTTP.Port)
+	}
+	names := map[string]bool{}
+	for i, key := range c.HTTP.APIKeys {
+		if key.Name == "" {
+			problem("http.api_keys[%d] (ADMIN_API_KEYS) has no name", i)
+		} else if names[key.Name] {
+			problem("http.api_keys (ADMIN_API_KEYS) has two keys named %s", key.Name)
+		}
+		names[key.Name] = true
+		if len(key.Key) < 16 {
+			problem("http.api_keys %s: the key must be at least 16 characters", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			if !validAPIScope(scope) {
+				problem("http.api_keys %s: unknown scope %q, try one of: %s", key.Name, scope, strings.Join(apiScopes, ", "))
+			}
+		}
+	}
+	if c.HTTP.OIDC.Issuer != "" && c.HTTP.OIDC.Audience == "" {
+		problem("http.oidc.audience (OIDC_AUDIENCE) is required with an issuer")
+	}
+
+	if c.Dashboard.URL != "" {
+		if u, err := url.Parse(c.Dashboard.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("dashboard.url (DASHBOARD_URL) %q is not an http or https URL", c.Dashboard.URL)
+		}
+		if c.Dashboard.ClientID == "" || c.Dashboard.ClientSecret == "" {
+			problem("dashboard.client_id (SLACK_CLIENT_ID) and dashboard.client_secret (SLACK_CLIENT_SECRET) are required with dashboard.url")
+		}
+		if len(c.Dashboard.SessionSecret) < 32 {
+			problem("dashboard.session_secret (DASHBOARD_SESSION_SECRET) of at least 32 characters is required with dashboard.url")
+		}
+	}
+
+	if len(c.Chains) == 0 {
+		if c.Ethereum.APIEndpoint == "" {
+			problem("ethereum.api_endpoint (ETH_API_ENDPOINT) is required when there are no chains")
+		}
+		if !common.IsHexAddress(c.Ethereum.TokenAddress) {
+			problem("ethereum.token_address (ERC20_TOKEN_ADDRESS) %q is not an address", c.Ethereum.TokenAddress)
+		}
+		if c.Ethereum.Signer.Type == signerKeyJSON && c.Ethereum.KeyJSON == "" {
+			problem("ethereum.key_json (ETH_KEY_JSON) or ethereum.signer (ETH_SIGNER) is required")
+		}
+	}
+	for _, ch := range c.Chains {
+		if !common.IsHexAddress(ch.TokenAddress) {
+			problem("chain %s: token_address %q is not an address", ch.Name, ch.TokenAddress)
+		}
+	}
+
+	hooks := map[string]bool{}
+	for i, h := range c.Webhooks {
+		if h.Name == "" {
+			problem("webhooks[%d] (WEBHOOKS) has no name", i)
+		} else if hooks[h.Name] {
+			problem("webhooks (WEBHOOKS) has two webhooks named %s", h.Name)
+		}
+		hooks[h.Name] = true
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("webhooks %s: url %q is not an http or https URL", h.Name, h.URL)
+		}
+		if len(h.Secret) < 16 {
+			problem("webhooks %s: the secret must be at least 16 characters", h.Name)
+		}
+		for _, event := range h.Events {
+			if !validWebhookEvent(event) {
+				problem("webhooks %s: unknown event %q, try one of: %s", h.Name, event, strings.Join(webhookEvents, ", "))
+			}
+		}
+	}
+
+	switch strings.ToUpper(c.GasFee.Asset) {
+	case "", etherAsset:
+	case tokenAsset:
+		if rate, ok := new(big.Int).SetString(c.GasFee.TokenRate, 10); !ok || rate.Sign() <= 0 {
+			problem("gas_fee.token_rate (GAS_FEE_TOKEN_RATE) %q must be a positive integer when gas_fee.asset is CULT", c.GasFee.TokenRate)
+		}
+	default:
+		problem("gas_fee.asset (GAS_FEE_ASSET) %q must be CULT or ETH", c.GasFee.Asset)
+	}
+
+	durations := map[string]string{
+		"withdraw_batch_window (WITHDRAW_BATCH_WINDOW)": c.WithdrawBatchWindow,
+		"reconcile_interval (RECONCILE_INTERVAL)":       c.ReconcileInterval,
+		"shutdown_timeout (SHUTDOWN_TIMEOUT)":           c.ShutdownTimeout,
+	}
+	for name, value := range durations {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			problem("%s: %v", name, err)
+		}
+	}
+
+	if c.Workers.Count <= 0 {
+		problem("workers.count (WORKERS) %d must be positive", c.Workers.Count)
+	}
+	if c.Workers.QueueSize <= 0 {
+		problem("workers.queue_size (WORKER_QUEUE_SIZE) %d must be positive", c.Workers.QueueSize)
+	}
+	timeouts := map[string]string{
+		"workers.queue_timeout (WORKER_QUEUE_TIMEOUT)": c.Workers.QueueTimeout,
+		"workers.command_timeout (COMMAND_TIMEOUT)":    c.Workers.CommandTimeout,
+	}
+	for name, value := range timeouts {
+		if d, err := time.ParseDuration(value); err != nil {
+			problem("%s: %v", name, err)
+		} else if d <= 0 {
+			problem("%s %s must be positive", name, value)
+		}
+	}
+
+	limits := map[string]string{
+		"rate_limits.user (RATE_LIMIT_USER)":       c.RateLimits.User,
+		"rate_limits.channel (RATE_LIMIT_CHANNEL)": c.RateLimits.Channel,
+		"rate_limits.global (RATE_LIMIT_GLOBAL)":   c.RateLimits.Global,
+	}
+	for name, value := range limits {
+		if _, err := parseRateLimits(value); err != nil {
+			problem("%s: %v", name, err)
+		}
+	}
+
+	for key, value := range c.Settings {
+		if err := validateSetting(key, value); err != nil {
+			problem("settings.%s: %v", key, err)
+		}
+	}
+	if _, err := parseLogLevel(c.Logging.Level); err != nil {
+		problem("logging.level (LOG_LEVEL): %v", err)
+	}
+
+	for key := range c.Messages {
+		if _, ok := defaultMessages[key]; !ok {
+			problem("messages.%s is not a message, try one of: %s", key, strings.Join(messageKeys(), ", "))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
+// validationError joins the problems of a config into one error.
+func validationError(problems []string) error {
+	return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+// currentConfig holds the *config in effect. Only the settings applied by
+// reloadConfig change after startup.
+var currentConfig atomic.Value
+
+func runtimeConfig() *config {
+	return currentConfig.Load().(*config)
+}
+
+// applyConfig makes c the config in effect at startup.
+func applyConfig(c *config) error {
+	var err error
+	slackBotToken = c.Slack.BotToken
+	httpdPort = c.HTTP.Port
+	slackVerificationToken = c.Slack.VerificationToken
+	adminHTTPToken = c.HTTP.AdminToken
+	if c.WithdrawBatchWindow != "" {
+		if withdrawBatchWindow, err = time.ParseDuration(c.WithdrawBatchWindow); err != nil {
+			return err
+		}
+	}
+	if c.ReconcileInterval != "" {
+		if reconcileInterval, err = time.ParseDuration(c.ReconcileInterval); err != nil {
+			return err
+		}
+	}
+	if c.ShutdownTimeout != "" {
+		if shutdownTimeout, err = time.ParseDuration(c.ShutdownTimeout); err != nil {
+			return err
+		}
+	}
+	workerCount, workerQueueSize = c.Workers.Count, c.Workers.QueueSize
+	if workerQueueTimeout, err = time.ParseDuration(c.Workers.QueueTimeout); err != nil {
+		return err
+	}
+	if commandTimeout, err = time.ParseDuration(c.Workers.CommandTimeout); err != nil {
+		return err
+	}
+
+	// the database is opened all over with DATABASE_URL
+	if err := os.Setenv("DATABASE_URL", c.Database.URL); err != nil {
+		return err
+	}
+
+	if err := loadChains(c); err != nil {
+		return err
+	}
+	if err := loadRateLimits(c.RateLimits.User, c.RateLimits.Channel, c.RateLimits.Global); err != nil {
+		return err
+	}
+	if err := configureLogging(c); err != nil {
+		return err
+	}
+	currentConfig.Store(c)
+	return nil
+}
+
+// reloadConfig rereads the config and applies its non-secret settings: the
+// admins, gas fees, rate limits, setting defaults, messages and logging.
+// Credentials, including the admin API keys and the webhooks with their
+// secrets, chains and intervals only change on restart.
+func reloadConfig(path string) error {
+	next, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if problems := next.validate(); len(problems) > 0 {
+		return validationError(problems)
+	}
+
+	current := runtimeConfig()
+	reloaded := *current
+	reloaded.Slack.TipReaction = next.Slack.TipReaction
+	reloaded.Slack.TipAmount = next.Slack.TipAmount
+	reloaded.Slack.AdminUsers = next.Slack.AdminUsers
+	reloaded.Slack.AdminGroups = next.Slack.AdminGroups
+	reloaded.Slack.AdminChannel = next.Slack.AdminChannel
+	reloaded.GasFee = next.GasFee
+	reloaded.RateLimits = next.RateLimits
+	reloaded.Settings = next.Settings
+	reloaded.Messages = next.Messages
+	reloaded.Logging = next.Logging
+
+	if err := loadRateLimits(reloaded.RateLimits.User, reloaded.RateLimits.Channel, reloaded.RateLimits.Global); err != nil {
+		return err
+	}
+	if err := configureLogging(&reloaded); err != nil {
+		return err
+	}
+	currentConfig.Store(&reloaded)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the config every time the process gets SIGHUP.
+func reloadOnSIGHUP(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloadConfig(path); err != nil {
+			logError(context.Background(), "Failed to reload configuration, keeping the current one", logFields{"error": err})
+			continue
+		}
+		logInfo(context.Background(), "Reloaded configuration", nil)
+	}
+}
+
+// checkConfig implements `tiperc20 config check`: it loads the config and
+// the chains it describes, and reports every problem found.
+func checkConfig(path string) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if problems := c.validate(); len(problems) > 0 {
+		return validationError(problems)
+	}
+	if err := loadChains(c); err != nil {
+		return validationError([]string{err.Error()})
+	}
+	return nil
+}
+
+// settingDefault returns the default of a setting, from the config or the
+// built-in defaults.
+func settingDefault(key string) string {
+	if value, ok := runtimeConfig().Settings[key]; ok {
+		return value
+	}
+	return settingDefaults[key]
+}
+
+// defaultMessages are the messages the config can replace.
+var defaultMessages = map[string]string{
+	"help": ":point_right: :sunglasses: :point_right: I'm a CultureCoin (CULT) tipbot. Try 'tip', 'register', 'balance', 'deposit', 'withdraw', 'withdrawals', or 'chains' to interact with me!",
+	"register_prompt": `
+:point_right: :sunglasses: :point_right: Please register your Ethereum address:
+
+> @tiperc20 register YOUR_ADDRESS
+		`,
+	"frozen":             ":ice_cube: Your account is frozen, please contact an admin",
+	"withdrawals_paused": ":hourglass: Withdrawals are paused by an admin, please try again later",
+}
+
+func messageKeys() []string {
+	keys := make([]string, 0, len(defaultMessages))
+	for key := range defaultMessages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// message returns the message for key, as replaced by the config.
+func message(key string) string {
+	if text, ok := runtimeConfig().Messages[key]; ok {
+		return text
+	}
+	return defaultMessages[key]
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTokenAddress = "0x1111111111111111111111111111111111111111"
+
+// validTestConfig returns a config without problems for the tests to break.
+func validTestConfig() *config {
+	c := defaultConfig()
+	c.Slack.BotToken = "xoxb-test"
+	c.Database.URL = "postgres://localhost/tiperc20"
+	c.Ethereum.APIEndpoint = "http://localhost:8545"
+	c.Ethereum.TokenAddress = testTokenAddress
+	c.Ethereum.KeyJSON = "{}"
+	return c
+}
+
+func TestConfigValidate(t *testing.T) {
+	if problems := validTestConfig().validate(); len(problems) != 0 {
+		t.Fatalf("valid config has problems: %v", problems)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *config)
+		want   string
+	}{
+		{"bot token", func(c *config) { c.Slack.BotToken = "" }, "slack.bot_token"},
+		{"database", func(c *config) { c.Database.URL = "" }, "database.url"},
+		{"sqlite", func(c *config) { c.Database.URL = "sqlite3://tiperc20.db" }, "must be a Postgres database"},
+		{"migrate", func(c *config) { c.Database.Migrate = "always" }, "database.migrate"},
+		{"port", func(c *config) { c.HTTP.Port = 70000 }, "http.port 70000"},
+		{"api key name", func(c *config) {
+			c.HTTP.APIKeys = []apiKey{{Key: strings.Repeat("k", 16)}}
+		}, "http.api_keys[0] (ADMIN_API_KEYS) has no name"},
+		{"api key duplicate", func(c *config) {
+			key := apiKey{Name: "ops", Key: strings.Repeat("k", 16)}
+			c.HTTP.APIKeys = []apiKey{key, key}
+		}, "two keys named ops"},
+		{"api key length", func(c *config) {
+			c.HTTP.APIKeys = []apiKey{{Name: "ops", Key: "short"}}
+		}, "at least 16 characters"},
+		{"api key scope", func(c *config) {
+			c.HTTP.APIKeys = []apiKey{{Name: "ops", Key: strings.Repeat("k", 16), Scopes: []string{"write"}}}
+		}, `unknown scope "write"`},
+		{"oidc audience", func(c *config) { c.HTTP.OIDC.Issuer = "https://issuer.example.com" }, "http.oidc.audience"},
+		{"dashboard url", func(c *config) {
+			c.Dashboard.URL = "ftp://dashboard.example.com"
+			c.Dashboard.ClientID = "id"
+			c.Dashboard.ClientSecret = "secret"
+			c.Dashboard.SessionSecret = strings.Repeat("s", 32)
+		}, "is not an http or https URL"},
+		{"dashboard client", func(c *config) {
+			c.Dashboard.URL = "https://dashboard.example.com"
+			c.Dashboard.SessionSecret = strings.Repeat("s", 32)
+		}, "dashboard.client_id"},
+		{"dashboard session", func(c *config) {
+			c.Dashboard.URL = "https://dashboard.example.com"
+			c.Dashboard.ClientID = "id"
+			c.Dashboard.ClientSecret = "secret"
+		}, "dashboard.session_secret"},
+		{"api endpoint", func(c *config) { c.Ethereum.APIEndpoint = "" }, "ethereum.api_endpoint"},
+		{"token address", func(c *config) { c.Ethereum.TokenAddress = "0x1234" }, "ethereum.token_address"},
+		{"key", func(c *config) { c.Ethereum.KeyJSON = "" }, "ethereum.key_json"},
+		{"chain token address", func(c *config) {
+			c.Chains = []*chain{{Name: "mainnet", TokenAddress: "cult"}}
+		}, "chain mainnet: token_address"},
+		{"webhook url", func(c *config) {
+			c.Webhooks = []webhookConfig{{Name: "ops", URL: "hooks.example.com", Secret: strings.Repeat("s", 16)}}
+		}, "webhooks ops: url"},
+		{"webhook duplicate", func(c *config) {
+			h := webhookConfig{Name: "ops", URL: "https://hooks.example.com", Secret: strings.Repeat("s", 16)}
+			c.Webhooks = []webhookConfig{h, h}
+		}, "two webhooks named ops"},
+		{"webhook secret", func(c *config) {
+			c.Webhooks = []webhookConfig{{Name: "ops", URL: "https://hooks.example.com", Secret: "short"}}
+		}, "webhooks ops: the secret"},
+		{"webhook event", func(c *config) {
+			c.Webhooks = []webhookConfig{{Name: "ops", URL: "https://hooks.example.com", Secret: strings.Repeat("s", 16), Events: []string{"tip"}}}
+		}, `unknown event "tip"`},
+		{"gas fee asset", func(c *config) { c.GasFee.Asset = "BTC" }, "gas_fee.asset"},
+		{"gas fee rate", func(c *config) {
+			c.GasFee.Asset = "cult"
+			c.GasFee.TokenRate = "0"
+		}, "gas_fee.token_rate"},
+		{"batch window", func(c *config) { c.WithdrawBatchWindow = "soon" }, "withdraw_batch_window"},
+		{"workers", func(c *config) { c.Workers.Count = 0 }, "workers.count"},
+		{"queue size", func(c *config) { c.Workers.QueueSize = -1 }, "workers.queue_size"},
+		{"queue timeout", func(c *config) { c.Workers.QueueTimeout = "0s" }, "workers.queue_timeout (WORKER_QUEUE_TIMEOUT) 0s must be positive"},
+		{"command timeout", func(c *config) { c.Workers.CommandTimeout = "" }, "workers.command_timeout"},
+		{"rate limits", func(c *config) { c.RateLimits.User = "read=10" }, "rate_limits.user"},
+		{"setting", func(c *config) {
+			c.Settings = map[string]string{settingSignupBonus: "lots"}
+		}, "settings.signup-bonus"},
+		{"log level", func(c *config) { c.Logging.Level = "loud" }, "logging.level"},
+		{"message", func(c *config) {
+			c.Messages = map[string]string{"no-such-message": "hi"}
+		}, "messages.no-such-message is not a message"},
+	}
+	for _, test := range tests {
+		c := validTestConfig()
+		test.change(c)
+		problems := c.validate()
+		if len(problems) != 1 || !strings.Contains(problems[0], test.want) {
+			t.Errorf("%s: problems are %q, want one with %q", test.name, problems, test.want)
+		}
+	}
+}
+
+func TestConfigValidateSorted(t *testing.T) {
+	c := validTestConfig()
+	c.Slack.BotToken = ""
+	c.Database.URL = ""
+	c.Logging.Level = "loud"
+	problems := c.validate()
+	want := []string{"database.url", "logging.level", "slack.bot_token"}
+	if len(problems) != len(want) {
+		t.Fatalf("problems are %q", problems)
+	}
+	for i, p := range problems {
+		if !strings.HasPrefix(p, want[i]) {
+			t.Errorf("problem %d is %q, want %s", i, p, want[i])
+		}
+	}
+}
+
+func TestValidateCtlSkipsSlack(t *testing.T) {
+	c := validTestConfig()
+	c.Slack.BotToken = ""
+	if problems := c.validateCtl(); len(problems) != 0 {
+		t.Errorf("ctl problems are %q", problems)
+	}
+}
+
+func writeTestConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "tiperc20.yml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	path := writeTestConfig(t, `
+slack:
+  bot_token: xoxb-file
+  admin_users: [U1]
+database:
+  url: postgres://file/tiperc20
+workers:
+  count: 2
+logging:
+  level: debug
+`)
+	t.Setenv("SLACK_BOT_TOKEN", "xoxb-env")
+	t.Setenv("SLACK_ADMIN_USERS", " U2, ,U3 ")
+	t.Setenv("WORKERS", "4")
+	t.Setenv("LOG_REDACT_ADDRESSES", "true")
+	t.Setenv("ADMIN_API_KEYS", `[{"name":"ops","key":"0123456789abcdef","scopes":["read"]}]`)
+	t.Setenv("CHAINS", `[{"name":"mainnet","chain_id":1,"token_address":"`+testTokenAddress+`"}]`)
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Slack.BotToken != "xoxb-env" {
+		t.Errorf("bot token is %q, want the environment's", c.Slack.BotToken)
+	}
+	if c.Database.URL != "postgres://file/tiperc20" {
+		t.Errorf("database url is %q, want the file's", c.Database.URL)
+	}
+	if strings.Join(c.Slack.AdminUsers, ",") != "U2,U3" {
+		t.Errorf("admin users are %q", c.Slack.AdminUsers)
+	}
+	if c.Workers.Count != 4 {
+		t.Errorf("workers are %d, want 4", c.Workers.Count)
+	}
+	if c.Workers.QueueSize != defaultConfig().Workers.QueueSize {
+		t.Errorf("queue size is %d, want the default", c.Workers.QueueSize)
+	}
+	if c.Logging.Level != "debug" || !c.Logging.RedactAddresses {
+		t.Errorf("logging is %+v", c.Logging)
+	}
+	if len(c.HTTP.APIKeys) != 1 || c.HTTP.APIKeys[0].Name != "ops" {
+		t.Errorf("api keys are %+v", c.HTTP.APIKeys)
+	}
+	if len(c.Chains) != 1 || c.Chains[0].Name != "mainnet" || c.Chains[0].ChainID != 1 {
+		t.Errorf("chains are %+v", c.Chains)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  map[string]string
+		want string
+	}{
+		{"unknown key", "slack:\n  bot_tokn: xoxb\n", nil, "bot_tokn"},
+		{"bool", "", map[string]string{"LOG_MESSAGE_TEXT": "maybe"}, "invalid LOG_MESSAGE_TEXT"},
+		{"int", "", map[string]string{"WORKER_QUEUE_SIZE": "many"}, "invalid WORKER_QUEUE_SIZE"},
+		{"json", "", map[string]string{"WEBHOOKS": "[{"}, "invalid WEBHOOKS"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			_, err := loadConfig(writeTestConfig(t, test.yaml))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error is %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfigKeepsSecrets(t *testing.T) {
+	running := validTestConfig()
+	running.Slack.AdminUsers = []string{"U1"}
+	running.HTTP.APIKeys = []apiKey{{Name: "ops", Key: strings.Repeat("k", 16), Scopes: []string{"read"}}}
+	running.Webhooks = []webhookConfig{{Name: "rewards", URL: "https://rewards.example.com/hooks", Secret: strings.Repeat("s", 16)}}
+	currentConfig.Store(running)
+	t.Cleanup(func() { currentConfig.Store(&config{}) })
+
+	path := writeTestConfig(t, `
+slack:
+  bot_token: xoxb-other
+  admin_users: [U2]
+database:
+  url: postgres://localhost/tiperc20
+http:
+  api_keys:
+  - name: intruder
+    key: 0123456789abcdef
+    scopes: [read, adjust]
+ethereum:
+  api_endpoint: http://localhost:8545
+  token_address: `+testTokenAddress+`
+  key_json: "{}"
+webhooks:
+- name: rewards
+  url: https://attacker.example.com/hooks
+  secret: tttttttttttttttt
+`)
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	c := runtimeConfig()
+	if strings.Join(c.Slack.AdminUsers, ",") != "U2" {
+		t.Errorf("admin users are %q, want the reloaded ones", c.Slack.AdminUsers)
+	}
+	if c.Slack.BotToken != "xoxb-test" {
+		t.Errorf("bot token is %q, want the running one", c.Slack.BotToken)
+	}
+	if len(c.HTTP.APIKeys) != 1 || c.HTTP.APIKeys[0].Name != "ops" || c.HTTP.APIKeys[0].Key != strings.Repeat("k", 16) {
+		t.Errorf("api keys are %+v, want the running ones", c.HTTP.APIKeys)
+	}
+	if len(c.Webhooks) != 1 || c.Webhooks[0].URL != "https://rewards.example.com/hooks" || c.Webhooks[0].Secret != strings.Repeat("s", 16) {
+		t.Errorf("webhooks are %+v, want the running ones", c.Webhooks)
+	}
+}
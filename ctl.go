@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nlopes/slack"
+)
+
+const ctlUsage = `usage: tiperc20ctl COMMAND [ARGS], or tiperc20 ctl COMMAND [ARGS]
+
+Operator commands that work on the database and chains directly, without
+connecting to Slack.
+
+  balance USER                              show an account and its balances
+  credit USER AMOUNT [ASSET] REASON...      credit a user
+  debit USER AMOUNT [ASSET] REASON...       debit a user
+  withdrawals [-status S] [-user U] [-chain C] [-limit N]
+                                            list withdrawals, newest first
+  withdrawals retry ID                      send or resolve a stuck withdrawal
+  withdrawals pause|resume                  pause or resume all withdrawals
+  reconcile                                 compare balances to on-chain holdings
+  export accounts|ledger|withdrawals [-format csv|json]
+                                            write every record to stdout
+  report ledger|statement|summary -month 2026-09 | -from DATE [-to DATE]
+         [-user USER] [-format csv|json]    write an accounting report to stdout
+  import [-dry-run] FILE                    apply a CSV of user_id,asset,amount,reason
+  rotate-key CHAIN ADDRESS                  move the hot wallet's funds to ADDRESS
+  rotate-key -finish CHAIN ADDRESS          resume withdrawals once CHAIN signs as ADDRESS
+  token [CHAIN]                             check the token contract of a chain`
+
+// ctlCommands are the subcommands of tiperc20 ctl. They print to stdout and
+// return an error to exit with.
+var ctlCommands = map[string]func(ctx context.Context, api *slack.Client, args []string) error{
+	"balance":     ctlBalance,
+	"credit":      ctlAdjust("credit"),
+	"debit":       ctlAdjust("debit"),
+	"withdrawals": ctlWithdrawals,
+	"reconcile":   ctlReconcile,
+	"export":      ctlExport,
+	"report":      ctlReport,
+	"import":      ctlImport,
+	"rotate-key":  ctlRotateKey,
+	"token":       ctlToken,
+}
+
+var (
+	errCtlUsage  = errors.New("invalid arguments")
+	errInsolvent = errors.New("the ledger is insolvent")
+)
+
+// startCtl applies what tiperc20 ctl needs of config, which leaves out Slack,
+// and runs it. The database must be migrated already, migrations are only
+// applied by the bot and tiperc20 migrate.
+func startCtl(ctx context.Context, config *config, args []string) int {
+	if problems := config.validateCtl(); len(problems) > 0 {
+		logFatal(ctx, "Invalid configuration", logFields{"problems": problems})
+	}
+	if err := applyConfig(config); err != nil {
+		logFatal(ctx, "Failed to apply configuration", logFields{"error": err})
+	}
+	if config.Database.Migrate != migrateOff {
+		if err := migrateOnStart(ctx, config.Database.URL, migrateVerify); err != nil {
+			logFatal(ctx, "The database isn't migrated, run tiperc20 migrate", logFields{"error": err})
+		}
+	}
+	return runCtl(correlatedContext(), slack.New(slackBotToken), args)
+}
+
+// runCtl runs a tiperc20 ctl command and returns its exit code: 1 when it
+// failed, 2 when reconcile found an insolvent asset.
+func runCtl(ctx context.Context, api *slack.Client, args []string) int {
+	if len(args) == 0 || ctlCommands[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, ctlUsage)
+		return 1
+	}
+
+	err := ctlCommands[args[0]](ctx, api, args[1:])
+	switch err {
+	case nil:
+		return 0
+	case errCtlUsage:
+		fmt.Fprintln(os.Stderr, ctlUsage)
+		return 1
+	case errInsolvent:
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Fprintln(os.Stderr, "error:", err)
+	return 1
+}
+
+// ctlActor is who the audit log records for changes made with tiperc20 ctl.
+func ctlActor() string {
+	if user := os.Getenv("USER"); user != "" {
+		return "ctl:" + user
+	}
+	return "ctl"
+}
+
+func ctlEvent(ctx context.Context) string {
+	return "ctl:" + correlationID(ctx)
+}
+
+func ctlBalance(ctx context.Context, api *slack.Client, args []string) error {
+	if len(args) != 1 {
+		return errCtlUsage
+	}
+	account, err := findAccount(args[0])
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return fmt.Errorf("no account for %s", args[0])
+	}
+
+	fmt.Println("user:   ", account.UserID)
+	fmt.Println("address:", account.Address)
+	if account.Frozen {
+		fmt.Println("frozen: ", account.FrozenReason)
+	}
+	assets := make([]string, 0, len(account.Balances))
+	for asset := range account.Balances {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+	for _, asset := range assets {
+		fmt.Printf("%-8s %s\n", asset+":", account.Balances[asset])
+	}
+	return nil
+}
+
+// ctlAdjust credits or debits a user like `admin credit` does in Slack.
+func ctlAdjust(action string) func(ctx context.Context, api *slack.Client, args []string) error {
+	return func(ctx context.Context, api *slack.Client, args []string) error {
+		if len(args) < 3 {
+			return errCtlUsage
+		}
+		userID, rest := args[0], args[2:]
+		asset := tokenAsset
+		if parsed, err := parseAsset(rest[0]); err == nil {
+			asset = parsed
+			rest = rest[1:]
+		}
+		reason := strings.Join(rest, " ")
+		if reason == "" {
+			return errors.New("please give a reason")
+		}
+		amount, err := parseAmount(args[1], asset)
+		if err != nil {
+			return err
+		}
+		if amount.Sign() < 1 {
+			return fmt.Errorf("must %s more than 0 %s", action, asset)
+		}
+
+		if err := adminAdjust(ctx, ctlActor(), ctlEvent(ctx), action, userID, asset, amount, reason, nil); err != nil {
+			return err
+		}
+		verb := adjustVerb(action)
+		fmt.Printf("%s %s %s %s, balance %s %s\n", strings.Title(verb), userID, formatAmount(amount, asset), asset,
+			formatAmount(retrieveAssetBalanceFor(userID, asset), asset), asset)
+		sendSlackMessage(api, userID, fmt.Sprintf(":bank: An admin %s your balance %s %s: %s", verb, formatAmount(amount, asset), asset, reason))
+		return nil
+	}
+}
+
+func ctlWithdrawals(ctx context.Context, api *slack.Client, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "retry":
+			if len(args) != 2 {
+				return errCtlUsage
+			}
+			id, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid withdrawal ID %q", args[1])
+			}
+			return ctlRetryWithdrawal(ctx, api, id)
+		case "pause", "resume":
+			if len(args) != 1 {
+				return errCtlUsage
+			}
+			return ctlSetWithdrawalsPaused(ctx, args[0] == "pause")
+		}
+	}
+
+	var f withdrawalFilter
+	flags := flag.NewFlagSet("withdrawals", flag.ContinueOnError)
+	flags.StringVar(&f.Status, "status", "", "only withdrawals with this status")
+	flags.StringVar(&f.User, "user", "", "only withdrawals of this Slack user ID")
+	flags.StringVar(&f.Chain, "chain", "", "only withdrawals on this chain")
+	limit := flags.Int("limit", 50, "how many withdrawals to list")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return errCtlUsage
+	}
+
+	withdrawals, err := filterWithdrawals(f, *limit)
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tCREATED\tUSER\tCHAIN\tAMOUNT\tADDRESS\tSTATUS\tTX\tERROR")
+	for _, w := range withdrawals {
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s %s\t%s\t%s\t%s\t%s\n", w.ID, w.CreatedAt.Format("2006-01-02 15:04"), w.UserID, w.Chain,
+			formatAmount(w.Amount, w.Asset), w.Asset, w.Address, w.Status, w.TxHash, w.Error)
+	}
+	return out.Flush()
+}
+
+// ctlRetryWithdrawal sends a withdrawal that is stuck queued, settles one
+// whose transaction was signed but not seen through, and looks up the batch
+// of one stuck batched. The bot must not be paying withdrawals at the same
+// time, so they must be paused.
+func ctlRetryWithdrawal(ctx context.Context, api *slack.Client, id int64) error {
+	if !withdrawalsPaused() {
+		return errors.New("pause withdrawals first, so the bot doesn't send them too")
+	}
+
+	found, err := queryWithdrawals(`WHERE id = $1;`, id)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no withdrawal %d", id)
+	}
+	w := found[0]
+	c, err := lookupChain(w.Chain)
+	if err != nil {
+		return err
+	}
+
+	pay := payable(w)
+	switch {
+	case pay:
+	case w.Status == withdrawalSending:
+		unlock, err := c.lockWallet(ctx)
+		if err != nil {
+			return err
+		}
+		resolveSendingWithdrawals(ctx, api, []*withdrawal{w}, errors.New("The withdrawal was never sent"))
+		unlock()
+	case w.Status == withdrawalBatched:
+		if pay, err = ctlSettleBatch(ctx, c, w); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("withdrawal %d is %s and can't be retried", w.ID, w.Status)
+	}
+
+	if pay {
+		tx, err := payWithdrawal(ctx, api, c, w)
+		if err != nil {
+			return err
+		}
+		if tx != nil {
+			fmt.Printf("Sent withdrawal %d: %s\n", w.ID, c.txLink(tx.Hash()))
+		}
+	}
+
+	found, err = queryWithdrawals(`WHERE id = $1;`, id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Withdrawal %d is %s\n", id, found[0].Status)
+	return nil
+}
+
+// ctlSettleBatch looks up the batch w was sent in while holding the hot
+// wallet of c. A mined batch is confirmed, and one still pending is left
+// alone. A batch that reverted, was replaced or was dropped is queued again,
+// and only then does it tell to pay w on its own. The other withdrawals of
+// the batch go out with the next one once withdrawals are resumed.
+func ctlSettleBatch(ctx context.Context, c *chain, w *withdrawal) (pay bool, err error) {
+	unlock, err := c.lockWallet(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	group, err := queryWithdrawals(`WHERE status = $1 AND tx_hash = $2 ORDER BY id;`, withdrawalBatched, w.TxHash)
+	if err != nil || len(group) == 0 {
+		return false, err
+	}
+	conn, err := c.backend()
+	if err != nil {
+		return false, err
+	}
+	state, signed, receipt, err := sentTxState(ctx, c, conn, group)
+	if err != nil {
+		return false, err
+	}
+
+	reason := "its batch reverted"
+	switch state {
+	case txPending:
+		return false, fmt.Errorf("the batch %s of withdrawal %d is still pending", w.TxHash, w.ID)
+	case txMined:
+		if err := setWithdrawalStatus(ctx, withdrawalIDs(group), withdrawalConfirmed, "", ""); err != nil {
+			return false, err
+		}
+		if signed != nil {
+			settleBatchFees(ctx, group, signed, receipt)
+		}
+		return false, nil
+	case txReplaced:
+		reason = "its batch was replaced"
+	case txMissing:
+		// the transfer of w takes the nonce the batch was signed with, so
+		// the batch can't be mined any more once it is sent
+		reason = "its batch was dropped"
+	}
+	requeued, err := requeueWithdrawals(ctx, group, reason)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range requeued {
+		if r.ID == w.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func ctlSetWithdrawalsPaused(ctx context.Context, paused bool) error {
+	value := strconv.FormatBool(paused)
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		previous, err := storeSetting(tx, settingWithdrawalsPaused, value, ctlActor())
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditRecord{Actor: ctlActor(), Action: "admin_set", Subject: settingWithdrawalsPaused, Before: previous, After: value, Event: ctlEvent(ctx)})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Set %s to %s\n", settingWithdrawalsPaused, value)
+	return nil
+}
+
+func ctlReconcile(ctx context.Context, api *slack.Client, args []string) error {
+	if len(args) != 0 {
+		return errCtlUsage
+	}
+	reports, err := reconcile(ctx)
+	if err != nil {
+		return err
+	}
+	insolvent := false
+	for _, r := range reports {
+		fmt.Println(r)
+		insolvent = insolvent || r.insolvent()
+	}
+	if insolvent {
+		return errInsolvent
+	}
+	return nil
+}
+
+func ctlExport(ctx context.Context, api *slack.Client, args []string) error {
+	if len(args) == 0 {
+		return errCtlUsage
+	}
+	kind := args[0]
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "csv", "csv or json")
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() > 0 {
+		return errCtlUsage
+	}
+	if *format != "csv" && *format != "json" {
+		return errors.New("format must be csv or json")
+	}
+
+	data, header, records, err := exportData(kind, withdrawalFilter{})
+	if err != nil {
+		return err
+	}
+	return printTable(*format, data, header, records)
+}
+
+func ctlReport(ctx context.Context, api *slack.Client, args []string) error {
+	if len(args) == 0 {
+		return errCtlUsage
+	}
+	kind := args[0]
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	month := flags.String("month", "", "the month to report, such as 2026-09")
+	from := flags.String("from", "", "the first day to report, such as 2026-09-01")
+	to := flags.String("to", "", "the day after the last one to report, default now")
+	user := flags.String("user", "", "only report this Slack user ID")
+	format := flags.String("format", "csv", "csv or json")
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() > 0 {
+		return errCtlUsage
+	}
+	if *format != "csv" && *format != "json" {
+		return errors.New("format must be csv or json")
+	}
+	period, err := parseReportPeriod(*month, *from, *to)
+	if err != nil {
+		return err
+	}
+
+	data, header, records, err := reportData(ctx, kind, period, *user)
+	if err != nil {
+		return err
+	}
+	return printTable(*format, data, header, records)
+}
+
+// printTable writes data as indented JSON, or the records as CSV, to stdout.
+func printTable(format string, data interface{}, header []string, records [][]string) error {
+	if format == "json" {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		return out.Encode(data)
+	}
+	out := csv.NewWriter(os.Stdout)
+	out.Write(header)
+	return out.WriteAll(records)
+}
+
+// adjustmentRow is a line of an import file.
+type adjustmentRow struct {
+	Line   int
+	UserID string
+	Asset  string
+	Action string
+	Amount *big.Int
+	Reason string
+}
+
+// ctlImport applies a CSV file of adjustments in a single transaction. Each
+// row credits, or with a negative amount debits, a user. -dry-run checks
+// every row against the balances and rolls back.
+func ctlImport(ctx context.Context, api *slack.Client, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "check the file without applying it")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errCtlUsage
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rows, err := readAdjustments(file)
+	if err != nil {
+		return err
+	}
+
+	errDryRun := errors.New("dry run")
+	actor, event := ctlActor(), ctlEvent(ctx)
+	err = withLedgerTx(ctx, func(tx *sql.Tx) error {
+		for _, row := range rows {
+			err := applyAdjustment(tx, actor, event, row.Action, row.UserID, row.Asset, row.Amount, row.Reason)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", row.Line, err)
+			}
+		}
+		if *dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		fmt.Printf("%d adjustments would apply\n", len(rows))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Applied %d adjustments\n", len(rows))
+	return nil
+}
+
+// readAdjustments parses an import file. Its first line is the header
+// user_id,asset,amount,reason.
+func readAdjustments(r io.Reader) ([]*adjustmentRow, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || strings.Join(records[0], ",") != "user_id,asset,amount,reason" {
+		return nil, errors.New("the file must start with the header user_id,asset,amount,reason")
+	}
+
+	var rows []*adjustmentRow
+	for i, record := range records[1:] {
+		row := &adjustmentRow{Line: i + 2, UserID: strings.TrimSpace(record[0]), Action: "credit", Reason: strings.TrimSpace(record[3])}
+		asset, err := parseAsset(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", row.Line, err)
+		}
+		row.Asset = asset
+		amount := strings.TrimSpace(record[2])
+		if strings.HasPrefix(amount, "-") {
+			row.Action, amount = "debit", amount[1:]
+		}
+		row.Amount, err = parseAmount(amount, asset)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", row.Line, err)
+		}
+		if row.UserID == "" || row.Reason == "" || row.Amount.Sign() == 0 {
+			return nil, fmt.Errorf("line %d: needs a user, a reason and an amount other than 0", row.Line)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ctlRotateKey moves the token and ether balances of a chain's hot wallet to
+// the address of its new key, holding the wallet so that nothing else sends
+// from it meanwhile, and waits for both transfers to be mined. Withdrawals
+// must be paused, and stay paused until rotate-key -finish finds the chain
+// configured with the new key.
+func ctlRotateKey(ctx context.Context, api *slack.Client, args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	finish := flags.Bool("finish", false, "resume withdrawals once the chain signs with the new key")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errCtlUsage
+	}
+	c, err := lookupChain(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !common.IsHexAddress(flags.Arg(1)) {
+		return fmt.Errorf("invalid address %q", flags.Arg(1))
+	}
+	to := common.HexToAddress(flags.Arg(1))
+	if !withdrawalsPaused() {
+		return errors.New("pause withdrawals first, so the bot doesn't send from the old wallet")
+	}
+	if *finish {
+		return ctlFinishKeyRotation(ctx, c, to)
+	}
+
+	unlock, err := c.lockWallet(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sending, err := queryWithdrawals(`WHERE chain = $1 AND status IN ($2, $3);`, c.Name, withdrawalSending, withdrawalBatched)
+	if err != nil {
+		return err
+	}
+	if len(sending) > 0 {
+		return fmt.Errorf("withdrawals %v are still in flight, retry them first", withdrawalIDs(sending))
+	}
+
+	conn, err := c.backend()
+	if err != nil {
+		return err
+	}
+	token, err := NewToken(common.HexToAddress(c.TokenAddress), conn)
+	if err != nil {
+		return err
+	}
+	from, err := c.hotWalletAddress()
+	if err != nil {
+		return err
+	}
+	if to == from {
+		return errors.New("that is the current hot wallet")
+	}
+
+	// a transaction still pending, such as a sweep to cold storage, would
+	// spend from the old wallet after the balances are read
+	var nonce, pending uint64
+	err = timeRPC(c, "eth_getTransactionCount", func() (err error) {
+		if nonce, err = conn.NonceAt(ctx, from, nil); err != nil {
+			return err
+		}
+		pending, err = conn.PendingNonceAt(ctx, from)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if pending > nonce {
+		return fmt.Errorf("the hot wallet has %d transactions pending, try again once they are mined", pending-nonce)
+	}
+
+	var tokens *big.Int
+	err = timeRPC(c, "eth_call", func() (err error) {
+		tokens, err = token.BalanceOf(&bind.CallOpts{Context: ctx}, from)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if tokens.Sign() > 0 {
+		auth, err := c.transactor()
+		if err != nil {
+			return err
+		}
+		auditSigned(ctx, auth, "rotate_key", c.Name, fmt.Sprintf("move %s CULT to %s", formatAmount(tokens, tokenAsset), to.Hex()))
+		if auth.GasPrice, err = c.suggestGasPrice(ctx, conn); err != nil {
+			return err
+		}
+		var tx *types.Transaction
+		err = c.withNonce(ctx, conn, from, func(nonce uint64) error {
+			auth.Nonce = new(big.Int).SetUint64(nonce)
+			tx, err = token.Transfer(auth, to, tokens)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to transfer the tokens: %v", err)
+		}
+		fmt.Printf("Transferring %s %s: %s\n", formatAmount(tokens, tokenAsset), tokenAsset, c.txLink(tx.Hash()))
+		if err := waitForRotation(ctx, c, conn, tx); err != nil {
+			return err
+		}
+	}
+
+	// the ether is read once the tokens moved, since their gas came out of it
+	var wei *big.Int
+	err = timeRPC(c, "eth_getBalance", func() (err error) {
+		wei, err = conn.BalanceAt(ctx, from, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	quote, err := quoteEtherTransfer(c)
+	if err != nil {
+		return err
+	}
+	value := new(big.Int).Sub(wei, quote.Cost())
+	if value.Sign() > 0 {
+		auth, err := c.transactor()
+		if err != nil {
+			return err
+		}
+		auditSigned(ctx, auth, "rotate_key", c.Name, fmt.Sprintf("move %s ETH to %s", formatAmount(value, etherAsset), to.Hex()))
+		var tx *types.Transaction
+		err = c.withNonce(ctx, conn, from, func(nonce uint64) error {
+			rawTx := types.NewTransaction(nonce, to, value, quote.GasLimit, quote.GasPrice, nil)
+			tx, err = auth.Signer(c.signer(), from, rawTx)
+			if err != nil {
+				return err
+			}
+			return conn.SendTransaction(ctx, tx)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to transfer the ether: %v", err)
+		}
+		fmt.Printf("Transferring %s %s: %s\n", formatAmount(value, etherAsset), etherAsset, c.txLink(tx.Hash()))
+		if err := waitForRotation(ctx, c, conn, tx); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("The ether left doesn't cover the gas of sending it")
+	}
+
+	fmt.Printf("Configure chain %s with the key of %s and restart the bot, then run rotate-key -finish %s %s to resume withdrawals.\n", c.Name, to.Hex(), c.Name, to.Hex())
+	if c.treasuryMode() {
+		fmt.Printf("The treasury must approve %s before withdrawals can be paid.\n", to.Hex())
+	}
+	return nil
+}
+
+// waitForRotation waits for a transfer of rotate-key to be mined, and fails
+// when it reverted.
+func waitForRotation(ctx context.Context, c *chain, conn chainBackend, tx *types.Transaction) error {
+	receipt, err := bind.WaitMined(ctx, conn, tx)
+	if err != nil {
+		return err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return fmt.Errorf("the transfer %s reverted", c.txLink(tx.Hash()))
+	}
+	fmt.Printf("Mined %s\n", tx.Hash().Hex())
+	return nil
+}
+
+// ctlFinishKeyRotation resumes withdrawals once chain c signs with the key
+// of address, and in treasury mode once the treasury approved it.
+func ctlFinishKeyRotation(ctx context.Context, c *chain, address common.Address) error {
+	from, err := c.hotWalletAddress()
+	if err != nil {
+		return err
+	}
+	if from != address {
+		return fmt.Errorf("chain %s still signs with %s, configure it with the key of %s first", c.Name, from.Hex(), address.Hex())
+	}
+	if c.treasuryMode() {
+		allowance, err := treasuryAllowance(c)
+		if err != nil {
+			return err
+		}
+		if allowance.Sign() == 0 {
+			return fmt.Errorf("the treasury hasn't approved %s yet", address.Hex())
+		}
+	}
+	return ctlSetWithdrawalsPaused(ctx, false)
+}
+
+// ctlToken reads the token contract of each chain, or of the one given,
+// through the Token bindings.
+func ctlToken(ctx context.Context, api *slack.Client, args []string) error {
+	names := chainNames()
+	if len(args) > 1 {
+		return errCtlUsage
+	}
+	if len(args) == 1 {
+		names = args
+	}
+
+	for _, name := range names {
+		c, err := lookupChain(name)
+		if err != nil {
+			return err
+		}
+		info, err := c.token(ctx)
+		if err != nil {
+			return fmt.Errorf("chain %s: %v", name, err)
+		}
+		conn, _, err := c.dial()
+		if err != nil {
+			return err
+		}
+		token, err := NewToken(common.HexToAddress(c.TokenAddress), conn)
+		if err != nil {
+			return err
+		}
+		from, err := c.hotWalletAddress()
+		if err != nil {
+			return err
+		}
+
+		var supply, balance, wei *big.Int
+		opts := &bind.CallOpts{Context: ctx}
+		err = timeRPC(c, "eth_call", func() (err error) {
+			if supply, err = token.TotalSupply(opts); err != nil {
+				return err
+			}
+			balance, err = token.BalanceOf(opts, from)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("chain %s: %v", name, err)
+		}
+		err = timeRPC(c, "eth_getBalance", func() (err error) {
+			wei, err = conn.BalanceAt(ctx, from, nil)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("chain %s: %v", name, err)
+		}
+
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+		fmt.Fprintf(out, "chain:\t%s\n", c.Name)
+		fmt.Fprintf(out, "token:\t%s\n", c.TokenAddress)
+		fmt.Fprintf(out, "name:\t%s\n", info.Name)
+		fmt.Fprintf(out, "symbol:\t%s\n", info.Symbol)
+		fmt.Fprintf(out, "decimals:\t%d\n", info.Decimals)
+		fmt.Fprintf(out, "totalSupply:\t%s\n", supply)
+		fmt.Fprintf(out, "hot wallet:\t%s\n", from.Hex())
+		fmt.Fprintf(out, "balanceOf:\t%s\n", balance)
+		fmt.Fprintf(out, "ether:\t%s %s\n", formatAmount(wei, etherAsset), etherAsset)
+		if info.Symbol != tokenAsset {
+			fmt.Fprintf(out, "warning:\tthe token symbol isn't %s\n", tokenAsset)
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	return nil
+}
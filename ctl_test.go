@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/nlopes/slack"
+)
+
+// startTestBatch sends the queued withdrawals of tc in a batch and pauses
+// withdrawals, like an operator about to retry them.
+func startTestBatch(t *testing.T, api *slack.Client, tc *testChain) {
+	ctx := context.Background()
+	if _, tx, fallback, err := startWithdrawalBatch(ctx, api, tc.chain); err != nil || tx == nil || fallback {
+		t.Fatalf("batch %v, fallback %v: %v", tx, fallback, err)
+	}
+	if err := ctlSetWithdrawalsPaused(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCtlRetryPendingBatch(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	api := testSlack(t)
+	ctx := context.Background()
+
+	items := queueTestWithdrawals(t, tc.chain, nil, 100, 200)
+	startTestBatch(t, api, tc)
+	if err := ctlRetryWithdrawal(ctx, api, items[0].ID); err == nil {
+		t.Error("retried a withdrawal whose batch is pending")
+	}
+
+	tc.sim.Commit()
+	if err := ctlRetryWithdrawal(ctx, api, items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range loadTestWithdrawals(t, items) {
+		if w.Status != withdrawalConfirmed {
+			t.Errorf("withdrawal %d is %s, want %s", w.ID, w.Status, withdrawalConfirmed)
+		}
+	}
+}
+
+func TestCtlRetryDroppedBatch(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	api := testSlack(t)
+	ctx := context.Background()
+
+	items := queueTestWithdrawals(t, tc.chain, nil, 100, 200)
+	tc.sim.dropNext = true
+	startTestBatch(t, api, tc)
+	if err := ctlRetryWithdrawal(ctx, api, items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	tc.sim.Commit()
+
+	current := loadTestWithdrawals(t, items)
+	if current[0].Status != withdrawalSent {
+		t.Errorf("retried withdrawal is %s, want %s", current[0].Status, withdrawalSent)
+	}
+	if current[1].Status != withdrawalQueued || current[1].TxHash != "" {
+		t.Errorf("rest of the batch is %s with %q, want it queued again", current[1].Status, current[1].TxHash)
+	}
+	if balance := tc.tokenBalance(t, common.HexToAddress(items[0].Address)); balance.Cmp(items[0].Amount) != 0 {
+		t.Errorf("delivered %s tokens, want %s", balance, items[0].Amount)
+	}
+}
+
+func TestCtlRotateKey(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	ctx := context.Background()
+	tc.mine(t)
+
+	newKey, _ := crypto.GenerateKey()
+	to := crypto.PubkeyToAddress(newKey.PublicKey)
+	old := tc.hotWallet.Address()
+	tokens := tc.tokenBalance(t, old)
+	args := []string{tc.Name, to.Hex()}
+
+	if err := ctlRotateKey(ctx, nil, args); err == nil {
+		t.Fatal("rotated the key while withdrawals run")
+	}
+	if err := ctlSetWithdrawalsPaused(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctlRotateKey(ctx, nil, args); err != nil {
+		t.Fatal(err)
+	}
+	if balance := tc.tokenBalance(t, to); balance.Cmp(tokens) != 0 {
+		t.Errorf("new wallet holds %s tokens, want %s", balance, tokens)
+	}
+	if balance := tc.tokenBalance(t, old); balance.Sign() != 0 {
+		t.Errorf("old wallet kept %s tokens", balance)
+	}
+	if wei, err := tc.sim.BalanceAt(ctx, to, nil); err != nil || wei.Sign() == 0 {
+		t.Errorf("new wallet holds %v wei: %v", wei, err)
+	}
+
+	finish := append([]string{"-finish"}, args...)
+	if err := ctlRotateKey(ctx, nil, finish); err == nil {
+		t.Error("finished the rotation before the chain signs with the new key")
+	}
+	tc.hotWallet = &keystoreSigner{key: &keystore.Key{Address: to, PrivateKey: newKey}}
+	if err := ctlRotateKey(ctx, nil, finish); err != nil {
+		t.Fatal(err)
+	}
+	if withdrawalsPaused() {
+		t.Error("withdrawals stayed paused after the rotation")
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	sessionCookie    = "tiperc20_session"
+	oauthStateCookie = "tiperc20_oauth_state"
+	// sessionLifetime is how long a sign-in lasts.
+	sessionLifetime = 7 * 24 * time.Hour
+	// leaderboardPeriod is the period the leaderboards cover.
+	leaderboardPeriod = 30 * 24 * time.Hour
+	// slackNameTTL is how long the names of users are cached for the
+	// leaderboards.
+	slackNameTTL = time.Hour
+)
+
+// dashboardConfig serves the web dashboard, where users sign in with Slack.
+type dashboardConfig struct {
+	// URL is where the dashboard is reached, without the /dashboard/ path.
+	// The dashboard is off without it.
+	URL          string `yaml:"url"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// SessionSecret signs the session cookies.
+	SessionSecret string `yaml:"session_secret"`
+}
+
+// dashboardSession is who signed in, kept in a signed cookie.
+type dashboardSession struct {
+	UserID  string `json:"u"`
+	Name    string `json:"n"`
+	Expires int64  `json:"e"`
+}
+
+// dashboardHandler serves the dashboard under /dashboard/: a user's
+// balances, history, pending withdrawals and address, and the team's
+// leaderboards and tipping volume.
+func dashboardHandler(api *slack.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := runtimeConfig().Dashboard
+		if config.URL == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		ctx := correlatedContext()
+		switch r.URL.Path {
+		case "/dashboard/":
+			session := readSession(r, config)
+			if session == nil {
+				renderDashboard(ctx, w, "signin", nil)
+				return
+			}
+			page, err := loadDashboard(ctx, api, session)
+			if err != nil {
+				logError(ctx, "Failed to load dashboard", logFields{"user": session.UserID, "error": err})
+				http.Error(w, "Something went wrong, please try again", http.StatusInternalServerError)
+				return
+			}
+			renderDashboard(ctx, w, "dashboard", page)
+		case "/dashboard/login":
+			startSignIn(w, r, config)
+		case "/dashboard/oauth":
+			finishSignIn(ctx, w, r, api, config)
+		case "/dashboard/logout":
+			if r.Method != "POST" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			setCookie(w, config, sessionCookie, "", -1)
+			http.Redirect(w, r, "/dashboard/", http.StatusSeeOther)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func setCookie(w http.ResponseWriter, config dashboardConfig, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/dashboard/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.URL, "https://"),
+	})
+}
+
+func redirectURI(config dashboardConfig) string {
+	return strings.TrimSuffix(config.URL, "/") + "/dashboard/oauth"
+}
+
+// startSignIn sends the user to Slack to sign in, with a random state that
+// the callback checks against a cookie.
+func startSignIn(w http.ResponseWriter, r *http.Request, config dashboardConfig) {
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		http.Error(w, "Something went wrong, please try again", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, config, oauthStateCookie, hex.EncodeToString(state), 600)
+
+	params := url.Values{
+		"client_id":    {config.ClientID},
+		"scope":        {"identity.basic"},
+		"redirect_uri": {redirectURI(config)},
+		"state":        {hex.EncodeToString(state)},
+	}
+	http.Redirect(w, r, "https://slack.com/oauth/authorize?"+params.Encode(), http.StatusFound)
+}
+
+// finishSignIn trades the code Slack sent back for the user's identity, and
+// signs them in when they belong to the bot's team.
+func finishSignIn(ctx context.Context, w http.ResponseWriter, r *http.Request, api *slack.Client, config dashboardConfig) {
+	state, err := r.Cookie(oauthStateCookie)
+	if err != nil || state.Value == "" || !secureEqual(state.Value, r.FormValue("state")) {
+		http.Error(w, "Your sign in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	setCookie(w, config, oauthStateCookie, "", -1)
+	if r.FormValue("error") != "" {
+		http.Redirect(w, r, "/dashboard/", http.StatusSeeOther)
+		return
+	}
+
+	token, _, err := slack.GetOAuthToken(config.ClientID, config.ClientSecret, r.FormValue("code"), redirectURI(config), false)
+	if err != nil {
+		logWarn(ctx, "Slack sign in failed", logFields{"error": err})
+		http.Error(w, "Slack sign in failed, please try again", http.StatusBadGateway)
+		return
+	}
+	identity, err := slack.New(token).GetUserIdentity()
+	if err != nil {
+		logWarn(ctx, "Failed to read Slack identity", logFields{"error": err})
+		http.Error(w, "Slack sign in failed, please try again", http.StatusBadGateway)
+		return
+	}
+	team, err := api.AuthTest()
+	if err != nil {
+		logWarn(ctx, "Failed to read the bot's team", logFields{"error": err})
+		http.Error(w, "Slack sign in failed, please try again", http.StatusBadGateway)
+		return
+	}
+	if identity.Team.ID != team.TeamID {
+		logWarn(ctx, "Dashboard sign in from another team", logFields{"user": identity.User.ID, "team": identity.Team.ID})
+		http.Error(w, "Please sign in to the team the bot is in", http.StatusForbidden)
+		return
+	}
+
+	session := dashboardSession{UserID: identity.User.ID, Name: identity.User.Name, Expires: time.Now().Add(sessionLifetime).Unix()}
+	setCookie(w, config, sessionCookie, signSession(session, config.SessionSecret), int(sessionLifetime.Seconds()))
+	logInfo(ctx, "Signed in to the dashboard", logFields{"user": session.UserID})
+	http.Redirect(w, r, "/dashboard/", http.StatusSeeOther)
+}
+
+func signSession(session dashboardSession, secret string) string {
+	payload, _ := json.Marshal(session)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + sessionMAC(encoded, secret)
+}
+
+func sessionMAC(encoded, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// readSession returns the session of r, or nil when it has none or its
+// cookie was tampered with or expired.
+func readSession(r *http.Request, config dashboardConfig) *dashboardSession {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(sessionMAC(parts[0], config.SessionSecret))) {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	var session dashboardSession
+	if err := json.Unmarshal(payload, &session); err != nil || session.UserID == "" || time.Now().Unix() > session.Expires {
+		return nil
+	}
+	return &session
+}
+
+// dashboardPage is what the dashboard shows a signed in user.
+type dashboardPage struct {
+	Name        string
+	Account     *apiAccount
+	History     []*apiLedgerEntry
+	Withdrawals []*apiWithdrawal
+	TopTippers  []leaderboardRow
+	TopTipped   []leaderboardRow
+	Daily       *volumeChart
+	Weekly      *volumeChart
+}
+
+type leaderboardRow struct {
+	Rank   int
+	Name   string
+	Amount string
+	Tips   int
+	You    bool
+}
+
+func loadDashboard(ctx context.Context, api *slack.Client, session *dashboardSession) (*dashboardPage, error) {
+	page := &dashboardPage{Name: session.Name}
+
+	account, err := findAccount(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		account = &apiAccount{UserID: session.UserID, Balances: map[string]string{}}
+	}
+	page.Account = account
+
+	if page.History, err = queryLedger(session.UserID, 0, 25); err != nil {
+		return nil, err
+	}
+	pending, err := queryWithdrawals(`WHERE slack_user_id = $1 AND status IN ($2, $3, $4, $5) ORDER BY id DESC;`,
+		session.UserID, withdrawalPendingApproval, withdrawalQueued, withdrawalSending, withdrawalBatched)
+	if err != nil {
+		return nil, err
+	}
+	page.Withdrawals = toAPIWithdrawals(pending)
+
+	if page.TopTippers, err = leaderboard(ctx, api, "from_user_id", session.UserID); err != nil {
+		return nil, err
+	}
+	if page.TopTipped, err = leaderboard(ctx, api, "to_user_id", session.UserID); err != nil {
+		return nil, err
+	}
+	if page.Daily, err = tipVolume("day", 30, "Jan 2"); err != nil {
+		return nil, err
+	}
+	if page.Weekly, err = tipVolume("week", 26, "Jan 2"); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// leaderboard ranks the ten users who tipped, or were tipped, the most CULT
+// over the leaderboard period. column is from_user_id or to_user_id.
+func leaderboard(ctx context.Context, api *slack.Client, column, viewer string) ([]leaderboardRow, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT `+column+`, SUM(amount), COUNT(*) FROM tips
+		WHERE asset = $1 AND created_at > $2 AND from_user_id <> to_user_id
+		GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT 10;
+	`, tokenAsset, time.Now().Add(-leaderboardPeriod))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var board []leaderboardRow
+	for rows.Next() {
+		var userID, sum string
+		var tips int
+		if err := rows.Scan(&userID, &sum, &tips); err != nil {
+			return nil, err
+		}
+		amount, _ := new(big.Int).SetString(sum, 10)
+		board = append(board, leaderboardRow{
+			Rank:   len(board) + 1,
+			Name:   slackNames.lookup(ctx, api, userID),
+			Amount: formatAmount(amount, tokenAsset),
+			Tips:   tips,
+			You:    userID == viewer,
+		})
+	}
+	return board, rows.Err()
+}
+
+// slackNameCache remembers the names of the users on the leaderboards, so
+// that every page view doesn't look them all up in Slack.
+type slackNameCache struct {
+	mu      sync.Mutex
+	names   map[string]string
+	fetched map[string]time.Time
+}
+
+var slackNames = &slackNameCache{names: map[string]string{}, fetched: map[string]time.Time{}}
+
+func (c *slackNameCache) lookup(ctx context.Context, api *slack.Client, userID string) string {
+	c.mu.Lock()
+	name, ok := c.names[userID]
+	fresh := time.Since(c.fetched[userID]) < slackNameTTL
+	c.mu.Unlock()
+	if ok && fresh {
+		return name
+	}
+
+	user, err := api.GetUserInfo(userID)
+	if err != nil || user == nil {
+		logDebug(ctx, "Failed to look up user", logFields{"user": userID, "error": err})
+		if ok {
+			return name
+		}
+		return userID
+	}
+	name = user.Profile.RealName
+	if name == "" {
+		name = user.Name
+	}
+
+	c.mu.Lock()
+	c.names[userID], c.fetched[userID] = name, time.Now()
+	c.mu.Unlock()
+	return name
+}
+
+// volumeChart is a bar chart of the CULT tipped per day or week, drawn as
+// SVG on the server.
+type volumeChart struct {
+	Width, Height int
+	Bars          []volumeBar
+	Total         string
+	Max           string
+}
+
+type volumeBar struct {
+	X, Y, Width, Height float64
+	Label               string
+	Title               string
+}
+
+const (
+	chartWidth  = 600
+	chartHeight = 160
+)
+
+// tipVolume sums the CULT tipped in each of the last periods units, which is
+// day or week, oldest first and with the empty ones included.
+func tipVolume(unit string, periods int, labelFormat string) (*volumeChart, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT p.start, COUNT(t.id), COALESCE(SUM(t.amount), 0)
+		FROM generate_series(
+			date_trunc($1, now()::timestamp) - ($2 - 1) * ('1 ' || $1)::interval,
+			date_trunc($1, now()::timestamp),
+			('1 ' || $1)::interval
+		) AS p(start)
+		LEFT JOIN tips t ON date_trunc($1, t.created_at) = p.start AND t.asset = $3 AND t.from_user_id <> t.to_user_id
+		GROUP BY p.start ORDER BY p.start;
+	`, unit, periods, tokenAsset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type period struct {
+		start  time.Time
+		tips   int
+		amount *big.Int
+	}
+	var list []period
+	total, max := new(big.Int), new(big.Int)
+	for rows.Next() {
+		var p period
+		var sum string
+		if err := rows.Scan(&p.start, &p.tips, &sum); err != nil {
+			return nil, err
+		}
+		p.amount, _ = new(big.Int).SetString(sum, 10)
+		if p.amount == nil {
+			p.amount = new(big.Int)
+		}
+		total.Add(total, p.amount)
+		if p.amount.Cmp(max) > 0 {
+			max.Set(p.amount)
+		}
+		list = append(list, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	chart := &volumeChart{Width: chartWidth, Height: chartHeight, Total: formatAmount(total, tokenAsset), Max: formatAmount(max, tokenAsset)}
+	if len(list) == 0 {
+		return chart, nil
+	}
+	slot := float64(chartWidth) / float64(len(list))
+	maxValue, _ := new(big.Float).SetInt(max).Float64()
+	for i, p := range list {
+		value, _ := new(big.Float).SetInt(p.amount).Float64()
+		height := 0.0
+		if maxValue > 0 {
+			height = value / maxValue * (chartHeight - 20)
+		}
+		bar := volumeBar{
+			X:      float64(i)*slot + 1,
+			Y:      chartHeight - 20 - height,
+			Width:  slot - 2,
+			Height: height,
+			Title:  fmt.Sprintf("%s: %s CULT in %d tips", p.start.Format(labelFormat), formatAmount(p.amount, tokenAsset), p.tips),
+		}
+		// label every fifth bar so that the labels don't overlap
+		if i%5 == 0 {
+			bar.Label = p.start.Format(labelFormat)
+		}
+		chart.Bars = append(chart.Bars, bar)
+	}
+	return chart, nil
+}
+
+var dashboardTemplates = template.Must(template.New("").Parse(dashboardHTML))
+
+func renderDashboard(ctx context.Context, w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates.ExecuteTemplate(w, name, data); err != nil {
+		logError(ctx, "Failed to render dashboard", logFields{"page": name, "error": err})
+	}
+}
+
+const dashboardHTML = `
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>tiperc20</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; max-width: 960px; margin: 0 auto; padding: 1em; color: #1d1c1d; }
+header { display: flex; justify-content: space-between; align-items: center; border-bottom: 1px solid #ddd; }
+section { margin: 2em 0; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .3em .6em; border-bottom: 1px solid #eee; }
+td.amount { text-align: right; font-variant-numeric: tabular-nums; }
+tr.you { background: #fff8d6; }
+.grid { display: grid; grid-template-columns: 1fr 1fr; gap: 2em; }
+.balance { font-size: 2em; margin-right: 1em; }
+.muted { color: #888; }
+code { word-break: break-all; }
+svg rect { fill: #4a154b; }
+svg text { font-size: 10px; fill: #888; }
+button, .button { background: #4a154b; color: #fff; border: 0; padding: .6em 1.2em; border-radius: 4px; text-decoration: none; cursor: pointer; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "signin"}}{{template "head"}}
+<header><h1>tiperc20</h1></header>
+<section>
+<p>See your balance, tips and withdrawals, and who tipped the most this month.</p>
+<p><a class="button" href="/dashboard/login">Sign in with Slack</a></p>
+</section>
+</body>
+</html>
+{{end}}
+
+{{define "chart"}}
+<svg width="100%" viewBox="0 0 {{.Width}} {{.Height}}" role="img">
+{{range .Bars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}"><title>{{.Title}}</title></rect>
+{{if .Label}}<text x="{{.X}}" y="{{$.Height}}">{{.Label}}</text>{{end}}
+{{end}}</svg>
+<p class="muted">{{.Total}} CULT in total, at most {{.Max}} in one period</p>
+{{end}}
+
+{{define "leaderboard"}}
+<table>
+<tr><th>#</th><th>Who</th><th>CULT</th><th>Tips</th></tr>
+{{range .}}<tr{{if .You}} class="you"{{end}}><td>{{.Rank}}</td><td>{{.Name}}</td><td class="amount">{{.Amount}}</td><td class="amount">{{.Tips}}</td></tr>
+{{else}}<tr><td colspan="4" class="muted">No tips yet</td></tr>
+{{end}}</table>
+{{end}}
+
+{{define "dashboard"}}{{template "head"}}
+<header>
+<h1>tiperc20</h1>
+<form method="post" action="/dashboard/logout"><span class="muted">{{.Name}}</span> <button type="submit">Sign out</button></form>
+</header>
+
+<section>
+<h2>Your balance</h2>
+{{range $asset, $balance := .Account.Balances}}<span class="balance">{{$balance}} {{$asset}}</span>{{else}}<span class="balance">0 CULT</span>{{end}}
+{{if .Account.Frozen}}<p><strong>Your funds are frozen by an admin{{if .Account.FrozenReason}}: {{.Account.FrozenReason}}{{end}}.</strong></p>{{end}}
+<p>Withdrawal address: {{if .Account.Address}}<code>{{.Account.Address}}</code>{{else}}<span class="muted">none yet, register one with <code>@tiperc20 register</code></span>{{end}}</p>
+</section>
+
+{{if .Withdrawals}}<section>
+<h2>Pending withdrawals</h2>
+<table>
+<tr><th>#</th><th>Amount</th><th>Chain</th><th>Status</th><th>Requested</th></tr>
+{{range .Withdrawals}}<tr><td>{{.ID}}</td><td class="amount">{{.Amount}} {{.Asset}}</td><td>{{.Chain}}</td><td>{{.Status}}</td><td>{{.CreatedAt.Format "Jan 2 15:04"}}</td></tr>
+{{end}}</table>
+</section>{{end}}
+
+<section>
+<h2>Your history</h2>
+<table>
+<tr><th>When</th><th>What</th><th>Amount</th><th>Details</th></tr>
+{{range .History}}<tr><td>{{.CreatedAt.Format "Jan 2 15:04"}}</td><td>{{.Kind}}</td><td class="amount">{{.Amount}} {{.Asset}}</td><td>{{.Note}}{{if .TxHash}} <code>{{.TxHash}}</code>{{end}}</td></tr>
+{{else}}<tr><td colspan="4" class="muted">Nothing yet, tip someone with a reaction!</td></tr>
+{{end}}</table>
+</section>
+
+<section class="grid">
+<div><h2>Top tippers</h2><p class="muted">Last 30 days</p>{{template "leaderboard" .TopTippers}}</div>
+<div><h2>Most tipped</h2><p class="muted">Last 30 days</p>{{template "leaderboard" .TopTipped}}</div>
+</section>
+
+<section>
+<h2>Tipping volume</h2>
+<h3>Per day</h3>
+{{template "chart" .Daily}}
+<h3>Per week</h3>
+{{template "chart" .Weekly}}
+</section>
+</body>
+</html>
+{{end}}
+`
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadSession(t *testing.T) {
+	config := dashboardConfig{SessionSecret: strings.Repeat("s", 32)}
+	valid := dashboardSession{UserID: "U1", Name: "alice", Expires: time.Now().Add(time.Hour).Unix()}
+	signed := signSession(valid, config.SessionSecret)
+	parts := strings.SplitN(signed, ".", 2)
+	// signedPayload signs a raw payload as a session would be
+	signedPayload := func(payload string) string {
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+		return encoded + "." + sessionMAC(encoded, config.SessionSecret)
+	}
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"u":"U0","n":"admin","e":9999999999}`))
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   string
+	}{
+		{"valid", signed, "U1"},
+		{"expired", signSession(dashboardSession{UserID: "U1", Expires: time.Now().Add(-time.Second).Unix()}, config.SessionSecret), ""},
+		{"other secret", signSession(valid, strings.Repeat("t", 32)), ""},
+		{"forged payload", forged + "." + parts[1], ""},
+		{"forged signature", parts[0] + "." + sessionMAC(parts[0], ""), ""},
+		{"truncated signature", parts[0] + "." + parts[1][:len(parts[1])-1], ""},
+		{"unsigned", parts[0], ""},
+		{"empty", "", ""},
+		{"no user", signSession(dashboardSession{Expires: valid.Expires}, config.SessionSecret), ""},
+		{"no expiry", signedPayload(`{"u":"U1"}`), ""},
+		{"not json", signedPayload(`U1`), ""},
+		{"not base64", "!!." + sessionMAC("!!", config.SessionSecret), ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/dashboard/", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: test.cookie})
+		session := readSession(r, config)
+		got := ""
+		if session != nil {
+			got = session.UserID
+		}
+		if got != test.want {
+			t.Errorf("%s: session of %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if session := readSession(httptest.NewRequest("GET", "/dashboard/", nil), config); session != nil {
+		t.Errorf("read %+v without a cookie", session)
+	}
+	r := httptest.NewRequest("GET", "/dashboard/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: signed})
+	if session := readSession(r, config); session == nil || *session != valid {
+		t.Errorf("read %+v, want %+v", session, valid)
+	}
+}
+
+func TestDashboardSignIn(t *testing.T) {
+	c := &config{}
+	c.Dashboard = dashboardConfig{URL: "https://tiperc20.example.com", ClientID: "id", ClientSecret: "secret", SessionSecret: strings.Repeat("s", 32)}
+	currentConfig.Store(c)
+	t.Cleanup(func() { currentConfig.Store(&config{}) })
+	handler := dashboardHandler(testSlack(t))
+
+	// signing in starts with a state that the callback has to return
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/dashboard/login", nil))
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "https://slack.com/oauth/authorize?") {
+		t.Fatalf("sign in answered %d %s", w.Code, w.Header().Get("Location"))
+	}
+	var state *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oauthStateCookie {
+			state = cookie
+		}
+	}
+	if state == nil || !state.HttpOnly || !state.Secure || len(state.Value) != 32 {
+		t.Fatalf("state cookie is %+v", state)
+	}
+	if !strings.Contains(w.Header().Get("Location"), "state="+state.Value) {
+		t.Errorf("Slack isn't sent the state: %s", w.Header().Get("Location"))
+	}
+
+	for _, returned := range []string{"", strings.Repeat("0", 32)} {
+		r := httptest.NewRequest("GET", "/dashboard/oauth?code=c&state="+returned, nil)
+		r.AddCookie(state)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("a callback with state %q answered %d", returned, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/dashboard/logout", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("signing out with GET answered %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/dashboard/logout", nil))
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusSeeOther || len(cookies) != 1 || cookies[0].Name != sessionCookie || cookies[0].MaxAge >= 0 {
+		t.Errorf("signing out answered %d with %+v", w.Code, cookies)
+	}
+
+	// without a session the sign in page is shown
+	r := httptest.NewRequest("GET", "/dashboard/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: signSession(dashboardSession{UserID: "U1", Expires: 1}, c.Dashboard.SessionSecret)})
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Sign in with Slack") {
+		t.Errorf("an expired session answered %d: %s", w.Code, w.Body)
+	}
+}
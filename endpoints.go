@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// defaultMaxHeadLag is how many blocks an RPC endpoint may be behind the
+// others of its chain before it is failed over from.
+const defaultMaxHeadLag = 10
+
+// endpointRetryAfter is how long a failed RPC endpoint is skipped before it
+// is tried again, unless a health check finds it working earlier.
+const endpointRetryAfter = time.Minute
+
+// rpcEndpoint is one RPC endpoint of a chain, over HTTP, WebSocket or IPC,
+// with its long-lived connection.
+type rpcEndpoint struct {
+	url   string
+	label string
+
+	mu       sync.Mutex
+	client   *rpc.Client
+	conn     *ethclient.Client
+	chainID  *big.Int
+	head     uint64
+	err      string
+	failedAt time.Time
+}
+
+func newEndpoints(urls []string) []*rpcEndpoint {
+	endpoints := make([]*rpcEndpoint, len(urls))
+	for i, u := range urls {
+		endpoints[i] = &rpcEndpoint{url: u, label: endpointLabel(u)}
+	}
+	return endpoints
+}
+
+// endpointLabel names an endpoint in logs and metrics without the API key
+// that providers put in the path of their URLs.
+func endpointLabel(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return "ipc"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// connect returns the connection of e, dialing it when there is none.
+func (e *rpcEndpoint) connect() (*ethclient.Client, *rpc.Client, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.client == nil {
+		client, err := rpc.Dial(e.url)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.client, e.conn = client, ethclient.NewClient(client)
+	}
+	return e.conn, e.client, nil
+}
+
+// usable reports whether e is healthy or failed long enough ago to retry.
+func (e *rpcEndpoint) usable() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.err == "" || time.Since(e.failedAt) > endpointRetryAfter
+}
+
+// fail takes e out of rotation for reason. Broken connections are closed so
+// that the next use dials afresh, while lagging ones are kept.
+func (e *rpcEndpoint) fail(reason string, disconnect bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.err, e.failedAt = reason, time.Now()
+	if disconnect && e.client != nil {
+		e.client.Close()
+		e.client, e.conn = nil, nil
+	}
+}
+
+func (e *rpcEndpoint) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.client != nil {
+		e.client.Close()
+		e.client, e.conn = nil, nil
+	}
+}
+
+// chainBackend is what sending and settling withdrawals needs of a node: the
+// connection of the chain's active endpoint, or a simulated chain in tests.
+type chainBackend interface {
+	bind.ContractBackend
+	TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+}
+
+// backend returns the connection that transactions of c are sent and looked
+// up through.
+func (c *chain) backend() (chainBackend, error) {
+	if c.simulated != nil {
+		return c.simulated, nil
+	}
+	conn, _, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial returns the shared connection of the chain's active RPC endpoint,
+// failing over to the next usable endpoint in configured order when it
+// can't be reached.
+func (c *chain) dial() (conn *ethclient.Client, client *rpc.Client, err error) {
+	c.endpointMu.Lock()
+	active := c.active
+	c.endpointMu.Unlock()
+
+	for i := range c.endpoints {
+		index := (active + i) % len(c.endpoints)
+		e := c.endpoints[index]
+		if !e.usable() {
+			continue
+		}
+		conn, client, err = e.connect()
+		if err != nil {
+			e.fail(err.Error(), true)
+			rpcEndpointUp.WithLabelValues(c.Name, e.label).Set(0)
+			logWarn(context.Background(), "Failed to connect to RPC endpoint", logFields{"chain": c.Name, "endpoint": e.label, "error": err})
+			continue
+		}
+		c.setActive(index)
+		return conn, client, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("every endpoint failed in the last %s", endpointRetryAfter)
+	}
+	return nil, nil, fmt.Errorf("no reachable RPC endpoint on %s: %v", c.Name, err)
+}
+
+func (c *chain) setActive(index int) {
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+
+	if c.active != index {
+		logWarn(context.Background(), "Failing over to RPC endpoint", logFields{"chain": c.Name, "from": c.endpoints[c.active].label, "to": c.endpoints[index].label})
+		c.active = index
+	}
+}
+
+// rpcFailed fails over from the active endpoint when err means the endpoint
+// itself is broken, rather than the call being rejected by the node.
+func (c *chain) rpcFailed(err error) {
+	if !isEndpointError(err) {
+		return
+	}
+
+	c.endpointMu.Lock()
+	e := c.endpoints[c.active]
+	next := (c.active + 1) % len(c.endpoints)
+	c.endpointMu.Unlock()
+
+	e.fail(err.Error(), true)
+	rpcEndpointUp.WithLabelValues(c.Name, e.label).Set(0)
+	logWarn(context.Background(), "RPC endpoint failed", logFields{"chain": c.Name, "endpoint": e.label, "error": err})
+	if len(c.endpoints) > 1 {
+		c.setActive(next)
+	}
+}
+
+var httpStatusPattern = regexp.MustCompile(`^[45]\d\d `)
+
+// isEndpointError tells transport failures, timeouts and HTTP errors such as
+// exhausted quotas apart from errors the node answered with.
+func isEndpointError(err error) bool {
+	if err == nil || err == ethereum.NotFound || err == context.Canceled {
+		return false
+	}
+	if _, ok := err.(interface{ ErrorCode() int }); ok {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// go-ethereum 1.7 reads the body of an HTTP error, such as a 503 page or
+	// an exhausted quota, as the answer, which then isn't JSON
+	if _, ok := err.(*json.SyntaxError); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == context.DeadlineExceeded ||
+		err == rpc.ErrClientQuit || httpStatusPattern.MatchString(err.Error())
+}
+
+// checkEndpoints probes every RPC endpoint of c, reconnecting the broken
+// ones, and makes the first healthy endpoint in configured order the active
+// one. Endpoints on the wrong network or too many blocks behind the best one
+// are failed.
+func (c *chain) checkEndpoints(ctx context.Context) {
+	heads := make([]uint64, len(c.endpoints))
+	reachable := make([]bool, len(c.endpoints))
+	var best uint64
+	for i, e := range c.endpoints {
+		head, err := c.probeEndpoint(ctx, e)
+		if err != nil {
+			e.fail(err.Error(), true)
+			rpcEndpointUp.WithLabelValues(c.Name, e.label).Set(0)
+			logWarn(ctx, "RPC endpoint unhealthy", logFields{"chain": c.Name, "endpoint": e.label, "error": err})
+			continue
+		}
+		heads[i], reachable[i] = head, true
+		if head > best {
+			best = head
+		}
+	}
+
+	healthy := -1
+	for i, e := range c.endpoints {
+		if !reachable[i] {
+			continue
+		}
+		rpcEndpointHead.WithLabelValues(c.Name, e.label).Set(float64(heads[i]))
+		if lag := best - heads[i]; lag > c.maxHeadLag {
+			e.fail(fmt.Sprintf("%d blocks behind", lag), false)
+			rpcEndpointUp.WithLabelValues(c.Name, e.label).Set(0)
+			logWarn(ctx, "RPC endpoint lagging", logFields{"chain": c.Name, "endpoint": e.label, "lag": lag})
+			continue
+		}
+
+		e.mu.Lock()
+		e.err = ""
+		e.mu.Unlock()
+		rpcEndpointUp.WithLabelValues(c.Name, e.label).Set(1)
+		if healthy < 0 {
+			healthy = i
+		}
+	}
+	if healthy >= 0 {
+		c.setActive(healthy)
+	}
+}
+
+// probeEndpoint reads the head of e, and the first time its chain ID, which
+// must be the one transactions of c are signed for. The network ID isn't
+// checked, since chains such as Ethereum Classic share it with others.
+func (c *chain) probeEndpoint(ctx context.Context, e *rpcEndpoint) (uint64, error) {
+	conn, client, err := e.connect()
+	if err != nil {
+		return 0, err
+	}
+
+	e.mu.Lock()
+	chainID := e.chainID
+	e.mu.Unlock()
+	if chainID == nil && c.ChainID != 0 {
+		var result hexutil.Big
+		if err := client.CallContext(ctx, &result, "eth_chainId"); err != nil {
+			return 0, fmt.Errorf("can't read the chain ID: %v", err)
+		}
+		chainID = result.ToInt()
+		e.mu.Lock()
+		e.chainID = chainID
+		e.mu.Unlock()
+	}
+	if c.ChainID != 0 && chainID.Int64() != c.ChainID {
+		return 0, fmt.Errorf("on chain %s instead of %d", chainID, c.ChainID)
+	}
+
+	head, err := conn.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	e.mu.Lock()
+	e.head = head.Number.Uint64()
+	e.mu.Unlock()
+	return head.Number.Uint64(), nil
+}
+
+// closeEndpoints closes the connections of every chain.
+func closeEndpoints() {
+	for _, c := range chains {
+		for _, e := range c.endpoints {
+			e.close()
+		}
+	}
+}
+
+// tokenInfo is the metadata of a chain's token, which never changes and is
+// read once.
+type tokenInfo struct {
+	Name     string
+	Symbol   string
+	Decimals uint8
+}
+
+// token returns the metadata of the token of c, cached after the first read.
+func (c *chain) token(ctx context.Context) (*tokenInfo, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.tokenInfo != nil {
+		return c.tokenInfo, nil
+	}
+
+	conn, _, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	token, err := NewToken(common.HexToAddress(c.TokenAddress), conn)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &bind.CallOpts{Context: ctx}
+	info := &tokenInfo{}
+	err = timeRPC(c, "eth_call", func() error {
+		name, err := token.Name(opts)
+		if err != nil {
+			return err
+		}
+		symbol, err := token.Symbol(opts)
+		if err != nil {
+			return err
+		}
+		decimals, err := token.Decimals(opts)
+		if err != nil {
+			return err
+		}
+		info.Name, info.Symbol, info.Decimals = strings.TrimSpace(name), strings.TrimSpace(symbol), uint8(decimals.Uint64())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.tokenInfo = info
+	return info, nil
+}
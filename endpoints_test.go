@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	ethereum "github.com/ethereum/go-ethereum"
+)
+
+// fakeNode answers eth_chainId and eth_getBlockByNumber over HTTP, or fails
+// every request with status when it is set.
+type fakeNode struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	chainID int64
+	head    uint64
+	status  int
+	calls   int
+}
+
+func newFakeNode(t *testing.T, chainID int64, head uint64) *fakeNode {
+	n := &fakeNode{chainID: chainID, head: head}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serve))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *fakeNode) set(fn func(n *fakeNode)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fn(n)
+}
+
+func (n *fakeNode) served() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls
+}
+
+func (n *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.status != 0 {
+		http.Error(w, http.StatusText(n.status), n.status)
+		return
+	}
+	var req struct {
+		ID     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.calls++
+
+	var result string
+	switch req.Method {
+	case "eth_chainId":
+		result = fmt.Sprintf(`"0x%x"`, n.chainID)
+	case "eth_getBlockByNumber":
+		hash := `"0x` + strings.Repeat("0", 64) + `"`
+		result = fmt.Sprintf(`{"parentHash":%s,"sha3Uncles":%s,"miner":"0x%s","stateRoot":%s,"transactionsRoot":%s,"receiptsRoot":%s,`+
+			`"logsBloom":"0x%s","difficulty":"0x1","number":"0x%x","gasLimit":"0x1","gasUsed":"0x0","timestamp":"0x0","extraData":"0x",`+
+			`"mixHash":%s,"nonce":"0x0000000000000000"}`, hash, hash, strings.Repeat("0", 40), hash, hash, hash, strings.Repeat("0", 512), n.head, hash)
+	default:
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"error":{"code":-32601,"message":"the method %s does not exist"}}`, req.ID, req.Method)
+		return
+	}
+	fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":%s}`, req.ID, result)
+}
+
+// testEndpointChain returns a chain with an endpoint for each node.
+func testEndpointChain(chainID int64, nodes ...*fakeNode) *chain {
+	urls := make([]string, len(nodes))
+	for i, n := range nodes {
+		urls[i] = n.URL
+	}
+	return &chain{Name: "test", ChainID: chainID, endpoints: newEndpoints(urls), maxHeadLag: defaultMaxHeadLag}
+}
+
+// readHead reads the head of c through its active endpoint, failing over as
+// the bot's calls do.
+func readHead(c *chain) error {
+	conn, _, err := c.dial()
+	if err != nil {
+		return err
+	}
+	_, err = conn.HeaderByNumber(context.Background(), nil)
+	c.rpcFailed(err)
+	return err
+}
+
+func (c *chain) activeEndpoint() int {
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+	return c.active
+}
+
+func TestEndpointFailover(t *testing.T) {
+	a, b := newFakeNode(t, 1, 100), newFakeNode(t, 1, 100)
+	c := testEndpointChain(0, a, b)
+	defer func() {
+		for _, e := range c.endpoints {
+			e.close()
+		}
+	}()
+
+	if err := readHead(c); err != nil || c.activeEndpoint() != 0 || a.served() != 1 {
+		t.Fatalf("read through endpoint %d, %d calls: %v", c.activeEndpoint(), a.served(), err)
+	}
+
+	// an HTTP error, as from a proxy or an exhausted quota
+	a.set(func(n *fakeNode) { n.status = http.StatusServiceUnavailable })
+	if err := readHead(c); err == nil {
+		t.Fatal("read through a failing endpoint")
+	}
+	if c.activeEndpoint() != 1 {
+		t.Fatalf("endpoint %d is active after the first one failed", c.activeEndpoint())
+	}
+	if err := readHead(c); err != nil || b.served() != 1 {
+		t.Fatalf("read through the second endpoint, %d calls: %v", b.served(), err)
+	}
+
+	// the failed endpoint is skipped until a health check finds it working
+	a.set(func(n *fakeNode) { n.status = 0 })
+	if err := readHead(c); err != nil || c.activeEndpoint() != 1 || a.served() != 1 {
+		t.Errorf("went back to the failed endpoint before checking it: %v", err)
+	}
+	c.checkEndpoints(context.Background())
+	if c.activeEndpoint() != 0 {
+		t.Errorf("endpoint %d is active after the first one recovered", c.activeEndpoint())
+	}
+
+	// a node answering with an error is not an endpoint failure
+	_, client, err := c.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var syncing bool
+	err = client.Call(&syncing, "eth_syncing")
+	c.rpcFailed(err)
+	if err == nil || c.activeEndpoint() != 0 {
+		t.Errorf("failed over on an error the node answered with")
+	}
+
+	// an unreachable endpoint, and then every endpoint failing
+	a.Close()
+	if err := readHead(c); err == nil || c.activeEndpoint() != 1 {
+		t.Fatalf("endpoint %d is active after the first one went away: %v", c.activeEndpoint(), err)
+	}
+	b.set(func(n *fakeNode) { n.status = http.StatusTooManyRequests })
+	readHead(c)
+	if err := readHead(c); err == nil || !strings.Contains(err.Error(), "no reachable RPC endpoint on test") {
+		t.Errorf("with every endpoint failed: %v", err)
+	}
+}
+
+func TestCheckEndpoints(t *testing.T) {
+	other, behind, best := newFakeNode(t, 5, 100), newFakeNode(t, 1, 80), newFakeNode(t, 1, 100)
+	c := testEndpointChain(1, other, behind, best)
+	defer func() {
+		for _, e := range c.endpoints {
+			e.close()
+		}
+	}()
+
+	c.checkEndpoints(context.Background())
+	if c.activeEndpoint() != 2 {
+		t.Errorf("endpoint %d is active, want the only healthy one", c.activeEndpoint())
+	}
+	for i, want := range []string{"on chain 5 instead of 1", "20 blocks behind", ""} {
+		if got := c.endpoints[i].err; got != want {
+			t.Errorf("endpoint %d failed with %q, want %q", i, got, want)
+		}
+	}
+
+	behind.set(func(n *fakeNode) { n.head = 95 })
+	c.checkEndpoints(context.Background())
+	if c.activeEndpoint() != 1 || c.endpoints[1].err != "" {
+		t.Errorf("endpoint %d is active after the second one caught up", c.activeEndpoint())
+	}
+}
+
+// rpcError is an error a node answered with.
+type rpcError struct{}
+
+func (rpcError) Error() string  { return "execution reverted" }
+func (rpcError) ErrorCode() int { return -32000 }
+
+func TestIsEndpointError(t *testing.T) {
+	var syntax error = &json.SyntaxError{}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{ethereum.NotFound, false},
+		{context.Canceled, false},
+		{rpcError{}, false},
+		{errors.New("insufficient funds for gas * price + value"), false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{context.DeadlineExceeded, true},
+		{errors.New("429 Too Many Requests"), true},
+		{errors.New("503 Service Unavailable: try later"), true},
+		{syntax, true},
+	}
+	for _, test := range tests {
+		if got := isEndpointError(test.err); got != test.want {
+			t.Errorf("%v: %v, want %v", test.err, got, test.want)
+		}
+	}
+}
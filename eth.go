@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// gas needed by a plain value transfer
+var etherTransferGas = big.NewInt(21000)
+
+var weiPerEther = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+// gasQuote is the maximum a transaction may cost in gas, fixed before the
+// transaction is sent so that the user can be charged exactly that.
+type gasQuote struct {
+	GasLimit *big.Int
+	GasPrice *big.Int
+}
+
+// Cost returns the quote in wei.
+func (q *gasQuote) Cost() *big.Int {
+	return new(big.Int).Mul(q.GasLimit, q.GasPrice)
+}
+
+// quoteTokenTransfer estimates the gas of an ERC20 transfer from the hot
+// wallet of c.
+func quoteTokenTransfer(c *chain, address string, amount *big.Int) (*gasQuote, error) {
+	conn, err := c.backend()
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := c.hotWalletAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := abi.JSON(strings.NewReader(TokenABI))
+	if err != nil {
+		return nil, err
+	}
+	var input []byte
+	if c.treasuryMode() {
+		input, err = parsed.Pack("transferFrom", common.HexToAddress(c.TreasuryAddress), common.HexToAddress(address), amount)
+	} else {
+		input, err = parsed.Pack("transfer", common.HexToAddress(address), amount)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	to := common.HexToAddress(c.TokenAddress)
+	gasLimit, err := conn.EstimateGas(ctx, ethereum.CallMsg{From: from, To: &to, Data: input})
+	if err != nil {
+		return nil, err
+	}
+	gasPrice, err := c.suggestGasPrice(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gasQuote{GasLimit: gasLimit, GasPrice: gasPrice}, nil
+}
+
+// quoteEtherTransfer prices a plain value transfer on c.
+func quoteEtherTransfer(c *chain) (*gasQuote, error) {
+	conn, err := c.backend()
+	if err != nil {
+		return nil, err
+	}
+
+	gasPrice, err := c.suggestGasPrice(context.Background(), conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gasQuote{GasLimit: new(big.Int).Set(etherTransferGas), GasPrice: gasPrice}, nil
+}
+
+// gasFeeInToken converts a fee in wei into token units at
+// GAS_FEE_TOKEN_RATE tokens per ether, rounding up.
+func gasFeeInToken(feeWei *big.Int) (*big.Int, error) {
+	tokenRate := runtimeConfig().GasFee.TokenRate
+	rate, ok := new(big.Int).SetString(tokenRate, 10)
+	if !ok || rate.Sign() <= 0 {
+		return nil, fmt.Errorf("Invalid GAS_FEE_TOKEN_RATE %q", tokenRate)
+	}
+
+	fee := new(big.Int).Mul(feeWei, rate)
+	fee.Add(fee, new(big.Int).Sub(weiPerEther, big.NewInt(1)))
+	return fee.Div(fee, weiPerEther), nil
+}
+
+// sendEtherTo transfers the ether of w to its address on c, storing the
+// signed transaction with w before it is broadcast.
+func sendEtherTo(ctx context.Context, c *chain, w *withdrawal, quote *gasQuote) (tx *types.Transaction, err error) {
+	conn, err := c.backend()
+	if err != nil {
+		logError(ctx, "Failed to connect to the Ethereum client", logFields{"chain": c.Name, "error": err})
+		return
+	}
+
+	auth, err := c.transactor()
+	if err != nil {
+		logError(ctx, "Failed to create authorized transactor", logFields{"chain": c.Name, "error": err})
+		return
+	}
+	persistSigned(ctx, auth, []*withdrawal{w})
+
+	err = c.withNonce(ctx, conn, auth.From, func(nonce uint64) error {
+		rawTx := types.NewTransaction(nonce, common.HexToAddress(w.Address), w.Amount, quote.GasLimit, quote.GasPrice, nil)
+		signed, err := auth.Signer(c.signer(), auth.From, rawTx)
+		if err != nil {
+			return err
+		}
+		tx = signed
+		return conn.SendTransaction(ctx, tx)
+	})
+	if err != nil {
+		logError(ctx, "Failed to send ether transfer", logFields{"chain": c.Name, "withdrawal": w.ID, "to": w.Address, "error": err})
+		return
+	}
+
+	logInfo(ctx, "Ether transfer pending", logFields{"chain": c.Name, "withdrawal": w.ID, "to": w.Address, "amount": formatAmount(w.Amount, etherAsset), "tx_hash": tx.Hash().Hex()})
+	return
+}
+
+// verifyEtherDeposit checks that txHash is a successful value transfer from
+// the given address to the hot wallet of c, buried under enough blocks, and
+// returns the deposited value.
+func verifyEtherDeposit(c *chain, txHash common.Hash, from string) (*big.Int, error) {
+	conn, client, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	tx, isPending, err := conn.TransactionByHash(ctx, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if isPending {
+		return nil, errors.New("That transaction is still pending, try again once it's mined")
+	}
+
+	receipt, err := conn.TransactionReceipt(ctx, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return nil, errors.New("That transaction failed")
+	}
+
+	confirmations, err := c.confirmations(ctx, conn, client, txHash)
+	if err != nil {
+		return nil, err
+	}
+	if confirmations < c.Confirmations {
+		return nil, fmt.Errorf("That transaction has %d of %d confirmations, try again later", confirmations, c.Confirmations)
+	}
+
+	hotWallet, err := c.hotWalletAddress()
+	if err != nil {
+		return nil, err
+	}
+	if tx.To() == nil || *tx.To() != hotWallet {
+		return nil, fmt.Errorf("That transaction wasn't sent to %s", hotWallet.Hex())
+	}
+
+	var signer types.Signer = types.HomesteadSigner{}
+	if tx.Protected() {
+		signer = types.NewEIP155Signer(tx.ChainId())
+	}
+	sender, err := types.Sender(signer, tx)
+	if err != nil {
+		return nil, err
+	}
+	if sender != common.HexToAddress(from) {
+		return nil, errors.New("That transaction wasn't sent from your registered address")
+	}
+
+	if tx.Value().Sign() <= 0 {
+		return nil, errors.New("That transaction has no ether in it")
+	}
+	return tx.Value(), nil
+}
+
+// chargeGasFee quotes w as an individual transfer and sets the gas fee the
+// user is charged for it. A fee in CULT comes out of the withdrawn amount, a
+// fee in ETH must be covered by the user's ETH balance.
+func chargeGasFee(c *chain, w *withdrawal) (*gasQuote, error) {
+	quote, feeAsset, fee, err := withdrawalGasFee(c, w.Address, w.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if feeAsset == tokenAsset {
+		if fee.Cmp(w.Amount) >= 0 {
+			return nil, fmt.Errorf("Your balance doesn't cover the gas fee of %s CULT", formatAmount(fee, tokenAsset))
+		}
+		w.Amount = new(big.Int).Sub(w.Amount, fee)
+	}
+	if feeAsset == etherAsset && retrieveAssetBalanceFor(w.UserID, etherAsset).Cmp(fee) < 0 {
+		return nil, fmt.Errorf("You need %s ETH to pay the gas fee of your withdrawal", formatAmount(fee, etherAsset))
+	}
+	w.Fee, w.FeeAsset = fee, feeAsset
+	return quote, nil
+}
+
+// withdrawalGasFee quotes an ERC20 withdrawal and converts its gas cost into
+// the GAS_FEE_ASSET the user is charged in. Without GAS_FEE_ASSET the quote
+// is nil and the fee is zero, leaving gas to the hot wallet.
+func withdrawalGasFee(c *chain, address string, amount *big.Int) (quote *gasQuote, feeAsset string, fee *big.Int, err error) {
+	fee = new(big.Int)
+	asset := runtimeConfig().GasFee.Asset
+	if asset == "" {
+		return
+	}
+
+	feeAsset, err = parseAsset(asset)
+	if err != nil {
+		return
+	}
+	quote, err = quoteTokenTransfer(c, address, amount)
+	if err != nil {
+		return
+	}
+
+	if feeAsset == tokenAsset {
+		fee, err = gasFeeInToken(quote.Cost())
+	} else {
+		fee = quote.Cost()
+	}
+	return
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// chainProbeInterval is how often every chain's RPC endpoints are probed.
+const chainProbeInterval = 30 * time.Second
+
+// slackReconnectGrace is how long the bot may be disconnected from Slack,
+// say while the RTM connection is reestablished, before it counts as
+// unhealthy.
+const slackReconnectGrace = 2 * time.Minute
+
+// defaultMaxBlockAge is how old the latest block of a chain may be before
+// its node counts as stuck or out of sync.
+const defaultMaxBlockAge = 5 * time.Minute
+
+// slackState tracks the RTM connection, which otherwise drops silently.
+type slackState struct {
+	mu        sync.Mutex
+	connected bool
+	since     time.Time
+}
+
+var slackConnection = &slackState{since: time.Now()}
+
+func (s *slackState) set(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if connected != s.connected {
+		s.connected = connected
+		s.since = time.Now()
+	}
+	if connected {
+		slackConnected.Set(1)
+	} else {
+		slackConnected.Set(0)
+	}
+}
+
+// check fails when the bot is not connected, or has been disconnected for
+// longer than grace.
+func (s *slackState) check(grace time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connected {
+		return nil
+	}
+	down := time.Since(s.since)
+	if down < grace {
+		return nil
+	}
+	return fmt.Errorf("disconnected for %s", down.Round(time.Second))
+}
+
+// chainStatus is the outcome of the last probe of a chain.
+type chainStatus struct {
+	Checked time.Time
+	Error   string
+	Head    uint64
+	HeadAge time.Duration
+	SyncLag uint64
+}
+
+var (
+	chainStatusMu sync.Mutex
+	chainStatuses = map[string]chainStatus{}
+)
+
+// runChainProbes probes every chain right away and then every
+// chainProbeInterval.
+func runChainProbes() {
+	for {
+		for _, name := range chainNames() {
+			probeChain(chains[name])
+		}
+		time.Sleep(chainProbeInterval)
+	}
+}
+
+// probeChain checks the RPC endpoints of c, reads the head and sync progress
+// of its active node and the balances of its hot wallet, and records them
+// for the health checks and the metrics.
+func probeChain(c *chain) {
+	status := chainStatus{Checked: time.Now()}
+	defer func() {
+		chainStatusMu.Lock()
+		chainStatuses[c.Name] = status
+		chainStatusMu.Unlock()
+
+		if status.Error != "" {
+			chainUp.WithLabelValues(c.Name).Set(0)
+			return
+		}
+		chainUp.WithLabelValues(c.Name).Set(1)
+		chainHeadAge.WithLabelValues(c.Name).Set(status.HeadAge.Seconds())
+		chainSyncLag.WithLabelValues(c.Name).Set(float64(status.SyncLag))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), chainProbeInterval/2)
+	defer cancel()
+	c.checkEndpoints(ctx)
+	if _, err := c.token(ctx); err != nil {
+		logWarn(ctx, "Failed to read token metadata", logFields{"chain": c.Name, "error": err})
+	}
+
+	conn, _, err := c.dial()
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+
+	err = timeRPC(c, "eth_getBlockByNumber", func() error {
+		head, err := conn.HeaderByNumber(ctx, nil)
+		if err == nil {
+			status.Head = head.Number.Uint64()
+			status.HeadAge = time.Since(time.Unix(head.Time.Int64(), 0))
+		}
+		return err
+	})
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+	err = timeRPC(c, "eth_syncing", func() error {
+		progress, err := conn.SyncProgress(ctx)
+		if err == nil && progress != nil && progress.HighestBlock > progress.CurrentBlock {
+			status.SyncLag = progress.HighestBlock - progress.CurrentBlock
+		}
+		return err
+	})
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+
+	for _, asset := range []string{tokenAsset, etherAsset} {
+		h := holdingOf(c, asset)
+		if h.Error != "" {
+			logWarn(context.Background(), "Failed to read the hot wallet balance", logFields{"chain": c.Name, "asset": asset, "error": h.Error})
+			continue
+		}
+		hotWalletBalance.WithLabelValues(c.Name, asset).Set(wholeUnits(h.Amount, asset))
+	}
+}
+
+// checkChain fails when the last probe of c failed or is too old, or when
+// its node is behind.
+func checkChain(c *chain) error {
+	chainStatusMu.Lock()
+	status, ok := chainStatuses[c.Name]
+	chainStatusMu.Unlock()
+
+	switch {
+	case !ok:
+		return fmt.Errorf("not probed yet")
+	case time.Since(status.Checked) > 3*chainProbeInterval:
+		return fmt.Errorf("not probed since %s", status.Checked.Format(time.RFC3339))
+	case status.Error != "":
+		return fmt.Errorf("%s", status.Error)
+	case status.SyncLag > 0:
+		return fmt.Errorf("syncing, %d blocks behind", status.SyncLag)
+	case status.HeadAge > c.maxBlockAge:
+		return fmt.Errorf("latest block %d is %s old", status.Head, status.HeadAge.Round(time.Second))
+	}
+	return nil
+}
+
+// checkDatabase fails when the database can't be reached.
+func checkDatabase() error {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Ping()
+}
+
+// healthHandler answers 200 when every check passes and 503 otherwise, with
+// the outcome of each check as JSON. Liveness only checks what a restart
+// could fix, the database and Slack connection, while readiness also needs
+// Slack connected right now and every chain reachable and in sync.
+func healthHandler(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		grace := slackReconnectGrace
+		if ready {
+			grace = 0
+		}
+		checks := map[string]error{
+			"database": checkDatabase(),
+			"slack":    slackConnection.check(grace),
+		}
+		if ready {
+			for name, c := range chains {
+				checks["chain/"+name] = checkChain(c)
+			}
+		}
+
+		status := http.StatusOK
+		results := map[string]string{}
+		for name, err := range checks {
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				results[name] = err.Error()
+			} else {
+				results[name] = "ok"
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(results)
+	}
+}
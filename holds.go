@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// withdrawalPendingApproval waits for an admin to approve or reject it.
+const withdrawalPendingApproval = "pending_approval"
+
+// withdrawalApprovalCallback is the callback ID of the Approve and Reject
+// buttons posted to the admin channel.
+const withdrawalApprovalCallback = "withdrawal_approval"
+
+// withdrawalLimits are the settings holding the velocity limits of each
+// asset, in that asset.
+var withdrawalLimits = map[string][]struct {
+	key    string
+	period time.Duration
+	name   string
+}{
+	tokenAsset: {
+		{settingWithdrawDailyLimit, 24 * time.Hour, "daily"},
+		{settingWithdrawWeeklyLimit, 7 * 24 * time.Hour, "weekly"},
+	},
+	etherAsset: {
+		{settingWithdrawDailyLimitEther, 24 * time.Hour, "daily"},
+		{settingWithdrawWeeklyLimitEther, 7 * 24 * time.Hour, "weekly"},
+	},
+}
+
+// withdrawalApprovalThresholds are the settings above which withdrawals of
+// each asset wait for an admin.
+var withdrawalApprovalThresholds = map[string]string{
+	tokenAsset: settingWithdrawApprovalThreshold,
+	etherAsset: settingWithdrawApprovalThresholdEther,
+}
+
+// checkWithdrawalHolds returns why the user can't withdraw amount of asset
+// right now, as it would exceed their velocity limits, or nil.
+func checkWithdrawalHolds(userID, asset string, amount *big.Int) error {
+	for _, l := range withdrawalLimits[asset] {
+		limit := retrieveAmountSetting(l.key)
+		if limit.Sign() == 0 {
+			continue
+		}
+		withdrawn, err := withdrawnSince(userID, asset, l.period)
+		if err != nil {
+			return err
+		}
+		if new(big.Int).Add(withdrawn, amount).Cmp(limit) > 0 {
+			return fmt.Errorf("That would exceed your %s withdrawal limit of %s %s, you already withdrew %s %s", l.name, formatAmount(limit, asset), asset, formatAmount(withdrawn, asset), asset)
+		}
+	}
+	return nil
+}
+
+// addressCooldownLeft returns how long the user still has to wait after
+// changing their registered address.
+func addressCooldownLeft(userID string) time.Duration {
+	cooldown := retrieveDurationSetting(settingAddressCooldown)
+	if cooldown <= 0 {
+		return 0
+	}
+
+	db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	defer db.Close()
+
+	var left sql.NullFloat64
+	db.QueryRow(`
+		SELECT EXTRACT(EPOCH FROM address_changed_at + $2 * interval '1 second' - now())
+		FROM accounts WHERE slack_user_id = $1 LIMIT 1;
+	`, userID, cooldown.Seconds()).Scan(&left)
+
+	if !left.Valid || left.Float64 <= 0 {
+		return 0
+	}
+	return (time.Duration(left.Float64) * time.Second).Round(time.Minute)
+}
+
+// withdrawnSince sums the user's withdrawals of asset over the last period,
+// including the ones still waiting to go out.
+func withdrawnSince(userID, asset string, period time.Duration) (*big.Int, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var sum string
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM withdrawals
+		WHERE slack_user_id = $1 AND asset = $2 AND status <> $3 AND created_at > now() - $4 * interval '1 second';
+	`, userID, asset, withdrawalFailed, period.Seconds()).Scan(&sum)
+	if err != nil {
+		return nil, err
+	}
+	withdrawn, _ := new(big.Int).SetString(sum, 10)
+	return withdrawn, nil
+}
+
+// withdrawalApprovalReason returns why a withdrawal of amount of asset by the
+// user has to be approved by an admin, as the user changed their address
+// within the cooldown or the amount reaches the approval threshold, or "".
+func withdrawalApprovalReason(userID, asset string, amount *big.Int) string {
+	if addressCooldownLeft(userID) > 0 {
+		return "the address was changed recently"
+	}
+	key, ok := withdrawalApprovalThresholds[asset]
+	if !ok {
+		return ""
+	}
+	if threshold := retrieveAmountSetting(key); threshold.Sign() > 0 && amount.Cmp(threshold) >= 0 {
+		return fmt.Sprintf("it is %s %s or more", formatAmount(threshold, asset), asset)
+	}
+	return ""
+}
+
+// requestWithdrawalApproval debits the user's balance, holds w until an admin
+// reviews it and posts the Approve and Reject buttons to the admin channel
+// along with why it needs approval.
+func requestWithdrawalApproval(ctx context.Context, api *slack.Client, w *withdrawal, reason string) error {
+	w.Status = withdrawalPendingApproval
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		return debitWithdrawal(tx, w)
+	})
+	if err != nil {
+		return err
+	}
+	logInfo(ctx, "Withdrawal held for approval", logFields{"withdrawal": w.ID, "user": w.UserID, "chain": w.Chain, "amount": formatAmount(w.Amount, w.Asset), "asset": w.Asset})
+
+	text := fmt.Sprintf(":raised_hand: <@%s> wants to withdraw %s %s on %s to `%s` (withdrawal %d), which needs approval because %s", w.UserID, formatAmount(w.Amount, w.Asset), w.Asset, w.Chain, w.Address, w.ID, reason)
+	channel := runtimeConfig().Slack.AdminChannel
+	if channel == "" {
+		alertAdmins(api, text+fmt.Sprintf(", use `admin approve %d` or `admin reject %d`", w.ID, w.ID))
+		return nil
+	}
+
+	id := strconv.FormatInt(w.ID, 10)
+	params := slack.PostMessageParameters{
+		Attachments: []slack.Attachment{{
+			Fallback:   fmt.Sprintf("Use `admin approve %d` or `admin reject %d`", w.ID, w.ID),
+			CallbackID: withdrawalApprovalCallback,
+			Actions: []slack.AttachmentAction{
+				{Name: "approve", Text: "Approve", Style: "primary", Type: "button", Value: id},
+				{Name: "reject", Text: "Reject", Style: "danger", Type: "button", Value: id},
+			},
+		}},
+	}
+	if _, _, err := api.PostMessage(channel, text, params); err != nil {
+		logWarn(ctx, "Failed to post withdrawal approval request", logFields{"withdrawal": w.ID, "error": err})
+	}
+	return nil
+}
+
+// reviewWithdrawal approves or rejects a withdrawal pending approval. An
+// approved withdrawal is queued for its chain, a rejected one is refunded.
+func reviewWithdrawal(ctx context.Context, api *slack.Client, id int64, approve bool, admin, event string) (*withdrawal, error) {
+	found, err := queryWithdrawals(`WHERE id = $1;`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("There is no withdrawal %d", id)
+	}
+	w := found[0]
+	if w.UserID == admin {
+		return nil, fmt.Errorf("You can't review your own withdrawal")
+	}
+	c, err := lookupChain(w.Chain)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := "rejected"
+	if approve {
+		decision = "approved"
+	}
+
+	err = withLedgerTx(ctx, func(tx *sql.Tx) error {
+		var status string
+		err := tx.QueryRow(`
+			SELECT status FROM withdrawals WHERE id = $1 FOR UPDATE;
+		`, id).Scan(&status)
+		if err != nil {
+			return err
+		}
+		if status != withdrawalPendingApproval {
+			return fmt.Errorf("Withdrawal %d was already reviewed", id)
+		}
+
+		if approve {
+			err = markWithdrawals(tx, []int64{id}, withdrawalQueued, "", "")
+		} else {
+			err = adjustBalance(tx, ledgerEntry{UserID: w.UserID, Asset: w.Asset, Kind: kindRefund, Amount: w.Amount, Chain: w.Chain})
+			if err == nil && w.Fee != nil && w.Fee.Sign() > 0 {
+				err = adjustBalance(tx, ledgerEntry{UserID: w.UserID, Asset: w.FeeAsset, Kind: kindRefund, Amount: w.Fee, Chain: w.Chain})
+			}
+			if err == nil {
+				err = markWithdrawals(tx, []int64{id}, withdrawalFailed, "", "rejected by an admin")
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE withdrawals SET reviewed_by = $2 WHERE id = $1;
+		`, id, admin)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, auditRecord{Actor: admin, Action: "withdrawal_review", Subject: fmt.Sprintf("withdrawal %d", id), Before: withdrawalPendingApproval, After: decision, Event: event})
+	})
+	if err != nil {
+		return nil, err
+	}
+	logInfo(ctx, "Reviewed withdrawal", logFields{"withdrawal": id, "admin": admin, "decision": decision})
+
+	if !approve {
+		sendSlackMessage(api, w.UserID, fmt.Sprintf(":x: Your withdrawal of %s %s was rejected by an admin and refunded", formatAmount(w.Amount, w.Asset), w.Asset))
+		return w, nil
+	}
+
+	// queued CULT withdrawals are picked up by the batcher when the chain
+	// batches, otherwise they are paid right away. ETH is never batched.
+	w.Status = withdrawalQueued
+	if withdrawalsPaused() {
+		sendSlackMessage(api, w.UserID, fmt.Sprintf(":hourglass: Your withdrawal of %s %s on %s was approved and goes out once an admin resumes withdrawals", formatAmount(w.Amount, w.Asset), w.Asset, c.Name))
+	} else if !batchingEnabled(c) || w.Asset != tokenAsset {
+		// a shutdown leaves the withdrawal queued for the next start. The
+		// payout outlives the command or request that approved it, so it runs
+		// in a context of its own.
+		if beginWork() {
+			go func() {
+				defer endWork()
+				payCtx := correlatedContext()
+				logInfo(payCtx, "Paying approved withdrawal", logFields{"withdrawal": w.ID, "review_correlation_id": correlationID(ctx)})
+				payWithdrawalsIndividually(payCtx, api, c, []*withdrawal{w})
+			}()
+		}
+	} else {
+		sendSlackMessage(api, w.UserID, fmt.Sprintf(":hourglass: Your withdrawal of %s CULT on %s was approved and goes out with the next batch", formatAmount(w.Amount, w.Asset), c.Name))
+	}
+	return w, nil
+}
+
+func handleAdminReviewCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, idArg string, approve bool) {
+	id, err := strconv.ParseInt(idArg, 10, 64)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":thonk: That isn't a withdrawal number")
+		return
+	}
+
+	w, err := reviewWithdrawal(ctx, api, id, approve, ev.User, slackEventRef(ev))
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	sendSlackMessage(api, ev.Channel, describeReview(w, ev.User, approve))
+}
+
+func describeReview(w *withdrawal, admin string, approve bool) string {
+	if approve {
+		return fmt.Sprintf(":white_check_mark: <@%s> approved the withdrawal of %s %s by <@%s>", admin, formatAmount(w.Amount, w.Asset), w.Asset, w.UserID)
+	}
+	return fmt.Sprintf(":no_entry_sign: <@%s> rejected the withdrawal of %s %s by <@%s>", admin, formatAmount(w.Amount, w.Asset), w.Asset, w.UserID)
+}
+
+// slackActionsHandler receives the clicks on the Approve and Reject buttons
+// and replaces the buttons with the decision.
+func slackActionsHandler(api *slack.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !beginWork() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer endWork()
+
+		var callback slack.AttachmentActionCallback
+		if err := json.Unmarshal([]byte(r.FormValue("payload")), &callback); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+		if slackVerificationToken == "" || callback.Token != slackVerificationToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if callback.CallbackID != withdrawalApprovalCallback || len(callback.Actions) != 1 {
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+
+		respond := func(text string, replace bool) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"text": text, "replace_original": replace})
+		}
+
+		if !isAdmin(api, callback.User.ID) {
+			respond(":no_entry: Only admins can do that", false)
+			return
+		}
+
+		action := callback.Actions[0]
+		id, err := strconv.ParseInt(action.Value, 10, 64)
+		if err != nil {
+			http.Error(w, "bad withdrawal", http.StatusBadRequest)
+			return
+		}
+
+		// the request's context ends with the response, while an approved
+		// withdrawal is paid after it
+		ctx := correlatedContext()
+		approve := action.Name == "approve"
+		logInfo(ctx, "Slack action", logFields{"action": action.Name, "withdrawal": id, "user": callback.User.ID})
+		withdrawal, err := reviewWithdrawal(ctx, api, id, approve, callback.User.ID, callback.Channel.ID+"/"+callback.ActionTs)
+		if err != nil {
+			respond(":x: "+err.Error(), false)
+			return
+		}
+		respond(describeReview(withdrawal, callback.User.ID, approve), true)
+	}
+}
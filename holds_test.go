@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWithdrawalApprovalReason(t *testing.T) {
+	testDatabase(t)
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		INSERT INTO accounts (slack_user_id, ethereum_address, address_changed_at) VALUES
+			('U1', '0x01', now() - interval '1 hour'),
+			('U2', '0x02', now() - interval '2 days'),
+			('U3', '0x03', NULL);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	threshold := map[string]string{settingWithdrawApprovalThreshold: "1000"}
+	tests := []struct {
+		name     string
+		settings map[string]string
+		user     string
+		asset    string
+		amount   string
+		want     string
+	}{
+		{"address changed", threshold, "U1", tokenAsset, "1", "the address was changed recently"},
+		{"address changed, ETH", threshold, "U1", etherAsset, "0.1", "the address was changed recently"},
+		{"no cooldown", map[string]string{settingAddressCooldown: "0s"}, "U1", tokenAsset, "1", ""},
+		{"longer cooldown", map[string]string{settingAddressCooldown: "72h"}, "U2", tokenAsset, "1", "the address was changed recently"},
+		{"address changed long ago", threshold, "U2", tokenAsset, "999", ""},
+		{"address never changed", threshold, "U3", tokenAsset, "999", ""},
+		{"threshold", threshold, "U2", tokenAsset, "1000", "it is 1000 CULT or more"},
+		{"above threshold", threshold, "U3", tokenAsset, "5000", "it is 1000 CULT or more"},
+		{"no threshold", nil, "U3", tokenAsset, "5000", ""},
+		{"ETH threshold", map[string]string{settingWithdrawApprovalThresholdEther: "0.5"}, "U3", etherAsset, "0.5", "it is 0.5 ETH or more"},
+		{"below ETH threshold", map[string]string{settingWithdrawApprovalThresholdEther: "0.5"}, "U3", etherAsset, "0.4", ""},
+	}
+	for _, test := range tests {
+		currentConfig.Store(&config{Settings: test.settings})
+		amount, err := parseAmount(test.amount, test.asset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := withdrawalApprovalReason(test.user, test.asset, amount); got != test.want {
+			t.Errorf("%s: reason %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckWithdrawalHolds(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	currentConfig.Store(&config{Settings: map[string]string{settingWithdrawDailyLimit: "500", settingWithdrawWeeklyLimit: "700"}})
+
+	items := queueTestWithdrawals(t, tc.chain, nil, 300, 100)
+	if err := checkWithdrawalHolds("U1", tokenAsset, big.NewInt(100)); err != nil {
+		t.Errorf("500 of a daily 500: %v", err)
+	}
+	if err := checkWithdrawalHolds("U1", tokenAsset, big.NewInt(101)); err == nil || !strings.Contains(err.Error(), "daily withdrawal limit of 500 CULT, you already withdrew 400 CULT") {
+		t.Errorf("501 of a daily 500: %v", err)
+	}
+	if err := checkWithdrawalHolds("U2", tokenAsset, big.NewInt(500)); err != nil {
+		t.Errorf("the withdrawals of U1 held U2: %v", err)
+	}
+	if err := checkWithdrawalHolds("U1", etherAsset, weiPerEther); err != nil {
+		t.Errorf("CULT withdrawals held ETH: %v", err)
+	}
+
+	// failed withdrawals don't count, older ones only against the week
+	if err := setWithdrawalStatus(context.Background(), []int64{items[1].ID}, withdrawalFailed, "", "test"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`UPDATE withdrawals SET created_at = now() - interval '2 days' WHERE id = $1;`, items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWithdrawalHolds("U1", tokenAsset, big.NewInt(400)); err != nil {
+		t.Errorf("400 after a failed withdrawal and one 2 days ago: %v", err)
+	}
+	if err := checkWithdrawalHolds("U1", tokenAsset, big.NewInt(401)); err == nil || !strings.Contains(err.Error(), "weekly withdrawal limit of 700 CULT, you already withdrew 300 CULT") {
+		t.Errorf("701 of a weekly 700: %v", err)
+	}
+}
+
+func TestReviewWithdrawal(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	tc.mine(t)
+	api := testSlack(t)
+	ctx := context.Background()
+
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		return adjustBalance(tx, ledgerEntry{UserID: "U1", Asset: tokenAsset, Kind: kindAdminCredit, Amount: big.NewInt(1000)})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(amount int64, address common.Address) *withdrawal {
+		w := &withdrawal{UserID: "U1", Chain: tc.Name, Asset: tokenAsset, Address: address.Hex(), Amount: big.NewInt(amount)}
+		if err := requestWithdrawalApproval(ctx, api, w, "it is 100 CULT or more"); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	approved, rejected := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	items := []*withdrawal{request(600, approved), request(300, rejected)}
+	for _, w := range loadTestWithdrawals(t, items) {
+		if w.Status != withdrawalPendingApproval {
+			t.Errorf("withdrawal %d is %s, want %s", w.ID, w.Status, withdrawalPendingApproval)
+		}
+	}
+	if balance := retrieveAssetBalanceFor("U1", tokenAsset); balance.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("balance is %v while both wait, want 100", balance)
+	}
+
+	if _, err := reviewWithdrawal(ctx, api, items[0].ID, true, "U1", ""); err == nil {
+		t.Error("U1 approved their own withdrawal")
+	}
+	if _, err := reviewWithdrawal(ctx, api, items[0].ID, true, "U0", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reviewWithdrawal(ctx, api, items[1].ID, false, "U0", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the approved withdrawal is paid in the background
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		current := loadTestWithdrawals(t, items[:1])[0]
+		inFlight.mu.Lock()
+		running := inFlight.count
+		inFlight.mu.Unlock()
+		if (current.Status == withdrawalSent || current.Status == withdrawalConfirmed) && running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the approved withdrawal is still %s", current.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// a second review, or the payout running again, pays nothing more
+	for _, approve := range []bool{true, false} {
+		if _, err := reviewWithdrawal(ctx, api, items[0].ID, approve, "U0", ""); err == nil || !strings.Contains(err.Error(), "already reviewed") {
+			t.Errorf("reviewing the approved withdrawal again: %v", err)
+		}
+	}
+	if _, err := reviewWithdrawal(ctx, api, items[1].ID, true, "U0", ""); err == nil || !strings.Contains(err.Error(), "already reviewed") {
+		t.Errorf("approving the rejected withdrawal: %v", err)
+	}
+	payWithdrawalsIndividually(ctx, api, tc.chain, items[:1])
+
+	if got := tc.tokenBalance(t, approved); got.Cmp(big.NewInt(600)) != 0 {
+		t.Errorf("the approved address got %v, want 600 once", got)
+	}
+	if got := tc.tokenBalance(t, rejected); got.Sign() != 0 {
+		t.Errorf("the rejected address got %v", got)
+	}
+	if balance := retrieveAssetBalanceFor("U1", tokenAsset); balance.Cmp(big.NewInt(400)) != 0 {
+		t.Errorf("balance is %v after the rejection, want the 300 back", balance)
+	}
+	if current := loadTestWithdrawals(t, items[1:])[0]; current.Status != withdrawalFailed {
+		t.Errorf("the rejected withdrawal is %s", current.Status)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/lib/pq"
+	"github.com/nlopes/slack"
+)
+
+// sendingStaleAfter is how long a withdrawal may be sending before the
+// recovery assumes whatever was sending it died.
+const sendingStaleAfter = 10 * time.Minute
+
+// recoveryInterval is how often withdrawals left behind by a crash are
+// resumed and sent withdrawals are settled.
+const recoveryInterval = 5 * time.Minute
+
+// States of a signed transaction on its chain, see signedTxState.
+const (
+	// txPending is known to the node but not mined yet.
+	txPending = iota
+	txMined
+	txReverted
+	// txMissing is unknown to the node and its nonce is still unused, so it
+	// can be broadcast again.
+	txMissing
+	// txReplaced is unknown to the node and another transaction took its
+	// nonce, so it can never be mined.
+	txReplaced
+)
+
+// startSending moves withdrawals that were already paid for to sending,
+// forgetting any transaction they were sent with before.
+func startSending(ctx context.Context, items []*withdrawal) error {
+	ids := withdrawalIDs(items)
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		if err := markWithdrawals(tx, ids, withdrawalSending, "", ""); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			UPDATE withdrawals SET tx_hash = NULL, raw_tx = NULL WHERE id = ANY($1);
+		`, pq.Array(ids))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, w := range items {
+		w.Status, w.TxHash, w.RawTx = withdrawalSending, "", ""
+	}
+	return nil
+}
+
+// persistSigned makes auth store every transaction it signs with items
+// before the transaction is broadcast, so that a crash right after the
+// broadcast can't lose track of it.
+func persistSigned(ctx context.Context, auth *bind.TransactOpts, items []*withdrawal) {
+	sign := auth.Signer
+	auth.Signer = func(signer types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+		signed, err := sign(signer, address, tx)
+		if err != nil {
+			return nil, err
+		}
+		if err := attachSignedTx(ctx, items, signed); err != nil {
+			return nil, err
+		}
+		return signed, nil
+	}
+}
+
+// auditSigned makes auth write every transaction it signs to the audit log
+// before the transaction is broadcast.
+func auditSigned(ctx context.Context, auth *bind.TransactOpts, action, subject, detail string) {
+	sign := auth.Signer
+	auth.Signer = func(signer types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+		signed, err := sign(signer, address, tx)
+		if err != nil {
+			return nil, err
+		}
+		err = withLedgerTx(ctx, func(dbtx *sql.Tx) error {
+			return recordAudit(dbtx, auditRecord{Actor: auditActorSystem, Action: action, Subject: subject, After: signed.Hash().Hex(), Detail: fmt.Sprintf("%s, nonce %d", detail, signed.Nonce())})
+		})
+		if err != nil {
+			return nil, err
+		}
+		return signed, nil
+	}
+}
+
+func attachSignedTx(ctx context.Context, items []*withdrawal, signed *types.Transaction) error {
+	encoded, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		return err
+	}
+	hash, raw := signed.Hash().Hex(), hex.EncodeToString(encoded)
+
+	err = withLedgerTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE withdrawals SET tx_hash = $2, raw_tx = $3, updated_at = now() WHERE id = ANY($1);
+		`, pq.Array(withdrawalIDs(items)), hash, raw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, w := range items {
+		w.TxHash, w.RawTx = hash, raw
+	}
+	return nil
+}
+
+// resolveSendingWithdrawals settles withdrawals whose sending failed or was
+// cut short. Those without a signed transaction were never broadcast and are
+// refunded for reason. Transactions the node knows about were sent. The
+// others are broadcast again, unless their nonce was already used, and
+// refunded when that fails. Withdrawals sent together are resolved together.
+func resolveSendingWithdrawals(ctx context.Context, api *slack.Client, items []*withdrawal, reason error) {
+	groups := map[string][]*withdrawal{}
+	var order []string
+	for _, w := range items {
+		if w.RawTx == "" {
+			refundWithdrawal(ctx, api, w, reason)
+			continue
+		}
+		if _, ok := groups[w.RawTx]; !ok {
+			order = append(order, w.RawTx)
+		}
+		groups[w.RawTx] = append(groups[w.RawTx], w)
+	}
+
+	for _, raw := range order {
+		group := groups[raw]
+		if err := resolveSignedTx(ctx, api, raw, group); err != nil {
+			logWarn(ctx, "Failed to resolve sending withdrawals, leaving them for later", logFields{"withdrawals": withdrawalIDs(group), "error": err})
+		}
+	}
+}
+
+var errReplaced = errors.New("its transaction was replaced")
+
+func resolveSignedTx(ctx context.Context, api *slack.Client, raw string, group []*withdrawal) error {
+	c, err := lookupChain(group[0].Chain)
+	if err != nil {
+		return err
+	}
+	signed, err := decodeRawTx(raw)
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	state, _, err := signedTxState(ctx, c, conn, signed)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case txReplaced:
+		for _, w := range group {
+			refundWithdrawal(ctx, api, w, errReplaced)
+		}
+		return nil
+	case txMissing:
+		err = timeRPC(c, "eth_sendRawTransaction", func() error { return conn.SendTransaction(ctx, signed) })
+		if err != nil {
+			for _, w := range group {
+				refundWithdrawal(ctx, api, w, err)
+			}
+			return nil
+		}
+		logInfo(ctx, "Rebroadcast withdrawal transaction", logFields{"chain": c.Name, "withdrawals": withdrawalIDs(group), "tx_hash": signed.Hash().Hex()})
+	}
+
+	status := withdrawalSent
+	if to := signed.To(); to != nil && c.DisperseAddress != "" && *to == common.HexToAddress(c.DisperseAddress) {
+		status = withdrawalBatched
+	}
+	if err := setWithdrawalStatus(ctx, withdrawalIDs(group), status, signed.Hash().Hex(), ""); err != nil {
+		return err
+	}
+	for _, w := range group {
+		message := fmt.Sprintf(":point_left: :sunglasses: :point_left: You successfully withdrew %s %s on %s at %s", formatAmount(w.Amount, w.Asset), w.Asset, c.Name, c.txLink(signed.Hash()))
+		sendSlackMessage(api, w.UserID, message)
+	}
+	return nil
+}
+
+func decodeRawTx(raw string) (*types.Transaction, error) {
+	encoded, err := hex.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	signed := new(types.Transaction)
+	if err := rlp.DecodeBytes(encoded, signed); err != nil {
+		return nil, err
+	}
+	return signed, nil
+}
+
+// signedTxState tells what became of a transaction the hot wallet of c
+// signed, along with its receipt once it was mined.
+func signedTxState(ctx context.Context, c *chain, conn chainBackend, signed *types.Transaction) (int, *types.Receipt, error) {
+	receipt, err := minedReceipt(ctx, c, conn, signed.Hash())
+	if err != nil || receipt != nil {
+		return receiptState(receipt), receipt, err
+	}
+
+	err = timeRPC(c, "eth_getTransactionByHash", func() (err error) {
+		_, _, err = conn.TransactionByHash(ctx, signed.Hash())
+		return
+	})
+	if err == nil {
+		return txPending, nil, nil
+	}
+	if err != ethereum.NotFound {
+		return 0, nil, err
+	}
+
+	from, err := types.Sender(c.signer(), signed)
+	if err != nil {
+		return 0, nil, err
+	}
+	var nonce uint64
+	err = timeRPC(c, "eth_getTransactionCount", func() (err error) {
+		nonce, err = conn.NonceAt(ctx, from, nil)
+		return
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if nonce <= signed.Nonce() {
+		return txMissing, nil, nil
+	}
+
+	// the nonce may have been taken by this very transaction, mined since
+	// its receipt was looked up
+	receipt, err = minedReceipt(ctx, c, conn, signed.Hash())
+	if err != nil || receipt != nil {
+		return receiptState(receipt), receipt, err
+	}
+	return txReplaced, nil, nil
+}
+
+// minedReceipt returns the receipt of txHash, or nil while it isn't mined.
+func minedReceipt(ctx context.Context, c *chain, conn chainBackend, txHash common.Hash) (*types.Receipt, error) {
+	var receipt *types.Receipt
+	err := timeRPC(c, "eth_getTransactionReceipt", func() (err error) {
+		receipt, err = conn.TransactionReceipt(ctx, txHash)
+		return
+	})
+	if err == ethereum.NotFound {
+		return nil, nil
+	}
+	return receipt, err
+}
+
+func receiptState(receipt *types.Receipt) int {
+	if receipt != nil && receipt.Status != types.ReceiptStatusSuccessful {
+		return txReverted
+	}
+	return txMined
+}
+
+// requeueWithdrawals puts the items of a batch that can't go through any
+// more back in the queue, unless something else already moved them on. It
+// returns the ones it requeued.
+func requeueWithdrawals(ctx context.Context, items []*withdrawal, reason string) ([]*withdrawal, error) {
+	var requeued []*withdrawal
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		requeued = nil
+		var ids []int64
+		for _, w := range items {
+			var status, txHash string
+			err := tx.QueryRow(`
+				SELECT status, COALESCE(tx_hash, '') FROM withdrawals WHERE id = $1 FOR UPDATE;
+			`, w.ID).Scan(&status, &txHash)
+			if err != nil {
+				return err
+			}
+			if status == withdrawalBatched && txHash == w.TxHash {
+				requeued = append(requeued, w)
+				ids = append(ids, w.ID)
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := markWithdrawals(tx, ids, withdrawalQueued, "", reason); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			UPDATE withdrawals SET tx_hash = NULL, raw_tx = NULL WHERE id = ANY($1);
+		`, pq.Array(ids))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range requeued {
+		w.Status, w.TxHash, w.RawTx = withdrawalQueued, "", ""
+	}
+	if len(requeued) > 0 {
+		logInfo(ctx, "Requeued withdrawals", logFields{"withdrawals": withdrawalIDs(requeued), "reason": reason})
+	}
+	return requeued, nil
+}
+
+// runWithdrawalRecovery resumes interrupted withdrawals and settles sent
+// ones once per recoveryInterval.
+func runWithdrawalRecovery(api *slack.Client) {
+	for range time.Tick(recoveryInterval) {
+		if !beginWork() {
+			return
+		}
+		recoverWithdrawals(correlatedContext(), api)
+		endWork()
+	}
+}
+
+// recoverWithdrawals resumes the withdrawals left behind for longer than
+// sendingStaleAfter and settles the sent ones of every chain.
+func recoverWithdrawals(ctx context.Context, api *slack.Client) {
+	if err := resumeWithdrawals(ctx, api, sendingStaleAfter); err != nil {
+		logError(ctx, "Failed to resume withdrawals", logFields{"error": err})
+	}
+	for _, name := range chainNames() {
+		if err := settleWithdrawals(ctx, api, chains[name]); err != nil {
+			logError(ctx, "Failed to settle withdrawals", logFields{"chain": name, "error": err})
+		}
+	}
+}
+
+// settleWithdrawals looks up the transactions of the sent and batched
+// withdrawals of c, while holding its hot wallet. Mined ones are confirmed.
+// Individual transfers that reverted or were replaced are refunded, batches
+// that did are queued again. Transactions the node dropped are broadcast
+// again.
+func settleWithdrawals(ctx context.Context, api *slack.Client, c *chain) error {
+	unlock, err := c.lockWallet(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pending, err := queryWithdrawals(`WHERE chain = $1 AND status = ANY($2) AND tx_hash IS NOT NULL ORDER BY id;`,
+		c.Name, pq.Array([]string{withdrawalBatched, withdrawalSent}))
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	conn, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	// the items of a batch share its transaction
+	groups := map[string][]*withdrawal{}
+	var order []string
+	for _, w := range pending {
+		if _, ok := groups[w.TxHash]; !ok {
+			order = append(order, w.TxHash)
+		}
+		groups[w.TxHash] = append(groups[w.TxHash], w)
+	}
+	for _, hash := range order {
+		if err := settleSignedTx(ctx, api, c, conn, groups[hash]); err != nil {
+			logWarn(ctx, "Failed to settle withdrawals, leaving them for later", logFields{"chain": c.Name, "withdrawals": withdrawalIDs(groups[hash]), "tx_hash": hash, "error": err})
+		}
+	}
+	return nil
+}
+
+// sentTxState tells what became of the transaction a group of withdrawals
+// was sent in, along with the transaction when it was stored and its receipt
+// once mined. Without the signed transaction only a receipt tells anything,
+// so such a group stays pending until it is mined.
+func sentTxState(ctx context.Context, c *chain, conn chainBackend, group []*withdrawal) (int, *types.Transaction, *types.Receipt, error) {
+	if group[0].RawTx == "" {
+		receipt, err := minedReceipt(ctx, c, conn, common.HexToHash(group[0].TxHash))
+		if err != nil || receipt == nil {
+			return txPending, nil, nil, err
+		}
+		return receiptState(receipt), nil, receipt, nil
+	}
+
+	signed, err := decodeRawTx(group[0].RawTx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	state, receipt, err := signedTxState(ctx, c, conn, signed)
+	return state, signed, receipt, err
+}
+
+func settleSignedTx(ctx context.Context, api *slack.Client, c *chain, conn chainBackend, group []*withdrawal) error {
+	batched := group[0].Status == withdrawalBatched
+	state, signed, receipt, err := sentTxState(ctx, c, conn, group)
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case txMined:
+		if err := setWithdrawalStatus(ctx, withdrawalIDs(group), withdrawalConfirmed, "", ""); err != nil {
+			return err
+		}
+		if batched && signed != nil {
+			settleBatchFees(ctx, group, signed, receipt)
+		}
+	case txReverted, txReplaced:
+		if batched {
+			reason := "its batch reverted"
+			if state == txReplaced {
+				reason = "its batch was replaced"
+			}
+			_, err := requeueWithdrawals(ctx, group, reason)
+			return err
+		}
+		reason := errReverted
+		if state == txReplaced {
+			reason = errReplaced
+		}
+		for _, w := range group {
+			refundWithdrawal(ctx, api, w, reason)
+		}
+	case txMissing:
+		err := timeRPC(c, "eth_sendRawTransaction", func() error { return conn.SendTransaction(ctx, signed) })
+		if err != nil {
+			return err
+		}
+		logInfo(ctx, "Rebroadcast dropped withdrawal transaction", logFields{"chain": c.Name, "withdrawals": withdrawalIDs(group), "tx_hash": signed.Hash().Hex()})
+	}
+	return nil
+}
+
+// resumeWithdrawals picks up the work left half-done by a crash or a
+// shutdown that ran out of time: withdrawals stuck sending for longer than
+// staleAfter are resolved, and approved withdrawals the batcher doesn't pay,
+// ETH or CULT on chains without batching, are sent unless withdrawals are
+// paused. Each chain is looked at while holding its hot wallet, so that
+// sends in progress are left alone.
+func resumeWithdrawals(ctx context.Context, api *slack.Client, staleAfter time.Duration) error {
+	for _, name := range chainNames() {
+		if err := resumeSendingWithdrawals(ctx, api, chains[name], staleAfter); err != nil {
+			return err
+		}
+	}
+	if withdrawalsPaused() {
+		return nil
+	}
+
+	queued, err := queryWithdrawals(`WHERE status = $1 AND updated_at < now() - $2 * interval '1 second' ORDER BY id;`,
+		withdrawalQueued, staleAfter.Seconds())
+	if err != nil {
+		return err
+	}
+	byChain := map[string][]*withdrawal{}
+	for _, w := range queued {
+		// the batcher pays the CULT queued on chains that batch
+		if c, ok := chains[w.Chain]; !ok || batchingEnabled(c) && w.Asset == tokenAsset {
+			continue
+		}
+		byChain[w.Chain] = append(byChain[w.Chain], w)
+	}
+	for name, items := range byChain {
+		c := chains[name]
+		logInfo(ctx, "Resuming approved withdrawals", logFields{"chain": name, "withdrawals": withdrawalIDs(items)})
+		payWithdrawalsIndividually(ctx, api, c, items)
+	}
+	return nil
+}
+
+func resumeSendingWithdrawals(ctx context.Context, api *slack.Client, c *chain, staleAfter time.Duration) error {
+	unlock, err := c.lockWallet(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sending, err := queryWithdrawals(`WHERE chain = $1 AND status = $2 AND updated_at < now() - $3 * interval '1 second' ORDER BY id;`,
+		c.Name, withdrawalSending, staleAfter.Seconds())
+	if err != nil || len(sending) == 0 {
+		return err
+	}
+	logInfo(ctx, "Resuming withdrawals left sending", logFields{"chain": c.Name, "withdrawals": withdrawalIDs(sending)})
+	resolveSendingWithdrawals(ctx, api, sending, errors.New("the bot stopped before sending it"))
+	return nil
+}
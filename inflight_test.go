@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nlopes/slack"
+)
+
+func TestSignedTxState(t *testing.T) {
+	tc := newTestChain(t)
+	ctx := context.Background()
+	auth, err := tc.transactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := tc.sim.PendingNonceAt(ctx, auth.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sign a transfer of ether, or a call that reverts when to is the armed
+	// disperse contract, which takes calls without data as arming it
+	sign := func(nonce uint64, to common.Address) *types.Transaction {
+		signed, err := auth.Signer(types.HomesteadSigner{}, auth.From, types.NewTransaction(nonce, to, big.NewInt(1), big.NewInt(100000), big.NewInt(1), []byte{1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	send := func(tx *types.Transaction) {
+		if err := tc.sim.SendTransaction(ctx, tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := func(tx *types.Transaction) int {
+		state, _, err := signedTxState(ctx, tc.chain, tc.sim, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+	recipient := common.HexToAddress("0x01")
+
+	mined := sign(nonce, recipient)
+	send(mined)
+	if got := state(mined); got != txPending {
+		t.Errorf("sent transaction is in state %d, want pending", got)
+	}
+	tc.sim.Commit()
+	if got := state(mined); got != txMined {
+		t.Errorf("mined transaction is in state %d, want mined", got)
+	}
+
+	tc.armDisperse(t)
+	reverted := sign(nonce+1, tc.disperse)
+	send(reverted)
+	tc.sim.Commit()
+	if got := state(reverted); got != txReverted {
+		t.Errorf("reverted transaction is in state %d, want reverted", got)
+	}
+
+	// signed and stored, but never broadcast
+	missing := sign(nonce+2, recipient)
+	if got := state(missing); got != txMissing {
+		t.Errorf("dropped transaction is in state %d, want missing", got)
+	}
+
+	replacement := sign(nonce+2, common.HexToAddress("0x02"))
+	send(replacement)
+	tc.sim.Commit()
+	if got := state(missing); got != txReplaced {
+		t.Errorf("replaced transaction is in state %d, want replaced", got)
+	}
+}
+
+func TestRecoverRevertedBatch(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	api := testSlack(t)
+	ctx := context.Background()
+
+	// the bot stops after broadcasting a batch that reverts
+	items := queueTestWithdrawals(t, tc.chain, nil, 100, 200)
+	tc.mine(t)
+	tc.sim.beforeSend = func(tx *types.Transaction) {
+		if tx.To() != nil && *tx.To() == tc.disperse {
+			tc.armDisperse(t)
+		}
+	}
+	if _, tx, fallback, err := startWithdrawalBatch(ctx, api, tc.chain); err != nil || tx == nil || fallback {
+		t.Fatalf("batch %v, fallback %v: %v", tx, fallback, err)
+	}
+
+	waitForWithdrawals(t, api, tc, items, withdrawalQueued)
+	for _, w := range loadTestWithdrawals(t, items) {
+		if w.TxHash != "" || w.RawTx != "" {
+			t.Errorf("requeued withdrawal %d kept the batch %s", w.ID, w.TxHash)
+		}
+	}
+}
+
+func TestRecoverDroppedTransfer(t *testing.T) {
+	testDatabase(t)
+	tc := newTestChain(t)
+	api := testSlack(t)
+	ctx := context.Background()
+
+	// the node accepts the transfer and loses it
+	items := queueTestWithdrawals(t, tc.chain, nil, 100)
+	tc.sim.dropNext = true
+	if tx, err := payWithdrawal(ctx, api, tc.chain, items[0]); err != nil || tx == nil {
+		t.Fatalf("transfer %v: %v", tx, err)
+	}
+
+	tc.mine(t)
+	waitForWithdrawals(t, api, tc, items, withdrawalConfirmed)
+	if balance := tc.tokenBalance(t, common.HexToAddress(items[0].Address)); balance.Cmp(items[0].Amount) != 0 {
+		t.Errorf("delivered %s tokens, want %s", balance, items[0].Amount)
+	}
+}
+
+// waitForWithdrawals settles the withdrawals of tc until they reach status.
+func waitForWithdrawals(t *testing.T, api *slack.Client, tc *testChain, items []*withdrawal, status string) {
+	ctx := context.Background()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := settleWithdrawals(ctx, api, tc.chain); err != nil {
+			t.Fatal(err)
+		}
+		done := true
+		for _, w := range loadTestWithdrawals(t, items) {
+			done = done && w.Status == status
+		}
+		if done {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, w := range loadTestWithdrawals(t, items) {
+		t.Errorf("withdrawal %d is %s, want %s", w.ID, w.Status, status)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Assets tracked in the balances table.
+const (
+	tokenAsset = "CULT"
+	etherAsset = "ETH"
+)
+
+// Kinds of ledger entries.
+const (
+	kindTip         = "tip"
+	kindDeposit     = "deposit"
+	kindWithdraw    = "withdraw"
+	kindFee         = "fee"
+	kindRefund      = "refund"
+	kindSignupBonus = "signup_bonus"
+	kindAdminCredit = "admin_credit"
+	kindAdminDebit  = "admin_debit"
+)
+
+var errInsufficientFunds = errors.New("Insufficient funds!")
+
+// assetDecimals is the number of decimals users type amounts of an asset in.
+// CULT is counted in whole token units as it always has been.
+func assetDecimals(asset string) int {
+	if asset == etherAsset {
+		return 18
+	}
+	return 0
+}
+
+// parseAsset normalizes an asset name given in a command. An empty name
+// means the ERC20 token.
+func parseAsset(name string) (string, error) {
+	switch strings.ToUpper(name) {
+	case "", tokenAsset:
+		return tokenAsset, nil
+	case etherAsset:
+		return etherAsset, nil
+	default:
+		return "", fmt.Errorf("Unknown asset %s", name)
+	}
+}
+
+// parseAmount converts a decimal amount such as "0.05" into the smallest unit
+// of the asset.
+func parseAmount(s string, asset string) (*big.Int, error) {
+	decimals := assetDecimals(asset)
+
+	parts := strings.SplitN(s, ".", 2)
+	frac := ""
+	if len(parts) == 2 {
+		frac = parts[1]
+	}
+	if len(frac) > decimals {
+		return nil, fmt.Errorf("Too many decimals in %s", s)
+	}
+
+	amount, ok := new(big.Int).SetString(parts[0]+frac+strings.Repeat("0", decimals-len(frac)), 10)
+	if !ok {
+		return nil, fmt.Errorf("Invalid amount %s", s)
+	}
+	return amount, nil
+}
+
+// formatAmount is the inverse of parseAmount.
+func formatAmount(amount *big.Int, asset string) string {
+	return formatUnits(amount, assetDecimals(asset))
+}
+
+// formatUnits writes amount of the smallest unit as a decimal number of
+// whole units with the given decimals.
+func formatUnits(amount *big.Int, decimals int) string {
+	if decimals == 0 {
+		return amount.String()
+	}
+
+	unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	quo, rem := new(big.Int).QuoRem(new(big.Int).Abs(amount), unit, new(big.Int))
+
+	s := quo.String()
+	if rem.Sign() != 0 {
+		frac := fmt.Sprintf("%0*s", decimals, rem.String())
+		s += "." + strings.TrimRight(frac, "0")
+	}
+	if amount.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// withLedgerTx runs fn inside a database transaction that is committed only
+// if fn succeeds.
+func withLedgerTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		logDebug(ctx, "Rolled back ledger transaction", logFields{"error": err})
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		logError(ctx, "Failed to commit ledger transaction", logFields{"error": err})
+		return err
+	}
+	logDebug(ctx, "Committed ledger transaction", nil)
+	return nil
+}
+
+// ledgerEntry is a single change to a user's balance. Entries that moved
+// funds on-chain name the chain and transaction, and admin adjustments carry
+// the admin's reason in the note.
+type ledgerEntry struct {
+	UserID string
+	Asset  string
+	Kind   string
+	Amount *big.Int
+	Chain  string
+	TxHash string
+	Note   string
+}
+
+// adjustBalance adds the entry's amount, which may be negative, to the user's
+// balance and records the entry. A balance never goes below zero.
+func adjustBalance(tx *sql.Tx, e ledgerEntry) error {
+	// create the balance first, so that there is always a row to lock: two
+	// transactions both finding none would both write their own total
+	_, err := tx.Exec(`
+		INSERT INTO balances(slack_user_id, asset, balance) VALUES ($1, $2, 0)
+		ON CONFLICT ON CONSTRAINT balances_slack_user_id_asset_key DO NOTHING;
+	`, e.UserID, e.Asset)
+	if err != nil {
+		return err
+	}
+
+	var stored string
+	err = tx.QueryRow(`
+		SELECT balance FROM balances WHERE slack_user_id = $1 AND asset = $2 FOR UPDATE;
+	`, e.UserID, e.Asset).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	balance, ok := parseStoredAmount(stored)
+	if !ok {
+		return fmt.Errorf("invalid %s balance of %s: %q", e.Asset, e.UserID, stored)
+	}
+
+	balance.Add(balance, e.Amount)
+	if balance.Sign() < 0 {
+		return errInsufficientFunds
+	}
+
+	_, err = tx.Exec(`
+		UPDATE balances SET balance = $3, updated_at = now() WHERE slack_user_id = $1 AND asset = $2;
+	`, e.UserID, e.Asset, balance.String())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO ledger_entries(slack_user_id, asset, kind, amount, chain, tx_hash, note) VALUES ($1, $2, $3, $4, $5, $6, $7);
+	`, e.UserID, e.Asset, e.Kind, e.Amount.String(), nullString(e.Chain), nullString(e.TxHash), nullString(e.Note))
+	if err != nil {
+		return err
+	}
+
+	return queueWebhookEvent(tx, eventBalanceChanged, map[string]interface{}{
+		"user_id": e.UserID,
+		"asset":   e.Asset,
+		"kind":    e.Kind,
+		"amount":  webhookAmount(e.Amount, e.Asset),
+		"balance": webhookAmount(balance, e.Asset),
+		"chain":   e.Chain,
+		"tx_hash": e.TxHash,
+		"note":    e.Note,
+	})
+}
+
+// transferBalance moves amount of asset from one user to another and records
+// it as a tip.
+func transferBalance(ctx context.Context, from, to, asset string, amount *big.Int) error {
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		if err := adjustBalance(tx, ledgerEntry{UserID: from, Asset: asset, Kind: kindTip, Amount: new(big.Int).Neg(amount)}); err != nil {
+			return err
+		}
+		if err := adjustBalance(tx, ledgerEntry{UserID: to, Asset: asset, Kind: kindTip, Amount: amount}); err != nil {
+			return err
+		}
+		var id int64
+		err := tx.QueryRow(`
+			INSERT INTO tips(from_user_id, to_user_id, asset, amount) VALUES ($1, $2, $3, $4) RETURNING id;
+		`, from, to, asset, amount.String()).Scan(&id)
+		if err != nil {
+			return err
+		}
+		return queueWebhookEvent(tx, eventTipCreated, map[string]interface{}{
+			"tip_id":       id,
+			"from_user_id": from,
+			"to_user_id":   to,
+			"asset":        asset,
+			"amount":       webhookAmount(amount, asset),
+		})
+	})
+	if err == nil {
+		logInfo(ctx, "Transferred balance", logFields{"from": from, "to": to, "asset": asset, "amount": formatAmount(amount, asset)})
+	}
+	return err
+}
+
+func retrieveAssetBalanceFor(userID, asset string) *big.Int {
+	db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	defer db.Close()
+
+	var stored string
+	db.QueryRow(`
+		SELECT balance FROM balances WHERE slack_user_id = $1 AND asset = $2 LIMIT 1;
+	`, userID, asset).Scan(&stored)
+
+	balance, ok := new(big.Int).SetString(stored, 10)
+	if !ok {
+		return new(big.Int)
+	}
+	return balance
+}
+
+// isUniqueViolation reports whether err was caused by a unique constraint.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		s     string
+		asset string
+		want  string
+		ok    bool
+	}{
+		{"100", tokenAsset, "100", true},
+		{"0", tokenAsset, "0", true},
+		{"1.5", tokenAsset, "", false},
+		{"1.0", tokenAsset, "", false},
+		{"abc", tokenAsset, "", false},
+		{"", tokenAsset, "", false},
+		{"1", etherAsset, "1000000000000000000", true},
+		{"0.05", etherAsset, "50000000000000000", true},
+		{".5", etherAsset, "500000000000000000", true},
+		{"1.", etherAsset, "1000000000000000000", true},
+		{"0.000000000000000001", etherAsset, "1", true},
+		{"0.0000000000000000001", etherAsset, "", false},
+		{"1.2.3", etherAsset, "", false},
+		{"1e18", etherAsset, "", false},
+	}
+	for _, test := range tests {
+		got, err := parseAmount(test.s, test.asset)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q %s: parsed as %s", test.s, test.asset, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %s: %v", test.s, test.asset, err)
+		} else if got.String() != test.want {
+			t.Errorf("%q %s: parsed as %s, want %s", test.s, test.asset, got, test.want)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount string
+		asset  string
+		want   string
+	}{
+		{"100", tokenAsset, "100"},
+		{"-100", tokenAsset, "-100"},
+		{"0", etherAsset, "0"},
+		{"1000000000000000000", etherAsset, "1"},
+		{"50000000000000000", etherAsset, "0.05"},
+		{"1", etherAsset, "0.000000000000000001"},
+		{"1500000000000000000", etherAsset, "1.5"},
+		{"-1500000000000000000", etherAsset, "-1.5"},
+		{"-1", etherAsset, "-0.000000000000000001"},
+	}
+	for _, test := range tests {
+		amount, _ := new(big.Int).SetString(test.amount, 10)
+		got := formatAmount(amount, test.asset)
+		if got != test.want {
+			t.Errorf("%s %s: formatted as %s, want %s", test.amount, test.asset, got, test.want)
+		}
+		if amount.Sign() < 0 {
+			continue
+		}
+		if back, err := parseAmount(got, test.asset); err != nil || back.Cmp(amount) != 0 {
+			t.Errorf("%s %s: %s parses back as %v: %v", test.amount, test.asset, got, back, err)
+		}
+	}
+}
+
+func TestParseAsset(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"", tokenAsset, true},
+		{"cult", tokenAsset, true},
+		{"CULT", tokenAsset, true},
+		{"eth", etherAsset, true},
+		{"ETH", etherAsset, true},
+		{"DAI", "", false},
+	}
+	for _, test := range tests {
+		got, err := parseAsset(test.name)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("%q: got %q, %v, want %q", test.name, got, err, test.want)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: parsed as %q", test.name, got)
+		}
+	}
+}
+
+func TestAdjustBalanceConcurrently(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+
+	// credits to a user without a balance yet, as two tips to a new user
+	const credits = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, credits)
+	for i := 0; i < credits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- withLedgerTx(ctx, func(tx *sql.Tx) error {
+				return adjustBalance(tx, ledgerEntry{UserID: "U1", Asset: tokenAsset, Kind: kindAdminCredit, Amount: big.NewInt(1)})
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if balance := retrieveAssetBalanceFor("U1", tokenAsset); balance.Cmp(big.NewInt(credits)) != 0 {
+		t.Fatalf("balance is %v after %d credits of 1", balance, credits)
+	}
+
+	// debits racing for the same balance
+	var paid, refused int32
+	for i := 0; i < 2*credits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+				return adjustBalance(tx, ledgerEntry{UserID: "U1", Asset: tokenAsset, Kind: kindAdminDebit, Amount: big.NewInt(-1)})
+			})
+			switch err {
+			case nil:
+				atomic.AddInt32(&paid, 1)
+			case errInsufficientFunds:
+				atomic.AddInt32(&refused, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if paid != credits || refused != credits {
+		t.Errorf("%d debits were paid and %d refused, want %d each", paid, refused, credits)
+	}
+	if balance := retrieveAssetBalanceFor("U1", tokenAsset); balance.Sign() != 0 {
+		t.Errorf("balance is %v after the debits", balance)
+	}
+}
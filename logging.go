@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, from the most to the least verbose.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func parseLogLevel(name string) (int, error) {
+	for level, n := range logLevelNames {
+		if strings.ToLower(name) == n {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, try one of: %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// logFields are the structured fields of a log line.
+type logFields map[string]interface{}
+
+// secretFields are never logged, whatever their value.
+var secretFields = map[string]bool{
+	"password":  true,
+	"token":     true,
+	"key_json":  true,
+	"auth":      true,
+	"signature": true,
+}
+
+var (
+	addressPattern    = regexp.MustCompile(`0x[0-9a-fA-F]{40}\b`)
+	slackTokenPattern = regexp.MustCompile(`xox[a-z]-[0-9A-Za-z-]+`)
+)
+
+// logger writes one JSON object per line. Secrets and Slack tokens are always
+// redacted, addresses only when configured to.
+type logger struct {
+	mu              sync.Mutex
+	out             io.Writer
+	level           int
+	redactAddresses bool
+	messageText     bool
+	secrets         []string
+}
+
+var defaultLogger = &logger{out: os.Stderr, level: levelInfo}
+
+// configureLogging applies the logging section of c, and redacts the secrets
+// of c wherever they would show up in a log line.
+func configureLogging(c *config) error {
+	level, err := parseLogLevel(c.Logging.Level)
+	if err != nil {
+		return err
+	}
+
+	secrets := []string{c.Slack.BotToken, c.Slack.VerificationToken, c.HTTP.AdminToken, c.Ethereum.Password, c.Ethereum.Signer.AuthToken, c.Dashboard.ClientSecret, c.Dashboard.SessionSecret}
+	for _, ch := range c.Chains {
+		secrets = append(secrets, ch.Password, ch.Signer.AuthToken)
+	}
+	for _, key := range c.HTTP.APIKeys {
+		secrets = append(secrets, key.Key)
+	}
+	for _, h := range c.Webhooks {
+		secrets = append(secrets, h.Secret)
+	}
+	var nonEmpty []string
+	for _, s := range secrets {
+		if s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+
+	l := defaultLogger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.level = level
+	l.redactAddresses = c.Logging.RedactAddresses
+	l.messageText = c.Logging.MessageText
+	l.secrets = nonEmpty
+	return nil
+}
+
+// logsMessageText reports whether the text of Slack messages may be logged.
+func logsMessageText() bool {
+	defaultLogger.mu.Lock()
+	defer defaultLogger.mu.Unlock()
+
+	return defaultLogger.messageText
+}
+
+func (l *logger) redact(s string) string {
+	for _, secret := range l.secrets {
+		s = strings.Replace(s, secret, "[REDACTED]", -1)
+	}
+	s = slackTokenPattern.ReplaceAllString(s, "[REDACTED]")
+	if l.redactAddresses {
+		s = addressPattern.ReplaceAllStringFunc(s, func(address string) string {
+			return address[:6] + "…" + address[len(address)-4:]
+		})
+	}
+	return s
+}
+
+func (l *logger) log(ctx context.Context, level int, msg string, fields logFields) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	line := map[string]interface{}{}
+	for key, value := range fields {
+		switch v := value.(type) {
+		case nil:
+			continue
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		if secretFields[key] {
+			value = "[REDACTED]"
+		}
+		if s, ok := value.(string); ok {
+			value = l.redact(s)
+		}
+		line[key] = value
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = logLevelNames[level]
+	line["msg"] = l.redact(msg)
+	if id := correlationID(ctx); id != "" {
+		line["correlation_id"] = id
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{"time": line["time"], "level": line["level"], "msg": line["msg"], "error": err.Error()})
+	}
+	l.out.Write(append(data, '\n'))
+}
+
+func logDebug(ctx context.Context, msg string, fields logFields) {
+	defaultLogger.log(ctx, levelDebug, msg, fields)
+}
+
+func logInfo(ctx context.Context, msg string, fields logFields) {
+	defaultLogger.log(ctx, levelInfo, msg, fields)
+}
+
+func logWarn(ctx context.Context, msg string, fields logFields) {
+	defaultLogger.log(ctx, levelWarn, msg, fields)
+}
+
+func logError(ctx context.Context, msg string, fields logFields) {
+	defaultLogger.log(ctx, levelError, msg, fields)
+}
+
+// logFatal logs at error level and exits.
+func logFatal(ctx context.Context, msg string, fields logFields) {
+	logError(ctx, msg, fields)
+	os.Exit(1)
+}
+
+// stdLogWriter sends what is written to the standard logger, by the HTTP
+// server for one, through the structured logger.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logWarn(context.Background(), strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+type correlationKey struct{}
+
+// newCorrelationID returns a random ID tying together the log lines caused
+// by one incoming event or background run.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// correlatedContext starts a context for a new incoming event or background
+// run.
+func correlatedContext() context.Context {
+	return withCorrelationID(context.Background(), newCorrelationID())
+}
+
+func correlationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
@@ -1,64 +1,143 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
-	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/nlopes/slack"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	_ "github.com/lib/pq"
 )
 
 var slackBotId string
 var slackBotToken string
-var slackTipReaction string
-var slackTipAmount string
-var tokenAddress string
-var ethApiEndpoint string
-var ethKeyJson string
-var ethPassword string
+var slackVerificationToken string
+var withdrawBatchWindow time.Duration
+var reconcileInterval time.Duration
+var shutdownTimeout time.Duration
+var workerCount int
+var workerQueueSize int
+var workerQueueTimeout time.Duration
+var commandTimeout time.Duration
+var adminHTTPToken string
 
 var httpdPort int
+var configPath string
 
 var cmdRegex = regexp.MustCompile("^<@[^>]+> ([^<]+) (?:<@)?([^ <>]+)(?:>)?")
 
 func init() {
-	slackBotToken = os.Getenv("SLACK_BOT_TOKEN")
-	slackTipReaction = os.Getenv("SLACK_TIP_REACTION")
-	slackTipAmount = os.Getenv("SLACK_TIP_AMOUNT")
-	tokenAddress = os.Getenv("ERC20_TOKEN_ADDRESS")
-	ethApiEndpoint = os.Getenv("ETH_API_ENDPOINT")
-	ethKeyJson = os.Getenv("ETH_KEY_JSON")
-	ethPassword = os.Getenv("ETH_PASSWORD")
-
 	flag.IntVar(&httpdPort, "port", 20020, "port number")
+	flag.StringVar(&configPath, "config", os.Getenv("TIPERC20_CONFIG"), "path of the YAML config file")
 }
 
 func main() {
 	flag.Parse()
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+
+	if flag.Arg(0) == "config" && flag.Arg(1) == "check" {
+		if err := checkConfig(configPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		return
+	}
+
+	ctx := context.Background()
+	config, err := loadConfig(configPath)
+	if err != nil {
+		logFatal(ctx, "Failed to load configuration", logFields{"error": err})
+	}
+	// an explicit -port wins over the config
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			config.HTTP.Port = httpdPort
+		}
+	})
+	if flag.Arg(0) == "migrate" {
+		os.Exit(runMigrate(ctx, config.Database.URL, flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "backup" || flag.Arg(0) == "restore" {
+		os.Exit(runBackup(ctx, config.Database.URL, flag.Args()))
+	}
+	// before the Slack token is required and migrations are applied
+	if flag.Arg(0) == "ctl" {
+		os.Exit(startCtl(ctx, config, flag.Args()[1:]))
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		logFatal(ctx, "Invalid configuration", logFields{"problems": problems})
+	}
+	if err := applyConfig(config); err != nil {
+		logFatal(ctx, "Failed to apply configuration", logFields{"error": err})
+	}
+	if err := migrateOnStart(ctx, config.Database.URL, config.Database.Migrate); err != nil {
+		logFatal(ctx, "Failed to migrate the database", logFields{"error": err})
+	}
+	go reloadOnSIGHUP(configPath)
+
+	api := slack.New(slackBotToken)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 		fmt.Fprintf(w, "SKRT SKRT")
 	})
+	http.HandleFunc("/healthz", healthHandler(false))
+	http.HandleFunc("/readyz", healthHandler(true))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/solvency", solvencyHandler())
+	http.HandleFunc("/slack/actions", slackActionsHandler(api))
+	http.HandleFunc("/api/v1/", adminAPIHandler(api))
+	http.HandleFunc("/dashboard/", dashboardHandler(api))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", httpdPort)}
 	go func() {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", httpdPort), nil))
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			logFatal(ctx, "HTTP server stopped", logFields{"error": err})
+		}
 	}()
 
-	api := slack.New(slackBotToken)
+	// finish what the last run left half-done before taking new work. Sends
+	// of other instances that are still running are left alone until they
+	// are sendingStaleAfter old.
+	if beginWork() {
+		go func() {
+			defer endWork()
+			recoverWithdrawals(correlatedContext(), api)
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	commands := newCommandPool(api, handleMessage)
 	rtm := api.NewRTM()
 	go rtm.ManageConnection()
+	go runWithdrawalBatcher(api)
+	go runWalletPolicy(api)
+	go runReconciliation(api)
+	go runWithdrawalRecovery(api)
+	go runChainProbes()
+	go runWebhookDispatcher(api)
 
 Loop:
 	for {
@@ -67,76 +146,181 @@ Loop:
 			switch ev := msg.Data.(type) {
 			case *slack.ConnectedEvent:
 				slackBotId = ev.Info.User.ID
+				slackConnection.set(true)
+			case *slack.ConnectingEvent, *slack.DisconnectedEvent:
+				slackConnection.set(false)
 			case *slack.MessageEvent:
-				handleMessage(api, ev)
+				commands.submit(ev)
 			case *slack.RTMError:
-				fmt.Printf("Error: %s\n", ev.Error())
+				logWarn(ctx, "Slack RTM error", logFields{"error": ev.Error()})
 			case *slack.InvalidAuthEvent:
-				fmt.Printf("Invalid credentials")
+				logError(ctx, "Invalid Slack credentials", nil)
 				break Loop
 			// case *slack.ReactionAddedEvent:
 			// 	handleReaction(api, ev)
 			default:
 				// Ignore unknown errors because it's emitted too much time
 			}
+		case sig := <-stop:
+			logInfo(ctx, "Shutting down", logFields{"signal": sig.String(), "timeout": shutdownTimeout.String()})
+			break Loop
 		}
 	}
+
+	// stop taking commands and let the work in flight finish, withdrawals
+	// still running past the timeout are resumed on the next start
+	if left := drainWork(shutdownTimeout); left > 0 {
+		logWarn(ctx, "Shutdown timed out with work in flight", logFields{"work": left})
+	}
+	rtm.Disconnect()
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logWarn(ctx, "Failed to stop the HTTP server", logFields{"error": err})
+	}
+	closeEndpoints()
+	logInfo(ctx, "Stopped", nil)
 }
 
-func handleMessage(api *slack.Client, ev *slack.MessageEvent) {
-	if !strings.HasPrefix(ev.Text, "<@"+slackBotId+">") {
-		return
+// handleMessage runs the command in ev, a message mentioning the bot. Every
+// line logged while handling it carries the correlation ID of ctx, and the
+// message text is only logged when configured to.
+func handleMessage(ctx context.Context, api *slack.Client, ev *slack.MessageEvent) {
+	fields := logFields{"user": ev.User, "channel": ev.Channel, "event": slackEventRef(ev)}
+	if logsMessageText() {
+		fields["text"] = ev.Text
 	}
 
 	// matched := cmdRegex.FindStringSubmatch(ev.Text)
 	matched := strings.Split(ev.Text, " ")
-	fmt.Println(matched)
-	// if len(matched) < 2 {
-	// 	fmt.Printf("Leave me alone, Julian")
-	// 	return
-	// }
 	if len(matched) < 2 {
-		fmt.Printf("Leave me alone, Julian")
+		logDebug(ctx, "Ignored mention without a command", fields)
 		return
 	}
+	fields["command"] = commandLabel(matched[1])
+	logInfo(ctx, "Received command", fields)
+
+	if !allowCommand(api, ev, matched[1]) {
+		logInfo(ctx, "Throttled command", logFields{"command": commandLabel(matched[1])})
+		return
+	}
+	defer observeCommand(matched[1], time.Now())
+	if err := auditCommand(ctx, ev, matched[1:]); err != nil {
+		logError(ctx, "Failed to audit command", logFields{"error": err})
+	}
+	switch matched[1] {
+	case "tip", "register", "withdraw":
+		if isFrozen(ev.User) {
+			sendSlackMessage(api, ev.User, message("frozen"))
+			return
+		}
+	}
 	switch matched[1] {
 	case "tip":
-		if len(matched) != 4 {
-			sendSlackMessage(api, ev.Channel, ":thonk: Usage: tip @user [amount]")
-			fmt.Printf("Leave me alone, Julian")
+		if len(matched) != 4 && len(matched) != 5 {
+			sendSlackMessage(api, ev.Channel, ":thonk: Usage: tip @user [amount] [CULT|ETH]")
 			return
 		}
-		handleTipCommand(api, ev, matched[2], matched[3])
+		asset := ""
+		if len(matched) == 5 {
+			asset = matched[4]
+		}
+		handleTipCommand(ctx, api, ev, matched[2], matched[3], asset)
 	case "register":
 		if len(matched) != 3 {
 			sendSlackMessage(api, ev.Channel, ":thonk: Usage: register [ETH wallet address]")
-			fmt.Printf("Leave me alone, Julian")
 			return
 		}
-		handleRegister(api, ev, matched[2])
+		handleRegister(ctx, api, ev, matched[2])
 	case "balance":
 		if len(matched) != 2 {
 			sendSlackMessage(api, ev.Channel, ":thonk: Usage: balance")
-			fmt.Printf("Leave me alone, Julian")
 			return
 		}
 		handleBalanceCommand(api, ev)
 	case "withdraw":
+		if len(matched) > 4 {
+			sendSlackMessage(api, ev.Channel, ":thonk: Usage: withdraw [CULT|ETH] [chain]")
+			return
+		}
+		if withdrawalsPaused() {
+			sendSlackMessage(api, ev.User, message("withdrawals_paused"))
+			return
+		}
+		asset, c, err := parseWithdrawArgs(matched[2:])
+		if err != nil {
+			sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+			return
+		}
+		if asset == etherAsset {
+			handleEtherWithdrawCommand(ctx, api, ev, c)
+		} else {
+			handleWithdrawCommand(ctx, api, ev, c)
+		}
+	case "deposit":
+		if len(matched) > 4 {
+			sendSlackMessage(api, ev.Channel, ":thonk: Usage: deposit [transaction hash] [chain]")
+			return
+		}
+		hash, chainName := "", ""
+		if len(matched) > 2 {
+			hash = matched[2]
+		}
+		if len(matched) > 3 {
+			chainName = matched[3]
+		}
+		c, err := lookupChain(chainName)
+		if err != nil {
+			sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+			return
+		}
+		handleDepositCommand(ctx, api, ev, hash, c)
+	case "withdrawals":
+		if len(matched) != 2 {
+			sendSlackMessage(api, ev.Channel, ":thonk: Usage: withdrawals")
+			return
+		}
+		handleWithdrawalsCommand(api, ev)
+	case "admin":
+		if !isAdmin(api, ev.User) {
+			sendSlackMessage(api, ev.Channel, ":no_entry: Only admins can do that")
+			return
+		}
+		handleAdminCommand(ctx, api, ev, matched[2:])
+	case "reconcile":
+		if !isAdmin(api, ev.User) {
+			sendSlackMessage(api, ev.Channel, ":no_entry: Only admins can do that")
+			return
+		}
 		if len(matched) != 2 {
-			sendSlackMessage(api, ev.Channel, ":thonk: Usage: withdraw")
-			fmt.Printf("Leave me alone, Julian")
+			sendSlackMessage(api, ev.Channel, ":thonk: Usage: reconcile")
 			return
 		}
-		handleWithdrawCommand(api, ev)
+		handleReconcileCommand(ctx, api, ev)
+	case "allowance":
+		if !isAdmin(api, ev.User) {
+			sendSlackMessage(api, ev.Channel, ":no_entry: Only admins can do that")
+			return
+		}
+		if len(matched) > 3 {
+			sendSlackMessage(api, ev.Channel, ":thonk: Usage: allowance [chain]")
+			return
+		}
+		handleAllowanceCommand(api, ev, strings.Join(matched[2:], ""))
+	case "chains":
+		if len(matched) != 2 {
+			sendSlackMessage(api, ev.Channel, ":thonk: Usage: chains")
+			return
+		}
+		handleChainsCommand(api, ev)
 	case "help":
 		if len(matched) != 2 {
 			sendSlackMessage(api, ev.Channel, ":thonk: Usage: help")
-			fmt.Printf("Leave me alone, Julian")
 			return
 		}
 		handleHelpCommand(api, ev)
 	default:
-		fmt.Printf("Unknown command")
+		logDebug(ctx, "Unknown command", nil)
 	}
 }
 
@@ -163,88 +347,333 @@ func handleMessage(api *slack.Client, ev *slack.MessageEvent) {
 // }
 
 func handleHelpCommand(api *slack.Client, ev *slack.MessageEvent) {
-	message := ":point_right: :sunglasses: :point_right: I'm a CultureCoin (CULT) tipbot. Try 'tip', 'register', 'balance', or 'withdraw' to interact with me!"
-	sendSlackMessage(api, ev.Channel, message)
+	sendSlackMessage(api, ev.Channel, message("help"))
 }
 
-func handleWithdrawCommand(api *slack.Client, ev *slack.MessageEvent) {
+func handleChainsCommand(api *slack.Client, ev *slack.MessageEvent) {
+	// token metadata is cached by the chain probes, this only waits for
+	// chains that weren't probed yet
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lines := []string{":link: You can deposit and withdraw on these chains:"}
+	for _, name := range chainNames() {
+		line := "• `" + name + "`"
+		if chains[name] == defaultChain {
+			line += " (default)"
+		}
+		if token, err := chains[name].token(ctx); err == nil && token.Symbol != "" {
+			line += fmt.Sprintf(": %s (%s) at `%s`", token.Name, token.Symbol, chains[name].TokenAddress)
+		}
+		lines = append(lines, line)
+	}
+	sendSlackMessage(api, ev.Channel, strings.Join(lines, "\n"))
+}
+
+func handleWithdrawCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, c *chain) {
 	address := retrieveAddressFor(ev.User)
-	amount := retrieveBalanceFor(ev.User)
+	amount := retrieveAssetBalanceFor(ev.User, tokenAsset)
+	minimum := retrieveAmountSetting(settingWithdrawMinimum)
 
-	if amount < 15 {
-		sendSlackMessage(api, ev.User, `
-:thonk: Must have at least 15 CULT before withdrawing
-		`)
+	if amount.Cmp(minimum) < 0 {
+		sendSlackMessage(api, ev.User, fmt.Sprintf(`
+:thonk: Must have at least %s CULT before withdrawing
+		`, formatAmount(minimum, tokenAsset)))
 	} else if address == "" {
+		sendSlackMessage(api, ev.User, message("register_prompt"))
+	} else if c.largeWithdrawalsPaused(amount) {
 		sendSlackMessage(api, ev.User, `
-:point_right: :sunglasses: :point_right: Please register your Ethereum address:
-
-> @tiperc20 register YOUR_ADDRESS
+:hourglass: Large withdrawals are paused while the hot wallet is being refilled, please try again later
 		`)
+	} else if err := checkWithdrawalHolds(ev.User, tokenAsset, amount); err != nil {
+		sendSlackMessage(api, ev.User, ":hourglass: "+err.Error())
+	} else if reason := withdrawalApprovalReason(ev.User, tokenAsset, amount); reason != "" {
+		w := &withdrawal{UserID: ev.User, Chain: c.Name, Asset: tokenAsset, Address: address, Amount: amount, Event: slackEventRef(ev)}
+		if _, err := chargeGasFee(c, w); err != nil {
+			sendSlackMessage(api, ev.User, ":thonk: "+err.Error())
+			return
+		}
+		if err := requestWithdrawalApproval(ctx, api, w, reason); err != nil {
+			sendSlackMessage(api, ev.User, ":x: "+err.Error())
+			return
+		}
+		message := fmt.Sprintf(":hourglass: Your withdrawal of %s CULT on %s is waiting for an admin to approve it because %s", formatAmount(w.Amount, tokenAsset), c.Name, reason)
+		if w.Fee.Sign() > 0 {
+			message += fmt.Sprintf(" (gas fee: %s %s)", formatAmount(w.Fee, w.FeeAsset), w.FeeAsset)
+		}
+		sendSlackMessage(api, ev.User, message)
+	} else if batchingEnabled(c) {
+		w := &withdrawal{UserID: ev.User, Chain: c.Name, Asset: tokenAsset, Address: address, Amount: amount, Event: slackEventRef(ev)}
+		if _, err := chargeGasFee(c, w); err != nil {
+			sendSlackMessage(api, ev.User, ":thonk: "+err.Error())
+			return
+		}
+		if err := queueWithdrawal(ctx, w); err != nil {
+			sendSlackMessage(api, ev.User, ":x: "+err.Error())
+			return
+		}
+		message := fmt.Sprintf(":hourglass: Your withdrawal of %s CULT on %s is queued and goes out with the next batch", formatAmount(w.Amount, tokenAsset), c.Name)
+		if w.Fee.Sign() > 0 {
+			message += fmt.Sprintf(" (gas fee: at most %s %s)", formatAmount(w.Fee, w.FeeAsset), w.FeeAsset)
+		}
+		sendSlackMessage(api, ev.User, message)
 	} else {
-		tx, errr := sendTokenTo(address, amount)
+		unlock, err := c.lockWallet(ctx)
+		if err != nil {
+			sendSlackMessage(api, ev.User, ":hourglass: "+err.Error())
+			return
+		}
+		defer unlock()
+		if withdrawalsPaused() {
+			sendSlackMessage(api, ev.User, message("withdrawals_paused"))
+			return
+		}
+
+		// charge the gas of the transfer to the user if configured to
+		w := &withdrawal{UserID: ev.User, Chain: c.Name, Asset: tokenAsset, Address: address, Amount: amount, Status: withdrawalSending, Event: slackEventRef(ev)}
+		quote, err := chargeGasFee(c, w)
+		if err != nil {
+			sendSlackMessage(api, ev.User, ":thonk: "+err.Error())
+			return
+		}
+
+		// the withdrawal is paid for and recorded before anything is sent, so
+		// that a crash mid-send can't lose track of it
+		err = withLedgerTx(ctx, func(dbtx *sql.Tx) error {
+			return debitWithdrawal(dbtx, w)
+		})
+		if err != nil {
+			sendSlackMessage(api, ev.User, ":x: "+err.Error())
+			return
+		}
+
+		tx, errr := sendTokenTo(ctx, c, w, quote)
 		if errr != nil {
-			sendSlackMessage(api, ev.User, ":x: "+errr.Error())
-		} else {
-			// update withdrawer balance to 0
-			db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
-			defer db.Close()
+			resolveSendingWithdrawals(ctx, api, []*withdrawal{w}, errr)
+			return
+		}
+		if err := setWithdrawalStatus(ctx, []int64{w.ID}, withdrawalSent, tx.Hash().Hex(), ""); err != nil {
+			logError(ctx, "Failed to update withdrawal", logFields{"withdrawal": w.ID, "error": err})
+		}
 
-			_, err := db.Exec(`
-				INSERT INTO balances(slack_user_id, balance) VALUES ($1, $2)
-				ON CONFLICT ON CONSTRAINT balances_slack_user_id_key
-				DO UPDATE SET balance=$2;
-			`, ev.User, 0)
+		// send success message
+		// user, _ := api.GetUserInfo(ev.User)
+		message := fmt.Sprintf(":point_left: :sunglasses: :point_left: You successfully withdrew %s CULT on %s at %s", formatAmount(w.Amount, tokenAsset), c.Name, c.txLink(tx.Hash()))
+		if w.Fee.Sign() > 0 {
+			message += fmt.Sprintf(" (gas fee: %s %s)", formatAmount(w.Fee, w.FeeAsset), w.FeeAsset)
+		}
+		sendSlackMessage(api, ev.User, message)
+		checkAllowanceHeadroom(ctx, api, c)
+	}
+}
 
-			if err != nil {
-				sendSlackMessage(api, ev.Channel, "Looks like I might have lost your CULT. Sorry!")
-			}
+func handleEtherWithdrawCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, c *chain) {
+	address := retrieveAddressFor(ev.User)
+	balance := retrieveAssetBalanceFor(ev.User, etherAsset)
 
-			// send success message
-			// user, _ := api.GetUserInfo(ev.User)
-			message := fmt.Sprintf(":point_left: :sunglasses: :point_left: You successfully withdrew %d CULT at %x", amount, tx.Hash())
-			sendSlackMessage(api, ev.User, message)
+	if address == "" {
+		sendSlackMessage(api, ev.User, message("register_prompt"))
+		return
+	}
+	if err := checkEtherChain(c); err != nil {
+		sendSlackMessage(api, ev.User, ":thonk: "+err.Error())
+		return
+	}
+	if balance.Sign() <= 0 {
+		sendSlackMessage(api, ev.User, ":thonk: You have no ETH to withdraw")
+		return
+	}
+	if err := checkWithdrawalHolds(ev.User, etherAsset, balance); err != nil {
+		sendSlackMessage(api, ev.User, ":hourglass: "+err.Error())
+		return
+	}
+
+	quote, err := quoteEtherTransfer(c)
+	if err != nil {
+		sendSlackMessage(api, ev.User, ":x: "+err.Error())
+		return
+	}
+
+	// ether withdrawals pay for their own gas when fees are charged
+	fee := new(big.Int)
+	if runtimeConfig().GasFee.Asset != "" {
+		fee = quote.Cost()
+	}
+	sent := new(big.Int).Sub(balance, fee)
+	if sent.Sign() <= 0 {
+		sendSlackMessage(api, ev.User, fmt.Sprintf(":thonk: Your balance doesn't cover the gas fee of %s ETH", formatAmount(fee, etherAsset)))
+		return
+	}
+
+	w := &withdrawal{UserID: ev.User, Chain: c.Name, Asset: etherAsset, Address: address, Amount: sent, Status: withdrawalSending, Fee: fee, FeeAsset: etherAsset, Event: slackEventRef(ev)}
+	if reason := withdrawalApprovalReason(ev.User, etherAsset, sent); reason != "" {
+		if err := requestWithdrawalApproval(ctx, api, w, reason); err != nil {
+			sendSlackMessage(api, ev.User, ":x: "+err.Error())
+			return
+		}
+		message := fmt.Sprintf(":hourglass: Your withdrawal of %s ETH on %s is waiting for an admin to approve it because %s", formatAmount(sent, etherAsset), c.Name, reason)
+		if fee.Sign() > 0 {
+			message += fmt.Sprintf(" (gas fee: %s ETH)", formatAmount(fee, etherAsset))
 		}
+		sendSlackMessage(api, ev.User, message)
+		return
 	}
+
+	unlock, err := c.lockWallet(ctx)
+	if err != nil {
+		sendSlackMessage(api, ev.User, ":hourglass: "+err.Error())
+		return
+	}
+	defer unlock()
+	if withdrawalsPaused() {
+		sendSlackMessage(api, ev.User, message("withdrawals_paused"))
+		return
+	}
+
+	err = withLedgerTx(ctx, func(dbtx *sql.Tx) error {
+		return debitWithdrawal(dbtx, w)
+	})
+	if err != nil {
+		sendSlackMessage(api, ev.User, ":x: "+err.Error())
+		return
+	}
+
+	tx, err := sendEtherTo(ctx, c, w, quote)
+	if err != nil {
+		resolveSendingWithdrawals(ctx, api, []*withdrawal{w}, err)
+		return
+	}
+	if err := setWithdrawalStatus(ctx, []int64{w.ID}, withdrawalSent, tx.Hash().Hex(), ""); err != nil {
+		logError(ctx, "Failed to update withdrawal", logFields{"withdrawal": w.ID, "error": err})
+	}
+
+	message := fmt.Sprintf(":point_left: :sunglasses: :point_left: You successfully withdrew %s ETH on %s at %s", formatAmount(sent, etherAsset), c.Name, c.txLink(tx.Hash()))
+	if fee.Sign() > 0 {
+		message += fmt.Sprintf(" (gas fee: %s ETH)", formatAmount(fee, etherAsset))
+	}
+	sendSlackMessage(api, ev.User, message)
 }
 
-func handleBalanceCommand(api *slack.Client, ev *slack.MessageEvent) {
-	amount := retrieveBalanceFor(ev.User)
-	message := fmt.Sprintf("Your balance is %d CULT", amount)
+func handleWithdrawalsCommand(api *slack.Client, ev *slack.MessageEvent) {
+	withdrawals, err := recentWithdrawalsFor(ev.User, 10)
+	if err != nil {
+		sendSlackMessage(api, ev.User, ":x: "+err.Error())
+		return
+	}
+	if len(withdrawals) == 0 {
+		sendSlackMessage(api, ev.User, ":thonk: You haven't withdrawn anything yet")
+		return
+	}
 
-	db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
-	defer db.Close()
+	lines := []string{"Your recent withdrawals:"}
+	for _, w := range withdrawals {
+		line := fmt.Sprintf("• %s %s %s on %s: *%s*", w.CreatedAt.Format("2006-01-02"), formatAmount(w.Amount, w.Asset), w.Asset, w.Chain, w.Status)
+		if c, ok := chains[w.Chain]; ok && w.TxHash != "" {
+			line += " " + c.txLink(common.HexToHash(w.TxHash))
+		}
+		if w.Error != "" {
+			line += " (" + w.Error + ")"
+		}
+		lines = append(lines, line)
+	}
+	sendSlackMessage(api, ev.User, strings.Join(lines, "\n"))
+}
+
+func handleDepositCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, hash string, c *chain) {
+	address := retrieveAddressFor(ev.User)
+	if address == "" {
+		sendSlackMessage(api, ev.User, message("register_prompt"))
+		return
+	}
+	if err := checkEtherChain(c); err != nil {
+		sendSlackMessage(api, ev.User, ":thonk: "+err.Error())
+		return
+	}
+
+	if hash == "" {
+		hotWallet, err := c.hotWalletAddress()
+		if err != nil {
+			sendSlackMessage(api, ev.User, ":x: "+err.Error())
+			return
+		}
+		sendSlackMessage(api, ev.User, fmt.Sprintf(`
+:point_right: :sunglasses: :point_right: Send ETH on %s from `+"`%s`"+` to `+"`%s`"+`, then tell me the transaction hash:
+
+> @tiperc20 deposit TRANSACTION_HASH %s
+		`, c.Name, address, hotWallet.Hex(), c.Name))
+		return
+	}
 
-	_, err := db.Exec(`
-		INSERT INTO balances(slack_user_id, balance) VALUES ($1, $2)
-		ON CONFLICT ON CONSTRAINT balances_slack_user_id_key
-		DO UPDATE SET balance=$2;
-	`, ev.User, amount)
+	if len(common.FromHex(hash)) != common.HashLength {
+		sendSlackMessage(api, ev.User, ":thonk: That doesn't look like a transaction hash")
+		return
+	}
+	txHash := common.HexToHash(hash)
 
+	value, err := verifyEtherDeposit(c, txHash, address)
 	if err != nil {
 		sendSlackMessage(api, ev.User, ":x: "+err.Error())
+		return
+	}
+
+	err = withLedgerTx(ctx, func(dbtx *sql.Tx) error {
+		err := adjustBalance(dbtx, ledgerEntry{UserID: ev.User, Asset: etherAsset, Kind: kindDeposit, Amount: value, Chain: c.Name, TxHash: txHash.Hex()})
+		if err != nil {
+			return err
+		}
+		return queueWebhookEvent(dbtx, eventDepositCredited, map[string]interface{}{
+			"user_id": ev.User,
+			"chain":   c.Name,
+			"asset":   etherAsset,
+			"amount":  webhookAmount(value, etherAsset),
+			"tx_hash": txHash.Hex(),
+		})
+	})
+	if isUniqueViolation(err) {
+		sendSlackMessage(api, ev.User, ":thonk: That deposit was already credited")
+	} else if err != nil {
+		sendSlackMessage(api, ev.User, ":x: "+err.Error())
+	} else {
+		message := fmt.Sprintf(":point_left: :sunglasses: :point_left: Credited your deposit of %s ETH", formatAmount(value, etherAsset))
+		sendSlackMessage(api, ev.User, message)
+	}
+}
+
+func handleBalanceCommand(api *slack.Client, ev *slack.MessageEvent) {
+	amount := retrieveAssetBalanceFor(ev.User, tokenAsset)
+	message := fmt.Sprintf("Your balance is %s CULT", formatAmount(amount, tokenAsset))
+
+	ether := retrieveAssetBalanceFor(ev.User, etherAsset)
+	if ether.Sign() > 0 {
+		message += fmt.Sprintf(" and %s ETH", formatAmount(ether, etherAsset))
 	}
 
 	sendSlackMessage(api, ev.User, message)
 }
 
-func handleTipCommand(api *slack.Client, ev *slack.MessageEvent, userID string, amount string) {
-	int_amount, errr := strconv.Atoi(amount)
+func handleTipCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, userID string, amount string, assetName string) {
+	asset, err := parseAsset(assetName)
+	if err != nil {
+		sendSlackMessage(api, ev.User, ":thonk: "+err.Error())
+		return
+	}
+
+	big_amount, errr := parseAmount(amount, asset)
 	if errr != nil {
-		log.Printf("Invalid tip amount: %v", errr)
+		logDebug(ctx, "Invalid tip amount", logFields{"error": errr})
 		return
 	}
 
-	if int_amount < 1 {
-		sendSlackMessage(api, ev.User, `
-:thonk: Must send at least 1 CultureCoin (CULT)
-		`)
+	if big_amount.Sign() < 1 {
+		sendSlackMessage(api, ev.User, fmt.Sprintf(`
+:thonk: Must send more than 0 %s
+		`, asset))
 		return
 	}
 
-	sender_balance := retrieveBalanceFor(ev.User)
+	sender_balance := retrieveAssetBalanceFor(ev.User, asset)
 
-	if sender_balance < int_amount {
+	if sender_balance.Cmp(big_amount) < 0 {
 		sendSlackMessage(api, ev.User, `
 :thonk: Insufficient funds!
 		`)
@@ -259,53 +688,34 @@ func handleTipCommand(api *slack.Client, ev *slack.MessageEvent, userID string,
 		return
 	}
 	formatted_userID := userID[2:len(userID)-1]
-	recipient_balance := retrieveBalanceFor(formatted_userID)
-
-	// if recipient_balance == 0 {
-	// 	recipient_balance = 0
-	// }
-	recipient_balance += int_amount
 
-	// update recipient balnace
-	db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
-	defer db.Close()
+	if reason := checkTipRateLimit(ctx, ev.User); reason != "" {
+		sendSlackMessage(api, ev.User, ":hourglass: "+reason)
+		return
+	}
 
-	_, err := db.Exec(`
-		INSERT INTO balances(slack_user_id, balance) VALUES ($1, $2)
-		ON CONFLICT ON CONSTRAINT balances_slack_user_id_key
-		DO UPDATE SET balance=$2;
-	`, formatted_userID, recipient_balance)
+	// move the balance in one transaction, which also makes tipping
+	// yourself a no-op
+	err = transferBalance(ctx, ev.User, formatted_userID, asset, big_amount)
 
 	if err != nil {
 		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
 	} else {
 		user, _ := api.GetUserInfo(ev.User)
-		message := fmt.Sprintf(":point_right: :sunglasses: :point_right: <@%s> just sent %s %d CULT!", user.Name, userID, int_amount)
+		message := fmt.Sprintf(":point_right: :sunglasses: :point_right: <@%s> just sent %s %s %s!", user.Name, userID, formatAmount(big_amount, asset), asset)
 		sendSlackMessage(api, ev.Channel, message)
-	}
-
-	// prevent miscalculating costs when sending to yourself
-	sender_balance = retrieveBalanceFor(ev.User)
-
-	sender_balance -= int_amount
-
-	// update sender balance
-	db, _ = sql.Open("postgres", os.Getenv("DATABASE_URL"))
-	defer db.Close()
-
-	_, err = db.Exec(`
-		INSERT INTO balances(slack_user_id, balance) VALUES ($1, $2)
-		ON CONFLICT ON CONSTRAINT balances_slack_user_id_key
-		DO UPDATE SET balance=$2;
-	`, ev.User, sender_balance)
-
-	if err != nil {
-		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
-	} 
-	// else {
-	// 	sendSlackMessage(api, ev.Channel, ":o: Updated balance")
-	// }
+		observeTip(asset, big_amount)
 
+		// tips going in circles are left for admins to look at
+		if ring := detectTipRing(ctx, ev.User, formatted_userID); ring != "" {
+			flagged, err := flagTipRing(ctx, api, ev.User, formatted_userID, ring)
+			if err != nil {
+				logError(ctx, "Failed to flag tip ring", logFields{"error": err})
+			} else if flagged {
+				sendSlackMessage(api, ev.User, ":mag: Your tips were flagged for an admin to review because "+ring+". Tipping back and forth doesn't earn anything.")
+			}
+		}
+	}
 
 	// address := retrieveAddressFor(userID)
 
@@ -330,7 +740,7 @@ func handleTipCommand(api *slack.Client, ev *slack.MessageEvent, userID string,
 // 	}
 }
 
-func handleRegister(api *slack.Client, ev *slack.MessageEvent, address string) {
+func handleRegister(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, address string) {
 	userId := ev.User
 	stored_address := retrieveAddressFor(userId)
 
@@ -339,14 +749,28 @@ func handleRegister(api *slack.Client, ev *slack.MessageEvent, address string) {
 		return
 	}
 
-	db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
-	defer db.Close()
-
-	_, err := db.Exec(`
-		INSERT INTO accounts(slack_user_id, ethereum_address) VALUES ($1, $2)
-		ON CONFLICT ON CONSTRAINT accounts_slack_user_id_key
-		DO UPDATE SET ethereum_address=$2;
-	`, userId, address)
+	// keep the replaced address in the audit log
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		// changing an address starts the withdrawal cooling-off period
+		_, err := tx.Exec(`
+			INSERT INTO accounts(slack_user_id, ethereum_address) VALUES ($1, $2)
+			ON CONFLICT ON CONSTRAINT accounts_slack_user_id_key
+			DO UPDATE SET ethereum_address=$2, updated_at=now(),
+				address_changed_at=CASE WHEN accounts.ethereum_address IS DISTINCT FROM $2 THEN now() ELSE accounts.address_changed_at END;
+		`, userId, address)
+		if err != nil {
+			return err
+		}
+		err = recordAudit(tx, auditRecord{Actor: userId, Action: "register", Subject: userId, Before: stored_address, After: address, Event: slackEventRef(ev)})
+		if err != nil {
+			return err
+		}
+		return queueWebhookEvent(tx, eventAccountRegistered, map[string]interface{}{
+			"user_id":          userId,
+			"address":          address,
+			"previous_address": stored_address,
+		})
+	})
 
 	if err != nil {
 		sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
@@ -354,66 +778,85 @@ func handleRegister(api *slack.Client, ev *slack.MessageEvent, address string) {
 		sendSlackMessage(api, ev.Channel, ":point_right: :sunglasses: :point_right: Registered `"+address+"`")
 	}
 
-	amount_in_acc := retrieveBalanceFor(ev.User)
-
-	// if no stored address, give one time payment of 10 CULT
-	if stored_address == "" {
-		db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
-		defer db.Close()
-
-		_, err := db.Exec(`
-			INSERT INTO balances(slack_user_id, balance) VALUES ($1, $2)
-			ON CONFLICT ON CONSTRAINT balances_slack_user_id_key
-			DO UPDATE SET balance=$2;
-		`, ev.User, amount_in_acc + 10)
-
-		if err != nil {
-			sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
-		} else {
-			sendSlackMessage(api, ev.Channel, ":point_left: :sunglasses: :point_left: Enjoy your free 10 CULT!")
-		}
+	// if no stored address, give one time payment of the signup bonus
+	if stored_address == "" && err == nil {
+		grantSignupBonus(ctx, api, ev, address)
 	}
 }
 
-func sendTokenTo(address string, amount int) (tx *types.Transaction, err error) {
-	conn, err := ethclient.Dial(ethApiEndpoint)
+// sendTokenTo transfers the tokens of w to its address on c, storing the
+// signed transaction with w before it is broadcast. A non-nil quote fixes the
+// gas limit and price of the transaction.
+func sendTokenTo(ctx context.Context, c *chain, w *withdrawal, quote *gasQuote) (tx *types.Transaction, err error) {
+	conn, err := c.backend()
 	if err != nil {
-		log.Printf("Failed to instantiate a Token contract: %v", err)
+		logError(ctx, "Failed to instantiate a Token contract", logFields{"chain": c.Name, "error": err})
 		return
 	}
 
-	token, err := NewToken(common.HexToAddress(tokenAddress), conn)
+	token, err := NewToken(common.HexToAddress(c.TokenAddress), conn)
 	if err != nil {
-		log.Printf("Failed to instantiate a Token contract: %v", err)
+		logError(ctx, "Failed to instantiate a Token contract", logFields{"chain": c.Name, "error": err})
 		return
 	}
 
-	auth, err := bind.NewTransactor(strings.NewReader(ethKeyJson), ethPassword)
+	auth, err := c.transactor()
 	if err != nil {
-		log.Printf("Failed to create authorized transactor: %v", err)
+		logError(ctx, "Failed to create authorized transactor", logFields{"chain": c.Name, "error": err})
 		return
 	}
 
+	// in treasury mode make sure the payout is covered before sending it
+	if c.treasuryMode() {
+		allowance, errr := treasuryAllowance(c)
+		if errr != nil {
+			err = errr
+			logError(ctx, "Failed to check treasury allowance", logFields{"chain": c.Name, "error": err})
+			return
+		}
+		if allowance.Cmp(w.Amount) < 0 {
+			err = errors.New("The treasury allowance is used up, please ask an admin to top it up")
+			logWarn(ctx, "Treasury allowance too low", logFields{"chain": c.Name, "amount": w.Amount, "allowance": allowance})
+			return
+		}
+	}
+
+	if quote != nil {
+		auth.GasLimit = quote.GasLimit
+		auth.GasPrice = quote.GasPrice
+	} else if c.FeeModel == feeModelFixed {
+		auth.GasPrice, _ = c.suggestGasPrice(ctx, conn)
+	}
+	persistSigned(ctx, auth, []*withdrawal{w})
+
 	// amount, err := strconv.ParseInt(slackTipAmount, 10, 64)
 	// if err != nil {
 	// 	log.Printf("Invalid tip amount: %v", err)
 	// 	return
 	// }
 
-	tx, err = token.Transfer(auth, common.HexToAddress(address), big.NewInt(int64(amount)))
+	err = c.withNonce(ctx, conn, auth.From, func(nonce uint64) error {
+		auth.Nonce = new(big.Int).SetUint64(nonce)
+		if c.treasuryMode() {
+			tx, err = token.TransferFrom(auth, common.HexToAddress(c.TreasuryAddress), common.HexToAddress(w.Address), w.Amount)
+		} else {
+			tx, err = token.Transfer(auth, common.HexToAddress(w.Address), w.Amount)
+		}
+		return err
+	})
 	if err != nil {
-		log.Printf("Failed to request token transfer: %v", err)
+		logError(ctx, "Failed to request token transfer", logFields{"chain": c.Name, "withdrawal": w.ID, "to": w.Address, "error": err})
 		return
 	}
 
-	log.Printf("Transfer pending: 0x%x\n", tx.Hash())
+	logInfo(ctx, "Transfer pending", logFields{"chain": c.Name, "withdrawal": w.ID, "to": w.Address, "amount": formatAmount(w.Amount, w.Asset), "tx_hash": tx.Hash().Hex()})
 	return
 }
 
 func sendSlackMessage(api *slack.Client, channel, message string) {
 	_, _, err := api.PostMessage(channel, message, slack.PostMessageParameters{})
 	if err != nil {
-		log.Println(err)
+		logWarn(context.Background(), "Failed to send Slack message", logFields{"channel": channel, "error": err})
 	}
 }
 
@@ -427,15 +870,3 @@ func retrieveAddressFor(userID string) (address string) {
 
 	return
 }
-
-// TODO retrieve actual balance
-func retrieveBalanceFor(userID string) (amount int) {
-	db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
-	defer db.Close()
-
-	db.QueryRow(`
-		SELECT balance FROM balances WHERE slack_user_id = $1 LIMIT 1;
-	`, userID).Scan(&amount)
-
-	return
-}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiperc20_commands_total",
+		Help: "Commands run, by command.",
+	}, []string{"command"})
+	commandsThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiperc20_commands_throttled_total",
+		Help: "Commands dropped by the rate limits, by class and the scope that ran out.",
+	}, []string{"class", "scope"})
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tiperc20_command_duration_seconds",
+		Help:    "Time taken to handle a command, by command.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"command"})
+	commandQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tiperc20_command_queue_depth",
+		Help: "Commands waiting for a worker.",
+	})
+	commandsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiperc20_commands_dropped_total",
+		Help: "Commands dropped because a worker queue was full or they waited in it too long, by reason.",
+	}, []string{"reason"})
+	commandsTimedOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tiperc20_commands_timed_out_total",
+		Help: "Commands that ran out of time.",
+	})
+
+	tipsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiperc20_tips_total",
+		Help: "Tips sent, by asset.",
+	}, []string{"asset"})
+	tipsVolume = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiperc20_tips_volume_total",
+		Help: "Amount tipped in whole units, by asset.",
+	}, []string{"asset"})
+
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "tiperc20_rpc_duration_seconds",
+		Help: "Latency of Ethereum RPC calls, by chain and method.",
+	}, []string{"chain", "method"})
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiperc20_rpc_errors_total",
+		Help: "Failed Ethereum RPC calls, by chain and method.",
+	}, []string{"chain", "method"})
+	rpcEndpointUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiperc20_rpc_endpoint_up",
+		Help: "Whether an RPC endpoint is in rotation, by chain and endpoint.",
+	}, []string{"chain", "endpoint"})
+	rpcEndpointHead = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiperc20_rpc_endpoint_head",
+		Help: "Latest block known to an RPC endpoint, by chain and endpoint.",
+	}, []string{"chain", "endpoint"})
+
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tiperc20_webhook_deliveries_total",
+		Help: "Webhook delivery attempts, by webhook and result: delivered, failed or dead.",
+	}, []string{"webhook", "result"})
+
+	hotWalletBalance = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiperc20_hot_wallet_balance",
+		Help: "What the hot wallet can pay out in whole units, by chain and asset. In treasury mode this is the usable treasury allowance.",
+	}, []string{"chain", "asset"})
+	chainUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiperc20_chain_up",
+		Help: "Whether the last probe of the chain's RPC endpoints succeeded.",
+	}, []string{"chain"})
+	chainHeadAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiperc20_chain_head_age_seconds",
+		Help: "Age of the latest block the chain's node knows about.",
+	}, []string{"chain"})
+	chainSyncLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tiperc20_chain_sync_lag_blocks",
+		Help: "Blocks the chain's node is behind while it syncs.",
+	}, []string{"chain"})
+
+	slackConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tiperc20_slack_connected",
+		Help: "Whether the bot is connected to the Slack RTM API.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		commandsTotal, commandsThrottled, commandDuration,
+		commandQueueDepth, commandsDropped, commandsTimedOut,
+		tipsTotal, tipsVolume,
+		rpcDuration, rpcErrors, rpcEndpointUp, rpcEndpointHead,
+		hotWalletBalance, chainUp, chainHeadAge, chainSyncLag,
+		slackConnected, webhookDeliveries,
+		withdrawalCollector{},
+	)
+}
+
+// commandLabel keeps the command label to the known commands, so that typos
+// don't grow the number of series.
+func commandLabel(command string) string {
+	if _, ok := commandClasses[command]; ok {
+		return command
+	}
+	return "unknown"
+}
+
+// observeCommand counts a command and the time it took since start.
+func observeCommand(command string, start time.Time) {
+	command = commandLabel(command)
+	commandsTotal.WithLabelValues(command).Inc()
+	commandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+}
+
+// observeTip counts a tip of amount of asset.
+func observeTip(asset string, amount *big.Int) {
+	tipsTotal.WithLabelValues(asset).Inc()
+	tipsVolume.WithLabelValues(asset).Add(wholeUnits(amount, asset))
+}
+
+// wholeUnits converts amount of asset into a float for metrics, where
+// rounding doesn't matter.
+func wholeUnits(amount *big.Int, asset string) float64 {
+	f, _ := strconv.ParseFloat(formatAmount(amount, asset), 64)
+	return f
+}
+
+// timeRPC runs call, an RPC to the node of c, and records its latency and
+// whether it failed under method. Calls failing for want of a working
+// endpoint fail the chain over to its next endpoint.
+func timeRPC(c *chain, method string, call func() error) error {
+	start := time.Now()
+	err := call()
+	rpcDuration.WithLabelValues(c.Name, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(c.Name, method).Inc()
+		c.rpcFailed(err)
+	}
+	return err
+}
+
+var (
+	withdrawalsDesc = prometheus.NewDesc(
+		"tiperc20_withdrawals",
+		"Withdrawals, by chain, asset and status.",
+		[]string{"chain", "asset", "status"}, nil,
+	)
+	withdrawalQueueDepthDesc = prometheus.NewDesc(
+		"tiperc20_withdrawal_queue_depth",
+		"Withdrawals waiting for the next batch or for an admin, by chain and status.",
+		[]string{"chain", "status"}, nil,
+	)
+)
+
+// withdrawalCollector reads the withdrawals by status from the database each
+// time the metrics are scraped, so that the numbers survive restarts.
+type withdrawalCollector struct{}
+
+func (withdrawalCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- withdrawalsDesc
+	ch <- withdrawalQueueDepthDesc
+}
+
+func (withdrawalCollector) Collect(ch chan<- prometheus.Metric) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(withdrawalsDesc, err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT chain, asset, status, count(*) FROM withdrawals GROUP BY chain, asset, status;
+	`)
+	if err != nil {
+		logWarn(context.Background(), "Failed to collect withdrawal metrics", logFields{"error": err})
+		ch <- prometheus.NewInvalidMetric(withdrawalsDesc, err)
+		return
+	}
+	defer rows.Close()
+
+	waiting := map[[2]string]float64{}
+	for _, name := range chainNames() {
+		waiting[[2]string{name, withdrawalQueued}] = 0
+		waiting[[2]string{name, withdrawalPendingApproval}] = 0
+	}
+	for rows.Next() {
+		var chainName, asset, status string
+		var count float64
+		if err := rows.Scan(&chainName, &asset, &status, &count); err != nil {
+			ch <- prometheus.NewInvalidMetric(withdrawalsDesc, err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(withdrawalsDesc, prometheus.GaugeValue, count, chainName, asset, status)
+		if status == withdrawalQueued || status == withdrawalPendingApproval {
+			waiting[[2]string{chainName, status}] += count
+		}
+	}
+	for key, count := range waiting {
+		ch <- prometheus.MustNewConstMetric(withdrawalQueueDepthDesc, prometheus.GaugeValue, count, key[0], key[1])
+	}
+}
@@ -0,0 +1,379 @@
+//go:generate go run cmd/genmigrations/main.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	// SQLite databases can be migrated, for development and testing.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Values of database.migrate (DB_MIGRATE), what to do about pending
+// migrations at startup.
+const (
+	migrateAuto   = "auto"
+	migrateVerify = "verify"
+	migrateOff    = "off"
+)
+
+// migration is one of the goose SQL files under migrations, embedded in the
+// binary by go generate.
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// sqlDialect is what migrating differs in between databases. Name is also
+// the database/sql driver and the directory under migrations.
+type sqlDialect struct {
+	Name string
+	// versionTable is where goose keeps the applied versions, so that
+	// cmd/goose can still be used on the same database.
+	versionTable string
+	// lock and unlock make other instances wait while one migrates.
+	lock   string
+	unlock string
+}
+
+var (
+	postgresDialect = &sqlDialect{
+		Name: "postgres",
+		versionTable: `
+			CREATE TABLE IF NOT EXISTS goose_db_version (
+				id SERIAL PRIMARY KEY,
+				version_id BIGINT NOT NULL,
+				is_applied BOOLEAN NOT NULL,
+				tstamp TIMESTAMP DEFAULT now()
+			);
+		`,
+		// the key is "tiperc20" in ASCII
+		lock:   `SELECT pg_advisory_lock(8388359361967370800);`,
+		unlock: `SELECT pg_advisory_unlock(8388359361967370800);`,
+	}
+	// SQLite transactions begin immediate, which locks the database against
+	// other writers, so they need no lock of their own.
+	sqliteDialect = &sqlDialect{
+		Name: "sqlite3",
+		versionTable: `
+			CREATE TABLE IF NOT EXISTS goose_db_version (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				version_id INTEGER NOT NULL,
+				is_applied INTEGER NOT NULL,
+				tstamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+	}
+)
+
+// databaseDialect tells the dialect of a database URL and the data source
+// name to open it with. sqlite3:// and file: URLs are SQLite databases, any
+// other is Postgres.
+func databaseDialect(url string) (*sqlDialect, string) {
+	switch {
+	case strings.HasPrefix(url, "sqlite3://"):
+		return sqliteDialect, sqliteDSN("file:" + strings.TrimPrefix(url, "sqlite3://"))
+	case strings.HasPrefix(url, "file:"):
+		return sqliteDialect, sqliteDSN(url)
+	}
+	return postgresDialect, url
+}
+
+func sqliteDSN(dsn string) string {
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + "_txlock=immediate&_foreign_keys=1"
+}
+
+// loadMigrations returns the embedded migrations of a dialect by version.
+func loadMigrations(d *sqlDialect) ([]*migration, error) {
+	prefix := "migrations/" + d.Name + "/"
+	var migrations []*migration
+	for path, source := range embeddedMigrations {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(path, prefix)
+		version, err := strconv.ParseInt(strings.SplitN(name, "_", 2)[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version", path)
+		}
+		m := &migration{Version: version, Name: name}
+		if m.Up, m.Down, err = splitMigration(source); err != nil {
+			return nil, fmt.Errorf("migration %s: %v", path, err)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// splitMigration separates the Up and Down sections of a goose SQL file.
+// Each runs as a single multi-statement Exec, so goose's statement
+// annotations are dropped.
+func splitMigration(source string) (up, down string, err error) {
+	var section *string
+	var upFound bool
+	scanner := bufio.NewScanner(strings.NewReader(source))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch strings.TrimSpace(line) {
+		case "-- +goose Up":
+			section, upFound = &up, true
+			continue
+		case "-- +goose Down":
+			section = &down
+			continue
+		case "-- +goose StatementBegin", "-- +goose StatementEnd":
+			continue
+		}
+		if section != nil {
+			*section += line + "\n"
+		}
+	}
+	if !upFound {
+		return "", "", errors.New("no -- +goose Up section")
+	}
+	return up, down, scanner.Err()
+}
+
+// appliedVersions reads which migrations the database has, from the latest
+// row of each version in the goose table.
+func appliedVersions(tx *sql.Tx) (map[int64]bool, error) {
+	rows, err := tx.Query(`SELECT version_id, is_applied FROM goose_db_version ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]bool{}
+	for rows.Next() {
+		var version int64
+		var isApplied bool
+		if err := rows.Scan(&version, &isApplied); err != nil {
+			return nil, err
+		}
+		applied[version] = isApplied
+	}
+	return applied, rows.Err()
+}
+
+// withMigrationLock runs fn in a transaction, while no other instance can
+// migrate the database at url. fn's changes are committed when it returns
+// commit true.
+func withMigrationLock(ctx context.Context, url string, fn func(tx *sql.Tx, migrations []*migration, applied map[int64]bool) (commit bool, err error)) error {
+	d, dsn := databaseDialect(url)
+	migrations, err := loadMigrations(d)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open(d.Name, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// the Postgres lock belongs to the session, so keep to one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if d.lock != "" {
+		if _, err := conn.ExecContext(ctx, d.lock); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), d.unlock)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(d.versionTable); err != nil {
+		return err
+	}
+	applied, err := appliedVersions(tx)
+	if err != nil {
+		return err
+	}
+
+	commit, err := fn(tx, migrations, applied)
+	if err != nil || !commit {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pendingMigrations returns the migrations not applied yet, warning about
+// applied versions this binary doesn't know, such as those of a newer
+// release that was rolled back.
+func pendingMigrations(ctx context.Context, migrations []*migration, applied map[int64]bool) []*migration {
+	known := map[int64]bool{}
+	var pending []*migration
+	for _, m := range migrations {
+		known[m.Version] = true
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	for version, isApplied := range applied {
+		if isApplied && version != 0 && !known[version] {
+			logWarn(ctx, "The database has a migration this version doesn't know", logFields{"version": version})
+		}
+	}
+	return pending
+}
+
+var errPendingMigrations = errors.New("the database has pending migrations, run `tiperc20 migrate up`")
+
+// migrateDatabase applies the pending migrations to the database at url in
+// a single transaction, or with apply false only checks there are none.
+func migrateDatabase(ctx context.Context, url string, apply bool) (done []*migration, err error) {
+	err = withMigrationLock(ctx, url, func(tx *sql.Tx, migrations []*migration, applied map[int64]bool) (bool, error) {
+		pending := pendingMigrations(ctx, migrations, applied)
+		if len(pending) == 0 {
+			return false, nil
+		}
+		if !apply {
+			done = pending
+			return false, errPendingMigrations
+		}
+
+		if err := applyMigrations(ctx, tx, pending); err != nil {
+			return false, err
+		}
+		done = pending
+		return true, nil
+	})
+	return done, err
+}
+
+func applyMigrations(ctx context.Context, tx *sql.Tx, pending []*migration) error {
+	for _, m := range pending {
+		if _, err := tx.Exec(m.Up); err != nil {
+			return fmt.Errorf("migration %s: %v", m.Name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, $2);`, m.Version, true); err != nil {
+			return err
+		}
+		logInfo(ctx, "Applied migration", logFields{"migration": m.Name})
+	}
+	return nil
+}
+
+// rollBackMigration reverts the latest applied migration of the database at
+// url.
+func rollBackMigration(ctx context.Context, url string) (reverted *migration, err error) {
+	err = withMigrationLock(ctx, url, func(tx *sql.Tx, migrations []*migration, applied map[int64]bool) (bool, error) {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if applied[migrations[i].Version] {
+				reverted = migrations[i]
+				break
+			}
+		}
+		if reverted == nil {
+			return false, errors.New("no migration to roll back")
+		}
+
+		if _, err := tx.Exec(reverted.Down); err != nil {
+			return false, fmt.Errorf("migration %s: %v", reverted.Name, err)
+		}
+		_, err := tx.Exec(`INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, $2);`, reverted.Version, false)
+		return err == nil, err
+	})
+	return reverted, err
+}
+
+// migrateOnStart applies or verifies the migrations as database.migrate
+// says, before anything else uses the database.
+func migrateOnStart(ctx context.Context, url, mode string) error {
+	switch mode {
+	case migrateOff:
+		return nil
+	case migrateVerify:
+		pending, err := migrateDatabase(ctx, url, false)
+		if err == errPendingMigrations {
+			names := make([]string, len(pending))
+			for i, m := range pending {
+				names[i] = m.Name
+			}
+			return fmt.Errorf("%v: %s", err, strings.Join(names, ", "))
+		}
+		return err
+	}
+	_, err := migrateDatabase(ctx, url, true)
+	return err
+}
+
+const migrateUsage = `usage: tiperc20 migrate [up|verify|status|down]
+
+  up      apply the pending migrations, the default
+  verify  exit with status 1 when migrations are pending
+  status  list the migrations and whether they are applied
+  down    roll back the latest migration`
+
+// runMigrate runs `tiperc20 migrate` and returns its exit code.
+func runMigrate(ctx context.Context, url string, args []string) int {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if len(args) > 1 || url == "" {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 1
+	}
+
+	var err error
+	switch command {
+	case "up":
+		var done []*migration
+		if done, err = migrateDatabase(ctx, url, true); err == nil {
+			fmt.Printf("Applied %d migrations\n", len(done))
+		}
+	case "verify":
+		if err = migrateOnStart(ctx, url, migrateVerify); err == nil {
+			fmt.Println("No pending migrations")
+		}
+	case "status":
+		err = withMigrationLock(ctx, url, func(tx *sql.Tx, migrations []*migration, applied map[int64]bool) (bool, error) {
+			for _, m := range migrations {
+				state := "pending"
+				if applied[m.Version] {
+					state = "applied"
+				}
+				fmt.Printf("%-8s %s\n", state, m.Name)
+			}
+			return false, nil
+		})
+	case "down":
+		var reverted *migration
+		if reverted, err = rollBackMigration(ctx, url); err == nil {
+			fmt.Println("Rolled back", reverted.Name)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
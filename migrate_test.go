@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitMigration(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		up, down string
+		ok       bool
+	}{
+		{
+			name:   "up and down",
+			source: "-- header\n-- +goose Up\nCREATE TABLE a (id INT);\n\n-- +goose Down\nDROP TABLE a;\n",
+			up:     "CREATE TABLE a (id INT);\n\n",
+			down:   "DROP TABLE a;\n",
+			ok:     true,
+		},
+		{
+			name:   "up only",
+			source: "-- +goose Up\nCREATE TABLE a (id INT);\n",
+			up:     "CREATE TABLE a (id INT);\n",
+			ok:     true,
+		},
+		{
+			name: "statements",
+			source: "-- +goose Up\n-- +goose StatementBegin\nCREATE FUNCTION f() RETURNS INT AS $$ SELECT 1; $$ LANGUAGE SQL;\n  -- +goose StatementEnd  \n" +
+				"-- +goose Down\n-- +goose StatementBegin\nDROP FUNCTION f();\n-- +goose StatementEnd\n",
+			up:   "CREATE FUNCTION f() RETURNS INT AS $$ SELECT 1; $$ LANGUAGE SQL;\n",
+			down: "DROP FUNCTION f();\n",
+			ok:   true,
+		},
+		{
+			name:   "no up",
+			source: "CREATE TABLE a (id INT);\n-- +goose Down\nDROP TABLE a;\n",
+		},
+	}
+	for _, test := range tests {
+		up, down, err := splitMigration(test.source)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: split as %q and %q", test.name, up, down)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if up != test.up || down != test.down {
+			t.Errorf("%s: split as %q and %q, want %q and %q", test.name, up, down, test.up, test.down)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	for _, d := range []*sqlDialect{postgresDialect, sqliteDialect} {
+		migrations, err := loadMigrations(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("no %s migrations are embedded", d.Name)
+		}
+		for i, m := range migrations {
+			if i > 0 && m.Version <= migrations[i-1].Version {
+				t.Errorf("%s: %s comes after %s", d.Name, m.Name, migrations[i-1].Name)
+			}
+			if m.Up == "" || m.Down == "" {
+				t.Errorf("%s: %s has no up or down section", d.Name, m.Name)
+			}
+		}
+	}
+
+	postgres, _ := loadMigrations(postgresDialect)
+	sqlite, _ := loadMigrations(sqliteDialect)
+	if latest := postgres[len(postgres)-1].Version; sqlite[len(sqlite)-1].Version != latest {
+		t.Errorf("the SQLite schema is at version %d, Postgres at %d", sqlite[len(sqlite)-1].Version, latest)
+	}
+}
+
+func TestDatabaseDialect(t *testing.T) {
+	tests := []struct {
+		url     string
+		dialect *sqlDialect
+		dsn     string
+	}{
+		{"postgres://localhost/tiperc20", postgresDialect, "postgres://localhost/tiperc20"},
+		{"user=tiperc20 dbname=tiperc20", postgresDialect, "user=tiperc20 dbname=tiperc20"},
+		{"sqlite3://data/tiperc20.db", sqliteDialect, "file:data/tiperc20.db?_txlock=immediate&_foreign_keys=1"},
+		{"file:tiperc20.db", sqliteDialect, "file:tiperc20.db?_txlock=immediate&_foreign_keys=1"},
+		{"file:tiperc20.db?mode=ro", sqliteDialect, "file:tiperc20.db?mode=ro&_txlock=immediate&_foreign_keys=1"},
+	}
+	for _, test := range tests {
+		d, dsn := databaseDialect(test.url)
+		if d != test.dialect || dsn != test.dsn {
+			t.Errorf("%s: %s %q, want %s %q", test.url, d.Name, dsn, test.dialect.Name, test.dsn)
+		}
+	}
+}
+
+// testSQLiteURL returns the URL of a new SQLite database.
+func testSQLiteURL(t *testing.T) string {
+	return "sqlite3://" + filepath.Join(t.TempDir(), "tiperc20.db")
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	ctx := context.Background()
+	url := testSQLiteURL(t)
+
+	if err := migrateOnStart(ctx, url, migrateVerify); err == nil || !strings.Contains(err.Error(), "00012_schema.sql") {
+		t.Errorf("verify before migrating: %v", err)
+	}
+	done, err := migrateDatabase(ctx, url, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 {
+		t.Errorf("applied %d migrations, want 1", len(done))
+	}
+	if err := migrateOnStart(ctx, url, migrateVerify); err != nil {
+		t.Errorf("verify after migrating: %v", err)
+	}
+	if done, err := migrateDatabase(ctx, url, true); err != nil || len(done) != 0 {
+		t.Errorf("migrating again applied %d: %v", len(done), err)
+	}
+
+	reverted, err := rollBackMigration(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Version != 12 {
+		t.Errorf("rolled back %s", reverted.Name)
+	}
+	if _, err := rollBackMigration(ctx, url); err == nil {
+		t.Error("rolled back past the first migration")
+	}
+	if done, err := migrateDatabase(ctx, url, true); err != nil || len(done) != 1 {
+		t.Errorf("migrating after the rollback applied %d: %v", len(done), err)
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []*migration{{Version: 1}, {Version: 2}, {Version: 3}}
+	tests := []struct {
+		applied map[int64]bool
+		want    []int64
+	}{
+		{map[int64]bool{}, []int64{1, 2, 3}},
+		{map[int64]bool{0: true, 1: true}, []int64{2, 3}},
+		{map[int64]bool{1: true, 2: false, 3: true}, []int64{2}},
+		{map[int64]bool{1: true, 2: true, 3: true, 4: true}, nil},
+	}
+	for _, test := range tests {
+		pending := pendingMigrations(context.Background(), migrations, test.applied)
+		var got []int64
+		for _, m := range pending {
+			got = append(got, m.Version)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v: pending are %v, want %v", test.applied, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: pending are %v, want %v", test.applied, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+-- +goose Up
+ALTER TABLE balances ADD COLUMN asset TEXT NOT NULL DEFAULT 'CULT';
+ALTER TABLE balances ALTER COLUMN balance TYPE NUMERIC(78, 0);
+ALTER TABLE balances DROP CONSTRAINT balances_slack_user_id_key;
+ALTER TABLE balances ADD CONSTRAINT balances_slack_user_id_asset_key UNIQUE (slack_user_id, asset);
+
+CREATE TABLE ledger_entries (
+    id SERIAL PRIMARY KEY,
+    slack_user_id TEXT NOT NULL,
+    asset TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    amount NUMERIC(78, 0) NOT NULL,
+    tx_hash TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- a deposit transaction can only ever be credited once
+CREATE UNIQUE INDEX ledger_entries_deposit_tx_hash_key ON ledger_entries (tx_hash) WHERE kind = 'deposit';
+
+-- +goose Down
+DROP TABLE ledger_entries;
+DELETE FROM balances WHERE asset <> 'CULT';
+ALTER TABLE balances DROP CONSTRAINT balances_slack_user_id_asset_key;
+ALTER TABLE balances ADD CONSTRAINT balances_slack_user_id_key UNIQUE (slack_user_id);
+ALTER TABLE balances ALTER COLUMN balance TYPE INTEGER;
+ALTER TABLE balances DROP COLUMN asset;
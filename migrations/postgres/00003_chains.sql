@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE ledger_entries ADD COLUMN chain TEXT;
+
+DROP INDEX ledger_entries_deposit_tx_hash_key;
+CREATE UNIQUE INDEX ledger_entries_deposit_tx_hash_key ON ledger_entries (chain, tx_hash) WHERE kind = 'deposit';
+
+-- +goose Down
+DROP INDEX ledger_entries_deposit_tx_hash_key;
+CREATE UNIQUE INDEX ledger_entries_deposit_tx_hash_key ON ledger_entries (tx_hash) WHERE kind = 'deposit';
+
+ALTER TABLE ledger_entries DROP COLUMN chain;
@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE withdrawals (
+    id SERIAL PRIMARY KEY,
+    slack_user_id TEXT NOT NULL,
+    chain TEXT NOT NULL,
+    asset TEXT NOT NULL,
+    address TEXT NOT NULL,
+    amount NUMERIC(78, 0) NOT NULL,
+    status TEXT NOT NULL,
+    tx_hash TEXT,
+    error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX withdrawals_status_idx ON withdrawals (chain, status);
+CREATE INDEX withdrawals_slack_user_id_idx ON withdrawals (slack_user_id);
+
+-- +goose Down
+DROP TABLE withdrawals;
@@ -0,0 +1,31 @@
+-- +goose Up
+CREATE TABLE settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE frozen_users (
+    slack_user_id TEXT PRIMARY KEY,
+    reason TEXT,
+    frozen_by TEXT NOT NULL,
+    frozen_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE audit_log (
+    id SERIAL PRIMARY KEY,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    subject TEXT,
+    detail TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE ledger_entries ADD COLUMN note TEXT;
+
+-- +goose Down
+ALTER TABLE ledger_entries DROP COLUMN note;
+DROP TABLE audit_log;
+DROP TABLE frozen_users;
+DROP TABLE settings;
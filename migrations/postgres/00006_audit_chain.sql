@@ -0,0 +1,19 @@
+-- +goose Up
+ALTER TABLE audit_log ADD COLUMN before_value TEXT;
+ALTER TABLE audit_log ADD COLUMN after_value TEXT;
+ALTER TABLE audit_log ADD COLUMN event TEXT;
+ALTER TABLE audit_log ADD COLUMN prev_hash TEXT;
+ALTER TABLE audit_log ADD COLUMN hash TEXT;
+
+-- the audit log is append-only
+CREATE RULE audit_log_no_update AS ON UPDATE TO audit_log DO INSTEAD NOTHING;
+CREATE RULE audit_log_no_delete AS ON DELETE TO audit_log DO INSTEAD NOTHING;
+
+-- +goose Down
+DROP RULE audit_log_no_delete ON audit_log;
+DROP RULE audit_log_no_update ON audit_log;
+ALTER TABLE audit_log DROP COLUMN hash;
+ALTER TABLE audit_log DROP COLUMN prev_hash;
+ALTER TABLE audit_log DROP COLUMN event;
+ALTER TABLE audit_log DROP COLUMN after_value;
+ALTER TABLE audit_log DROP COLUMN before_value;
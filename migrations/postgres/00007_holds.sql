@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE accounts ADD COLUMN address_changed_at TIMESTAMP;
+ALTER TABLE withdrawals ADD COLUMN reviewed_by TEXT;
+
+CREATE INDEX withdrawals_velocity_idx ON withdrawals (slack_user_id, asset, created_at);
+
+-- +goose Down
+DROP INDEX withdrawals_velocity_idx;
+ALTER TABLE withdrawals DROP COLUMN reviewed_by;
+ALTER TABLE accounts DROP COLUMN address_changed_at;
@@ -0,0 +1,48 @@
+-- +goose Up
+CREATE TABLE tips (
+    id SERIAL PRIMARY KEY,
+    from_user_id TEXT NOT NULL,
+    to_user_id TEXT NOT NULL,
+    asset TEXT NOT NULL,
+    amount NUMERIC(78, 0) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX tips_from_user_id_idx ON tips (from_user_id, created_at);
+CREATE INDEX tips_to_user_id_idx ON tips (to_user_id, created_at);
+
+-- one signup bonus per user and per address
+CREATE TABLE signup_bonuses (
+    slack_user_id TEXT PRIMARY KEY,
+    ethereum_address TEXT NOT NULL,
+    granted_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX signup_bonuses_address_key ON signup_bonuses (lower(ethereum_address));
+
+INSERT INTO signup_bonuses (slack_user_id, ethereum_address)
+SELECT DISTINCT ON (lower(a.ethereum_address)) a.slack_user_id, a.ethereum_address
+FROM accounts a JOIN ledger_entries l ON l.slack_user_id = a.slack_user_id AND l.kind = 'signup_bonus'
+WHERE a.ethereum_address IS NOT NULL
+ORDER BY lower(a.ethereum_address), a.id;
+
+CREATE TABLE reviews (
+    id SERIAL PRIMARY KEY,
+    kind TEXT NOT NULL,
+    slack_user_id TEXT NOT NULL,
+    other_user_id TEXT,
+    ethereum_address TEXT,
+    amount NUMERIC(78, 0),
+    reason TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    reviewed_by TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    reviewed_at TIMESTAMP
+);
+
+CREATE INDEX reviews_status_idx ON reviews (status);
+
+-- +goose Down
+DROP TABLE reviews;
+DROP TABLE signup_bonuses;
+DROP TABLE tips;
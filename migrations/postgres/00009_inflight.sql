@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE withdrawals ADD COLUMN raw_tx TEXT;
+ALTER TABLE withdrawals ADD COLUMN fee NUMERIC(78, 0);
+ALTER TABLE withdrawals ADD COLUMN fee_asset TEXT;
+
+-- +goose Down
+ALTER TABLE withdrawals DROP COLUMN fee_asset;
+ALTER TABLE withdrawals DROP COLUMN fee;
+ALTER TABLE withdrawals DROP COLUMN raw_tx;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- the answers to admin API requests made with an Idempotency-Key, replayed
+-- when a request is retried
+CREATE TABLE api_idempotency_keys (
+    actor TEXT NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    response TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (actor, key)
+);
+
+-- +goose Down
+DROP TABLE api_idempotency_keys;
@@ -0,0 +1,30 @@
+-- +goose Up
+-- webhook deliveries waiting to be sent, removed once delivered
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    webhook TEXT NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT now(),
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at);
+
+-- deliveries that ran out of attempts, until an admin replays them
+CREATE TABLE webhook_dead_letters (
+    id INTEGER PRIMARY KEY,
+    webhook TEXT NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    failed_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- +goose Down
+DROP TABLE webhook_dead_letters;
+DROP TABLE webhook_deliveries;
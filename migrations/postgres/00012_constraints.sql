@@ -0,0 +1,65 @@
+-- +goose Up
+-- accounts and balances from 00001_init.sql lacked keys, NOT NULL and
+-- timestamps. Rows without a user could never be read, so they go, unless
+-- they hold a balance, which fails the migration for an operator to sort out.
+DELETE FROM accounts WHERE slack_user_id IS NULL;
+ALTER TABLE accounts ALTER COLUMN slack_user_id SET NOT NULL;
+ALTER TABLE accounts ADD PRIMARY KEY (id);
+-- existing rows get the time of the migration
+ALTER TABLE accounts ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT now();
+ALTER TABLE accounts ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT now();
+
+DELETE FROM balances WHERE slack_user_id IS NULL AND COALESCE(balance, 0) = 0;
+UPDATE balances SET balance = 0 WHERE balance IS NULL;
+ALTER TABLE balances ALTER COLUMN slack_user_id SET NOT NULL;
+ALTER TABLE balances ALTER COLUMN balance SET NOT NULL;
+ALTER TABLE balances ALTER COLUMN balance SET DEFAULT 0;
+ALTER TABLE balances ADD PRIMARY KEY (id);
+ALTER TABLE balances ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT now();
+ALTER TABLE balances ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT now();
+
+-- every ledger entry, withdrawal and tip moved a balance, which may predate
+-- the ledger; give the odd orphan an empty balance rather than lose it
+INSERT INTO balances (slack_user_id, asset, balance)
+SELECT slack_user_id, asset, 0 FROM ledger_entries
+UNION SELECT slack_user_id, asset, 0 FROM withdrawals
+UNION SELECT from_user_id, asset, 0 FROM tips
+UNION SELECT to_user_id, asset, 0 FROM tips
+ON CONFLICT ON CONSTRAINT balances_slack_user_id_asset_key DO NOTHING;
+
+ALTER TABLE ledger_entries ADD CONSTRAINT ledger_entries_balance_fkey
+    FOREIGN KEY (slack_user_id, asset) REFERENCES balances (slack_user_id, asset);
+ALTER TABLE withdrawals ADD CONSTRAINT withdrawals_balance_fkey
+    FOREIGN KEY (slack_user_id, asset) REFERENCES balances (slack_user_id, asset);
+ALTER TABLE tips ADD CONSTRAINT tips_from_balance_fkey
+    FOREIGN KEY (from_user_id, asset) REFERENCES balances (slack_user_id, asset);
+ALTER TABLE tips ADD CONSTRAINT tips_to_balance_fkey
+    FOREIGN KEY (to_user_id, asset) REFERENCES balances (slack_user_id, asset);
+
+-- signup bonuses are granted on registration
+INSERT INTO accounts (slack_user_id, ethereum_address)
+SELECT slack_user_id, ethereum_address FROM signup_bonuses
+ON CONFLICT ON CONSTRAINT accounts_slack_user_id_key DO NOTHING;
+ALTER TABLE signup_bonuses ADD CONSTRAINT signup_bonuses_account_fkey
+    FOREIGN KEY (slack_user_id) REFERENCES accounts (slack_user_id);
+
+ALTER TABLE reviews ALTER COLUMN status SET NOT NULL;
+
+-- +goose Down
+ALTER TABLE signup_bonuses DROP CONSTRAINT signup_bonuses_account_fkey;
+ALTER TABLE tips DROP CONSTRAINT tips_to_balance_fkey;
+ALTER TABLE tips DROP CONSTRAINT tips_from_balance_fkey;
+ALTER TABLE withdrawals DROP CONSTRAINT withdrawals_balance_fkey;
+ALTER TABLE ledger_entries DROP CONSTRAINT ledger_entries_balance_fkey;
+
+ALTER TABLE balances DROP COLUMN updated_at;
+ALTER TABLE balances DROP COLUMN created_at;
+ALTER TABLE balances DROP CONSTRAINT balances_pkey;
+ALTER TABLE balances ALTER COLUMN balance DROP DEFAULT;
+ALTER TABLE balances ALTER COLUMN balance DROP NOT NULL;
+ALTER TABLE balances ALTER COLUMN slack_user_id DROP NOT NULL;
+
+ALTER TABLE accounts DROP COLUMN updated_at;
+ALTER TABLE accounts DROP COLUMN created_at;
+ALTER TABLE accounts DROP CONSTRAINT accounts_pkey;
+ALTER TABLE accounts ALTER COLUMN slack_user_id DROP NOT NULL;
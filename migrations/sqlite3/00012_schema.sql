@@ -0,0 +1,184 @@
+-- +goose Up
+-- SQLite databases start at the schema of postgres/00012_constraints.sql.
+-- Amounts are TEXT, since SQLite's NUMERIC can't hold 78 digits.
+CREATE TABLE accounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slack_user_id TEXT NOT NULL CONSTRAINT accounts_slack_user_id_key UNIQUE,
+    ethereum_address TEXT,
+    address_changed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE balances (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slack_user_id TEXT NOT NULL,
+    asset TEXT NOT NULL DEFAULT 'CULT',
+    balance TEXT NOT NULL DEFAULT '0',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT balances_slack_user_id_asset_key UNIQUE (slack_user_id, asset)
+);
+
+CREATE TABLE ledger_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slack_user_id TEXT NOT NULL,
+    asset TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    amount TEXT NOT NULL,
+    chain TEXT,
+    tx_hash TEXT,
+    note TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT ledger_entries_balance_fkey FOREIGN KEY (slack_user_id, asset) REFERENCES balances (slack_user_id, asset)
+);
+
+-- a deposit transaction can only ever be credited once
+CREATE UNIQUE INDEX ledger_entries_deposit_tx_hash_key ON ledger_entries (chain, tx_hash) WHERE kind = 'deposit';
+
+CREATE TABLE withdrawals (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slack_user_id TEXT NOT NULL,
+    chain TEXT NOT NULL,
+    asset TEXT NOT NULL,
+    address TEXT NOT NULL,
+    amount TEXT NOT NULL,
+    status TEXT NOT NULL,
+    tx_hash TEXT,
+    error TEXT,
+    reviewed_by TEXT,
+    raw_tx TEXT,
+    fee TEXT,
+    fee_asset TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT withdrawals_balance_fkey FOREIGN KEY (slack_user_id, asset) REFERENCES balances (slack_user_id, asset)
+);
+
+CREATE INDEX withdrawals_status_idx ON withdrawals (chain, status);
+CREATE INDEX withdrawals_slack_user_id_idx ON withdrawals (slack_user_id);
+CREATE INDEX withdrawals_velocity_idx ON withdrawals (slack_user_id, asset, created_at);
+
+CREATE TABLE settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE frozen_users (
+    slack_user_id TEXT PRIMARY KEY,
+    reason TEXT,
+    frozen_by TEXT NOT NULL,
+    frozen_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    subject TEXT,
+    detail TEXT,
+    before_value TEXT,
+    after_value TEXT,
+    event TEXT,
+    prev_hash TEXT,
+    hash TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- the audit log is append-only
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log BEGIN SELECT RAISE(IGNORE); END;
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log BEGIN SELECT RAISE(IGNORE); END;
+
+CREATE TABLE tips (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    from_user_id TEXT NOT NULL,
+    to_user_id TEXT NOT NULL,
+    asset TEXT NOT NULL,
+    amount TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT tips_from_balance_fkey FOREIGN KEY (from_user_id, asset) REFERENCES balances (slack_user_id, asset),
+    CONSTRAINT tips_to_balance_fkey FOREIGN KEY (to_user_id, asset) REFERENCES balances (slack_user_id, asset)
+);
+
+CREATE INDEX tips_from_user_id_idx ON tips (from_user_id, created_at);
+CREATE INDEX tips_to_user_id_idx ON tips (to_user_id, created_at);
+
+-- one signup bonus per user and per address
+CREATE TABLE signup_bonuses (
+    slack_user_id TEXT PRIMARY KEY,
+    ethereum_address TEXT NOT NULL,
+    granted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT signup_bonuses_account_fkey FOREIGN KEY (slack_user_id) REFERENCES accounts (slack_user_id)
+);
+
+CREATE UNIQUE INDEX signup_bonuses_address_key ON signup_bonuses (lower(ethereum_address));
+
+CREATE TABLE reviews (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,
+    slack_user_id TEXT NOT NULL,
+    other_user_id TEXT,
+    ethereum_address TEXT,
+    amount TEXT,
+    reason TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    reviewed_by TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reviewed_at TIMESTAMP
+);
+
+CREATE INDEX reviews_status_idx ON reviews (status);
+
+-- the answers to admin API requests made with an Idempotency-Key, replayed
+-- when a request is retried
+CREATE TABLE api_idempotency_keys (
+    actor TEXT NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    response TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (actor, key)
+);
+
+-- webhook deliveries waiting to be sent, removed once delivered
+CREATE TABLE webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook TEXT NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at);
+
+-- deliveries that ran out of attempts, until an admin replays them
+CREATE TABLE webhook_dead_letters (
+    id INTEGER PRIMARY KEY,
+    webhook TEXT NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE webhook_dead_letters;
+DROP TABLE webhook_deliveries;
+DROP TABLE api_idempotency_keys;
+DROP TABLE reviews;
+DROP TABLE signup_bonuses;
+DROP TABLE tips;
+DROP TABLE audit_log;
+DROP TABLE frozen_users;
+DROP TABLE settings;
+DROP TABLE withdrawals;
+DROP TABLE ledger_entries;
+DROP TABLE balances;
+DROP TABLE accounts;
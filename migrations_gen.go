@@ -0,0 +1,20 @@
+// Code generated by cmd/genmigrations; DO NOT EDIT.
+
+package main
+
+// embeddedMigrations are the files under migrations, by path.
+var embeddedMigrations = map[string]string{
+	"migrations/postgres/00001_init.sql":        "-- +goose Up\nCREATE TABLE accounts (\n    id SERIAL,\n    slack_user_id TEXT UNIQUE,\n    ethereum_address TEXT\n);\n\nCREATE TABLE balances (\n    id SERIAL,\n    slack_user_id TEXT UNIQUE,\n    balance INTEGER\n);\n-- +goose Down\nDROP TABLE accounts;\nDROP TABLE balances;\n",
+	"migrations/postgres/00002_assets.sql":      "-- +goose Up\nALTER TABLE balances ADD COLUMN asset TEXT NOT NULL DEFAULT 'CULT';\nALTER TABLE balances ALTER COLUMN balance TYPE NUMERIC(78, 0);\nALTER TABLE balances DROP CONSTRAINT balances_slack_user_id_key;\nALTER TABLE balances ADD CONSTRAINT balances_slack_user_id_asset_key UNIQUE (slack_user_id, asset);\n\nCREATE TABLE ledger_entries (\n    id SERIAL PRIMARY KEY,\n    slack_user_id TEXT NOT NULL,\n    asset TEXT NOT NULL,\n    kind TEXT NOT NULL,\n    amount NUMERIC(78, 0) NOT NULL,\n    tx_hash TEXT,\n    created_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\n-- a deposit transaction can only ever be credited once\nCREATE UNIQUE INDEX ledger_entries_deposit_tx_hash_key ON ledger_entries (tx_hash) WHERE kind = 'deposit';\n\n-- +goose Down\nDROP TABLE ledger_entries;\nDELETE FROM balances WHERE asset <> 'CULT';\nALTER TABLE balances DROP CONSTRAINT balances_slack_user_id_asset_key;\nALTER TABLE balances ADD CONSTRAINT balances_slack_user_id_key UNIQUE (slack_user_id);\nALTER TABLE balances ALTER COLUMN balance TYPE INTEGER;\nALTER TABLE balances DROP COLUMN asset;\n",
+	"migrations/postgres/00003_chains.sql":      "-- +goose Up\nALTER TABLE ledger_entries ADD COLUMN chain TEXT;\n\nDROP INDEX ledger_entries_deposit_tx_hash_key;\nCREATE UNIQUE INDEX ledger_entries_deposit_tx_hash_key ON ledger_entries (chain, tx_hash) WHERE kind = 'deposit';\n\n-- +goose Down\nDROP INDEX ledger_entries_deposit_tx_hash_key;\nCREATE UNIQUE INDEX ledger_entries_deposit_tx_hash_key ON ledger_entries (tx_hash) WHERE kind = 'deposit';\n\nALTER TABLE ledger_entries DROP COLUMN chain;\n",
+	"migrations/postgres/00004_withdrawals.sql": "-- +goose Up\nCREATE TABLE withdrawals (\n    id SERIAL PRIMARY KEY,\n    slack_user_id TEXT NOT NULL,\n    chain TEXT NOT NULL,\n    asset TEXT NOT NULL,\n    address TEXT NOT NULL,\n    amount NUMERIC(78, 0) NOT NULL,\n    status TEXT NOT NULL,\n    tx_hash TEXT,\n    error TEXT,\n    created_at TIMESTAMP NOT NULL DEFAULT now(),\n    updated_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\nCREATE INDEX withdrawals_status_idx ON withdrawals (chain, status);\nCREATE INDEX withdrawals_slack_user_id_idx ON withdrawals (slack_user_id);\n\n-- +goose Down\nDROP TABLE withdrawals;\n",
+	"migrations/postgres/00005_admin.sql":       "-- +goose Up\nCREATE TABLE settings (\n    key TEXT PRIMARY KEY,\n    value TEXT NOT NULL,\n    updated_by TEXT NOT NULL,\n    updated_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\nCREATE TABLE frozen_users (\n    slack_user_id TEXT PRIMARY KEY,\n    reason TEXT,\n    frozen_by TEXT NOT NULL,\n    frozen_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\nCREATE TABLE audit_log (\n    id SERIAL PRIMARY KEY,\n    actor TEXT NOT NULL,\n    action TEXT NOT NULL,\n    subject TEXT,\n    detail TEXT,\n    created_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\nALTER TABLE ledger_entries ADD COLUMN note TEXT;\n\n-- +goose Down\nALTER TABLE ledger_entries DROP COLUMN note;\nDROP TABLE audit_log;\nDROP TABLE frozen_users;\nDROP TABLE settings;\n",
+	"migrations/postgres/00006_audit_chain.sql": "-- +goose Up\nALTER TABLE audit_log ADD COLUMN before_value TEXT;\nALTER TABLE audit_log ADD COLUMN after_value TEXT;\nALTER TABLE audit_log ADD COLUMN event TEXT;\nALTER TABLE audit_log ADD COLUMN prev_hash TEXT;\nALTER TABLE audit_log ADD COLUMN hash TEXT;\n\n-- the audit log is append-only\nCREATE RULE audit_log_no_update AS ON UPDATE TO audit_log DO INSTEAD NOTHING;\nCREATE RULE audit_log_no_delete AS ON DELETE TO audit_log DO INSTEAD NOTHING;\n\n-- +goose Down\nDROP RULE audit_log_no_delete ON audit_log;\nDROP RULE audit_log_no_update ON audit_log;\nALTER TABLE audit_log DROP COLUMN hash;\nALTER TABLE audit_log DROP COLUMN prev_hash;\nALTER TABLE audit_log DROP COLUMN event;\nALTER TABLE audit_log DROP COLUMN after_value;\nALTER TABLE audit_log DROP COLUMN before_value;\n",
+	"migrations/postgres/00007_holds.sql":       "-- +goose Up\nALTER TABLE accounts ADD COLUMN address_changed_at TIMESTAMP;\nALTER TABLE withdrawals ADD COLUMN reviewed_by TEXT;\n\nCREATE INDEX withdrawals_velocity_idx ON withdrawals (slack_user_id, asset, created_at);\n\n-- +goose Down\nDROP INDEX withdrawals_velocity_idx;\nALTER TABLE withdrawals DROP COLUMN reviewed_by;\nALTER TABLE accounts DROP COLUMN address_changed_at;\n",
+	"migrations/postgres/00008_abuse.sql":       "-- +goose Up\nCREATE TABLE tips (\n    id SERIAL PRIMARY KEY,\n    from_user_id TEXT NOT NULL,\n    to_user_id TEXT NOT NULL,\n    asset TEXT NOT NULL,\n    amount NUMERIC(78, 0) NOT NULL,\n    created_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\nCREATE INDEX tips_from_user_id_idx ON tips (from_user_id, created_at);\nCREATE INDEX tips_to_user_id_idx ON tips (to_user_id, created_at);\n\n-- one signup bonus per user and per address\nCREATE TABLE signup_bonuses (\n    slack_user_id TEXT PRIMARY KEY,\n    ethereum_address TEXT NOT NULL,\n    granted_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\nCREATE UNIQUE INDEX signup_bonuses_address_key ON signup_bonuses (lower(ethereum_address));\n\nINSERT INTO signup_bonuses (slack_user_id, ethereum_address)\nSELECT DISTINCT ON (lower(a.ethereum_address)) a.slack_user_id, a.ethereum_address\nFROM accounts a JOIN ledger_entries l ON l.slack_user_id = a.slack_user_id AND l.kind = 'signup_bonus'\nWHERE a.ethereum_address IS NOT NULL\nORDER BY lower(a.ethereum_address), a.id;\n\nCREATE TABLE reviews (\n    id SERIAL PRIMARY KEY,\n    kind TEXT NOT NULL,\n    slack_user_id TEXT NOT NULL,\n    other_user_id TEXT,\n    ethereum_address TEXT,\n    amount NUMERIC(78, 0),\n    reason TEXT NOT NULL,\n    status TEXT NOT NULL DEFAULT 'pending',\n    reviewed_by TEXT,\n    created_at TIMESTAMP NOT NULL DEFAULT now(),\n    reviewed_at TIMESTAMP\n);\n\nCREATE INDEX reviews_status_idx ON reviews (status);\n\n-- +goose Down\nDROP TABLE reviews;\nDROP TABLE signup_bonuses;\nDROP TABLE tips;\n",
+	"migrations/postgres/00009_inflight.sql":    "-- +goose Up\nALTER TABLE withdrawals ADD COLUMN raw_tx TEXT;\nALTER TABLE withdrawals ADD COLUMN fee NUMERIC(78, 0);\nALTER TABLE withdrawals ADD COLUMN fee_asset TEXT;\n\n-- +goose Down\nALTER TABLE withdrawals DROP COLUMN fee_asset;\nALTER TABLE withdrawals DROP COLUMN fee;\nALTER TABLE withdrawals DROP COLUMN raw_tx;\n",
+	"migrations/postgres/00010_api.sql":         "-- +goose Up\n-- the answers to admin API requests made with an Idempotency-Key, replayed\n-- when a request is retried\nCREATE TABLE api_idempotency_keys (\n    actor TEXT NOT NULL,\n    key TEXT NOT NULL,\n    request_hash TEXT NOT NULL,\n    response TEXT NOT NULL,\n    created_at TIMESTAMP NOT NULL DEFAULT now(),\n    PRIMARY KEY (actor, key)\n);\n\n-- +goose Down\nDROP TABLE api_idempotency_keys;\n",
+	"migrations/postgres/00011_webhooks.sql":    "-- +goose Up\n-- webhook deliveries waiting to be sent, removed once delivered\nCREATE TABLE webhook_deliveries (\n    id SERIAL PRIMARY KEY,\n    webhook TEXT NOT NULL,\n    event TEXT NOT NULL,\n    payload TEXT NOT NULL,\n    attempts INTEGER NOT NULL DEFAULT 0,\n    last_error TEXT,\n    next_attempt_at TIMESTAMP NOT NULL DEFAULT now(),\n    created_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\nCREATE INDEX webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at);\n\n-- deliveries that ran out of attempts, until an admin replays them\nCREATE TABLE webhook_dead_letters (\n    id INTEGER PRIMARY KEY,\n    webhook TEXT NOT NULL,\n    event TEXT NOT NULL,\n    payload TEXT NOT NULL,\n    attempts INTEGER NOT NULL,\n    last_error TEXT,\n    created_at TIMESTAMP NOT NULL,\n    failed_at TIMESTAMP NOT NULL DEFAULT now()\n);\n\n-- +goose Down\nDROP TABLE webhook_dead_letters;\nDROP TABLE webhook_deliveries;\n",
+	"migrations/postgres/00012_constraints.sql": "-- +goose Up\n-- accounts and balances from 00001_init.sql lacked keys, NOT NULL and\n-- timestamps. Rows without a user could never be read, so they go, unless\n-- they hold a balance, which fails the migration for an operator to sort out.\nDELETE FROM accounts WHERE slack_user_id IS NULL;\nALTER TABLE accounts ALTER COLUMN slack_user_id SET NOT NULL;\nALTER TABLE accounts ADD PRIMARY KEY (id);\n-- existing rows get the time of the migration\nALTER TABLE accounts ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT now();\nALTER TABLE accounts ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT now();\n\nDELETE FROM balances WHERE slack_user_id IS NULL AND COALESCE(balance, 0) = 0;\nUPDATE balances SET balance = 0 WHERE balance IS NULL;\nALTER TABLE balances ALTER COLUMN slack_user_id SET NOT NULL;\nALTER TABLE balances ALTER COLUMN balance SET NOT NULL;\nALTER TABLE balances ALTER COLUMN balance SET DEFAULT 0;\nALTER TABLE balances ADD PRIMARY KEY (id);\nALTER TABLE balances ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT now();\nALTER TABLE balances ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT now();\n\n-- every ledger entry, withdrawal and tip moved a balance, which may predate\n-- the ledger; give the odd orphan an empty balance rather than lose it\nINSERT INTO balances (slack_user_id, asset, balance)\nSELECT slack_user_id, asset, 0 FROM ledger_entries\nUNION SELECT slack_user_id, asset, 0 FROM withdrawals\nUNION SELECT from_user_id, asset, 0 FROM tips\nUNION SELECT to_user_id, asset, 0 FROM tips\nON CONFLICT ON CONSTRAINT balances_slack_user_id_asset_key DO NOTHING;\n\nALTER TABLE ledger_entries ADD CONSTRAINT ledger_entries_balance_fkey\n    FOREIGN KEY (slack_user_id, asset) REFERENCES balances (slack_user_id, asset);\nALTER TABLE withdrawals ADD CONSTRAINT withdrawals_balance_fkey\n    FOREIGN KEY (slack_user_id, asset) REFERENCES balances (slack_user_id, asset);\nALTER TABLE tips ADD CONSTRAINT tips_from_balance_fkey\n    FOREIGN KEY (from_user_id, asset) REFERENCES balances (slack_user_id, asset);\nALTER TABLE tips ADD CONSTRAINT tips_to_balance_fkey\n    FOREIGN KEY (to_user_id, asset) REFERENCES balances (slack_user_id, asset);\n\n-- signup bonuses are granted on registration\nINSERT INTO accounts (slack_user_id, ethereum_address)\nSELECT slack_user_id, ethereum_address FROM signup_bonuses\nON CONFLICT ON CONSTRAINT accounts_slack_user_id_key DO NOTHING;\nALTER TABLE signup_bonuses ADD CONSTRAINT signup_bonuses_account_fkey\n    FOREIGN KEY (slack_user_id) REFERENCES accounts (slack_user_id);\n\nALTER TABLE reviews ALTER COLUMN status SET NOT NULL;\n\n-- +goose Down\nALTER TABLE signup_bonuses DROP CONSTRAINT signup_bonuses_account_fkey;\nALTER TABLE tips DROP CONSTRAINT tips_to_balance_fkey;\nALTER TABLE tips DROP CONSTRAINT tips_from_balance_fkey;\nALTER TABLE withdrawals DROP CONSTRAINT withdrawals_balance_fkey;\nALTER TABLE ledger_entries DROP CONSTRAINT ledger_entries_balance_fkey;\n\nALTER TABLE balances DROP COLUMN updated_at;\nALTER TABLE balances DROP COLUMN created_at;\nALTER TABLE balances DROP CONSTRAINT balances_pkey;\nALTER TABLE balances ALTER COLUMN balance DROP DEFAULT;\nALTER TABLE balances ALTER COLUMN balance DROP NOT NULL;\nALTER TABLE balances ALTER COLUMN slack_user_id DROP NOT NULL;\n\nALTER TABLE accounts DROP COLUMN updated_at;\nALTER TABLE accounts DROP COLUMN created_at;\nALTER TABLE accounts DROP CONSTRAINT accounts_pkey;\nALTER TABLE accounts ALTER COLUMN slack_user_id DROP NOT NULL;\n",
+	"migrations/sqlite3/00012_schema.sql":       "-- +goose Up\n-- SQLite databases start at the schema of postgres/00012_constraints.sql.\n-- Amounts are TEXT, since SQLite's NUMERIC can't hold 78 digits.\nCREATE TABLE accounts (\n    id INTEGER PRIMARY KEY AUTOINCREMENT,\n    slack_user_id TEXT NOT NULL CONSTRAINT accounts_slack_user_id_key UNIQUE,\n    ethereum_address TEXT,\n    address_changed_at TIMESTAMP,\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP\n);\n\nCREATE TABLE balances (\n    id INTEGER PRIMARY KEY AUTOINCREMENT,\n    slack_user_id TEXT NOT NULL,\n    asset TEXT NOT NULL DEFAULT 'CULT',\n    balance TEXT NOT NULL DEFAULT '0',\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    CONSTRAINT balances_slack_user_id_asset_key UNIQUE (slack_user_id, asset)\n);\n\nCREATE TABLE ledger_entries (\n    id INTEGER PRIMARY KEY AUTOINCREMENT,\n    slack_user_id TEXT NOT NULL,\n    asset TEXT NOT NULL,\n    kind TEXT NOT NULL,\n    amount TEXT NOT NULL,\n    chain TEXT,\n    tx_hash TEXT,\n    note TEXT,\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    CONSTRAINT ledger_entries_balance_fkey FOREIGN KEY (slack_user_id, asset) REFERENCES balances (slack_user_id, asset)\n);\n\n-- a deposit transaction can only ever be credited once\nCREATE UNIQUE INDEX ledger_entries_deposit_tx_hash_key ON ledger_entries (chain, tx_hash) WHERE kind = 'deposit';\n\nCREATE TABLE withdrawals (\n    id INTEGER PRIMARY KEY AUTOINCREMENT,\n    slack_user_id TEXT NOT NULL,\n    chain TEXT NOT NULL,\n    asset TEXT NOT NULL,\n    address TEXT NOT NULL,\n    amount TEXT NOT NULL,\n    status TEXT NOT NULL,\n    tx_hash TEXT,\n    error TEXT,\n    reviewed_by TEXT,\n    raw_tx TEXT,\n    fee TEXT,\n    fee_asset TEXT,\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    CONSTRAINT withdrawals_balance_fkey FOREIGN KEY (slack_user_id, asset) REFERENCES balances (slack_user_id, asset)\n);\n\nCREATE INDEX withdrawals_status_idx ON withdrawals (chain, status);\nCREATE INDEX withdrawals_slack_user_id_idx ON withdrawals (slack_user_id);\nCREATE INDEX withdrawals_velocity_idx ON withdrawals (slack_user_id, asset, created_at);\n\nCREATE TABLE settings (\n    key TEXT PRIMARY KEY,\n    value TEXT NOT NULL,\n    updated_by TEXT NOT NULL,\n    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP\n);\n\nCREATE TABLE frozen_users (\n    slack_user_id TEXT PRIMARY KEY,\n    reason TEXT,\n    frozen_by TEXT NOT NULL,\n    frozen_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP\n);\n\nCREATE TABLE audit_log (\n    id INTEGER PRIMARY KEY AUTOINCREMENT,\n    actor TEXT NOT NULL,\n    action TEXT NOT NULL,\n    subject TEXT,\n    detail TEXT,\n    before_value TEXT,\n    after_value TEXT,\n    event TEXT,\n    prev_hash TEXT,\n    hash TEXT,\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP\n);\n\n-- the audit log is append-only\nCREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log BEGIN SELECT RAISE(IGNORE); END;\nCREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log BEGIN SELECT RAISE(IGNORE); END;\n\nCREATE TABLE tips (\n    id INTEGER PRIMARY KEY AUTOINCREMENT,\n    from_user_id TEXT NOT NULL,\n    to_user_id TEXT NOT NULL,\n    asset TEXT NOT NULL,\n    amount TEXT NOT NULL,\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    CONSTRAINT tips_from_balance_fkey FOREIGN KEY (from_user_id, asset) REFERENCES balances (slack_user_id, asset),\n    CONSTRAINT tips_to_balance_fkey FOREIGN KEY (to_user_id, asset) REFERENCES balances (slack_user_id, asset)\n);\n\nCREATE INDEX tips_from_user_id_idx ON tips (from_user_id, created_at);\nCREATE INDEX tips_to_user_id_idx ON tips (to_user_id, created_at);\n\n-- one signup bonus per user and per address\nCREATE TABLE signup_bonuses (\n    slack_user_id TEXT PRIMARY KEY,\n    ethereum_address TEXT NOT NULL,\n    granted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    CONSTRAINT signup_bonuses_account_fkey FOREIGN KEY (slack_user_id) REFERENCES accounts (slack_user_id)\n);\n\nCREATE UNIQUE INDEX signup_bonuses_address_key ON signup_bonuses (lower(ethereum_address));\n\nCREATE TABLE reviews (\n    id INTEGER PRIMARY KEY AUTOINCREMENT,\n    kind TEXT NOT NULL,\n    slack_user_id TEXT NOT NULL,\n    other_user_id TEXT,\n    ethereum_address TEXT,\n    amount TEXT,\n    reason TEXT NOT NULL,\n    status TEXT NOT NULL DEFAULT 'pending',\n    reviewed_by TEXT,\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    reviewed_at TIMESTAMP\n);\n\nCREATE INDEX reviews_status_idx ON reviews (status);\n\n-- the answers to admin API requests made with an Idempotency-Key, replayed\n-- when a request is retried\nCREATE TABLE api_idempotency_keys (\n    actor TEXT NOT NULL,\n    key TEXT NOT NULL,\n    request_hash TEXT NOT NULL,\n    response TEXT NOT NULL,\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    PRIMARY KEY (actor, key)\n);\n\n-- webhook deliveries waiting to be sent, removed once delivered\nCREATE TABLE webhook_deliveries (\n    id INTEGER PRIMARY KEY AUTOINCREMENT,\n    webhook TEXT NOT NULL,\n    event TEXT NOT NULL,\n    payload TEXT NOT NULL,\n    attempts INTEGER NOT NULL DEFAULT 0,\n    last_error TEXT,\n    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,\n    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP\n);\n\nCREATE INDEX webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at);\n\n-- deliveries that ran out of attempts, until an admin replays them\nCREATE TABLE webhook_dead_letters (\n    id INTEGER PRIMARY KEY,\n    webhook TEXT NOT NULL,\n    event TEXT NOT NULL,\n    payload TEXT NOT NULL,\n    attempts INTEGER NOT NULL,\n    last_error TEXT,\n    created_at TIMESTAMP NOT NULL,\n    failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP\n);\n\n-- +goose Down\nDROP TABLE webhook_dead_letters;\nDROP TABLE webhook_deliveries;\nDROP TABLE api_idempotency_keys;\nDROP TABLE reviews;\nDROP TABLE signup_bonuses;\nDROP TABLE tips;\nDROP TABLE audit_log;\nDROP TABLE frozen_users;\nDROP TABLE settings;\nDROP TABLE withdrawals;\nDROP TABLE ledger_entries;\nDROP TABLE balances;\nDROP TABLE accounts;\n",
+}
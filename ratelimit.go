@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Classes of commands, limited separately.
+const (
+	// classRead only looks things up.
+	classRead = "read"
+	// classMoney moves balances around in the database.
+	classMoney = "money"
+	// classOnChain talks to a chain and may send transactions.
+	classOnChain = "onchain"
+	// classAdmin is never limited.
+	classAdmin = "admin"
+)
+
+var commandClasses = map[string]string{
+	"tip":         classMoney,
+	"register":    classMoney,
+	"withdraw":    classOnChain,
+	"deposit":     classOnChain,
+	"admin":       classAdmin,
+	"reconcile":   classAdmin,
+	"allowance":   classAdmin,
+	"balance":     classRead,
+	"withdrawals": classRead,
+	"chains":      classRead,
+	"help":        classRead,
+}
+
+// Default quotas of each class, as "class=tokens/period" lists.
+const (
+	defaultUserRateLimits    = "read=10/1m,money=10/1m,onchain=3/10m"
+	defaultChannelRateLimits = "read=30/1m,money=30/1m,onchain=10/10m"
+	defaultGlobalRateLimits  = "read=100/1m,money=100/1m,onchain=30/10m"
+)
+
+// rateLimitSweepInterval is how often idle buckets are forgotten.
+const rateLimitSweepInterval = 10 * time.Minute
+
+// rate allows bursts of up to tokens commands, refilled evenly over period.
+type rate struct {
+	tokens float64
+	period time.Duration
+}
+
+func (r rate) perSecond() float64 {
+	return r.tokens / r.period.Seconds()
+}
+
+// parseRateLimits parses a "class=tokens/period" list such as
+// "read=10/1m,onchain=3/10m".
+func parseRateLimits(s string) (map[string]rate, error) {
+	limits := map[string]rate{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q", item)
+		}
+		quota := strings.SplitN(parts[1], "/", 2)
+		if len(quota) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q", item)
+		}
+		tokens, err := strconv.ParseFloat(quota[0], 64)
+		if err != nil || tokens <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q", item)
+		}
+		period, err := time.ParseDuration(quota[1])
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q", item)
+		}
+		limits[strings.TrimSpace(parts[0])] = rate{tokens: tokens, period: period}
+	}
+	return limits, nil
+}
+
+// tokenBucket holds the tokens left for one user, channel or the whole bot
+// in one class.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// warned is set once the owner was told they are throttled, so that a
+	// flood of commands doesn't turn into a flood of replies.
+	warned bool
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *tokenBucket) refill(r rate, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * r.perSecond()
+	if b.tokens > r.tokens {
+		b.tokens = r.tokens
+	}
+	b.last = now
+}
+
+// wait is how long until the bucket has a token again.
+func (b *tokenBucket) wait(r rate) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / r.perSecond() * float64(time.Second))
+}
+
+// rateLimiter keeps token buckets per user, per channel and globally.
+type rateLimiter struct {
+	mu        sync.Mutex
+	scopes    map[string]map[string]rate
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// configure replaces the quotas. Buckets keep their tokens, capped to the
+// new bursts the next time they are used.
+func (l *rateLimiter) configure(user, channel, global map[string]rate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.scopes = map[string]map[string]rate{"user": user, "channel": channel, "global": global}
+}
+
+// allow takes a token of class from the buckets of the user, the channel and
+// the whole bot, or from none of them when one is empty. It returns the
+// scope that ran out, how long until it refills, and whether the caller
+// should be told.
+func (l *rateLimiter) allow(userID, channelID, class string) (scope string, wait time.Duration, warn bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	keys := map[string]string{"user": userID, "channel": channelID, "global": ""}
+	type limited struct {
+		bucket *tokenBucket
+		rate   rate
+	}
+	var taken []limited
+	for _, s := range []string{"user", "channel", "global"} {
+		r, ok := l.scopes[s][class]
+		if !ok {
+			continue
+		}
+		key := s + "/" + keys[s] + "/" + class
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: r.tokens, last: now}
+			l.buckets[key] = b
+		}
+		b.refill(r, now)
+		if b.tokens < 1 {
+			warn = !b.warned
+			b.warned = true
+			return s, b.wait(r), warn
+		}
+		taken = append(taken, limited{b, r})
+	}
+
+	for _, t := range taken {
+		t.bucket.tokens--
+		t.bucket.warned = false
+	}
+	return "", 0, false
+}
+
+// sweep forgets buckets that have refilled completely, which behave the same
+// as new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		parts := strings.Split(key, "/")
+		r, ok := l.scopes[parts[0]][parts[2]]
+		if !ok || now.Sub(b.last).Seconds()*r.perSecond()+b.tokens >= r.tokens {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var commandLimiter = newRateLimiter()
+
+// loadRateLimits configures the command limiter with the quotas of users,
+// channels and the whole bot.
+func loadRateLimits(user, channel, global string) error {
+	var scopes []map[string]rate
+	for _, config := range []string{user, channel, global} {
+		limits, err := parseRateLimits(config)
+		if err != nil {
+			return err
+		}
+		scopes = append(scopes, limits)
+	}
+	commandLimiter.configure(scopes[0], scopes[1], scopes[2])
+	return nil
+}
+
+// allowCommand reports whether the command may run now, and replies with a
+// friendly note the first time a user, channel or the bot is throttled.
+func allowCommand(api *slack.Client, ev *slack.MessageEvent, command string) bool {
+	class, ok := commandClasses[command]
+	if !ok {
+		class = classRead
+	}
+	if class == classAdmin {
+		return true
+	}
+
+	scope, wait, warn := commandLimiter.allow(ev.User, ev.Channel, class)
+	if scope == "" {
+		return true
+	}
+	commandsThrottled.WithLabelValues(class, scope).Inc()
+
+	if warn {
+		wait = wait.Round(time.Second) + time.Second
+		switch scope {
+		case "user":
+			sendSlackMessage(api, ev.User, fmt.Sprintf(":snail: Whoa, slow down! Try `%s` again in %s", command, wait))
+		case "channel":
+			sendSlackMessage(api, ev.Channel, fmt.Sprintf(":snail: This channel is keeping me busy, try again in %s", wait))
+		default:
+			sendSlackMessage(api, ev.Channel, fmt.Sprintf(":snail: I'm swamped right now, try again in %s", wait))
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[string]rate
+		ok   bool
+	}{
+		{"", map[string]rate{}, true},
+		{"read=10/1m", map[string]rate{"read": {10, time.Minute}}, true},
+		{" read=10/1m, onchain=0.5/10m ,", map[string]rate{"read": {10, time.Minute}, "onchain": {0.5, 10 * time.Minute}}, true},
+		{defaultUserRateLimits, map[string]rate{"read": {10, time.Minute}, "money": {10, time.Minute}, "onchain": {3, 10 * time.Minute}}, true},
+		{"read", nil, false},
+		{"read=10", nil, false},
+		{"read=0/1m", nil, false},
+		{"read=-1/1m", nil, false},
+		{"read=ten/1m", nil, false},
+		{"read=10/0s", nil, false},
+		{"read=10/minute", nil, false},
+	}
+	for _, test := range tests {
+		got, err := parseRateLimits(test.s)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q: parsed as %v", test.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%q: parsed as %v, want %v", test.s, got, test.want)
+		}
+		for class, r := range test.want {
+			if got[class] != r {
+				t.Errorf("%q: %s is %v, want %v", test.s, class, got[class], r)
+			}
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	r := rate{tokens: 2, period: time.Minute}
+	start := time.Now()
+	b := &tokenBucket{tokens: 0, last: start}
+
+	tests := []struct {
+		after  time.Duration
+		tokens float64
+		wait   time.Duration
+	}{
+		{0, 0, 30 * time.Second},
+		{15 * time.Second, 0.5, 15 * time.Second},
+		{30 * time.Second, 1, 0},
+		// the burst caps the refill
+		{10 * time.Minute, 2, 0},
+	}
+	for _, test := range tests {
+		b.refill(r, start.Add(test.after))
+		if b.tokens != test.tokens {
+			t.Errorf("after %s: %v tokens, want %v", test.after, b.tokens, test.tokens)
+		}
+		if wait := b.wait(r); wait != test.wait {
+			t.Errorf("after %s: wait %s, want %s", test.after, wait, test.wait)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter()
+	l.configure(
+		map[string]rate{"read": {2, time.Hour}},
+		map[string]rate{"read": {3, time.Hour}},
+		map[string]rate{"read": {4, time.Hour}, "money": {1, time.Hour}},
+	)
+
+	tests := []struct {
+		user    string
+		channel string
+		class   string
+		scope   string
+		warn    bool
+	}{
+		{"U1", "C1", "read", "", false},
+		{"U1", "C1", "read", "", false},
+		{"U1", "C1", "read", "user", true},
+		// told once until a command goes through again
+		{"U1", "C1", "read", "user", false},
+		{"U2", "C1", "read", "", false},
+		{"U2", "C1", "read", "channel", true},
+		// the channel ran out before U2 took a token of its own
+		{"U2", "C2", "read", "", false},
+		{"U3", "C2", "read", "global", true},
+		{"U3", "C2", "money", "", false},
+		{"U3", "C2", "money", "global", true},
+		// classes without quotas aren't limited
+		{"U3", "C2", "admin", "", false},
+	}
+	for i, test := range tests {
+		scope, wait, warn := l.allow(test.user, test.channel, test.class)
+		if scope != test.scope || warn != test.warn {
+			t.Errorf("%d: %s in %s %s: limited by %q, warn %v, want %q, warn %v", i, test.user, test.channel, test.class, scope, warn, test.scope, test.warn)
+		}
+		if (scope != "") != (wait > 0) {
+			t.Errorf("%d: limited by %q with a wait of %s", i, scope, wait)
+		}
+	}
+}
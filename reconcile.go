@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/lib/pq"
+	"github.com/nlopes/slack"
+)
+
+// holding is what one chain holds of an asset for the users.
+type holding struct {
+	Chain   string   `json:"chain"`
+	Address string   `json:"address"`
+	Amount  *big.Int `json:"amount"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// solvencyReport compares what the ledger owes users of an asset to what the
+// bot holds on-chain.
+type solvencyReport struct {
+	Asset string `json:"asset"`
+	// Liabilities is the sum of all user balances.
+	Liabilities *big.Int `json:"liabilities"`
+	// InFlight was debited from balances for withdrawals that haven't left
+	// the hot wallets yet.
+	InFlight *big.Int  `json:"in_flight"`
+	Holdings []holding `json:"holdings"`
+	Held     *big.Int  `json:"held"`
+	// Surplus is Held minus Liabilities and InFlight. Deposits that were
+	// sent but not credited yet show up as surplus.
+	Surplus   *big.Int  `json:"surplus"`
+	Complete  bool      `json:"complete"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func (r *solvencyReport) insolvent() bool {
+	return r.Complete && r.Surplus.Sign() < 0
+}
+
+func (r *solvencyReport) String() string {
+	state := ":white_check_mark: solvent"
+	if r.insolvent() {
+		state = ":rotating_light: *INSOLVENT*"
+	} else if !r.Complete {
+		state = ":warning: incomplete"
+	}
+
+	lines := []string{fmt.Sprintf("%s %s: owes %s + %s in flight, holds %s, surplus %s",
+		r.Asset, state, formatAmount(r.Liabilities, r.Asset), formatAmount(r.InFlight, r.Asset), formatAmount(r.Held, r.Asset), formatAmount(r.Surplus, r.Asset))}
+	for _, h := range r.Holdings {
+		if h.Error != "" {
+			lines = append(lines, fmt.Sprintf("• `%s`: :x: %s", h.Chain, h.Error))
+		} else {
+			lines = append(lines, fmt.Sprintf("• `%s` `%s`: %s", h.Chain, h.Address, formatAmount(h.Amount, r.Asset)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runReconciliation reports solvency to the admin channel once per
+// RECONCILE_INTERVAL.
+func runReconciliation(api *slack.Client) {
+	if reconcileInterval <= 0 {
+		return
+	}
+
+	for range time.Tick(reconcileInterval) {
+		if !beginWork() {
+			return
+		}
+		ctx := correlatedContext()
+		reports, err := reconcile(ctx)
+		endWork()
+		if err != nil {
+			logError(ctx, "Failed to reconcile", logFields{"error": err})
+			continue
+		}
+		alertAdmins(api, formatSolvencyReports(reports))
+	}
+}
+
+func formatSolvencyReports(reports []*solvencyReport) string {
+	lines := []string{":scales: Reconciliation of the ledger against on-chain balances:"}
+	for _, r := range reports {
+		line := r.String()
+		if r.insolvent() {
+			line = "<!here> " + line
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reconcile builds a solvency report per asset. It only reads, withdrawals
+// are resumed and settled by runWithdrawalRecovery.
+func reconcile(ctx context.Context) ([]*solvencyReport, error) {
+	liabilities, err := sumByAsset(`SELECT asset, COALESCE(SUM(balance), 0) FROM balances GROUP BY asset;`)
+	if err != nil {
+		return nil, err
+	}
+	inFlight, err := sumByAsset(`SELECT asset, COALESCE(SUM(amount), 0) FROM withdrawals WHERE status = ANY($1) GROUP BY asset;`,
+		pq.Array([]string{withdrawalPendingApproval, withdrawalQueued, withdrawalSending, withdrawalBatched, withdrawalSent}))
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*solvencyReport
+	for _, asset := range []string{tokenAsset, etherAsset} {
+		var holdings []holding
+		for _, name := range chainNames() {
+			// the ether of other chains isn't the users' ETH
+			if asset == etherAsset && chains[name] != etherChain {
+				continue
+			}
+			holdings = append(holdings, holdingOf(chains[name], asset))
+		}
+		r := newSolvencyReport(asset, liabilities[asset], inFlight[asset], holdings)
+		reports = append(reports, r)
+		logInfo(ctx, "Reconciled", logFields{"asset": asset, "liabilities": r.Liabilities, "in_flight": r.InFlight, "held": r.Held, "surplus": r.Surplus, "complete": r.Complete})
+	}
+	return reports, nil
+}
+
+// newSolvencyReport compares the liabilities and withdrawals in flight of
+// asset to its holdings. Holdings that couldn't be read make the report
+// incomplete rather than insolvent.
+func newSolvencyReport(asset string, liabilities, inFlight *big.Int, holdings []holding) *solvencyReport {
+	r := &solvencyReport{
+		Asset:       asset,
+		Liabilities: liabilities,
+		InFlight:    inFlight,
+		Holdings:    holdings,
+		Held:        new(big.Int),
+		Complete:    true,
+		CheckedAt:   time.Now(),
+	}
+	for _, h := range holdings {
+		if h.Error != "" {
+			r.Complete = false
+		} else {
+			r.Held.Add(r.Held, h.Amount)
+		}
+	}
+	r.Surplus = new(big.Int).Sub(r.Held, r.Liabilities)
+	r.Surplus.Sub(r.Surplus, r.InFlight)
+	return r
+}
+
+// sumByAsset runs a query returning asset and amount pairs. Assets missing
+// from the result sum to zero.
+func sumByAsset(query string, args ...interface{}) (map[string]*big.Int, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[string]*big.Int{tokenAsset: new(big.Int), etherAsset: new(big.Int)}
+	for rows.Next() {
+		var asset, sum string
+		if err := rows.Scan(&asset, &sum); err != nil {
+			return nil, err
+		}
+		sums[asset], _ = new(big.Int).SetString(sum, 10)
+	}
+	return sums, rows.Err()
+}
+
+// holdingOf reads what c holds of asset for the users: the hot wallet's
+// balance, or in treasury mode as much of the treasury's tokens as the hot
+// wallet is allowed to move.
+func holdingOf(c *chain, asset string) holding {
+	h := holding{Chain: c.Name, Amount: new(big.Int)}
+
+	hotWallet, err := c.hotWalletAddress()
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	h.Address = hotWallet.Hex()
+
+	conn, err := c.backend()
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	ctx := context.Background()
+
+	if asset == etherAsset {
+		balance, err := conn.BalanceAt(ctx, hotWallet, nil)
+		if err != nil {
+			h.Error = err.Error()
+		} else {
+			h.Amount = balance
+		}
+		return h
+	}
+
+	token, err := NewTokenCaller(common.HexToAddress(c.TokenAddress), conn)
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	opts := &bind.CallOpts{Context: ctx}
+
+	if !c.treasuryMode() {
+		balance, err := token.BalanceOf(opts, hotWallet)
+		if err != nil {
+			h.Error = err.Error()
+		} else {
+			h.Amount = balance
+		}
+		return h
+	}
+
+	h.Address = c.TreasuryAddress
+	balance, err := token.BalanceOf(opts, common.HexToAddress(c.TreasuryAddress))
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	allowance, err := token.Allowance(opts, common.HexToAddress(c.TreasuryAddress), hotWallet)
+	if err != nil {
+		h.Error = err.Error()
+		return h
+	}
+	if allowance.Cmp(balance) < 0 {
+		balance = allowance
+	}
+	h.Amount = balance
+	return h
+}
+
+func handleReconcileCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent) {
+	reports, err := reconcile(ctx)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	sendSlackMessage(api, ev.Channel, formatSolvencyReports(reports))
+}
+
+// solvencyHandler serves the solvency reports as JSON to callers presenting
+// ADMIN_HTTP_TOKEN. It answers 503 when the bot is insolvent so that uptime
+// monitors can alert on it.
+func solvencyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminHTTPToken == "" || r.Header.Get("Authorization") != "Bearer "+adminHTTPToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		reports, err := reconcile(correlatedContext())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		for _, report := range reports {
+			if report.insolvent() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				break
+			}
+		}
+		json.NewEncoder(w).Encode(reports)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestNewSolvencyReport(t *testing.T) {
+	held := func(chain string, amount int64) holding {
+		return holding{Chain: chain, Amount: big.NewInt(amount)}
+	}
+	tests := []struct {
+		name                  string
+		liabilities, inFlight int64
+		holdings              []holding
+		held, surplus         int64
+		complete, insolvent   bool
+	}{
+		{"solvent", 100, 20, []holding{held("a", 150)}, 150, 30, true, false},
+		{"even across chains", 100, 0, []holding{held("a", 60), held("b", 40)}, 100, 0, true, false},
+		{"owing withdrawals in flight", 100, 20, []holding{held("a", 110)}, 110, -10, true, true},
+		{"insolvent", 100, 0, []holding{held("a", 60), held("b", 30)}, 90, -10, true, true},
+		{"incomplete", 100, 0, []holding{held("a", 50), {Chain: "b", Amount: new(big.Int), Error: "no reachable RPC endpoint"}}, 50, -50, false, false},
+		{"nothing", 0, 0, nil, 0, 0, true, false},
+	}
+	for _, test := range tests {
+		r := newSolvencyReport(tokenAsset, big.NewInt(test.liabilities), big.NewInt(test.inFlight), test.holdings)
+		if r.Held.Int64() != test.held || r.Surplus.Int64() != test.surplus || r.Complete != test.complete || r.insolvent() != test.insolvent {
+			t.Errorf("%s: held %v, surplus %v, complete %v, insolvent %v", test.name, r.Held, r.Surplus, r.Complete, r.insolvent())
+		}
+	}
+}
+
+func TestFormatSolvencyReports(t *testing.T) {
+	reports := []*solvencyReport{
+		newSolvencyReport(tokenAsset, big.NewInt(100), big.NewInt(0), []holding{{Chain: "a", Address: "0xa", Amount: big.NewInt(90)}}),
+		newSolvencyReport(etherAsset, new(big.Int), new(big.Int), []holding{{Chain: "b", Amount: new(big.Int), Error: "boom"}}),
+	}
+	lines := strings.Split(formatSolvencyReports(reports), "\n")
+	want := []string{
+		":scales: Reconciliation of the ledger against on-chain balances:",
+		"<!here> CULT :rotating_light: *INSOLVENT*: owes 100 + 0 in flight, holds 90, surplus -10",
+		"• `a` `0xa`: 90",
+		"ETH :warning: incomplete: owes 0 + 0 in flight, holds 0, surplus 0",
+		"• `b`: :x: boom",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("formatted as %q", lines)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d is %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestHoldingOf(t *testing.T) {
+	tc := newTestChain(t)
+	auth, err := tc.transactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := holdingOf(tc.chain, tokenAsset); h.Error != "" || h.Address != auth.From.Hex() || h.Amount.Cmp(tc.tokenBalance(t, auth.From)) != 0 {
+		t.Errorf("token holding is %+v", h)
+	}
+	ether, err := tc.sim.BalanceAt(context.Background(), auth.From, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := holdingOf(tc.chain, etherAsset); h.Error != "" || h.Amount.Cmp(ether) != 0 {
+		t.Errorf("ether holding is %+v, want %v", h, ether)
+	}
+
+	// in treasury mode, as much of the treasury's tokens as the hot wallet
+	// may move
+	token, err := NewToken(tc.token, tc.sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treasury := crypto.PubkeyToAddress(tc.operator.PublicKey)
+	if _, err := token.Transfer(auth, treasury, big.NewInt(500)); err != nil {
+		t.Fatal(err)
+	}
+	tc.sim.Commit()
+	tc.TreasuryAddress = treasury.Hex()
+	for _, allowance := range []int64{200, 1000} {
+		if _, err := token.Approve(bind.NewKeyedTransactor(tc.operator), auth.From, big.NewInt(allowance)); err != nil {
+			t.Fatal(err)
+		}
+		tc.sim.Commit()
+		want := allowance
+		if want > 500 {
+			want = 500
+		}
+		if h := holdingOf(tc.chain, tokenAsset); h.Error != "" || h.Address != treasury.Hex() || h.Amount.Int64() != want {
+			t.Errorf("allowed %d of 500: holding is %+v", allowance, h)
+		}
+	}
+}
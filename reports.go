@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+)
+
+// reportPeriod is the time range a report covers, From included and To
+// excluded.
+type reportPeriod struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+var errReportPeriod = errors.New("give a month such as 2026-09, or from and to dates such as 2026-09-01")
+
+// parseReportPeriod reads a period from a month, or from a start date and an
+// optional end date, which defaults to now. Dates are in UTC.
+func parseReportPeriod(month, from, to string) (reportPeriod, error) {
+	var p reportPeriod
+	var err error
+	switch {
+	case month != "" && from == "" && to == "":
+		if p.From, err = time.Parse("2006-01", month); err != nil {
+			return p, errReportPeriod
+		}
+		p.To = p.From.AddDate(0, 1, 0)
+		return p, nil
+	case month != "" || from == "":
+		return p, errReportPeriod
+	}
+
+	if p.From, err = parseReportDate(from); err != nil {
+		return p, errReportPeriod
+	}
+	p.To = time.Now().UTC()
+	if to != "" {
+		if p.To, err = parseReportDate(to); err != nil {
+			return p, errReportPeriod
+		}
+	}
+	if !p.From.Before(p.To) {
+		return p, errors.New("the period must end after it starts")
+	}
+	return p, nil
+}
+
+func parseReportDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// reportDecimals returns the decimals to format each asset with in reports,
+// the units users type and see everywhere else, so CULT is in whole tokens.
+func reportDecimals() map[string]int {
+	return map[string]int{
+		tokenAsset: assetDecimals(tokenAsset),
+		etherAsset: assetDecimals(etherAsset),
+	}
+}
+
+var errUnknownReport = errors.New("report ledger, statement or summary")
+
+// reportData builds a ledger, statement or summary report for the period,
+// limited to userID when given, both as JSON values and as CSV records.
+func reportData(ctx context.Context, kind string, p reportPeriod, userID string) (data interface{}, header []string, records [][]string, err error) {
+	if kind != "ledger" && kind != "statement" && kind != "summary" {
+		return nil, nil, nil, errUnknownReport
+	}
+	decimals := reportDecimals()
+
+	switch kind {
+	case "ledger":
+		entries, err := queryLedgerPeriod(userID, p)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		list := make([]*apiLedgerEntry, len(entries))
+		header = []string{"id", "created_at", "user_id", "asset", "kind", "amount", "chain", "tx_hash", "note"}
+		for i, e := range entries {
+			list[i] = e.apiEntry(decimals)
+			records = append(records, []string{strconv.FormatInt(e.ID, 10), e.CreatedAt.Format(time.RFC3339), e.UserID, e.Asset, e.Kind,
+				list[i].Amount, e.Chain, e.TxHash, e.Note})
+		}
+		return map[string]interface{}{"period": p, "entries": list}, header, records, nil
+
+	case "statement":
+		statements, err := queryStatements(userID, p, decimals)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		header = []string{"user_id", "asset", "date", "kind", "amount", "balance", "note"}
+		for _, s := range statements {
+			records = append(records, []string{s.UserID, s.Asset, p.From.Format(time.RFC3339), "opening_balance", "", s.Opening, ""})
+			for _, line := range s.Entries {
+				records = append(records, []string{s.UserID, s.Asset, line.CreatedAt.Format(time.RFC3339), line.Kind, line.Amount, line.Balance, line.Note})
+			}
+			records = append(records, []string{s.UserID, s.Asset, p.To.Format(time.RFC3339), "closing_balance", "", s.Closing, ""})
+		}
+		return map[string]interface{}{"period": p, "statements": statements}, header, records, nil
+	}
+
+	totals, err := querySummary(p, decimals)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	header = []string{"asset", "kind", "entries", "credited", "debited", "net"}
+	for _, t := range totals {
+		records = append(records, []string{t.Asset, t.Kind, strconv.FormatInt(t.Entries, 10), t.Credited, t.Debited, t.Net})
+	}
+	return map[string]interface{}{"period": p, "totals": totals}, header, records, nil
+}
+
+// ledgerRow is a ledger entry with its amount still in the smallest unit.
+type ledgerRow struct {
+	ID        int64
+	UserID    string
+	Asset     string
+	Kind      string
+	Amount    *big.Int
+	Chain     string
+	TxHash    string
+	Note      string
+	CreatedAt time.Time
+}
+
+func (e *ledgerRow) apiEntry(decimals map[string]int) *apiLedgerEntry {
+	return &apiLedgerEntry{
+		ID:        e.ID,
+		UserID:    e.UserID,
+		Asset:     e.Asset,
+		Kind:      e.Kind,
+		Amount:    formatUnits(e.Amount, decimals[e.Asset]),
+		Chain:     e.Chain,
+		TxHash:    e.TxHash,
+		Note:      e.Note,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// queryLedgerPeriod returns the ledger entries of the period, of userID
+// when given, by user, asset and time.
+func queryLedgerPeriod(userID string, p reportPeriod) ([]*ledgerRow, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT id, slack_user_id, asset, kind, amount, COALESCE(chain, ''), COALESCE(tx_hash, ''), COALESCE(note, ''), created_at
+		FROM ledger_entries
+		WHERE ($1 = '' OR slack_user_id = $1) AND created_at >= $2 AND created_at < $3
+		ORDER BY slack_user_id, asset, id;
+	`, userID, p.From, p.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*ledgerRow
+	for rows.Next() {
+		e := &ledgerRow{}
+		var amount string
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Asset, &e.Kind, &amount, &e.Chain, &e.TxHash, &e.Note, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if e.Amount, ok = parseStoredAmount(amount); !ok {
+			return nil, fmt.Errorf("ledger entry %d has an invalid amount %q", e.ID, amount)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// statement is what happened to the balance of one asset of a user over a
+// period.
+type statement struct {
+	UserID  string           `json:"user_id"`
+	Asset   string           `json:"asset"`
+	Opening string           `json:"opening_balance"`
+	Credits string           `json:"credits"`
+	Debits  string           `json:"debits"`
+	Closing string           `json:"closing_balance"`
+	Entries []*statementLine `json:"entries"`
+}
+
+// statementLine is a ledger entry along with the balance after it.
+type statementLine struct {
+	*apiLedgerEntry
+	Balance string `json:"balance"`
+}
+
+// queryStatements returns the statements of every balance, or those of
+// userID when given. Balances may predate the ledger, so the opening and
+// closing balances are worked back from the current one.
+func queryStatements(userID string, p reportPeriod, decimals map[string]int) ([]*statement, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT b.slack_user_id, b.asset, b.balance,
+			COALESCE(SUM(l.amount) FILTER (WHERE l.created_at >= $2), 0),
+			COALESCE(SUM(l.amount) FILTER (WHERE l.created_at >= $3), 0)
+		FROM balances b
+		LEFT JOIN ledger_entries l ON l.slack_user_id = b.slack_user_id AND l.asset = b.asset
+		WHERE $1 = '' OR b.slack_user_id = $1
+		GROUP BY b.slack_user_id, b.asset, b.balance
+		ORDER BY b.slack_user_id, b.asset;
+	`, userID, p.From, p.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type key struct{ user, asset string }
+	var statements []*statement
+	opening := map[key]*big.Int{}
+	byKey := map[key]*statement{}
+	for rows.Next() {
+		s := &statement{Entries: []*statementLine{}}
+		var balance, sinceFrom, sinceTo string
+		if err := rows.Scan(&s.UserID, &s.Asset, &balance, &sinceFrom, &sinceTo); err != nil {
+			return nil, err
+		}
+		current, ok1 := parseStoredAmount(balance)
+		afterFrom, ok2 := parseStoredAmount(sinceFrom)
+		afterTo, ok3 := parseStoredAmount(sinceTo)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("the %s balance of %s has an invalid amount", s.Asset, s.UserID)
+		}
+		k := key{s.UserID, s.Asset}
+		opening[k] = new(big.Int).Sub(current, afterFrom)
+		s.Opening = formatUnits(opening[k], decimals[s.Asset])
+		s.Closing = formatUnits(new(big.Int).Sub(current, afterTo), decimals[s.Asset])
+		byKey[k] = s
+		statements = append(statements, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	entries, err := queryLedgerPeriod(userID, p)
+	if err != nil {
+		return nil, err
+	}
+	credits, debits := map[key]*big.Int{}, map[key]*big.Int{}
+	for _, e := range entries {
+		k := key{e.UserID, e.Asset}
+		s := byKey[k]
+		if s == nil {
+			continue
+		}
+		if credits[k] == nil {
+			credits[k], debits[k] = new(big.Int), new(big.Int)
+		}
+		if e.Amount.Sign() > 0 {
+			credits[k].Add(credits[k], e.Amount)
+		} else {
+			debits[k].Sub(debits[k], e.Amount)
+		}
+		// opening becomes the running balance
+		opening[k].Add(opening[k], e.Amount)
+		s.Entries = append(s.Entries, &statementLine{e.apiEntry(decimals), formatUnits(opening[k], decimals[e.Asset])})
+	}
+
+	// leave out balances that neither held anything nor moved
+	var list []*statement
+	for _, s := range statements {
+		k := key{s.UserID, s.Asset}
+		s.Credits, s.Debits = "0", "0"
+		if credits[k] != nil {
+			s.Credits, s.Debits = formatUnits(credits[k], decimals[s.Asset]), formatUnits(debits[k], decimals[s.Asset])
+		}
+		if len(s.Entries) > 0 || s.Opening != "0" || userID != "" {
+			list = append(list, s)
+		}
+	}
+	return list, nil
+}
+
+// reportTotal sums the ledger entries of one kind and asset, such as the
+// tokens issued as signup bonuses, tipped, deposited or withdrawn.
+type reportTotal struct {
+	Asset    string `json:"asset"`
+	Kind     string `json:"kind"`
+	Entries  int64  `json:"entries"`
+	Credited string `json:"credited"`
+	Debited  string `json:"debited"`
+	Net      string `json:"net"`
+}
+
+func querySummary(p reportPeriod, decimals map[string]int) ([]*reportTotal, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT asset, kind, COUNT(*),
+			COALESCE(SUM(amount) FILTER (WHERE amount > 0), 0),
+			COALESCE(-SUM(amount) FILTER (WHERE amount < 0), 0)
+		FROM ledger_entries
+		WHERE created_at >= $1 AND created_at < $2
+		GROUP BY asset, kind
+		ORDER BY asset, kind;
+	`, p.From, p.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []*reportTotal{}
+	for rows.Next() {
+		t := &reportTotal{}
+		var credited, debited string
+		if err := rows.Scan(&t.Asset, &t.Kind, &t.Entries, &credited, &debited); err != nil {
+			return nil, err
+		}
+		in, ok1 := parseStoredAmount(credited)
+		out, ok2 := parseStoredAmount(debited)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("the %s %s total is invalid", t.Asset, t.Kind)
+		}
+		t.Credited = formatUnits(in, decimals[t.Asset])
+		t.Debited = formatUnits(out, decimals[t.Asset])
+		t.Net = formatUnits(new(big.Int).Sub(in, out), decimals[t.Asset])
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestParseReportPeriod(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	tests := []struct {
+		month, from, to string
+		want            reportPeriod
+		ok              bool
+	}{
+		{"2026-09", "", "", reportPeriod{day("2026-09-01"), day("2026-10-01")}, true},
+		{"2026-12", "", "", reportPeriod{day("2026-12-01"), day("2027-01-01")}, true},
+		{"", "2026-09-01", "2026-09-15", reportPeriod{day("2026-09-01"), day("2026-09-15")}, true},
+		{"", "2026-09-01T12:00:00Z", "2026-09-02", reportPeriod{day("2026-09-01").Add(12 * time.Hour), day("2026-09-02")}, true},
+		{"", "", "", reportPeriod{}, false},
+		{"2026-13", "", "", reportPeriod{}, false},
+		{"2026-09", "2026-09-01", "", reportPeriod{}, false},
+		{"", "", "2026-09-15", reportPeriod{}, false},
+		{"", "2026-09-15", "2026-09-01", reportPeriod{}, false},
+		{"", "2026-09-15", "2026-09-15", reportPeriod{}, false},
+		{"", "yesterday", "", reportPeriod{}, false},
+	}
+	for _, test := range tests {
+		p, err := parseReportPeriod(test.month, test.from, test.to)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q %q %q: period is %v", test.month, test.from, test.to, p)
+			}
+			continue
+		}
+		if err != nil || !p.From.Equal(test.want.From) || !p.To.Equal(test.want.To) {
+			t.Errorf("%q %q %q: period is %v: %v, want %v", test.month, test.from, test.to, p, err, test.want)
+		}
+	}
+
+	p, err := parseReportPeriod("", "2026-09-01", "")
+	if err != nil || time.Since(p.To) > time.Minute {
+		t.Errorf("a period without an end ends at %v: %v", p.To, err)
+	}
+}
+
+func TestReportData(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+	// reports are formatted without asking a node
+	saved := defaultChain
+	defaultChain = nil
+	defer func() { defaultChain = saved }()
+
+	ether, _ := parseAmount("0.5", etherAsset)
+	entries := []ledgerEntry{
+		{UserID: "U1", Asset: tokenAsset, Kind: kindSignupBonus, Amount: big.NewInt(100)},
+		{UserID: "U1", Asset: tokenAsset, Kind: kindTip, Amount: big.NewInt(-30)},
+		{UserID: "U2", Asset: tokenAsset, Kind: kindTip, Amount: big.NewInt(30)},
+		{UserID: "U1", Asset: etherAsset, Kind: kindDeposit, Amount: ether},
+	}
+	for _, e := range entries {
+		err := withLedgerTx(ctx, func(tx *sql.Tx) error { return adjustBalance(tx, e) })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC()
+	p := reportPeriod{From: now.Add(-24 * time.Hour), To: now.Add(24 * time.Hour)}
+
+	_, header, records, err := reportData(ctx, "summary", p, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"CULT", "signup_bonus", "1", "100", "0", "100"},
+		{"CULT", "tip", "2", "30", "30", "0"},
+		{"ETH", "deposit", "1", "0.5", "0", "0.5"},
+	}
+	if len(header) != 6 || len(records) != len(want) {
+		t.Fatalf("summary is %q %q", header, records)
+	}
+	for i := range want {
+		for j := range want[i] {
+			if records[i][j] != want[i][j] {
+				t.Errorf("summary row %d is %q, want %q", i, records[i], want[i])
+				break
+			}
+		}
+	}
+
+	data, _, records, err := reportData(ctx, "statement", p, "U1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := data.(map[string]interface{})["statements"].([]*statement)
+	if len(statements) != 2 {
+		t.Fatalf("U1 has %d statements", len(statements))
+	}
+	if s := statements[0]; s.Asset != tokenAsset || s.Opening != "0" || s.Credits != "100" || s.Debits != "30" || s.Closing != "70" || len(s.Entries) != 2 || s.Entries[1].Balance != "70" {
+		t.Errorf("CULT statement is %+v", s)
+	}
+	if s := statements[1]; s.Asset != etherAsset || s.Closing != "0.5" {
+		t.Errorf("ETH statement is %+v", s)
+	}
+	if len(records) != 7 {
+		t.Errorf("statement has %d records", len(records))
+	}
+
+	if _, _, _, err := reportData(ctx, "balances", p, ""); err != errUnknownReport {
+		t.Errorf("an unknown report: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Settings admins can change at runtime with `admin set`.
+const (
+	settingSignupBonus       = "signup-bonus"
+	settingWithdrawMinimum   = "withdraw-minimum"
+	settingWithdrawalsPaused = "withdrawals-paused"
+
+	settingAddressCooldown           = "address-cooldown"
+	settingWithdrawDailyLimit        = "withdraw-daily-limit"
+	settingWithdrawWeeklyLimit       = "withdraw-weekly-limit"
+	settingWithdrawApprovalThreshold = "withdraw-approval-threshold"
+
+	settingWithdrawDailyLimitEther        = "withdraw-daily-limit-eth"
+	settingWithdrawWeeklyLimitEther       = "withdraw-weekly-limit-eth"
+	settingWithdrawApprovalThresholdEther = "withdraw-approval-threshold-eth"
+
+	settingBonusMinAge      = "bonus-min-age"
+	settingTipHourlyLimit   = "tip-hourly-limit"
+	settingTipRingThreshold = "tip-ring-threshold"
+	settingTipRingWindow    = "tip-ring-window"
+)
+
+// settingDefaults are the values of settings that were never set, and the
+// list of settings that exist.
+var settingDefaults = map[string]string{
+	settingSignupBonus:       "10",
+	settingWithdrawMinimum:   "15",
+	settingWithdrawalsPaused: "false",
+	settingAddressCooldown:   "24h",
+	// a zero limit or threshold turns the rule off
+	settingWithdrawDailyLimit:        "0",
+	settingWithdrawWeeklyLimit:       "0",
+	settingWithdrawApprovalThreshold: "0",
+	// the same for ETH, in ETH
+	settingWithdrawDailyLimitEther:        "0",
+	settingWithdrawWeeklyLimitEther:       "0",
+	settingWithdrawApprovalThresholdEther: "0",
+	settingBonusMinAge:                    "0s",
+	settingTipHourlyLimit:                 "0",
+	settingTipRingThreshold:               "4",
+	settingTipRingWindow:                  "24h",
+}
+
+// validateSetting checks that value is acceptable for key.
+func validateSetting(key, value string) error {
+	switch key {
+	case settingSignupBonus, settingWithdrawMinimum, settingWithdrawDailyLimit, settingWithdrawWeeklyLimit, settingWithdrawApprovalThreshold,
+		settingWithdrawDailyLimitEther, settingWithdrawWeeklyLimitEther, settingWithdrawApprovalThresholdEther:
+		amount, err := parseAmount(value, settingAsset(key))
+		if err != nil {
+			return err
+		}
+		if amount.Sign() < 0 {
+			return fmt.Errorf("%s can't be negative", key)
+		}
+		return nil
+	case settingWithdrawalsPaused:
+		_, err := strconv.ParseBool(value)
+		return err
+	case settingTipHourlyLimit, settingTipRingThreshold:
+		n, err := strconv.Atoi(value)
+		if err == nil && n < 0 {
+			err = fmt.Errorf("%s can't be negative", key)
+		}
+		return err
+	case settingAddressCooldown, settingBonusMinAge, settingTipRingWindow:
+		_, err := time.ParseDuration(value)
+		return err
+	default:
+		return fmt.Errorf("Unknown setting %s", key)
+	}
+}
+
+func settingNames() []string {
+	names := make([]string, 0, len(settingDefaults))
+	for name := range settingDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// retrieveSetting returns the stored value of key, or its default.
+func retrieveSetting(key string) string {
+	db, _ := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	defer db.Close()
+
+	value := settingDefault(key)
+	db.QueryRow(`
+		SELECT value FROM settings WHERE key = $1 LIMIT 1;
+	`, key).Scan(&value)
+
+	return value
+}
+
+// settingAsset returns the asset a setting holding an amount is in.
+func settingAsset(key string) string {
+	switch key {
+	case settingWithdrawDailyLimitEther, settingWithdrawWeeklyLimitEther, settingWithdrawApprovalThresholdEther:
+		return etherAsset
+	}
+	return tokenAsset
+}
+
+// retrieveAmountSetting returns a setting holding an amount of the asset
+// settingAsset names.
+func retrieveAmountSetting(key string) *big.Int {
+	asset := settingAsset(key)
+	amount, err := parseAmount(retrieveSetting(key), asset)
+	if err != nil {
+		amount, _ = parseAmount(settingDefault(key), asset)
+	}
+	return amount
+}
+
+func retrieveDurationSetting(key string) time.Duration {
+	d, err := time.ParseDuration(retrieveSetting(key))
+	if err != nil {
+		d, _ = time.ParseDuration(settingDefault(key))
+	}
+	return d
+}
+
+func retrieveCountSetting(key string) int {
+	n, err := strconv.Atoi(retrieveSetting(key))
+	if err != nil {
+		n, _ = strconv.Atoi(settingDefault(key))
+	}
+	return n
+}
+
+func withdrawalsPaused() bool {
+	paused, _ := strconv.ParseBool(retrieveSetting(settingWithdrawalsPaused))
+	return paused
+}
+
+// storeSetting saves value for key, returning the value it replaces.
+func storeSetting(tx *sql.Tx, key, value, actor string) (string, error) {
+	previous := settingDefault(key)
+	err := tx.QueryRow(`
+		SELECT value FROM settings WHERE key = $1 FOR UPDATE;
+	`, key).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO settings(key, value, updated_by, updated_at) VALUES ($1, $2, $3, now())
+		ON CONFLICT (key)
+		DO UPDATE SET value=$2, updated_by=$3, updated_at=now();
+	`, key, value, actor)
+	return previous, err
+}
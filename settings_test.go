@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestValidateSetting(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{settingWithdrawMinimum, "15", true},
+		{settingWithdrawMinimum, "-1", false},
+		{settingWithdrawMinimum, "1.5", false},
+		{settingWithdrawApprovalThreshold, "1000", true},
+		{settingWithdrawApprovalThresholdEther, "0.5", true},
+		{settingWithdrawApprovalThresholdEther, "-0.5", false},
+		{settingWithdrawDailyLimitEther, "1.000000000000000001", true},
+		{settingWithdrawWeeklyLimitEther, "1.0000000000000000001", false},
+		{settingWithdrawalsPaused, "true", true},
+		{settingWithdrawalsPaused, "maybe", false},
+		{settingTipHourlyLimit, "-3", false},
+		{settingAddressCooldown, "48h", true},
+		{settingAddressCooldown, "2 days", false},
+		{"withdraw-maximum", "1", false},
+	}
+	for _, test := range tests {
+		err := validateSetting(test.key, test.value)
+		if test.ok && err != nil {
+			t.Errorf("%s %s: %v", test.key, test.value, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s %s: no error", test.key, test.value)
+		}
+	}
+}
+
+func TestSettingDefaultsAreValid(t *testing.T) {
+	for key, value := range settingDefaults {
+		if err := validateSetting(key, value); err != nil {
+			t.Errorf("default of %s: %v", key, err)
+		}
+	}
+}
+
+func TestWithdrawalHoldSettings(t *testing.T) {
+	for _, asset := range []string{tokenAsset, etherAsset} {
+		key, ok := withdrawalApprovalThresholds[asset]
+		if !ok || settingAsset(key) != asset {
+			t.Errorf("%s: approval threshold %q", asset, key)
+		}
+		if len(withdrawalLimits[asset]) == 0 {
+			t.Errorf("%s: no velocity limits", asset)
+		}
+		for _, l := range withdrawalLimits[asset] {
+			if settingAsset(l.key) != asset {
+				t.Errorf("%s: limit %s is in %s", asset, l.key, settingAsset(l.key))
+			}
+		}
+	}
+}
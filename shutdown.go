@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// inFlight tracks the work that must not be cut short by a shutdown, like
+// payouts between their ledger entries and their broadcast.
+var inFlight struct {
+	mu           sync.Mutex
+	wg           sync.WaitGroup
+	count        int
+	shuttingDown bool
+}
+
+// beginWork registers a unit of work, and fails once the bot is shutting
+// down, in which case the work must not start. Every successful beginWork
+// must be followed by endWork.
+func beginWork() bool {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+
+	if inFlight.shuttingDown {
+		return false
+	}
+	inFlight.count++
+	inFlight.wg.Add(1)
+	return true
+}
+
+func endWork() {
+	inFlight.mu.Lock()
+	inFlight.count--
+	inFlight.mu.Unlock()
+	inFlight.wg.Done()
+}
+
+// drainWork stops new work from starting and waits up to timeout for the
+// work in flight to finish. It returns how much work was still running.
+// Withdrawals cut short are resumed on the next start.
+func drainWork(timeout time.Duration) int {
+	inFlight.mu.Lock()
+	inFlight.shuttingDown = true
+	inFlight.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		inFlight.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+		inFlight.mu.Lock()
+		defer inFlight.mu.Unlock()
+		return inFlight.count
+	}
+}
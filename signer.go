@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Types of signers a hot wallet can use.
+const (
+	// signerKeyJSON decrypts a keystore JSON given inline, the way
+	// ETH_KEY_JSON always worked.
+	signerKeyJSON = ""
+	// signerKeystore decrypts a keystore file on disk with a password read
+	// from another file.
+	signerKeystore = "keystore"
+	// signerClef asks a Clef-compatible external signer over JSON-RPC or IPC.
+	signerClef = "clef"
+	// signerRemote posts transactions to a remote signing service over HTTP.
+	signerRemote = "remote"
+)
+
+// signerTimeout bounds a round trip to an external signer, which may wait for
+// a human to approve the transaction.
+const signerTimeout = 2 * time.Minute
+
+// Signer signs transactions of a hot wallet. Only the local keystore signers
+// ever hold the private key in the bot's process.
+type Signer interface {
+	Address() common.Address
+	SignTx(tx *types.Transaction, signer types.Signer, chainID *big.Int) (*types.Transaction, error)
+}
+
+// signerConfig selects and configures the signer of a chain.
+type signerConfig struct {
+	Type         string `json:"type" yaml:"type"`
+	KeyFile      string `json:"key_file" yaml:"key_file"`
+	PasswordFile string `json:"password_file" yaml:"password_file"`
+	Endpoint     string `json:"endpoint" yaml:"endpoint"`
+	Address      string `json:"address" yaml:"address"`
+	AuthToken    string `json:"auth_token" yaml:"auth_token"`
+}
+
+// newSigner builds the signer described by config. keyJSON and password are
+// only used by the inline keystore signer.
+func newSigner(config signerConfig, keyJSON, password string) (Signer, error) {
+	switch config.Type {
+	case signerKeyJSON:
+		return newKeystoreSigner([]byte(keyJSON), password)
+	case signerKeystore:
+		keyJSON, err := ioutil.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		password, err := ioutil.ReadFile(config.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		return newKeystoreSigner(keyJSON, strings.TrimRight(string(password), "\r\n"))
+	case signerClef, signerRemote:
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("%s signer has no endpoint", config.Type)
+		}
+		if !common.IsHexAddress(config.Address) {
+			return nil, fmt.Errorf("%s signer has an invalid address %q", config.Type, config.Address)
+		}
+		if config.Type == signerClef {
+			return &clefSigner{endpoint: config.Endpoint, address: common.HexToAddress(config.Address)}, nil
+		}
+		return &remoteSigner{endpoint: config.Endpoint, address: common.HexToAddress(config.Address), authToken: config.AuthToken}, nil
+	default:
+		return nil, fmt.Errorf("unknown signer type %q", config.Type)
+	}
+}
+
+// keystoreSigner signs with a key decrypted once from a keystore JSON.
+type keystoreSigner struct {
+	key *keystore.Key
+}
+
+func newKeystoreSigner(keyJSON []byte, password string) (*keystoreSigner, error) {
+	key, err := keystore.DecryptKey(keyJSON, password)
+	if err != nil {
+		return nil, err
+	}
+	return &keystoreSigner{key: key}, nil
+}
+
+func (s *keystoreSigner) Address() common.Address {
+	return s.key.Address
+}
+
+func (s *keystoreSigner) SignTx(tx *types.Transaction, signer types.Signer, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, signer, s.key.PrivateKey)
+}
+
+// sendTxArgs is a transaction to sign in the format of Clef's
+// account_signTransaction.
+type sendTxArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      hexutil.Uint64  `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Nonce    hexutil.Uint64  `json:"nonce"`
+	Data     hexutil.Bytes   `json:"data"`
+	ChainID  *hexutil.Big    `json:"chainId,omitempty"`
+}
+
+func newSendTxArgs(from common.Address, tx *types.Transaction, chainID *big.Int) sendTxArgs {
+	args := sendTxArgs{
+		From:     from,
+		To:       tx.To(),
+		Gas:      hexutil.Uint64(tx.Gas().Uint64()),
+		GasPrice: (*hexutil.Big)(tx.GasPrice()),
+		Value:    (*hexutil.Big)(tx.Value()),
+		Nonce:    hexutil.Uint64(tx.Nonce()),
+		Data:     tx.Data(),
+	}
+	if chainID != nil && chainID.Sign() > 0 {
+		args.ChainID = (*hexutil.Big)(chainID)
+	}
+	return args
+}
+
+// decodeSignedTx decodes the raw signed transaction returned by a signer and
+// checks that it is the one that was asked for.
+func decodeSignedTx(raw []byte, unsigned *types.Transaction, signer types.Signer, from common.Address) (*types.Transaction, error) {
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(raw, tx); err != nil {
+		return nil, err
+	}
+	if tx.Nonce() != unsigned.Nonce() || tx.Value().Cmp(unsigned.Value()) != 0 || !bytes.Equal(tx.Data(), unsigned.Data()) {
+		return nil, errors.New("signer returned a different transaction")
+	}
+	sender, err := types.Sender(signer, tx)
+	if err != nil {
+		return nil, err
+	}
+	if sender != from {
+		return nil, fmt.Errorf("signer signed for %s instead of %s", sender.Hex(), from.Hex())
+	}
+	return tx, nil
+}
+
+// clefSigner asks a Clef-compatible signer, reached over IPC or HTTP, to sign
+// each transaction.
+type clefSigner struct {
+	endpoint string
+	address  common.Address
+}
+
+func (s *clefSigner) Address() common.Address {
+	return s.address
+}
+
+func (s *clefSigner) SignTx(tx *types.Transaction, signer types.Signer, chainID *big.Int) (*types.Transaction, error) {
+	client, err := rpc.Dial(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), signerTimeout)
+	defer cancel()
+
+	var result struct {
+		Raw hexutil.Bytes `json:"raw"`
+	}
+	if err := client.CallContext(ctx, &result, "account_signTransaction", newSendTxArgs(s.address, tx, chainID)); err != nil {
+		return nil, err
+	}
+	return decodeSignedTx(result.Raw, tx, signer, s.address)
+}
+
+// remoteSigner posts each transaction as JSON to a remote signing service,
+// which answers with the raw signed transaction.
+type remoteSigner struct {
+	endpoint  string
+	address   common.Address
+	authToken string
+}
+
+func (s *remoteSigner) Address() common.Address {
+	return s.address
+}
+
+func (s *remoteSigner) SignTx(tx *types.Transaction, signer types.Signer, chainID *big.Int) (*types.Transaction, error) {
+	body, err := json.Marshal(newSendTxArgs(s.address, tx, chainID))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+
+	client := &http.Client{Timeout: signerTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("remote signer refused: %s %s", resp.Status, bytes.TrimSpace(message))
+	}
+
+	var result struct {
+		Raw hexutil.Bytes `json:"raw"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return decodeSignedTx(result.Raw, tx, signer, s.address)
+}
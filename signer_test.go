@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// fakeSigner signs with a key it holds, like an external signer would, and
+// remembers the chain ID it was asked to sign for.
+type fakeSigner struct {
+	key     *ecdsa.PrivateKey
+	chainID *big.Int
+}
+
+func (s *fakeSigner) Address() common.Address {
+	return crypto.PubkeyToAddress(s.key.PublicKey)
+}
+
+func (s *fakeSigner) SignTx(tx *types.Transaction, signer types.Signer, chainID *big.Int) (*types.Transaction, error) {
+	s.chainID = chainID
+	return types.SignTx(tx, signer, s.key)
+}
+
+func testTransaction(nonce uint64) *types.Transaction {
+	return types.NewTransaction(nonce, common.HexToAddress("0x01"), big.NewInt(1), big.NewInt(21000), big.NewInt(1), []byte{1, 2, 3})
+}
+
+// testKeyJSON creates a keystore file encrypted with password in dir.
+func testKeyJSON(t *testing.T, dir, password string) (path string, key *keystore.Key) {
+	ks := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	account, err := ks.NewAccount(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err := ioutil.ReadFile(account.URL.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = keystore.DecryptKey(keyJSON, password); err != nil {
+		t.Fatal(err)
+	}
+	return account.URL.Path, key
+}
+
+func TestTransactorChainID(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	tests := []struct {
+		chainID   int64
+		protected bool
+	}{
+		{0, false},
+		{1, true},
+		{5, true},
+	}
+	for _, test := range tests {
+		fake := &fakeSigner{key: key}
+		c := &chain{Name: "test", ChainID: test.chainID, hotWallet: fake}
+		auth, err := c.transactor()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// bind passes a homestead signer, which the transactor replaces
+		signed, err := auth.Signer(types.HomesteadSigner{}, auth.From, testTransaction(0))
+		if err != nil {
+			t.Fatalf("chain %d: %v", test.chainID, err)
+		}
+		if signed.Protected() != test.protected {
+			t.Errorf("chain %d: protected %v, want %v", test.chainID, signed.Protected(), test.protected)
+		}
+		if fake.chainID.Int64() != test.chainID {
+			t.Errorf("chain %d: signer was asked for chain %s", test.chainID, fake.chainID)
+		}
+		sender, err := types.Sender(c.signer(), signed)
+		if err != nil || sender != auth.From {
+			t.Errorf("chain %d: signed by %s: %v", test.chainID, sender.Hex(), err)
+		}
+		if test.protected {
+			other := &chain{ChainID: test.chainID + 1}
+			if _, err := types.Sender(other.signer(), signed); err == nil {
+				t.Errorf("chain %d: transaction replays on chain %d", test.chainID, test.chainID+1)
+			}
+		}
+
+		if _, err := auth.Signer(types.HomesteadSigner{}, common.HexToAddress("0x02"), testTransaction(0)); err == nil {
+			t.Errorf("chain %d: signed for another account", test.chainID)
+		}
+	}
+}
+
+func TestKeystoreSigners(t *testing.T) {
+	dir := t.TempDir()
+	path, key := testKeyJSON(t, dir, "secret")
+	keyJSON, _ := ioutil.ReadFile(path)
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wrongPasswordFile := filepath.Join(dir, "wrong")
+	if err := ioutil.WriteFile(wrongPasswordFile, []byte("wrong\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		config   signerConfig
+		keyJSON  string
+		password string
+		ok       bool
+	}{
+		{"inline", signerConfig{}, string(keyJSON), "secret", true},
+		{"inline with the wrong password", signerConfig{}, string(keyJSON), "wrong", false},
+		{"inline without a key", signerConfig{}, "", "", false},
+		{"file", signerConfig{Type: signerKeystore, KeyFile: path, PasswordFile: passwordFile}, "", "", true},
+		{"file with the wrong password", signerConfig{Type: signerKeystore, KeyFile: path, PasswordFile: wrongPasswordFile}, "", "", false},
+		{"missing file", signerConfig{Type: signerKeystore, KeyFile: filepath.Join(dir, "missing"), PasswordFile: passwordFile}, "", "", false},
+	}
+	for _, test := range tests {
+		s, err := newSigner(test.config, test.keyJSON, test.password)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if s.Address() != key.Address {
+			t.Errorf("%s: address %s, want %s", test.name, s.Address().Hex(), key.Address.Hex())
+		}
+
+		signer := types.NewEIP155Signer(big.NewInt(5))
+		signed, err := s.SignTx(testTransaction(0), signer, big.NewInt(5))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if sender, _ := types.Sender(signer, signed); sender != key.Address {
+			t.Errorf("%s: signed by %s", test.name, sender.Hex())
+		}
+	}
+}
+
+func TestNewSignerConfig(t *testing.T) {
+	address := "0x0000000000000000000000000000000000000001"
+	tests := []struct {
+		config signerConfig
+		err    string
+	}{
+		{signerConfig{Type: signerClef, Address: address}, "clef signer has no endpoint"},
+		{signerConfig{Type: signerRemote, Endpoint: "http://signer", Address: "0x01"}, `remote signer has an invalid address "0x01"`},
+		{signerConfig{Type: "hsm"}, `unknown signer type "hsm"`},
+		{signerConfig{Type: signerClef, Endpoint: "/run/clef.ipc", Address: address}, ""},
+		{signerConfig{Type: signerRemote, Endpoint: "http://signer", Address: address}, ""},
+	}
+	for _, test := range tests {
+		_, err := newSigner(test.config, "", "")
+		if test.err == "" && err != nil {
+			t.Errorf("%+v: %v", test.config, err)
+		}
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%+v: error %v, want %q", test.config, err, test.err)
+		}
+	}
+}
+
+// signRequest signs a request of a remote or Clef signer the way the
+// service would, with key and the chain ID the request names.
+func signRequest(t *testing.T, args sendTxArgs, key *ecdsa.PrivateKey) hexutil.Bytes {
+	tx := types.NewTransaction(uint64(args.Nonce), *args.To, args.Value.ToInt(), new(big.Int).SetUint64(uint64(args.Gas)), args.GasPrice.ToInt(), args.Data)
+	var signer types.Signer = types.HomesteadSigner{}
+	if args.ChainID != nil {
+		signer = types.NewEIP155Signer(args.ChainID.ToInt())
+	}
+	signed, err := types.SignTx(tx, signer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestRemoteSigner(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	address := crypto.PubkeyToAddress(key.PublicKey)
+
+	tests := []struct {
+		name    string
+		chainID int64
+		// sign answers the request the service got
+		sign func(args sendTxArgs) (int, interface{})
+		err  string
+	}{
+		{"signed", 5, func(args sendTxArgs) (int, interface{}) {
+			return http.StatusOK, map[string]interface{}{"raw": signRequest(t, args, key)}
+		}, ""},
+		{"unprotected", 0, func(args sendTxArgs) (int, interface{}) {
+			return http.StatusOK, map[string]interface{}{"raw": signRequest(t, args, key)}
+		}, ""},
+		{"refused", 5, func(args sendTxArgs) (int, interface{}) {
+			return http.StatusForbidden, "policy"
+		}, "remote signer refused: 403 Forbidden"},
+		{"another key", 5, func(args sendTxArgs) (int, interface{}) {
+			return http.StatusOK, map[string]interface{}{"raw": signRequest(t, args, other)}
+		}, "signer signed for"},
+		{"another transaction", 5, func(args sendTxArgs) (int, interface{}) {
+			args.Nonce++
+			return http.StatusOK, map[string]interface{}{"raw": signRequest(t, args, key)}
+		}, "signer returned a different transaction"},
+		{"another chain", 5, func(args sendTxArgs) (int, interface{}) {
+			args.ChainID = (*hexutil.Big)(big.NewInt(1))
+			return http.StatusOK, map[string]interface{}{"raw": signRequest(t, args, key)}
+		}, "invalid chain id"},
+	}
+	for _, test := range tests {
+		var requested sendTxArgs
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if err := json.NewDecoder(r.Body).Decode(&requested); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			status, answer := test.sign(requested)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(answer)
+		}))
+
+		s, err := newSigner(signerConfig{Type: signerRemote, Endpoint: srv.URL, Address: address.Hex(), AuthToken: "token"}, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &chain{ChainID: test.chainID}
+		signed, err := s.SignTx(testTransaction(7), c.signer(), big.NewInt(test.chainID))
+		srv.Close()
+
+		if requested.From != address || uint64(requested.Nonce) != 7 {
+			t.Errorf("%s: requested %+v", test.name, requested)
+		}
+		if (requested.ChainID != nil) != (test.chainID != 0) || requested.ChainID != nil && requested.ChainID.ToInt().Int64() != test.chainID {
+			t.Errorf("%s: requested chain ID %v, want %d", test.name, requested.ChainID, test.chainID)
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if sender, _ := types.Sender(c.signer(), signed); sender != address {
+			t.Errorf("%s: signed by %s", test.name, sender.Hex())
+		}
+	}
+}
+
+// ClefStub answers account_signTransaction like Clef, with key. The rpc
+// package only serves exported methods of exported types.
+type ClefStub struct {
+	t   *testing.T
+	key *ecdsa.PrivateKey
+}
+
+type ClefTxArgs sendTxArgs
+
+func (c *ClefStub) SignTransaction(args ClefTxArgs) (map[string]interface{}, error) {
+	return map[string]interface{}{"raw": signRequest(c.t, sendTxArgs(args), c.key)}, nil
+}
+
+func TestClefSigner(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	server := rpc.NewServer()
+	if err := server.RegisterName("account", &ClefStub{t: t, key: key}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	s, err := newSigner(signerConfig{Type: signerClef, Endpoint: srv.URL, Address: address.Hex()}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := types.NewEIP155Signer(big.NewInt(5))
+	signed, err := s.SignTx(testTransaction(0), signer, big.NewInt(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender, _ := types.Sender(signer, signed); sender != address {
+		t.Errorf("signed by %s", sender.Hex())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nlopes/slack"
+)
+
+// walletPolicyInterval is how often hot wallet balances are checked against
+// their cap and floor.
+const walletPolicyInterval = 10 * time.Minute
+
+// hasWalletPolicy reports whether the hot wallet of c is capped or floored.
+// Treasury mode hot wallets hold no tokens, so they have no policy.
+func (c *chain) hasWalletPolicy() bool {
+	return !c.treasuryMode() && (c.HotWalletCap != "" || c.HotWalletFloor != "")
+}
+
+func parseTokenAmount(s string) *big.Int {
+	amount, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil
+	}
+	return amount
+}
+
+// largeWithdrawalsPaused reports whether a withdrawal of amount must wait for
+// the hot wallet of c to be refilled.
+func (c *chain) largeWithdrawalsPaused(amount *big.Int) bool {
+	c.walletMu.Lock()
+	defer c.walletMu.Unlock()
+
+	large := parseTokenAmount(c.LargeWithdrawal)
+	return c.belowFloor && large != nil && amount.Cmp(large) >= 0
+}
+
+// runWalletPolicy periodically enforces the hot wallet policy of every chain.
+func runWalletPolicy(api *slack.Client) {
+	for {
+		for _, name := range chainNames() {
+			c := chains[name]
+			if !c.hasWalletPolicy() {
+				continue
+			}
+			if !beginWork() {
+				return
+			}
+			ctx := correlatedContext()
+			if err := enforceWalletPolicy(ctx, api, c); err != nil {
+				logError(ctx, "Failed to enforce hot wallet policy", logFields{"chain": c.Name, "error": err})
+			}
+			endWork()
+		}
+		time.Sleep(walletPolicyInterval)
+	}
+}
+
+// enforceWalletPolicy sweeps tokens above the cap of the hot wallet to the
+// cold wallet, and asks admins for a refill when it falls below the floor.
+// Large withdrawals stay paused until the hot wallet is back above the floor.
+func enforceWalletPolicy(ctx context.Context, api *slack.Client, c *chain) error {
+	unlock, err := c.lockWallet(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	conn, _, err := c.dial()
+	if err != nil {
+		return err
+	}
+	token, err := NewToken(common.HexToAddress(c.TokenAddress), conn)
+	if err != nil {
+		return err
+	}
+	hotWallet, err := c.hotWalletAddress()
+	if err != nil {
+		return err
+	}
+
+	balance, err := token.BalanceOf(&bind.CallOpts{Context: ctx}, hotWallet)
+	if err != nil {
+		return err
+	}
+
+	if floor := parseTokenAmount(c.HotWalletFloor); floor != nil {
+		below := balance.Cmp(floor) < 0
+
+		c.walletMu.Lock()
+		changed := below != c.belowFloor
+		c.belowFloor = below
+		c.walletMu.Unlock()
+
+		if changed && below {
+			// refill up to the cap when there is one, or to twice the floor
+			target := parseTokenAmount(c.HotWalletCap)
+			if target == nil {
+				target = new(big.Int).Mul(floor, big.NewInt(2))
+			}
+			refill := new(big.Int).Sub(target, balance)
+			alertAdmins(api, fmt.Sprintf(":fuelpump: Refill request: the hot wallet `%s` on %s holds %s CULT, below its floor of %s. Please send %s CULT from cold storage. Large withdrawals are paused until then.", hotWallet.Hex(), c.Name, formatAmount(balance, tokenAsset), formatAmount(floor, tokenAsset), formatAmount(refill, tokenAsset)))
+		} else if changed {
+			alertAdmins(api, fmt.Sprintf(":white_check_mark: The hot wallet on %s was refilled to %s CULT, large withdrawals are resumed.", c.Name, formatAmount(balance, tokenAsset)))
+		}
+	}
+
+	limit := parseTokenAmount(c.HotWalletCap)
+	if limit == nil || balance.Cmp(limit) <= 0 || !common.IsHexAddress(c.ColdAddress) {
+		return nil
+	}
+
+	excess := new(big.Int).Sub(balance, limit)
+	auth, err := c.transactor()
+	if err != nil {
+		return err
+	}
+
+	var tx *types.Transaction
+	err = c.withNonce(ctx, conn, auth.From, func(nonce uint64) error {
+		auth.Nonce = new(big.Int).SetUint64(nonce)
+		tx, err = token.Transfer(auth, common.HexToAddress(c.ColdAddress), excess)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("sweep of %s CULT: %v", formatAmount(excess, tokenAsset), err)
+	}
+
+	logInfo(ctx, "Sweep pending", logFields{"chain": c.Name, "amount": formatAmount(excess, tokenAsset), "to": c.ColdAddress, "tx_hash": tx.Hash().Hex()})
+	alertAdmins(api, fmt.Sprintf(":broom: Swept %s CULT above the hot wallet cap on %s to cold storage `%s` at %s", formatAmount(excess, tokenAsset), c.Name, c.ColdAddress, c.txLink(tx.Hash())))
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/nlopes/slack"
+)
+
+// allowanceAlertInterval keeps a chain that stays below its allowance
+// threshold from alerting admins on every withdrawal.
+const allowanceAlertInterval = time.Hour
+
+var allowanceAlertsMu sync.Mutex
+var allowanceAlertedAt = map[string]time.Time{}
+
+// treasuryMode reports whether withdrawals on c are paid from a separate
+// treasury through the allowance it granted to the hot wallet, instead of
+// from the hot wallet's own tokens.
+func (c *chain) treasuryMode() bool {
+	return c.TreasuryAddress != ""
+}
+
+// treasuryAllowance returns how many tokens the hot wallet may still move out
+// of the treasury of c.
+func treasuryAllowance(c *chain) (*big.Int, error) {
+	conn, _, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := NewTokenCaller(common.HexToAddress(c.TokenAddress), conn)
+	if err != nil {
+		return nil, err
+	}
+	hotWallet, err := c.hotWalletAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &bind.CallOpts{Context: context.Background()}
+	return token.Allowance(opts, common.HexToAddress(c.TreasuryAddress), hotWallet)
+}
+
+// allowanceThreshold returns the headroom below which admins are alerted.
+func (c *chain) allowanceThreshold() *big.Int {
+	threshold, ok := new(big.Int).SetString(c.AllowanceAlertThreshold, 10)
+	if !ok {
+		return new(big.Int)
+	}
+	return threshold
+}
+
+// checkAllowanceHeadroom alerts admins when the treasury allowance of c has
+// fallen below its threshold.
+func checkAllowanceHeadroom(ctx context.Context, api *slack.Client, c *chain) {
+	if !c.treasuryMode() {
+		return
+	}
+
+	allowance, err := treasuryAllowance(c)
+	if err != nil {
+		logWarn(ctx, "Failed to check treasury allowance", logFields{"chain": c.Name, "error": err})
+		return
+	}
+	if allowance.Cmp(c.allowanceThreshold()) >= 0 {
+		return
+	}
+
+	allowanceAlertsMu.Lock()
+	defer allowanceAlertsMu.Unlock()
+	if time.Since(allowanceAlertedAt[c.Name]) < allowanceAlertInterval {
+		return
+	}
+	allowanceAlertedAt[c.Name] = time.Now()
+
+	alertAdmins(api, fmt.Sprintf(":rotating_light: Only %s CULT of treasury allowance left on %s. Please `approve` or `increaseApproval` more for the bot's hot wallet from `%s`.", formatAmount(allowance, tokenAsset), c.Name, c.TreasuryAddress))
+}
+
+func handleAllowanceCommand(api *slack.Client, ev *slack.MessageEvent, chainName string) {
+	targets := []*chain{}
+	if chainName != "" {
+		c, err := lookupChain(chainName)
+		if err != nil {
+			sendSlackMessage(api, ev.Channel, ":thonk: "+err.Error())
+			return
+		}
+		targets = append(targets, c)
+	} else {
+		for _, name := range chainNames() {
+			targets = append(targets, chains[name])
+		}
+	}
+
+	lines := []string{":bank: Treasury allowances:"}
+	for _, c := range targets {
+		if !c.treasuryMode() {
+			lines = append(lines, fmt.Sprintf("• `%s`: paid from the hot wallet", c.Name))
+			continue
+		}
+
+		allowance, err := treasuryAllowance(c)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("• `%s`: :x: %s", c.Name, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("• `%s`: %s CULT from `%s` (alert below %s)", c.Name, formatAmount(allowance, tokenAsset), c.TreasuryAddress, formatAmount(c.allowanceThreshold(), tokenAsset)))
+	}
+	sendSlackMessage(api, ev.Channel, strings.Join(lines, "\n"))
+}
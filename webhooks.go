@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Events sent to webhooks.
+const (
+	eventTipCreated          = "tip.created"
+	eventDepositCredited     = "deposit.credited"
+	eventAccountRegistered   = "account.registered"
+	eventBalanceChanged      = "balance.changed"
+	eventWithdrawalCreated   = "withdrawal.created"
+	eventWithdrawalSent      = "withdrawal.sent"
+	eventWithdrawalConfirmed = "withdrawal.confirmed"
+	eventWithdrawalFailed    = "withdrawal.failed"
+)
+
+var webhookEvents = []string{
+	eventTipCreated, eventDepositCredited, eventAccountRegistered, eventBalanceChanged,
+	eventWithdrawalCreated, eventWithdrawalSent, eventWithdrawalConfirmed, eventWithdrawalFailed,
+}
+
+const (
+	// webhookPollInterval is how often deliveries that are due are sent.
+	webhookPollInterval = 5 * time.Second
+	// webhookTimeout is how long a receiver has to answer.
+	webhookTimeout = 10 * time.Second
+	// webhookMaxAttempts deliveries are tried before they are dead-lettered,
+	// waiting webhookBackoff after the first failure and twice as long after
+	// each of the next, up to webhookMaxBackoff. That is about 14 hours.
+	webhookMaxAttempts = 12
+	webhookBackoff     = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	// webhookLease is how long a delivery being sent is hidden from the
+	// other instances.
+	webhookLease = 2 * time.Minute
+)
+
+// webhookSignatureHeader carries t=TIMESTAMP,v1=HMAC, the hex HMAC-SHA256 of
+// TIMESTAMP.BODY with the webhook's secret.
+const webhookSignatureHeader = "X-Tiperc20-Signature"
+
+// webhookConfig is a receiver of the events of the bot.
+type webhookConfig struct {
+	Name   string `json:"name" yaml:"name"`
+	URL    string `json:"url" yaml:"url"`
+	Secret string `json:"secret" yaml:"secret"`
+	// Events are the events sent to the webhook, all of them when empty.
+	Events []string `json:"events" yaml:"events"`
+}
+
+func (h webhookConfig) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupWebhook(name string) (webhookConfig, bool) {
+	for _, h := range runtimeConfig().Webhooks {
+		if h.Name == name {
+			return h, true
+		}
+	}
+	return webhookConfig{}, false
+}
+
+// webhookPayload is the JSON body POSTed to webhooks. ID is the same for
+// every webhook and every retry of the event, for receivers to skip the ones
+// they've seen.
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// queueWebhookEvent queues event for the webhooks that want it, within tx so
+// that it is sent if and only if the change it describes is committed.
+func queueWebhookEvent(tx *sql.Tx, event string, data interface{}) error {
+	var hooks []webhookConfig
+	for _, h := range runtimeConfig().Webhooks {
+		if h.wants(event) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(webhookPayload{ID: hex.EncodeToString(id), Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hooks {
+		_, err := tx.Exec(`
+			INSERT INTO webhook_deliveries(webhook, event, payload) VALUES ($1, $2, $3);
+		`, h.Name, event, string(payload))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookAmount is an amount in webhook payloads, formatted like everywhere
+// else in the bot.
+func webhookAmount(amount *big.Int, asset string) string {
+	if amount == nil {
+		return ""
+	}
+	return formatAmount(amount, asset)
+}
+
+// withdrawalEvent is the event of a withdrawal moving to status, if any.
+// Withdrawals waiting for approval, a batch or their transaction aren't
+// announced.
+func withdrawalEvent(status string) string {
+	switch status {
+	case withdrawalSent, withdrawalBatched:
+		return eventWithdrawalSent
+	case withdrawalConfirmed:
+		return eventWithdrawalConfirmed
+	case withdrawalFailed:
+		return eventWithdrawalFailed
+	}
+	return ""
+}
+
+func withdrawalEventData(w *withdrawal) map[string]interface{} {
+	return map[string]interface{}{
+		"withdrawal_id": w.ID,
+		"user_id":       w.UserID,
+		"chain":         w.Chain,
+		"asset":         w.Asset,
+		"address":       w.Address,
+		"amount":        webhookAmount(w.Amount, w.Asset),
+		"status":        w.Status,
+		"tx_hash":       w.TxHash,
+		"error":         w.Error,
+	}
+}
+
+// runWebhookDispatcher sends the webhook deliveries as they fall due.
+func runWebhookDispatcher(api *slack.Client) {
+	for range time.Tick(webhookPollInterval) {
+		if len(runtimeConfig().Webhooks) == 0 {
+			continue
+		}
+		if !beginWork() {
+			return
+		}
+		ctx := correlatedContext()
+		if err := dispatchWebhooks(ctx, api); err != nil {
+			logError(ctx, "Failed to dispatch webhooks", logFields{"error": err})
+		}
+		endWork()
+	}
+}
+
+type webhookDelivery struct {
+	ID       int64
+	Webhook  string
+	Event    string
+	Payload  string
+	Attempts int
+}
+
+// dispatchWebhooks sends the deliveries that are due. They are leased first,
+// so that other instances of the bot skip them meanwhile.
+func dispatchWebhooks(ctx context.Context, api *slack.Client) error {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, `
+		UPDATE webhook_deliveries SET next_attempt_at = now() + $1 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries WHERE next_attempt_at <= now()
+			ORDER BY id LIMIT 20 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, webhook, event, payload, attempts;
+	`, int(webhookLease.Seconds()))
+	if err != nil {
+		return err
+	}
+	var due []*webhookDelivery
+	for rows.Next() {
+		var d webhookDelivery
+		if err := rows.Scan(&d.ID, &d.Webhook, &d.Event, &d.Payload, &d.Attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, &d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		err := deliverWebhook(ctx, d)
+		if err := recordWebhookAttempt(ctx, api, d, err); err != nil {
+			logError(ctx, "Failed to record webhook delivery", logFields{"delivery": d.ID, "error": err})
+		}
+	}
+	return nil
+}
+
+// deliverWebhook POSTs d to its webhook. Any answer but a 2xx is a failure.
+func deliverWebhook(ctx context.Context, d *webhookDelivery) error {
+	hook, ok := lookupWebhook(d.Webhook)
+	if !ok {
+		return fmt.Errorf("webhook %s is no longer configured", d.Webhook)
+	}
+
+	req, err := http.NewRequest("POST", hook.URL, strings.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tiperc20-webhooks")
+	req.Header.Set("X-Tiperc20-Event", d.Event)
+	req.Header.Set("X-Tiperc20-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set(webhookSignatureHeader, "t="+timestamp+",v1="+signWebhook(hook.Secret, timestamp, []byte(d.Payload)))
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay is how long to wait after the attempts-th failure.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+// recordWebhookAttempt removes a delivered delivery, and schedules the retry
+// of a failed one or moves it to the dead letters once it has run out of
+// attempts.
+func recordWebhookAttempt(ctx context.Context, api *slack.Client, d *webhookDelivery, deliveryErr error) error {
+	if deliveryErr == nil {
+		webhookDeliveries.WithLabelValues(d.Webhook, "delivered").Inc()
+		logInfo(ctx, "Delivered webhook", logFields{"delivery": d.ID, "webhook": d.Webhook, "event": d.Event, "attempts": d.Attempts + 1})
+		return withLedgerTx(ctx, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE id = $1;`, d.ID)
+			return err
+		})
+	}
+
+	attempts := d.Attempts + 1
+	if attempts < webhookMaxAttempts {
+		webhookDeliveries.WithLabelValues(d.Webhook, "failed").Inc()
+		delay := webhookRetryDelay(attempts)
+		logWarn(ctx, "Webhook delivery failed, retrying", logFields{"delivery": d.ID, "webhook": d.Webhook, "event": d.Event, "attempts": attempts, "retry_in": delay.String(), "error": deliveryErr})
+		return withLedgerTx(ctx, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				UPDATE webhook_deliveries SET attempts = $2, last_error = $3, next_attempt_at = now() + $4 * interval '1 second'
+				WHERE id = $1;
+			`, d.ID, attempts, deliveryErr.Error(), int(delay.Seconds()))
+			return err
+		})
+	}
+
+	webhookDeliveries.WithLabelValues(d.Webhook, "dead").Inc()
+	logError(ctx, "Webhook delivery gave up", logFields{"delivery": d.ID, "webhook": d.Webhook, "event": d.Event, "attempts": attempts, "error": deliveryErr})
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO webhook_dead_letters(id, webhook, event, payload, attempts, last_error, created_at)
+			SELECT id, webhook, event, payload, $2, $3, created_at FROM webhook_deliveries WHERE id = $1;
+		`, d.ID, attempts, deliveryErr.Error())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE id = $1;`, d.ID)
+		return err
+	})
+	if err == nil {
+		alertAdmins(api, fmt.Sprintf(":warning: Gave up delivering %s %d to webhook `%s` after %d attempts: %s. Replay it with `admin webhooks replay %d`", d.Event, d.ID, d.Webhook, attempts, deliveryErr, d.ID))
+	}
+	return err
+}
+
+// handleAdminWebhooksCommand lists the dead letters.
+func handleAdminWebhooksCommand(api *slack.Client, ev *slack.MessageEvent) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	defer db.Close()
+
+	var pending, dead int
+	err = db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM webhook_deliveries), (SELECT COUNT(*) FROM webhook_dead_letters);
+	`).Scan(&pending, &dead)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+
+	lines := []string{fmt.Sprintf(":satellite_antenna: %d webhook deliveries pending, %d dead letters", pending, dead)}
+	rows, err := db.Query(`
+		SELECT id, webhook, event, COALESCE(last_error, ''), failed_at FROM webhook_dead_letters ORDER BY id DESC LIMIT 10;
+	`)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var webhook, event, lastError string
+		var failedAt time.Time
+		if err := rows.Scan(&id, &webhook, &event, &lastError, &failedAt); err != nil {
+			sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+			return
+		}
+		lines = append(lines, fmt.Sprintf("• `%d` %s to `%s`, failed %s: %s", id, event, webhook, failedAt.Format("Jan 2 15:04"), lastError))
+	}
+	if dead > 0 {
+		lines = append(lines, "Replay them with `admin webhooks replay [id|all]`")
+	}
+	sendSlackMessage(api, ev.Channel, strings.Join(lines, "\n"))
+}
+
+// handleAdminWebhooksReplayCommand queues one dead letter, or all of them,
+// to be delivered again with a fresh set of attempts.
+func handleAdminWebhooksReplayCommand(ctx context.Context, api *slack.Client, ev *slack.MessageEvent, which string) {
+	var id int64
+	if which != "all" {
+		var err error
+		if id, err = strconv.ParseInt(which, 10, 64); err != nil {
+			sendSlackMessage(api, ev.Channel, ":thonk: Give a dead letter number or `all`")
+			return
+		}
+	}
+
+	replayed, err := replayDeadLetters(ctx, ev.User, slackEventRef(ev), id)
+	if err != nil {
+		sendSlackMessage(api, ev.Channel, ":x: "+err.Error())
+		return
+	}
+	if replayed == 0 {
+		sendSlackMessage(api, ev.Channel, ":thonk: There is no such dead letter")
+		return
+	}
+	sendSlackMessage(api, ev.Channel, fmt.Sprintf(":satellite_antenna: Replaying %d webhook deliveries", replayed))
+}
+
+// replayDeadLetters moves the dead letter id, or all of them when id is 0,
+// back to the deliveries, and returns how many were moved.
+func replayDeadLetters(ctx context.Context, actor, event string, id int64) (int64, error) {
+	var replayed int64
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`
+			INSERT INTO webhook_deliveries(id, webhook, event, payload, created_at)
+			SELECT id, webhook, event, payload, created_at FROM webhook_dead_letters WHERE $1 = 0 OR id = $1;
+		`, id)
+		if err != nil {
+			return err
+		}
+		if replayed, err = result.RowsAffected(); err != nil || replayed == 0 {
+			return err
+		}
+		if _, err = tx.Exec(`DELETE FROM webhook_dead_letters WHERE $1 = 0 OR id = $1;`, id); err != nil {
+			return err
+		}
+
+		subject := "all"
+		if id != 0 {
+			subject = strconv.FormatInt(id, 10)
+		}
+		return recordAudit(tx, auditRecord{Actor: actor, Action: "webhook_replay", Subject: "dead letter " + subject, Detail: fmt.Sprintf("%d deliveries", replayed), Event: event})
+	})
+	return replayed, err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	body := `{"id":"5f2b","event":"tip.created"}`
+	tests := []struct {
+		secret, timestamp, body string
+		want                    string
+	}{
+		{"whsec_0123456789abcdef", "1760877000", body, "148c1543d671ff3686f862db21c46389760691e47318112a8ba4c5351fcb3339"},
+		{"whsec_0123456789abcdef", "1760877001", body, "d882ff4fecc5b8f7115c2d37dfec4a4ce9972b8be6bc18e60456819af8c7366d"},
+		{"", "0", "", "b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+	}
+	for _, test := range tests {
+		if got := signWebhook(test.secret, test.timestamp, []byte(test.body)); got != test.want {
+			t.Errorf("%q at %s: signed %s, want %s", test.secret, test.timestamp, got, test.want)
+		}
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{6, 16 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, 6 * time.Hour},
+		{webhookMaxAttempts, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, test := range tests {
+		if got := webhookRetryDelay(test.attempts); got != test.want {
+			t.Errorf("after %d failures: %v, want %v", test.attempts, got, test.want)
+		}
+	}
+
+	var total time.Duration
+	for attempts := 1; attempts < webhookMaxAttempts; attempts++ {
+		total += webhookRetryDelay(attempts)
+	}
+	if total < 14*time.Hour || total > 15*time.Hour {
+		t.Errorf("deliveries are retried for %v, about 14 hours are documented", total)
+	}
+}
+
+// testWebhooks configures webhooks for the test.
+func testWebhooks(t *testing.T, hooks ...webhookConfig) {
+	c := &config{Webhooks: hooks}
+	currentConfig.Store(c)
+	t.Cleanup(func() { currentConfig.Store(&config{}) })
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	var status int
+	var got *http.Request
+	var gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got, gotBody = r, string(body)
+		w.WriteHeader(status)
+		w.Write([]byte("  try later \n"))
+	}))
+	defer srv.Close()
+	secret := "whsec_0123456789abcdef"
+	testWebhooks(t, webhookConfig{Name: "hr", URL: srv.URL + "/hooks", Secret: secret})
+
+	d := &webhookDelivery{ID: 42, Webhook: "hr", Event: eventTipCreated, Payload: `{"id":"5f2b","event":"tip.created"}`}
+	status = http.StatusNoContent
+	before := time.Now().Unix()
+	if err := deliverWebhook(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != "POST" || got.URL.Path != "/hooks" || gotBody != d.Payload {
+		t.Errorf("sent %s %s %s", got.Method, got.URL.Path, gotBody)
+	}
+	if got.Header.Get("X-Tiperc20-Event") != eventTipCreated || got.Header.Get("X-Tiperc20-Delivery") != "42" || got.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("headers are %v", got.Header)
+	}
+
+	// verify the signature as a receiver would
+	var timestamp, signature string
+	for _, part := range strings.Split(got.Header.Get(webhookSignatureHeader), ",") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			timestamp = strings.TrimPrefix(part, "t=")
+		case strings.HasPrefix(part, "v1="):
+			signature = strings.TrimPrefix(part, "v1=")
+		}
+	}
+	if at, err := strconv.ParseInt(timestamp, 10, 64); err != nil || at < before || at > time.Now().Unix() {
+		t.Errorf("signature timestamp is %q", timestamp)
+	}
+	if signature != signWebhook(secret, timestamp, []byte(gotBody)) {
+		t.Errorf("signature %q doesn't match the body", got.Header.Get(webhookSignatureHeader))
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := deliverWebhook(context.Background(), d); err == nil || err.Error() != "503 Service Unavailable: try later" {
+		t.Errorf("a 503 answer: %v", err)
+	}
+	d.Webhook = "removed"
+	if err := deliverWebhook(context.Background(), d); err == nil || !strings.Contains(err.Error(), "no longer configured") {
+		t.Errorf("a removed webhook: %v", err)
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	testDatabase(t)
+	api := testSlack(t)
+	testWebhooks(t, webhookConfig{Name: "hr", URL: "http://127.0.0.1:1/hooks", Secret: "whsec_0123456789abcdef"})
+	ctx := context.Background()
+
+	err := withLedgerTx(ctx, func(tx *sql.Tx) error {
+		return queueWebhookEvent(tx, eventTipCreated, map[string]string{"from": "U1"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d := &webhookDelivery{}
+	err = db.QueryRow(`SELECT id, webhook, event, payload, attempts FROM webhook_deliveries;`).Scan(&d.ID, &d.Webhook, &d.Event, &d.Payload, &d.Attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("connection refused")
+	for d.Attempts = 0; d.Attempts < webhookMaxAttempts-1; d.Attempts++ {
+		if err := recordWebhookAttempt(ctx, api, d, failure); err != nil {
+			t.Fatal(err)
+		}
+		var attempts int
+		var retryIn float64
+		err := db.QueryRow(`SELECT attempts, EXTRACT(EPOCH FROM next_attempt_at - now()) FROM webhook_deliveries WHERE id = $1;`, d.ID).Scan(&attempts, &retryIn)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", d.Attempts+1, err)
+		}
+		if want := webhookRetryDelay(d.Attempts + 1).Seconds(); attempts != d.Attempts+1 || retryIn < want-60 || retryIn > want+1 {
+			t.Errorf("attempt %d: recorded %d attempts, retrying in %vs, want %vs", d.Attempts+1, attempts, retryIn, want)
+		}
+	}
+	if err := recordWebhookAttempt(ctx, api, d, failure); err != nil {
+		t.Fatal(err)
+	}
+	var deliveries, dead, attempts int
+	db.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries;`).Scan(&deliveries)
+	db.QueryRow(`SELECT COUNT(*), MAX(attempts) FROM webhook_dead_letters WHERE id = $1;`, d.ID).Scan(&dead, &attempts)
+	if deliveries != 0 || dead != 1 || attempts != webhookMaxAttempts {
+		t.Fatalf("after the last attempt: %d deliveries, %d dead letters after %d attempts", deliveries, dead, attempts)
+	}
+
+	replayed, err := replayDeadLetters(ctx, "U0", "", d.ID)
+	if err != nil || replayed != 1 {
+		t.Fatalf("replayed %d: %v", replayed, err)
+	}
+	db.QueryRow(`SELECT COUNT(*), MAX(attempts) FROM webhook_deliveries WHERE id = $1;`, d.ID).Scan(&deliveries, &attempts)
+	db.QueryRow(`SELECT COUNT(*) FROM webhook_dead_letters;`).Scan(&dead)
+	if deliveries != 1 || attempts != 0 || dead != 0 {
+		t.Errorf("after the replay: %d deliveries with %d attempts, %d dead letters", deliveries, attempts, dead)
+	}
+	if replayed, err := replayDeadLetters(ctx, "U0", "", 0); err != nil || replayed != 0 {
+		t.Errorf("replaying nothing replayed %d: %v", replayed, err)
+	}
+
+	d.Attempts = 0
+	if err := recordWebhookAttempt(ctx, api, d, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries;`).Scan(&deliveries)
+	if deliveries != 0 {
+		t.Errorf("a delivered webhook is still queued")
+	}
+}
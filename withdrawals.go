@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Statuses of a withdrawal.
+const (
+	// withdrawalQueued waits for the next batch of its chain.
+	withdrawalQueued = "queued"
+	// withdrawalSending was paid for and is being signed and broadcast. Its
+	// signed transaction is kept so that it can be resumed after a crash.
+	withdrawalSending = "sending"
+	// withdrawalBatched was sent as part of a disperse transaction.
+	withdrawalBatched = "batched"
+	// withdrawalSent was sent as an individual transfer.
+	withdrawalSent = "sent"
+	// withdrawalConfirmed had its transaction mined successfully.
+	withdrawalConfirmed = "confirmed"
+	// withdrawalFailed couldn't be paid out and was refunded.
+	withdrawalFailed = "failed"
+)
+
+// withdrawal is a payout of a user's balance to their registered address.
+type withdrawal struct {
+	ID        int64
+	UserID    string
+	Chain     string
+	Asset     string
+	Address   string
+	Amount    *big.Int
+	Status    string
+	TxHash    string
+	Error     string
+	CreatedAt time.Time
+	// Fee is the gas fee the user was charged in FeeAsset, given back along
+	// with the amount when the withdrawal is never sent.
+	Fee      *big.Int
+	FeeAsset string
+	// RawTx is the signed transaction, hex encoded, once there is one.
+	RawTx string
+	// Event is the Slack message that requested a new withdrawal. It is only
+	// written to the audit log.
+	Event string
+}
+
+// debitWithdrawal takes the amount of w and its gas fee out of the user's
+// balance and records w, within tx.
+func debitWithdrawal(tx *sql.Tx, w *withdrawal) error {
+	err := adjustBalance(tx, ledgerEntry{UserID: w.UserID, Asset: w.Asset, Kind: kindWithdraw, Amount: new(big.Int).Neg(w.Amount), Chain: w.Chain})
+	if err != nil {
+		return err
+	}
+	if w.Fee != nil && w.Fee.Sign() > 0 {
+		err = adjustBalance(tx, ledgerEntry{UserID: w.UserID, Asset: w.FeeAsset, Kind: kindFee, Amount: new(big.Int).Neg(w.Fee), Chain: w.Chain})
+		if err != nil {
+			return err
+		}
+	}
+	return recordWithdrawal(tx, w)
+}
+
+// recordWithdrawal inserts w within tx and sets its ID.
+func recordWithdrawal(tx *sql.Tx, w *withdrawal) error {
+	err := tx.QueryRow(`
+		INSERT INTO withdrawals(slack_user_id, chain, asset, address, amount, status, tx_hash, fee, fee_asset)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;
+	`, w.UserID, w.Chain, w.Asset, w.Address, w.Amount.String(), w.Status, nullString(w.TxHash), nullAmount(w.Fee), nullString(w.FeeAsset)).Scan(&w.ID)
+	if err != nil {
+		return err
+	}
+
+	err = recordAudit(tx, auditRecord{
+		Actor:   w.UserID,
+		Action:  "withdrawal",
+		Subject: fmt.Sprintf("withdrawal %d", w.ID),
+		After:   w.Status,
+		Detail:  fmt.Sprintf("%s %s to %s on %s %s", formatAmount(w.Amount, w.Asset), w.Asset, w.Address, w.Chain, w.TxHash),
+		Event:   w.Event,
+	})
+	if err != nil {
+		return err
+	}
+	return queueWebhookEvent(tx, eventWithdrawalCreated, withdrawalEventData(w))
+}
+
+// setWithdrawalStatus moves withdrawals to status. An empty txHash keeps the
+// hash they already have.
+func setWithdrawalStatus(ctx context.Context, ids []int64, status, txHash, reason string) error {
+	return withLedgerTx(ctx, func(tx *sql.Tx) error {
+		return markWithdrawals(tx, ids, status, txHash, reason)
+	})
+}
+
+// markWithdrawals is setWithdrawalStatus within tx.
+func markWithdrawals(tx *sql.Tx, ids []int64, status, txHash, reason string) error {
+	rows, err := tx.Query(`
+		SELECT id, status, slack_user_id, chain, asset, address, amount, COALESCE(tx_hash, '') FROM withdrawals
+		WHERE id = ANY($1) ORDER BY id FOR UPDATE;
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	previous := map[int64]*withdrawal{}
+	for rows.Next() {
+		var w withdrawal
+		var amount string
+		if err := rows.Scan(&w.ID, &w.Status, &w.UserID, &w.Chain, &w.Asset, &w.Address, &amount, &w.TxHash); err != nil {
+			rows.Close()
+			return err
+		}
+		w.Amount, _ = new(big.Int).SetString(amount, 10)
+		previous[w.ID] = &w
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE withdrawals SET status = $2, tx_hash = COALESCE($3, tx_hash), error = $4, updated_at = now()
+		WHERE id = ANY($1);
+	`, pq.Array(ids), status, nullString(txHash), nullString(reason))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		before := ""
+		w, ok := previous[id]
+		if ok {
+			before = w.Status
+		}
+		err := recordAudit(tx, auditRecord{
+			Actor:   auditActorSystem,
+			Action:  "withdrawal_status",
+			Subject: fmt.Sprintf("withdrawal %d", id),
+			Before:  before,
+			After:   status,
+			Detail:  strings.TrimSpace(txHash + " " + reason),
+		})
+		if err != nil {
+			return err
+		}
+
+		event := withdrawalEvent(status)
+		if !ok || event == "" || before == status {
+			continue
+		}
+		w.Status, w.Error = status, reason
+		if txHash != "" {
+			w.TxHash = txHash
+		}
+		if err := queueWebhookEvent(tx, event, withdrawalEventData(w)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryWithdrawals loads the withdrawals selected by a query on the
+// withdrawals table.
+func queryWithdrawals(query string, args ...interface{}) ([]*withdrawal, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT id, slack_user_id, chain, asset, address, amount, status, tx_hash, error, created_at, fee, fee_asset, raw_tx
+		FROM withdrawals `+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var withdrawals []*withdrawal
+	for rows.Next() {
+		var w withdrawal
+		var amount string
+		var txHash, reason, fee, feeAsset, rawTx sql.NullString
+		if err := rows.Scan(&w.ID, &w.UserID, &w.Chain, &w.Asset, &w.Address, &amount, &w.Status, &txHash, &reason, &w.CreatedAt, &fee, &feeAsset, &rawTx); err != nil {
+			return nil, err
+		}
+		w.Amount, _ = new(big.Int).SetString(amount, 10)
+		w.TxHash, w.Error = txHash.String, reason.String
+		w.FeeAsset, w.RawTx = feeAsset.String, rawTx.String
+		if fee.Valid {
+			w.Fee, _ = new(big.Int).SetString(fee.String, 10)
+		}
+		withdrawals = append(withdrawals, &w)
+	}
+	return withdrawals, rows.Err()
+}
+
+func recentWithdrawalsFor(userID string, limit int) ([]*withdrawal, error) {
+	return queryWithdrawals(`WHERE slack_user_id = $1 ORDER BY id DESC LIMIT $2;`, userID, limit)
+}
+
+// queuedWithdrawals returns the CULT withdrawals waiting for the next batch
+// of a chain.
+func queuedWithdrawals(chainName string, limit int) ([]*withdrawal, error) {
+	return queryWithdrawals(`WHERE chain = $1 AND asset = $2 AND status = $3 ORDER BY id LIMIT $4;`, chainName, tokenAsset, withdrawalQueued, limit)
+}
+
+func nullAmount(amount *big.Int) sql.NullString {
+	if amount == nil || amount.Sign() == 0 {
+		return sql.NullString{}
+	}
+	return nullString(amount.String())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// errWalletBusy is returned when the hot wallet stayed locked by other
+// transfers until the command ran out of time.
+var errWalletBusy = errors.New("The hot wallet is busy with other transfers, please try again in a moment")
+
+// commandPool handles Slack commands on a fixed number of workers, each with
+// a bounded queue. The commands of one user always go to the same worker, so
+// they run one at a time and in order while other users' commands run
+// alongside.
+type commandPool struct {
+	api    *slack.Client
+	handle func(ctx context.Context, api *slack.Client, ev *slack.MessageEvent)
+	queues []chan queuedCommand
+}
+
+type queuedCommand struct {
+	ev     *slack.MessageEvent
+	queued time.Time
+}
+
+// newCommandPool starts workerCount workers with queues of workerQueueSize
+// commands each, which pass the commands to handle.
+func newCommandPool(api *slack.Client, handle func(ctx context.Context, api *slack.Client, ev *slack.MessageEvent)) *commandPool {
+	p := &commandPool{api: api, handle: handle, queues: make([]chan queuedCommand, workerCount)}
+	for i := range p.queues {
+		p.queues[i] = make(chan queuedCommand, workerQueueSize)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// submit queues ev when it is a command for the bot. When the worker of its
+// user is backed up the command is dropped and the user asked to retry, so
+// that a flood of commands can't grow the backlog without bound.
+func (p *commandPool) submit(ev *slack.MessageEvent) {
+	if !strings.HasPrefix(ev.Text, "<@"+slackBotId+">") {
+		return
+	}
+	if !beginWork() {
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(ev.User))
+	queue := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	select {
+	case queue <- queuedCommand{ev: ev, queued: time.Now()}:
+		commandQueueDepth.Inc()
+	default:
+		endWork()
+		commandsDropped.WithLabelValues("queue_full").Inc()
+		logWarn(context.Background(), "Dropped command, the queue is full", logFields{"user": ev.User, "channel": ev.Channel, "event": slackEventRef(ev)})
+		go sendSlackMessage(p.api, ev.User, ":hourglass: I'm swamped right now, please try again in a moment")
+	}
+}
+
+func (p *commandPool) work(queue chan queuedCommand) {
+	for cmd := range queue {
+		commandQueueDepth.Dec()
+		p.run(cmd)
+	}
+}
+
+// run handles cmd within commandTimeout, unless it waited in the queue for
+// longer than workerQueueTimeout, by which time the user has likely moved
+// on.
+func (p *commandPool) run(cmd queuedCommand) {
+	defer endWork()
+
+	ctx := correlatedContext()
+	if waited := time.Since(cmd.queued); waited > workerQueueTimeout {
+		commandsDropped.WithLabelValues("queue_timeout").Inc()
+		logWarn(ctx, "Dropped command that waited too long", logFields{"user": cmd.ev.User, "event": slackEventRef(cmd.ev), "waited": waited.String()})
+		sendSlackMessage(p.api, cmd.ev.User, ":hourglass: Sorry, I was too busy to get to your command, please try again")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	p.handle(ctx, p.api, cmd.ev)
+	if ctx.Err() == context.DeadlineExceeded {
+		commandsTimedOut.Inc()
+		logWarn(ctx, "Command timed out", logFields{"user": cmd.ev.User, "event": slackEventRef(cmd.ev), "timeout": commandTimeout.String()})
+	}
+}
+
+// walletLockPoll is how often lockWallet retries the advisory lock of a hot
+// wallet held by another process.
+const walletLockPoll = 100 * time.Millisecond
+
+// lockWallet serializes the transfers out of the hot wallet of c, so that
+// its balance, allowance and nonce checks aren't raced by other transfers.
+// Within the bot transfers take turns on c.sending, and across processes,
+// such as tiperc20ctl or a second bot, on a Postgres advisory lock held by a
+// connection of its own. It waits until the wallet is free or ctx is done.
+func (c *chain) lockWallet(ctx context.Context) (unlock func(), err error) {
+	select {
+	case c.sending <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errWalletBusy
+	}
+
+	release, err := lockWalletAcrossProcesses(ctx, c.Name)
+	if err != nil {
+		<-c.sending
+		return nil, err
+	}
+	return func() {
+		release()
+		<-c.sending
+	}, nil
+}
+
+// walletLockID is the advisory lock key of the hot wallet on chain.
+func walletLockID(chain string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("tiperc20 wallet " + chain))
+	return int64(h.Sum64())
+}
+
+// lockWalletAcrossProcesses takes the advisory lock of the hot wallet on
+// chain. Advisory locks belong to a session, so the connection that took it
+// is kept out of the pool until the lock is released.
+func lockWalletAcrossProcesses(ctx context.Context, chain string) (release func(), err error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	closeAll := func() {
+		conn.Close()
+		db.Close()
+	}
+
+	id := walletLockID(chain)
+	for {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1);`, id).Scan(&locked); err != nil {
+			closeAll()
+			if ctx.Err() != nil {
+				return nil, errWalletBusy
+			}
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		select {
+		case <-time.After(walletLockPoll):
+		case <-ctx.Done():
+			closeAll()
+			return nil, errWalletBusy
+		}
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1);`, id); err != nil {
+			logWarn(context.Background(), "Failed to release the hot wallet lock", logFields{"chain": chain, "error": err})
+		}
+		closeAll()
+	}, nil
+}
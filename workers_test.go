@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// testCommandPool sets up the workers of a command pool for the test.
+func testCommandPool(t *testing.T, workers int) {
+	saved := []interface{}{slackBotId, workerCount, workerQueueSize, workerQueueTimeout, commandTimeout}
+	slackBotId, workerCount, workerQueueSize = "UBOT", workers, 16
+	workerQueueTimeout, commandTimeout = time.Minute, time.Minute
+	t.Cleanup(func() {
+		slackBotId, workerCount, workerQueueSize = saved[0].(string), saved[1].(int), saved[2].(int)
+		workerQueueTimeout, commandTimeout = saved[3].(time.Duration), saved[4].(time.Duration)
+	})
+}
+
+// workerOf returns the worker that handles the commands of user.
+func workerOf(user string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	return h.Sum32() % uint32(workerCount)
+}
+
+func TestCommandPoolOrder(t *testing.T) {
+	testCommandPool(t, 4)
+	slow, fast := "U1", ""
+	for i := 2; fast == ""; i++ {
+		if user := fmt.Sprintf("U%d", i); workerOf(user) != workerOf(slow) {
+			fast = user
+		}
+	}
+
+	var mu sync.Mutex
+	handled := map[string][]string{}
+	unblock := make(chan struct{})
+	fastDone := make(chan struct{})
+	const commands = 10
+	p := newCommandPool(testSlack(t), func(ctx context.Context, api *slack.Client, ev *slack.MessageEvent) {
+		if ev.User == slow {
+			<-unblock
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled[ev.User] = append(handled[ev.User], ev.Text)
+		if ev.User == fast && len(handled[fast]) == commands {
+			close(fastDone)
+		}
+	})
+
+	for i := 0; i < commands; i++ {
+		for _, user := range []string{slow, fast} {
+			p.submit(&slack.MessageEvent{Msg: slack.Msg{User: user, Channel: "D" + user, Text: fmt.Sprintf("<@UBOT> balance %d", i)}})
+		}
+	}
+	p.submit(&slack.MessageEvent{Msg: slack.Msg{User: fast, Text: "balance"}})
+
+	select {
+	case <-fastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the commands of a slow user held up another worker")
+	}
+	mu.Lock()
+	if len(handled[slow]) != 0 {
+		t.Errorf("handled %q while the first command of %s was running", handled[slow], slow)
+	}
+	mu.Unlock()
+
+	close(unblock)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(handled[slow])
+		mu.Unlock()
+		if n == commands || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, user := range []string{slow, fast} {
+		if len(handled[user]) != commands {
+			t.Errorf("handled %d commands of %s, want %d", len(handled[user]), user, commands)
+			continue
+		}
+		for i, text := range handled[user] {
+			if want := fmt.Sprintf("<@UBOT> balance %d", i); text != want {
+				t.Errorf("command %d of %s was %q, want %q", i, user, text, want)
+			}
+		}
+	}
+}
+
+func TestWalletLockAcrossProcesses(t *testing.T) {
+	testDatabase(t)
+	ctx := context.Background()
+
+	release, err := lockWalletAcrossProcesses(ctx, "ethereum")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another process waits for the wallet of the same chain only
+	waitCtx, cancel := context.WithTimeout(ctx, 3*walletLockPoll)
+	defer cancel()
+	if _, err := lockWalletAcrossProcesses(waitCtx, "ethereum"); err != errWalletBusy {
+		t.Errorf("locked a held wallet: %v", err)
+	}
+	other, err := lockWalletAcrossProcesses(ctx, "optimism")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	done := make(chan error, 1)
+	go func() {
+		next, err := lockWalletAcrossProcesses(ctx, "ethereum")
+		if err == nil {
+			next()
+		}
+		done <- err
+	}()
+	release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the wallet stayed locked after its release")
+	}
+}